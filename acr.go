@@ -0,0 +1,138 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+const (
+	// aadLoginURL is where the service principal gets its Azure AD token
+	aadLoginURL = "https://login.microsoftonline.com"
+	// aadResource is the audience of the Azure AD token ACR exchanges
+	aadResource = "https://management.azure.com/"
+
+	// acrRefreshTokenUsername is the username docker logs in to ACR with
+	// when the password is an ACR refresh token
+	acrRefreshTokenUsername = "00000000-0000-0000-0000-000000000000"
+)
+
+// AzureInterface exchanges the service principal's credentials for an ACR refresh token
+type AzureInterface interface {
+	ExchangeRefreshToken(registry string) (string, error)
+}
+
+// azureClient signs in to Azure AD as a service principal, then exchanges
+// the AAD token for a refresh token of the registry
+type azureClient struct {
+	tenantID     string
+	clientID     string
+	clientSecret string
+
+	// loginURL and httpClient are replaced in tests
+	loginURL   string
+	httpClient *http.Client
+}
+
+func newAzureClient(tenantID, clientID, clientSecret string) AzureInterface {
+	return &azureClient{tenantID: tenantID, clientID: clientID, clientSecret: clientSecret, loginURL: aadLoginURL}
+}
+
+// acrEnabled reports whether the ACR service principal and registry are configured
+func acrEnabled() bool {
+	return acrClientID != "" && *argACRRegistry != ""
+}
+
+func (a *azureClient) ExchangeRefreshToken(registry string) (string, error) {
+	aadToken, err := a.postForm(a.loginURL+"/"+url.PathEscape(a.tenantID)+"/oauth2/token", url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {a.clientID},
+		"client_secret": {a.clientSecret},
+		"resource":      {aadResource},
+	}, "access_token")
+	if err != nil {
+		return "", fmt.Errorf("signing in to Azure AD: %v", err)
+	}
+
+	refreshToken, err := a.postForm("https://"+registry+"/oauth2/exchange", url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {registry},
+		"tenant":       {a.tenantID},
+		"access_token": {aadToken},
+	}, "refresh_token")
+	if err != nil {
+		return "", fmt.Errorf("exchanging the Azure AD token with %s: %v", registry, err)
+	}
+	return refreshToken, nil
+}
+
+// postForm posts a form and returns a string field of the JSON response
+func (a *azureClient) postForm(endpoint string, form url.Values, field string) (string, error) {
+	client := a.httpClient
+	if client == nil {
+		client = tokenRequestClient()
+	}
+
+	resp, err := client.PostForm(endpoint, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// The body explains the failure but could be large, keep the start of it
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("%s returned %s: %s", endpoint, resp.Status, body)
+	}
+
+	var result map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("invalid response from %s: %v", endpoint, err)
+	}
+	value, _ := result[field].(string)
+	if value == "" {
+		return "", fmt.Errorf("response from %s has no %s", endpoint, field)
+	}
+	return value, nil
+}
+
+func (c *controller) getACRAuthorizationKey() (AuthToken, error) {
+	refreshToken, err := c.azureClient.ExchangeRefreshToken(*argACRRegistry)
+	if err != nil {
+		return AuthToken{}, err
+	}
+
+	// Like an ECR token, the access token is the base64 encoded auth value
+	auth := base64.StdEncoding.EncodeToString([]byte(acrRefreshTokenUsername + ":" + refreshToken))
+	return AuthToken{
+		AccessToken: redactedString(auth),
+		Endpoint:    registryHost(*argACRRegistry)}, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util/clock"
+)
+
+type fakeAzureClient struct {
+	err error
+}
+
+func (f *fakeAzureClient) ExchangeRefreshToken(registry string) (string, error) {
+	if f.err != nil {
+		return "", f.err
+	}
+	return "refresh-" + registry, nil
+}
+
+func TestAzureClientExchangeRefreshToken(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, r.ParseForm())
+		switch r.URL.Path {
+		case "/tenant/oauth2/token":
+			assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+			assert.Equal(t, "client", r.PostForm.Get("client_id"))
+			assert.Equal(t, "secret", r.PostForm.Get("client_secret"))
+			fmt.Fprint(w, `{"access_token":"aad-token"}`)
+		case "/oauth2/exchange":
+			assert.Equal(t, "access_token", r.PostForm.Get("grant_type"))
+			assert.Equal(t, "aad-token", r.PostForm.Get("access_token"))
+			assert.Equal(t, "tenant", r.PostForm.Get("tenant"))
+			fmt.Fprint(w, `{"refresh_token":"acr-refresh"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := &azureClient{tenantID: "tenant", clientID: "client", clientSecret: "secret", loginURL: server.URL, httpClient: server.Client()}
+
+	token, err := client.ExchangeRefreshToken(serverURL.Host)
+	assert.Nil(t, err)
+	assert.Equal(t, "acr-refresh", token)
+
+	client.clientSecret = ""
+	client.loginURL = server.URL + "/missing"
+	_, err = client.ExchangeRefreshToken(serverURL.Host)
+	assert.NotNil(t, err)
+}
+
+func TestProcessWithACR(t *testing.T) {
+	*argACRRegistry = "myregistry.azurecr.io"
+	defer func() { *argACRRegistry = "" }()
+
+	kubeClient := newFakeKubeClient()
+	azure := &fakeAzureClient{}
+	// The fake clock skips the backoff of the failing refresh's token retries
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient(), azureClient: azure, clock: clock.NewFakeClock(time.Now())}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	auth := base64.StdEncoding.EncodeToString([]byte(acrRefreshTokenUsername + ":refresh-myregistry.azurecr.io"))
+	for _, namespace := range []string{"namespace1", "namespace2"} {
+		secret, err := kubeClient.Secrets(namespace).Get(*argACRSecretName)
+		assert.Nil(t, err)
+		assert.Equal(t, api.SecretType("kubernetes.io/dockerconfigjson"), secret.Type)
+		assert.Contains(t, string(secret.Data[".dockerconfigjson"]), `"myregistry.azurecr.io":{"auth":"`+auth+`"`)
+
+		serviceAccount, err := kubeClient.ServiceAccounts(namespace).Get("default")
+		assert.Nil(t, err)
+		assert.Contains(t, serviceAccount.ImagePullSecrets, api.LocalObjectReference{Name: *argACRSecretName})
+	}
+
+	// An ACR failure leaves the other providers' secrets alone
+	azure.err = errors.New("AADSTS7000215: Invalid client secret")
+	err = c.process()
+	assert.NotNil(t, err)
+	_, err = kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+}
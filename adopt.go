@@ -0,0 +1,112 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/labels"
+)
+
+// parseAdoptLabels parses --adopt-labels, a list of key=value labels that
+// mark secrets written by an older version or a fork of the controller
+func parseAdoptLabels(entries []string) ([]labels.Set, error) {
+	sets := []labels.Set{}
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%q must be key=value", entry)
+		}
+		sets = append(sets, labels.Set{parts[0]: parts[1]})
+	}
+	return sets, nil
+}
+
+// secretProvider guesses the provider of an adopted secret from its name
+func secretProvider(name string) string {
+	switch name {
+	case *argAWSSecretName:
+		return providerAWS
+	case *argGCRSecretName:
+		return providerGCR
+	case *argACRSecretName:
+		return providerACR
+	case *argDockerHubSecretName:
+		return providerDockerHub
+	case *argGHCRSecretName:
+		return providerGHCR
+	case *argCombinedSecretName:
+		return combinedProvider
+	}
+	return ""
+}
+
+// adoptLegacySecrets relabels the secrets carrying an --adopt-labels label
+// as managed by this controller, dropping the legacy label, so they're
+// refreshed and cleaned up like the controller's own from then on. Their
+// provider is taken from the configured secret names; a secret under another
+// name is managed but belongs to no provider.
+func (c *controller) adoptLegacySecrets(namespaces []api.Namespace) error {
+	// validateParams already checked the labels
+	sets, _ := parseAdoptLabels(*argAdoptLabels)
+	for _, namespace := range namespaces {
+		if namespaceExcluded(namespace.GetName()) {
+			continue
+		}
+
+		for _, set := range sets {
+			secrets, err := c.kubeClient.Secrets(namespace.GetName()).List(api.ListOptions{LabelSelector: labels.SelectorFromSet(set)})
+			if err != nil {
+				return err
+			}
+
+			for _, secret := range secrets.Items {
+				if secret.Labels[managedByLabel] == managedByValue {
+					continue
+				}
+
+				for key := range set {
+					delete(secret.Labels, key)
+				}
+				markManaged(&secret, secretProvider(secret.Name))
+				if secret.Annotations[providerAnnotation] == "" {
+					delete(secret.Annotations, providerAnnotation)
+				}
+
+				updated, err := c.kubeClient.Secrets(namespace.GetName()).Update(&secret)
+				if err != nil {
+					return fmt.Errorf("adopting secret %s/%s: %v", namespace.GetName(), secret.Name, err)
+				}
+				c.recordWrite(updated)
+				log.Printf("Adopted secret %s/%s labelled %s", namespace.GetName(), secret.Name, set)
+				c.recordEvent(objectReference("Secret", namespace.GetName(), updated.ObjectMeta), api.EventTypeNormal, "Adopted", "Adopted secret %s labelled %s", secret.Name, set)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+func TestParseAdoptLabels(t *testing.T) {
+	sets, err := parseAdoptLabels([]string{"app.kubernetes.io/managed-by=old-registry-creds", "fork=true"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(sets))
+	assert.Equal(t, "old-registry-creds", sets[0]["app.kubernetes.io/managed-by"])
+
+	_, err = parseAdoptLabels([]string{"fork"})
+	assert.NotNil(t, err)
+}
+
+func TestProcessAdoptsLegacySecrets(t *testing.T) {
+	defer func(adopt []string) { *argAdoptLabels = adopt }(*argAdoptLabels)
+	*argAdoptLabels = []string{"app.kubernetes.io/managed-by=old-registry-creds"}
+
+	legacyLabels := func() map[string]string {
+		return map[string]string{"app.kubernetes.io/managed-by": "old-registry-creds", "team": "platform"}
+	}
+	kubeClient := newFakeKubeClient()
+	kubeClient.secrets["namespace1"].store[*argAWSSecretName] = &api.Secret{
+		ObjectMeta: api.ObjectMeta{Name: *argAWSSecretName, Labels: legacyLabels()},
+		Data:       map[string][]byte{".dockerconfigjson": []byte("stale")},
+	}
+	kubeClient.secrets["namespace2"].store["old-ecr"] = &api.Secret{ObjectMeta: api.ObjectMeta{Name: "old-ecr", Labels: legacyLabels()}}
+	kubeClient.secrets["namespace2"].store["team-secret"] = &api.Secret{ObjectMeta: api.ObjectMeta{Name: "team-secret", Labels: map[string]string{"team": "platform"}}}
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	// A legacy secret under the configured name is adopted, then refreshed
+	secret, err := kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, managedByValue, secret.Labels[managedByLabel])
+	assert.Equal(t, providerAWS, secret.Annotations[providerAnnotation])
+	assert.NotEqual(t, []byte("stale"), secret.Data[".dockerconfigjson"])
+
+	// Under another name it's managed, without a provider, and keeps its other labels
+	adopted, err := kubeClient.Secrets("namespace2").Get("old-ecr")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{managedByLabel: managedByValue, "team": "platform"}, adopted.Labels)
+	_, ok := adopted.Annotations[providerAnnotation]
+	assert.False(t, ok)
+
+	// Secrets without the legacy label are left alone
+	unrelated, err := kubeClient.Secrets("namespace2").Get("team-secret")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"team": "platform"}, unrelated.Labels)
+}
@@ -0,0 +1,73 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// assumedRoleCredentials are the --aws-assume-role credentials shared by every
+// AWS client, built on first use
+var assumedRoleCredentials *credentials.Credentials
+
+// validAssumeRoleARN checks --aws-assume-role looks like an IAM role ARN
+func validAssumeRoleARN(arn string) bool {
+	return strings.HasPrefix(arn, "arn:") && strings.Contains(arn, ":role/")
+}
+
+// newAssumedRoleCredentials assumes --aws-assume-role with the client's
+// credentials, passing --aws-assume-role-external-id when set
+func newAssumedRoleCredentials(client stscreds.AssumeRoler) *credentials.Credentials {
+	return stscreds.NewCredentialsWithClient(client, *argAWSAssumeRole, func(p *stscreds.AssumeRoleProvider) {
+		if *argAWSAssumeRoleExternalID != "" {
+			p.ExternalID = aws.String(*argAWSAssumeRoleExternalID)
+		}
+		p.ExpiryWindow = time.Minute
+	})
+}
+
+// withAssumedRole makes the config use the assumed role, which is assumed
+// with the credentials config already has
+func withAssumedRole(sess *session.Session, config *aws.Config) *aws.Config {
+	if assumedRoleCredentials == nil {
+		assumedRoleCredentials = newAssumedRoleCredentials(sts.New(sess, config))
+	}
+	return config.Copy().WithCredentials(assumedRoleCredentials)
+}
+
+// expireAssumedRoleCredentials makes the next AWS call assume the role again,
+// so each refresh starts with fresh STS credentials
+func expireAssumedRoleCredentials() {
+	if assumedRoleCredentials != nil {
+		assumedRoleCredentials.Expire()
+	}
+}
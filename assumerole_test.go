@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeAssumeRoler struct {
+	inputs []*sts.AssumeRoleInput
+}
+
+func (f *fakeAssumeRoler) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	f.inputs = append(f.inputs, input)
+	return &sts.AssumeRoleOutput{Credentials: &sts.Credentials{
+		AccessKeyId:     aws.String("assumed-key"),
+		SecretAccessKey: aws.String("assumed-secret"),
+		SessionToken:    aws.String("assumed-token"),
+		Expiration:      aws.Time(time.Now().Add(time.Hour)),
+	}}, nil
+}
+
+func TestAssumedRoleCredentials(t *testing.T) {
+	*argAWSAssumeRole = "arn:aws:iam::210987654321:role/ecr-reader"
+	*argAWSAssumeRoleExternalID = "registry-creds"
+	defer func() {
+		*argAWSAssumeRole = ""
+		*argAWSAssumeRoleExternalID = ""
+		assumedRoleCredentials = nil
+	}()
+
+	client := &fakeAssumeRoler{}
+	assumedRoleCredentials = newAssumedRoleCredentials(client)
+
+	value, err := assumedRoleCredentials.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "assumed-key", value.AccessKeyID)
+	_, err = assumedRoleCredentials.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(client.inputs))
+	assert.Equal(t, *argAWSAssumeRole, *client.inputs[0].RoleArn)
+	assert.Equal(t, "registry-creds", *client.inputs[0].ExternalId)
+
+	// Each refresh assumes the role again
+	c := &controller{kubeClient: newFakeKubeClient(), ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+	assert.Nil(t, c.process())
+	_, err = assumedRoleCredentials.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(client.inputs))
+}
+
+func TestValidAssumeRoleARN(t *testing.T) {
+	assert.True(t, validAssumeRoleARN("arn:aws:iam::210987654321:role/ecr-reader"))
+	assert.True(t, validAssumeRoleARN("arn:aws-cn:iam::210987654321:role/path/ecr-reader"))
+	assert.False(t, validAssumeRoleARN("ecr-reader"))
+	assert.False(t, validAssumeRoleARN("arn:aws:iam::210987654321:user/someone"))
+}
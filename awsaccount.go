@@ -0,0 +1,121 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+type callerIdentityClient interface {
+	GetCallerIdentity(input *sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error)
+}
+
+// newCallerIdentityClient builds the STS client that discovers the AWS
+// account when awsaccount isn't set. Tests replace it with a stub.
+var newCallerIdentityClient = func() (callerIdentityClient, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	config, err := awsClientConfig(sess)
+	if err != nil {
+		return nil, err
+	}
+	return sts.New(sess, config), nil
+}
+
+// awsClientConfig configures an AWS client for --aws-region with credentials
+// from --aws-credential-source, or of --aws-assume-role when set
+func awsClientConfig(sess *session.Session) (*aws.Config, error) {
+	config := aws.NewConfig().WithRegion(*argAWSRegion)
+
+	creds, err := awsCredentials(*argAWSCredentialSource, sess)
+	if err != nil {
+		return nil, err
+	}
+	if creds != nil {
+		config = config.WithCredentials(creds)
+	}
+	if *argAWSAssumeRole != "" {
+		config = withAssumedRole(sess, config)
+	}
+	return config, nil
+}
+
+// resolveAWSAccount sets awsAccountID from the awsaccount env variable, or
+// else from STS. Without any AWS credentials AWS is simply not configured,
+// but credentials whose account can't be discovered, e.g. during an STS
+// outage, are an error: treating AWS as disabled then would let
+// --strip-existing-managed-secrets-on-disable or a prune delete every ECR secret.
+func resolveAWSAccount() error {
+	awsAccountID = os.Getenv("awsaccount")
+	if awsAccountID != "" {
+		return nil
+	}
+
+	account, err := discoverAWSAccountID()
+	if awsCredentialsMissing(err) {
+		log.Print("Missing awsaccount env variable and there are no AWS credentials, assuming GCR usage")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("missing awsaccount env variable and couldn't discover the AWS account of the current credentials: %v", err)
+	}
+
+	log.Printf("Missing awsaccount env variable, using AWS account %s of the current credentials", account)
+	awsAccountID = account
+	return nil
+}
+
+// awsCredentialsMissing reports whether err is the SDK's error for a chain
+// without any credentials, rather than a failed call
+func awsCredentialsMissing(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == "NoCredentialProviders"
+}
+
+// discoverAWSAccountID asks STS which account the current credentials belong to
+func discoverAWSAccountID() (string, error) {
+	client, err := newCallerIdentityClient()
+	if err != nil {
+		return "", err
+	}
+
+	identity, err := client.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", err
+	}
+	if identity.Account == nil || *identity.Account == "" {
+		return "", fmt.Errorf("STS returned no account for the current credentials")
+	}
+	return *identity.Account, nil
+}
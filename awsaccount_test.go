@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeCallerIdentityClient struct {
+	account string
+	err     error
+}
+
+func (f *fakeCallerIdentityClient) GetCallerIdentity(input *sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &sts.GetCallerIdentityOutput{Account: aws.String(f.account)}, nil
+}
+
+func stubCallerIdentity(client *fakeCallerIdentityClient) {
+	newCallerIdentityClient = func() (callerIdentityClient, error) {
+		return client, nil
+	}
+}
+
+func TestValidateParamsDiscoversAWSAccount(t *testing.T) {
+	defer func(newClient func() (callerIdentityClient, error)) { newCallerIdentityClient = newClient }(newCallerIdentityClient)
+	defer func(accountID string) { awsAccountID = accountID }(awsAccountID)
+	if account, ok := os.LookupEnv("awsaccount"); ok {
+		defer os.Setenv("awsaccount", account)
+	}
+	os.Unsetenv("awsaccount")
+
+	stubCallerIdentity(&fakeCallerIdentityClient{account: "123456789012"})
+	validateParams()
+	assert.Equal(t, "123456789012", awsAccountID)
+
+	// Without credentials AWS stays disabled
+	stubCallerIdentity(&fakeCallerIdentityClient{err: credentials.ErrNoValidProvidersFoundInChain})
+	validateParams()
+	assert.Equal(t, "", awsAccountID)
+
+	// An explicit account wins
+	os.Setenv("awsaccount", "210987654321")
+	defer os.Unsetenv("awsaccount")
+	stubCallerIdentity(&fakeCallerIdentityClient{account: "123456789012"})
+	validateParams()
+	assert.Equal(t, "210987654321", awsAccountID)
+}
+
+func TestResolveAWSAccountDiscoveryFails(t *testing.T) {
+	defer func(newClient func() (callerIdentityClient, error)) { newCallerIdentityClient = newClient }(newCallerIdentityClient)
+	defer func(accountID string) { awsAccountID = accountID }(awsAccountID)
+	if account, ok := os.LookupEnv("awsaccount"); ok {
+		defer os.Setenv("awsaccount", account)
+	}
+	os.Unsetenv("awsaccount")
+
+	// With credentials, an STS outage isn't mistaken for AWS being disabled
+	stubCallerIdentity(&fakeCallerIdentityClient{err: errors.New("ServiceUnavailable")})
+	err := resolveAWSAccount()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "ServiceUnavailable")
+	assert.Equal(t, "", awsAccountID)
+
+	stubCallerIdentity(&fakeCallerIdentityClient{err: credentials.ErrNoValidProvidersFoundInChain})
+	assert.Nil(t, resolveAWSAccount())
+}
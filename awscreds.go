@@ -0,0 +1,160 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+const (
+	awsCredentialSourceIRSA    = "irsa"
+	awsCredentialSourceEnv     = "env"
+	awsCredentialSourceProfile = "profile"
+	awsCredentialSourceIMDS    = "imds"
+	awsCredentialSourceChain   = "chain"
+)
+
+func validAWSCredentialSource(source string) bool {
+	switch source {
+	case awsCredentialSourceIRSA, awsCredentialSourceEnv, awsCredentialSourceProfile, awsCredentialSourceIMDS, awsCredentialSourceChain:
+		return true
+	}
+	return false
+}
+
+// awsCredentialProviders builds the provider for each explicit credential
+// source, chain is left to the SDK's default chain. Tests replace entries with stubs.
+var awsCredentialProviders = map[string]func(p client.ConfigProvider) credentials.Provider{
+	awsCredentialSourceIRSA: func(p client.ConfigProvider) credentials.Provider {
+		return &webIdentityProvider{
+			client:    sts.New(p, aws.NewConfig().WithCredentials(credentials.AnonymousCredentials)),
+			roleARN:   os.Getenv("AWS_ROLE_ARN"),
+			tokenFile: os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"),
+		}
+	},
+	awsCredentialSourceEnv: func(p client.ConfigProvider) credentials.Provider {
+		return &credentials.EnvProvider{}
+	},
+	awsCredentialSourceProfile: func(p client.ConfigProvider) credentials.Provider {
+		return &credentials.SharedCredentialsProvider{}
+	},
+	awsCredentialSourceIMDS: func(p client.ConfigProvider) credentials.Provider {
+		return &ec2rolecreds.EC2RoleProvider{Client: ec2metadata.New(p)}
+	},
+}
+
+// irsaConfigured reports whether the pod has an IAM role for its service
+// account, i.e. EKS injected AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE
+func irsaConfigured() bool {
+	return os.Getenv("AWS_ROLE_ARN") != "" && os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != ""
+}
+
+// irsaChain is the SDK's default chain with the web identity token tried
+// after static keys and before the instance role, in the order newer SDKs use
+func irsaChain(p client.ConfigProvider) *credentials.Credentials {
+	providers := []credentials.Provider{}
+	for _, source := range []string{awsCredentialSourceEnv, awsCredentialSourceProfile, awsCredentialSourceIRSA, awsCredentialSourceIMDS} {
+		providers = append(providers, awsCredentialProviders[source](p))
+	}
+	return credentials.NewCredentials(&credentials.ChainProvider{Providers: providers, VerboseErrors: true})
+}
+
+// awsCredentials returns credentials from the configured source only, or nil
+// to use the default chain. An explicit source is checked up front so a
+// missing credential fails at startup rather than on the first refresh. This
+// SDK's default chain doesn't know IRSA, so when its environment variables are
+// set the chain is built here instead.
+func awsCredentials(source string, p client.ConfigProvider) (*credentials.Credentials, error) {
+	if source == awsCredentialSourceChain {
+		if irsaConfigured() {
+			return irsaChain(p), nil
+		}
+		return nil, nil
+	}
+
+	newProvider, ok := awsCredentialProviders[source]
+	if !ok {
+		return nil, fmt.Errorf("unknown AWS credential source %q", source)
+	}
+
+	creds := credentials.NewCredentials(newProvider(p))
+	if _, err := creds.Get(); err != nil {
+		return nil, fmt.Errorf("no AWS credentials from %s: %v", source, err)
+	}
+	return creds, nil
+}
+
+type webIdentityClient interface {
+	AssumeRoleWithWebIdentity(input *sts.AssumeRoleWithWebIdentityInput) (*sts.AssumeRoleWithWebIdentityOutput, error)
+}
+
+// webIdentityProvider exchanges the projected service account token for role
+// credentials (IAM roles for service accounts), which this SDK doesn't support
+type webIdentityProvider struct {
+	credentials.Expiry
+
+	client    webIdentityClient
+	roleARN   string
+	tokenFile string
+}
+
+func (p *webIdentityProvider) Retrieve() (credentials.Value, error) {
+	if p.roleARN == "" || p.tokenFile == "" {
+		return credentials.Value{}, fmt.Errorf("AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE must be set")
+	}
+
+	token, err := ioutil.ReadFile(p.tokenFile)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	resp, err := p.client.AssumeRoleWithWebIdentity(&sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(p.roleARN),
+		RoleSessionName:  aws.String(fmt.Sprintf("registry-creds-%d", time.Now().UnixNano())),
+		WebIdentityToken: aws.String(strings.TrimSpace(string(token))),
+	})
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	p.SetExpiration(*resp.Credentials.Expiration, time.Minute)
+	return credentials.Value{
+		AccessKeyID:     *resp.Credentials.AccessKeyId,
+		SecretAccessKey: *resp.Credentials.SecretAccessKey,
+		SessionToken:    *resp.Credentials.SessionToken,
+		ProviderName:    "WebIdentityProvider",
+	}, nil
+}
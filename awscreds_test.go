@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/stretchr/testify/assert"
+)
+
+// stubAWSCredentialProviders replaces every explicit source with a stub that
+// fails, except source which returns static credentials named after it
+func stubAWSCredentialProviders(source string) func() {
+	original := awsCredentialProviders
+	awsCredentialProviders = map[string]func(p client.ConfigProvider) credentials.Provider{}
+	for name := range original {
+		name := name
+		awsCredentialProviders[name] = func(p client.ConfigProvider) credentials.Provider {
+			if name != source {
+				return &stubProvider{err: errors.New(name + " has no credentials")}
+			}
+			return &stubProvider{value: credentials.Value{AccessKeyID: name, ProviderName: name}}
+		}
+	}
+	return func() { awsCredentialProviders = original }
+}
+
+type stubProvider struct {
+	value credentials.Value
+	err   error
+}
+
+func (s *stubProvider) Retrieve() (credentials.Value, error) { return s.value, s.err }
+func (s *stubProvider) IsExpired() bool                      { return false }
+
+func TestValidAWSCredentialSource(t *testing.T) {
+	assert.True(t, validAWSCredentialSource("irsa"))
+	assert.True(t, validAWSCredentialSource("chain"))
+	assert.False(t, validAWSCredentialSource("instance"))
+}
+
+func TestAWSCredentialsExplicitSource(t *testing.T) {
+	for _, source := range []string{awsCredentialSourceIRSA, awsCredentialSourceEnv, awsCredentialSourceProfile, awsCredentialSourceIMDS} {
+		restore := stubAWSCredentialProviders(source)
+
+		creds, err := awsCredentials(source, session.New())
+		assert.Nil(t, err)
+		value, err := creds.Get()
+		assert.Nil(t, err)
+		assert.Equal(t, source, value.ProviderName)
+
+		restore()
+	}
+}
+
+func TestAWSCredentialsFailFast(t *testing.T) {
+	defer stubAWSCredentialProviders(awsCredentialSourceEnv)()
+
+	// The other sources would have credentials, but only irsa is asked
+	creds, err := awsCredentials(awsCredentialSourceIRSA, session.New())
+	assert.Nil(t, creds)
+	assert.NotNil(t, err)
+}
+
+func TestAWSCredentialsChain(t *testing.T) {
+	creds, err := awsCredentials(awsCredentialSourceChain, session.New())
+	assert.Nil(t, err)
+	assert.Nil(t, creds)
+}
+
+func TestAWSCredentialsChainWithIRSA(t *testing.T) {
+	defer stubAWSCredentialProviders(awsCredentialSourceIRSA)()
+	for _, env := range []string{"AWS_ROLE_ARN", "AWS_WEB_IDENTITY_TOKEN_FILE"} {
+		if value, ok := os.LookupEnv(env); ok {
+			defer os.Setenv(env, value)
+		} else {
+			defer os.Unsetenv(env)
+		}
+	}
+
+	// EKS sets both, the SDK's chain wouldn't look at them
+	os.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/registry-creds")
+	os.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "/var/run/secrets/eks.amazonaws.com/serviceaccount/token")
+	creds, err := awsCredentials(awsCredentialSourceChain, session.New())
+	assert.Nil(t, err)
+	value, err := creds.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, awsCredentialSourceIRSA, value.ProviderName)
+
+	// Static keys still win when they're there
+	restore := stubAWSCredentialProviders(awsCredentialSourceEnv)
+	creds, err = awsCredentials(awsCredentialSourceChain, session.New())
+	assert.Nil(t, err)
+	value, err = creds.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, awsCredentialSourceEnv, value.ProviderName)
+	restore()
+
+	os.Unsetenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	creds, err = awsCredentials(awsCredentialSourceChain, session.New())
+	assert.Nil(t, err)
+	assert.Nil(t, creds)
+}
+
+type fakeWebIdentityClient struct {
+	input *sts.AssumeRoleWithWebIdentityInput
+}
+
+func (f *fakeWebIdentityClient) AssumeRoleWithWebIdentity(input *sts.AssumeRoleWithWebIdentityInput) (*sts.AssumeRoleWithWebIdentityOutput, error) {
+	f.input = input
+	return &sts.AssumeRoleWithWebIdentityOutput{
+		Credentials: &sts.Credentials{
+			AccessKeyId:     aws.String("fakeKeyID"),
+			SecretAccessKey: aws.String("fakeSecret"),
+			SessionToken:    aws.String("fakeSession"),
+			Expiration:      aws.Time(time.Now().Add(time.Hour)),
+		},
+	}, nil
+}
+
+func TestWebIdentityProvider(t *testing.T) {
+	tokenFile, err := ioutil.TempFile("", "token")
+	assert.Nil(t, err)
+	defer os.Remove(tokenFile.Name())
+	tokenFile.WriteString("fakeWebIdentityToken\n")
+	tokenFile.Close()
+
+	stsClient := &fakeWebIdentityClient{}
+	p := &webIdentityProvider{client: stsClient, roleARN: "arn:aws:iam::123456789012:role/registry-creds", tokenFile: tokenFile.Name()}
+
+	value, err := p.Retrieve()
+	assert.Nil(t, err)
+	assert.Equal(t, "fakeKeyID", value.AccessKeyID)
+	assert.Equal(t, "fakeSession", value.SessionToken)
+	assert.Equal(t, "fakeWebIdentityToken", *stsClient.input.WebIdentityToken)
+	assert.False(t, p.IsExpired())
+
+	p = &webIdentityProvider{client: stsClient}
+	_, err = p.Retrieve()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,94 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/labels"
+)
+
+const (
+	// backupOfLabel names the secret a --keep-previous-secrets backup was taken of
+	backupOfLabel = "registry-creds.io/previous-of"
+
+	// backupTimeFormat is the suffix of a backup's name. It sorts in time
+	// order and only uses characters allowed in secret names.
+	backupTimeFormat = "20060102-150405"
+)
+
+// backupSecret copies a secret about to be rotated to <name>-<timestamp>,
+// then deletes all but the newest --keep-previous-secrets backups of it
+func (c *controller) backupSecret(namespace string, existing *api.Secret) error {
+	backup := &api.Secret{
+		ObjectMeta: api.ObjectMeta{
+			Name:        fmt.Sprintf("%s-%s", existing.Name, c.now().UTC().Format(backupTimeFormat)),
+			Labels:      copyStringMap(existing.Labels),
+			Annotations: copyStringMap(existing.Annotations),
+		},
+		Data: existing.Data,
+		Type: existing.Type,
+	}
+	if backup.Labels == nil {
+		backup.Labels = map[string]string{}
+	}
+	backup.Labels[backupOfLabel] = existing.Name
+
+	// A second rotation within the same second already has its backup
+	if _, err := c.kubeClient.Secrets(namespace).Create(backup); err != nil && !errors.IsAlreadyExists(err) {
+		return fmt.Errorf("backing up secret %s/%s: %v", namespace, existing.Name, err)
+	}
+	log.Printf("Kept the previous version of secret %s/%s as %s", namespace, existing.Name, backup.Name)
+
+	return c.trimBackups(namespace, existing.Name)
+}
+
+// trimBackups deletes the oldest backups of a secret beyond --keep-previous-secrets
+func (c *controller) trimBackups(namespace, name string) error {
+	selector := labels.SelectorFromSet(labels.Set{backupOfLabel: name})
+	list, err := c.kubeClient.Secrets(namespace).List(api.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return err
+	}
+
+	backups := []string{}
+	for _, secret := range list.Items {
+		backups = append(backups, secret.Name)
+	}
+	sort.Strings(backups)
+
+	for len(backups) > *argKeepPreviousSecrets {
+		if err := c.kubeClient.Secrets(namespace).Delete(backups[0]); err != nil {
+			return err
+		}
+		log.Printf("Deleted old backup %s/%s", namespace, backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util/clock"
+)
+
+func TestProcessKeepsPreviousSecrets(t *testing.T) {
+	*argKeepPreviousSecrets = 2
+	defer func() { *argKeepPreviousSecrets = 0 }()
+
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	// Creating a secret leaves nothing to back up
+	err := c.process()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(kubeClient.secrets["namespace1"].store))
+
+	stale := []string{"c3RhbGU6b25l", "c3RhbGU6dHdv", "c3RhbGU6dGhyZWU="}
+	for _, token := range stale {
+		fakeClock.Step(time.Minute)
+		secret, err := kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+		assert.Nil(t, err)
+		rotated := *secret
+		rotated.Data = map[string][]byte{".dockerconfigjson": []byte(`{"auths":{"fakeEndpoint":{"auth":"` + token + `","email":"none"}}}`)}
+		_, err = kubeClient.Secrets("namespace1").Update(&rotated)
+		assert.Nil(t, err)
+
+		err = c.process()
+		assert.Nil(t, err)
+	}
+
+	// The two newest backups are kept, each holding the version it replaced
+	_, err = kubeClient.Secrets("namespace1").Get(*argAWSSecretName + "-20161001-000100")
+	assert.NotNil(t, err)
+	for i, name := range []string{"-20161001-000200", "-20161001-000300"} {
+		backup, err := kubeClient.Secrets("namespace1").Get(*argAWSSecretName + name)
+		assert.Nil(t, err)
+		assert.Equal(t, *argAWSSecretName, backup.Labels[backupOfLabel])
+		assert.Equal(t, api.SecretTypeDockerConfigJson, backup.Type)
+		assert.Contains(t, string(backup.Data[".dockerconfigjson"]), stale[i+1])
+	}
+
+	// The up to date secret isn't backed up again
+	fakeClock.Step(time.Minute)
+	err = c.process()
+	assert.Nil(t, err)
+	_, err = kubeClient.Secrets("namespace1").Get(*argAWSSecretName + "-20161001-000400")
+	assert.NotNil(t, err)
+}
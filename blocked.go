@@ -0,0 +1,79 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"log"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/errors"
+)
+
+// blockedNamespaces maps namespaces whose secret writes were forbidden, e.g.
+// by a ResourceQuota, to when they may be probed again
+type blockedNamespaces map[string]time.Time
+
+// namespaceBlocked reports whether the namespace is skipped for now. Once its
+// retry time passes the next write probes it again.
+func (c *controller) namespaceBlocked(namespace string) bool {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	until, ok := c.blocked[namespace]
+	return ok && c.now().Before(until)
+}
+
+// blockNamespace skips the namespace until --blocked-namespace-retry has
+// passed when err shows the write is refused rather than failing. It reports
+// whether the namespace was blocked, in which case err isn't returned.
+func (c *controller) blockNamespace(namespace api.Namespace, err error) bool {
+	if *argBlockedNamespaceRetry <= 0 || !errors.IsForbidden(err) {
+		return false
+	}
+
+	until := c.now().Add(*argBlockedNamespaceRetry)
+	c.stateLock.Lock()
+	if c.blocked == nil {
+		c.blocked = blockedNamespaces{}
+	}
+	c.blocked[namespace.Name] = until
+	c.stateLock.Unlock()
+
+	log.Printf("Writing secrets to namespace %s is forbidden, skipping it until %v: %v", namespace.Name, until, err)
+	c.recordEvent(objectReference("Namespace", namespace.Name, namespace.ObjectMeta), api.EventTypeWarning, "SecretWriteBlocked", "Skipping namespace until %v, writing secrets is forbidden: %v", until.Format(time.RFC3339), err)
+	return true
+}
+
+// unblockNamespace forgets a blocked namespace once a write succeeds
+func (c *controller) unblockNamespace(namespace string) {
+	c.stateLock.Lock()
+	_, ok := c.blocked[namespace]
+	delete(c.blocked, namespace)
+	c.stateLock.Unlock()
+	if !ok {
+		return
+	}
+	log.Printf("Writing secrets to namespace %s works again", namespace)
+}
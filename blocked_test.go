@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/util/clock"
+)
+
+// quotaSecrets refuses creates with a quota error while full is set
+type quotaSecrets struct {
+	*fakeSecrets
+	full    bool
+	creates int
+}
+
+func (q *quotaSecrets) Create(secret *api.Secret) (*api.Secret, error) {
+	q.creates++
+	if q.full {
+		return nil, errors.NewForbidden(api.Resource("secrets"), secret.Name, fmt.Errorf("exceeded quota: object-counts, requested: secrets=1, used: secrets=10, limited: secrets=10"))
+	}
+	return q.fakeSecrets.Create(secret)
+}
+
+// quotaKubeClient serves namespace1's secrets through quotaSecrets
+type quotaKubeClient struct {
+	*fakeKubeClient
+	secrets *quotaSecrets
+}
+
+func (q *quotaKubeClient) Secrets(namespace string) unversioned.SecretsInterface {
+	if namespace == "namespace1" {
+		return q.secrets
+	}
+	return q.fakeKubeClient.Secrets(namespace)
+}
+
+func newQuotaKubeClient() *quotaKubeClient {
+	fake := newFakeKubeClient()
+	return &quotaKubeClient{fakeKubeClient: fake, secrets: &quotaSecrets{fakeSecrets: fake.secrets["namespace1"], full: true}}
+}
+
+func TestProcessSkipsBlockedNamespace(t *testing.T) {
+	*argBlockedNamespaceRetry = time.Hour
+	defer func() { *argBlockedNamespaceRetry = 0 }()
+
+	kubeClient := newQuotaKubeClient()
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient(), clock: fakeClock}
+	c.recorder = newEventRecorder(kubeClient.fakeKubeClient)
+
+	// The quota doesn't fail the refresh, namespace2 still gets its secrets
+	err := c.process()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, kubeClient.secrets.creates)
+	_, err = kubeClient.Secrets("namespace2").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+
+	warnings := []*api.Event{}
+	for _, event := range receiveEvents(t, kubeClient.fakeKubeClient, 5) {
+		if event.Type == api.EventTypeWarning {
+			warnings = append(warnings, event)
+		}
+	}
+	assert.Equal(t, 1, len(warnings))
+	assert.Equal(t, "SecretWriteBlocked", warnings[0].Reason)
+	assert.Equal(t, "Namespace", warnings[0].InvolvedObject.Kind)
+	assert.Equal(t, "namespace1", warnings[0].Namespace)
+
+	// Within the retry interval the namespace isn't written to at all
+	fakeClock.Step(30 * time.Minute)
+	skipped := skippedCount(t, skipReasonBlocked)
+	err = c.process()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, kubeClient.secrets.creates)
+	assert.Equal(t, skipped+2, skippedCount(t, skipReasonBlocked))
+
+	// Once it has passed the namespace is probed again, and stays unblocked when writes work
+	kubeClient.secrets.full = false
+	fakeClock.Step(31 * time.Minute)
+	err = c.process()
+	assert.Nil(t, err)
+	_, err = kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	assert.False(t, c.namespaceBlocked("namespace1"))
+	assert.Equal(t, 0, len(c.blocked))
+}
+
+func TestProcessFailsOnQuotaByDefault(t *testing.T) {
+	kubeClient := newQuotaKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	err := c.process()
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, len(c.blocked))
+}
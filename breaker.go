@@ -0,0 +1,118 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Breaker states, also the values reported by the state gauge
+const (
+	breakerClosed   = 0
+	breakerHalfOpen = 1
+	breakerOpen     = 2
+)
+
+var breakerStateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "registry_creds_circuit_breaker_state",
+	Help: "Circuit breaker state per provider: 0 closed, 1 half-open, 2 open",
+}, []string{"provider"})
+
+func init() {
+	prometheus.MustRegister(breakerStateGauge)
+}
+
+type providerBreaker struct {
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+// circuitBreakers stops calling a provider whose token fetch keeps failing.
+// After --circuit-breaker-failures consecutive failures the breaker opens and
+// the provider is skipped, leaving its secrets as they are. Once
+// --circuit-breaker-cooldown has passed it half-opens and the next refresh
+// probes the provider: a success closes it again, a failure reopens it.
+type circuitBreakers struct {
+	providers map[string]*providerBreaker
+}
+
+func (b *circuitBreakers) get(provider string) *providerBreaker {
+	if b.providers == nil {
+		b.providers = map[string]*providerBreaker{}
+	}
+	breaker, ok := b.providers[provider]
+	if !ok {
+		breaker = &providerBreaker{}
+		b.providers[provider] = breaker
+	}
+	return breaker
+}
+
+// allow reports whether the provider should be called this refresh
+func (b *circuitBreakers) allow(provider string, now time.Time) bool {
+	breaker := b.get(provider)
+	if breaker.state != breakerOpen {
+		return true
+	}
+	if now.Sub(breaker.openedAt) < *argBreakerCooldown {
+		return false
+	}
+
+	log.Printf("Circuit breaker for %s is half-open, probing provider", provider)
+	b.setState(provider, breaker, breakerHalfOpen)
+	return true
+}
+
+func (b *circuitBreakers) recordSuccess(provider string) {
+	breaker := b.get(provider)
+	if breaker.state != breakerClosed {
+		log.Printf("Circuit breaker for %s closed", provider)
+	}
+	breaker.failures = 0
+	b.setState(provider, breaker, breakerClosed)
+}
+
+func (b *circuitBreakers) recordFailure(provider string, now time.Time) {
+	breaker := b.get(provider)
+	breaker.failures++
+	if *argBreakerFailures <= 0 {
+		return
+	}
+
+	if breaker.state == breakerHalfOpen || breaker.failures >= *argBreakerFailures {
+		log.Printf("Circuit breaker for %s opened after %d consecutive failures, skipping it for %v", provider, breaker.failures, *argBreakerCooldown)
+		breaker.openedAt = now
+		b.setState(provider, breaker, breakerOpen)
+	}
+}
+
+func (b *circuitBreakers) setState(provider string, breaker *providerBreaker, state int) {
+	breaker.state = state
+	breakerStateGauge.WithLabelValues(provider).Set(float64(state))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/util/clock"
+)
+
+// flakyEcrClient fails while err is set and counts every call
+type flakyEcrClient struct {
+	fakeEcrClient
+	err   error
+	calls int
+}
+
+func (f *flakyEcrClient) GetAuthorizationToken(input *ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.fakeEcrClient.GetAuthorizationToken(input)
+}
+
+func gaugeValue(t *testing.T, gauge prometheus.Gauge) float64 {
+	m := &dto.Metric{}
+	assert.Nil(t, gauge.Write(m))
+	return m.GetGauge().GetValue()
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	*argBreakerFailures = 3
+	defer func() { *argBreakerFailures = 5 }()
+
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	b := circuitBreakers{}
+
+	// Closed until the threshold is reached
+	for i := 0; i < 2; i++ {
+		assert.True(t, b.allow(providerAWS, fakeClock.Now()))
+		b.recordFailure(providerAWS, fakeClock.Now())
+	}
+	assert.Equal(t, breakerClosed, b.get(providerAWS).state)
+
+	b.recordFailure(providerAWS, fakeClock.Now())
+	assert.Equal(t, breakerOpen, b.get(providerAWS).state)
+	assert.Equal(t, float64(breakerOpen), gaugeValue(t, breakerStateGauge.WithLabelValues(providerAWS)))
+
+	// Open for the whole cooldown
+	fakeClock.Step(*argBreakerCooldown - time.Second)
+	assert.False(t, b.allow(providerAWS, fakeClock.Now()))
+
+	// Half-open once the cooldown has passed, and a failed probe reopens it
+	fakeClock.Step(time.Second)
+	assert.True(t, b.allow(providerAWS, fakeClock.Now()))
+	assert.Equal(t, breakerHalfOpen, b.get(providerAWS).state)
+	assert.Equal(t, float64(breakerHalfOpen), gaugeValue(t, breakerStateGauge.WithLabelValues(providerAWS)))
+
+	b.recordFailure(providerAWS, fakeClock.Now())
+	assert.Equal(t, breakerOpen, b.get(providerAWS).state)
+	assert.False(t, b.allow(providerAWS, fakeClock.Now()))
+
+	// A successful probe closes it
+	fakeClock.Step(*argBreakerCooldown)
+	assert.True(t, b.allow(providerAWS, fakeClock.Now()))
+	b.recordSuccess(providerAWS)
+	assert.Equal(t, breakerClosed, b.get(providerAWS).state)
+	assert.Equal(t, 0, b.get(providerAWS).failures)
+	assert.Equal(t, float64(breakerClosed), gaugeValue(t, breakerStateGauge.WithLabelValues(providerAWS)))
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	*argBreakerFailures = 0
+	defer func() { *argBreakerFailures = 5 }()
+
+	b := circuitBreakers{}
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		b.recordFailure(providerGCR, now)
+	}
+	assert.True(t, b.allow(providerGCR, now))
+}
+
+func TestProcessSkipsProviderWhileBreakerOpen(t *testing.T) {
+	*argBreakerFailures = 2
+	defer func() { *argBreakerFailures = 5 }()
+
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	ecrClient := &flakyEcrClient{err: errors.New("throttled")}
+	c := &controller{kubeClient: newFakeKubeClient(), ecrClient: ecrClient, gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	// Each failed refresh retries the token request --max-retries times
+	assert.NotNil(t, c.process())
+	assert.NotNil(t, c.process())
+	assert.Equal(t, 2*tokenAttempts(), ecrClient.calls)
+
+	// The breaker is open, so ECR isn't called and GCR still refreshes
+	assert.Nil(t, c.process())
+	assert.Equal(t, 2*tokenAttempts(), ecrClient.calls)
+	_, err := c.kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.NotNil(t, err)
+	_, err = c.kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+
+	// After the cooldown the provider is probed and recovers
+	ecrClient.err = nil
+	fakeClock.Step(*argBreakerCooldown)
+	assert.Nil(t, c.process())
+	assert.Equal(t, 2*tokenAttempts()+1, ecrClient.calls)
+	assert.Equal(t, breakerClosed, c.breakers.get(providerAWS).state)
+	_, err = c.kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+}
+
+func TestRunOpensBreakerOnRepeatedFailures(t *testing.T) {
+	*argBreakerFailures = 2
+	defer func() { *argBreakerFailures = 5 }()
+	defer func(cooldown time.Duration) { *argBreakerCooldown = cooldown }(*argBreakerCooldown)
+	*argBreakerCooldown = 3 * globalRefreshInterval()
+
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	ecrClient := &flakyEcrClient{err: errors.New("throttled")}
+	c := &controller{kubeClient: newFakeKubeClient(), ecrClient: ecrClient, gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	stopCh := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- c.run(stopCh) }()
+
+	// The startup refresh and the next one fail, which opens the breaker
+	waitForTimer(t, fakeClock)
+	fakeClock.Step(globalRefreshInterval())
+	waitForTimer(t, fakeClock)
+	assert.Equal(t, 2*tokenAttempts(), ecrClient.calls)
+	assert.Equal(t, breakerOpen, c.breakers.get(providerAWS).state)
+
+	// The controller keeps refreshing GCR while ECR is skipped
+	fakeClock.Step(globalRefreshInterval())
+	waitForTimer(t, fakeClock)
+	assert.Equal(t, 2*tokenAttempts(), ecrClient.calls)
+
+	close(stopCh)
+	assert.Nil(t, <-done)
+}
@@ -0,0 +1,207 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+const (
+	combineSecretsOff      = "off"
+	combineSecretsCombined = "combined"
+	combineSecretsDual     = "dual"
+)
+
+// dockerConfigJSON is the .dockerconfigjson layout of a combined secret
+type dockerConfigJSON struct {
+	Auths map[string]dockerConfigEntry `json:"auths"`
+}
+
+type dockerConfigEntry struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Auth     string `json:"auth"`
+	Email    string `json:"email"`
+}
+
+func validCombineSecrets(mode string) bool {
+	return mode == combineSecretsOff || mode == combineSecretsCombined || mode == combineSecretsDual
+}
+
+// newDockerConfigEntry builds the auths entry for one provider token
+func newDockerConfigEntry(token AuthToken, isJSONCfg bool) (dockerConfigEntry, error) {
+	// ECR tokens are already the base64 encoded auth value
+	if isJSONCfg && *argCompatMode != compatModeFleet {
+		return dockerConfigEntry{Auth: string(token.AccessToken), Email: "none"}, nil
+	}
+
+	username, password, err := splitCredentials(string(token.AccessToken), isJSONCfg)
+	if err != nil {
+		return dockerConfigEntry{}, err
+	}
+
+	entry := dockerConfigEntry{
+		Auth:  base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+		Email: "none",
+	}
+	if *argCompatMode == compatModeFleet {
+		entry.Username = username
+		entry.Password = password
+	}
+	return entry, nil
+}
+
+// generateCombinedSecretObj builds a single dockerconfigjson secret holding the
+// auths entries of every provider. encoding/json writes map keys in sorted
+// order, so the auths are sorted by host and the data is byte for byte the
+// same whenever the entries are, letting secretUpToDate skip the write.
+func generateCombinedSecretObj(auths map[string]dockerConfigEntry, secretName string) (*api.Secret, error) {
+	config, err := json.Marshal(dockerConfigJSON{Auths: auths})
+	if err != nil {
+		return nil, err
+	}
+
+	secret := &api.Secret{
+		ObjectMeta: api.ObjectMeta{
+			Name: secretName,
+		},
+		Data: map[string][]byte{
+			".dockerconfigjson": config},
+		Type: "kubernetes.io/dockerconfigjson",
+	}
+	if *argCompatMode == compatModeFleet {
+		secret.Labels = map[string]string{compatModeLabel: compatModeFleet}
+	}
+	return secret, nil
+}
+
+// validateDockerConfig checks a generated .dockerconfigjson is a JSON object
+// with a non-empty auths object whose entries each have a non-empty auth (or a
+// username and password), so a bug in building the config fails the write
+// instead of producing a secret that can't pull anything
+func validateDockerConfig(data []byte) error {
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("invalid docker config JSON: %v", err)
+	}
+
+	raw, ok := config["auths"]
+	if !ok {
+		return fmt.Errorf("docker config has no auths")
+	}
+	var auths map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &auths); err != nil || auths == nil {
+		return fmt.Errorf("docker config auths isn't an object")
+	}
+	if len(auths) == 0 {
+		return fmt.Errorf("docker config auths is empty")
+	}
+
+	for host, raw := range auths {
+		if host == "" {
+			return fmt.Errorf("docker config has an auths entry without a host")
+		}
+		var entry dockerConfigEntry
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return fmt.Errorf("docker config auths entry for %s isn't an object with string credentials", host)
+		}
+		// Converted .dockercfg entries carry a username and password instead
+		if entry.Auth == "" && (entry.Username == "" || entry.Password == "") {
+			return fmt.Errorf("docker config auths entry for %s has an empty auth", host)
+		}
+	}
+	return nil
+}
+
+// checkSecretSize warns when a secret's data adds up to more than
+// --max-secret-size bytes, e.g. because a runaway registry hosts list bloated
+// the combined auths, and fails the write with --fail-on-max-secret-size
+func checkSecretSize(namespace string, secret *api.Secret) error {
+	if *argMaxSecretSize <= 0 {
+		return nil
+	}
+
+	size := 0
+	for _, value := range secret.Data {
+		size += len(value)
+	}
+	if size <= *argMaxSecretSize {
+		return nil
+	}
+
+	err := fmt.Errorf("secret %s/%s is %d bytes, over max-secret-size %d, with %d auths entries", namespace, secret.Name, size, *argMaxSecretSize, countAuths(secret))
+	if *argFailOnMaxSecretSize {
+		return err
+	}
+	log.Printf("Warning: %v", err)
+	return nil
+}
+
+// countAuths counts the registry entries in each docker config of a secret,
+// whatever key and format it's stored under
+func countAuths(secret *api.Secret) int {
+	count := 0
+	for _, value := range secret.Data {
+		var config dockerConfigJSON
+		if err := json.Unmarshal(value, &config); err == nil && config.Auths != nil {
+			count += len(config.Auths)
+			continue
+		}
+		var legacy map[string]json.RawMessage
+		if err := json.Unmarshal(value, &legacy); err == nil {
+			count += len(legacy)
+		}
+	}
+	return count
+}
+
+// dockerConfigCorrupt reports whether a secret's docker config no longer parses,
+// either as JSON or because an auth value isn't valid base64
+func dockerConfigCorrupt(secret *api.Secret) bool {
+	if data, ok := secret.Data[".dockerconfigjson"]; ok {
+		var config dockerConfigJSON
+		if err := json.Unmarshal(data, &config); err != nil || config.Auths == nil {
+			return true
+		}
+		for _, entry := range config.Auths {
+			if _, err := base64.StdEncoding.DecodeString(entry.Auth); err != nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	if data, ok := secret.Data[".dockercfg"]; ok {
+		var config map[string]dockerConfigEntry
+		return json.Unmarshal(data, &config) != nil
+	}
+
+	return false
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+func TestGenerateCombinedSecretObj(t *testing.T) {
+	secret, err := generateCombinedSecretObj(map[string]dockerConfigEntry{
+		"fakeEndpoint":    {Auth: "fakeToken", Email: "none"},
+		"fakeGCREndpoint": {Auth: "otherToken", Email: "none"},
+	}, "combined-secret")
+	assert.Nil(t, err)
+	assert.Equal(t, "combined-secret", secret.Name)
+	assert.Equal(t, api.SecretType("kubernetes.io/dockerconfigjson"), secret.Type)
+	assert.Equal(t,
+		`{"auths":{"fakeEndpoint":{"auth":"fakeToken","email":"none"},"fakeGCREndpoint":{"auth":"otherToken","email":"none"}}}`,
+		string(secret.Data[".dockerconfigjson"]))
+}
+
+func TestGenerateCombinedSecretObjIsStable(t *testing.T) {
+	hosts := []string{"zeta.internal", "fakeEndpoint", "alpha.internal", "gcr.io", "registry.internal:5000"}
+
+	forward := map[string]dockerConfigEntry{}
+	for _, host := range hosts {
+		forward[host] = dockerConfigEntry{Auth: "token-" + host, Email: "none"}
+	}
+	reverse := map[string]dockerConfigEntry{}
+	for i := len(hosts) - 1; i >= 0; i-- {
+		reverse[hosts[i]] = dockerConfigEntry{Auth: "token-" + hosts[i], Email: "none"}
+	}
+
+	first, err := generateCombinedSecretObj(forward, "combined-secret")
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		second, err := generateCombinedSecretObj(reverse, "combined-secret")
+		assert.Nil(t, err)
+		assert.Equal(t, string(first.Data[".dockerconfigjson"]), string(second.Data[".dockerconfigjson"]))
+		assert.True(t, secretUpToDate(first, second))
+	}
+
+	// The entries are sorted by host
+	assert.Equal(t,
+		`{"auths":{"alpha.internal":{"auth":"token-alpha.internal","email":"none"},"fakeEndpoint":{"auth":"token-fakeEndpoint","email":"none"},"gcr.io":{"auth":"token-gcr.io","email":"none"},"registry.internal:5000":{"auth":"token-registry.internal:5000","email":"none"},"zeta.internal":{"auth":"token-zeta.internal","email":"none"}}}`,
+		string(first.Data[".dockerconfigjson"]))
+}
+
+func TestProcessCombinedSecrets(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	ecrClient := newFakeEcrClient()
+	*argGCRURL = "fakeGCREndpoint"
+	gcrClient := newFakeGcrClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: gcrClient}
+
+	*argCombineSecrets = combineSecretsCombined
+	defer func() { *argCombineSecrets = combineSecretsOff }()
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	secret, err := c.kubeClient.Secrets("namespace1").Get(*argCombinedSecretName)
+	assert.Nil(t, err)
+
+	var config dockerConfigJSON
+	assert.Nil(t, json.Unmarshal(secret.Data[".dockerconfigjson"], &config))
+	assert.Equal(t, 2, len(config.Auths))
+	assert.Equal(t, "fakeToken", config.Auths["fakeEndpoint"].Auth)
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("oauth2accesstoken:fakeToken")), config.Auths["fakeGCREndpoint"].Auth)
+
+	_, err = c.kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.NotNil(t, err)
+	_, err = c.kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.NotNil(t, err)
+
+	serviceAccount, err := c.kubeClient.ServiceAccounts("namespace1").Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, []api.LocalObjectReference{{Name: *argCombinedSecretName}}, serviceAccount.ImagePullSecrets)
+}
+
+func TestProcessDualSecrets(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	ecrClient := newFakeEcrClient()
+	*argGCRURL = "fakeGCREndpoint"
+	gcrClient := newFakeGcrClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: gcrClient}
+
+	*argCombineSecrets = combineSecretsDual
+	defer func() { *argCombineSecrets = combineSecretsOff }()
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	for _, namespace := range []string{"namespace1", "namespace2"} {
+		secret, err := c.kubeClient.Secrets(namespace).Get(*argGCRSecretName)
+		assert.Nil(t, err)
+		assert.Equal(t, api.SecretType("kubernetes.io/dockercfg"), secret.Type)
+
+		secret, err = c.kubeClient.Secrets(namespace).Get(*argAWSSecretName)
+		assert.Nil(t, err)
+		assert.Equal(t, api.SecretType("kubernetes.io/dockerconfigjson"), secret.Type)
+
+		secret, err = c.kubeClient.Secrets(namespace).Get(*argCombinedSecretName)
+		assert.Nil(t, err)
+		assert.Equal(t, api.SecretType("kubernetes.io/dockerconfigjson"), secret.Type)
+
+		serviceAccount, err := c.kubeClient.ServiceAccounts(namespace).Get("default")
+		assert.Nil(t, err)
+		assert.Equal(t, []api.LocalObjectReference{
+			{Name: *argGCRSecretName},
+			{Name: *argAWSSecretName},
+			{Name: *argCombinedSecretName},
+		}, serviceAccount.ImagePullSecrets)
+	}
+
+	_, err = c.kubeClient.Secrets("kube-system").Get(*argCombinedSecretName)
+	assert.NotNil(t, err)
+}
+
+func TestDockerConfigCorrupt(t *testing.T) {
+	valid := generateSecretObj(base64.StdEncoding.EncodeToString([]byte("AWS:password")), "fakeEndpoint", true, "secret")
+	assert.False(t, dockerConfigCorrupt(valid))
+	assert.False(t, dockerConfigCorrupt(generateSecretObj("fakeToken", "fakeEndpoint", false, "secret")))
+	assert.False(t, dockerConfigCorrupt(&api.Secret{}))
+
+	for _, data := range []map[string][]byte{
+		{".dockerconfigjson": []byte(`{"auths":`)},
+		{".dockerconfigjson": []byte(`{}`)},
+		{".dockerconfigjson": []byte(`{"auths":{"fakeEndpoint":{"auth":"not base64!"}}}`)},
+		{".dockercfg": []byte(`not json`)},
+	} {
+		assert.True(t, dockerConfigCorrupt(&api.Secret{Data: data}), "%s", data)
+	}
+}
+
+func TestProcessRepairsCorruptedSecret(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	ecrClient := newFakeEcrClient()
+	gcrClient := newFakeGcrClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: gcrClient}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	// An external edit leaves invalid JSON behind
+	secret, err := c.kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	expected := secret.Data
+	corrupted := *secret
+	corrupted.Data = map[string][]byte{".dockerconfigjson": []byte(`{"auths":{"fakeEndpoint":`)}
+	_, err = c.kubeClient.Secrets("namespace1").Update(&corrupted)
+	assert.Nil(t, err)
+
+	err = c.process()
+	assert.Nil(t, err)
+
+	secret, err = c.kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, secret.Data)
+}
+
+func TestValidateDockerConfig(t *testing.T) {
+	valid := generateSecretObj(base64.StdEncoding.EncodeToString([]byte("AWS:password")), "fakeEndpoint", true, "secret")
+	assert.Nil(t, validateDockerConfig(valid.Data[".dockerconfigjson"]))
+	assert.Nil(t, validateDockerConfig([]byte(`{"auths":{"gcr.io":{"username":"_token","password":"fakeToken","email":"none"}}}`)))
+
+	for _, data := range []string{
+		`not json`,
+		`[]`,
+		`{}`,
+		`{"auths":null}`,
+		`{"auths":"fakeEndpoint"}`,
+		`{"auths":{}}`,
+		`{"auths":{"":{"auth":"ZmFrZQ=="}}}`,
+		`{"auths":{"fakeEndpoint":"ZmFrZQ=="}}`,
+		`{"auths":{"fakeEndpoint":{"auth":""}}}`,
+		`{"auths":{"fakeEndpoint":{"username":"AWS"}}}`,
+	} {
+		assert.NotNil(t, validateDockerConfig([]byte(data)), "%s", data)
+	}
+}
+
+func TestEnsureSecretRejectsInvalidDockerConfig(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	secret := generateSecretObj("", "fakeEndpoint", true, "secret")
+	err := c.ensureSecret("namespace1", secret)
+	assert.NotNil(t, err)
+
+	_, err = kubeClient.Secrets("namespace1").Get("secret")
+	assert.NotNil(t, err)
+}
+
+func TestCheckSecretSize(t *testing.T) {
+	defer func() { *argMaxSecretSize = 0; *argFailOnMaxSecretSize = false }()
+
+	secret, err := generateCombinedSecretObj(map[string]dockerConfigEntry{
+		"registry1.example.com": {Auth: "dXNlcjE6cGFzczE="},
+		"registry2.example.com": {Auth: "dXNlcjI6cGFzczI="},
+	}, "combined-secret")
+	assert.Nil(t, err)
+	size := len(secret.Data[".dockerconfigjson"])
+
+	// Exactly at the limit is fine
+	*argMaxSecretSize = size
+	*argFailOnMaxSecretSize = true
+	assert.Nil(t, checkSecretSize("namespace1", secret))
+
+	// One byte over fails, listing the entries
+	*argMaxSecretSize = size - 1
+	err = checkSecretSize("namespace1", secret)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "with 2 auths entries")
+
+	// Without fail-on-max-secret-size it's only a warning
+	*argFailOnMaxSecretSize = false
+	assert.Nil(t, checkSecretSize("namespace1", secret))
+}
+
+func TestProcessFailsOnMaxSecretSize(t *testing.T) {
+	*argCombineSecrets = combineSecretsCombined
+	defer func() { *argCombineSecrets = combineSecretsOff }()
+	*argMaxSecretSize = 10
+	*argFailOnMaxSecretSize = true
+	defer func() { *argMaxSecretSize = 0; *argFailOnMaxSecretSize = false }()
+
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	err := c.process()
+	assert.NotNil(t, err)
+	_, err = kubeClient.Secrets("namespace1").Get(*argCombinedSecretName)
+	assert.NotNil(t, err)
+}
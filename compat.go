@@ -0,0 +1,114 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+const (
+	compatModeNone  = "none"
+	compatModeFleet = "fleet"
+
+	compatModeLabel = "registry-creds.io/compat-mode"
+
+	// gcrUsername is the default username for a GCR access token
+	gcrUsername = "oauth2accesstoken"
+)
+
+func validCompatMode(mode string) bool {
+	return mode == compatModeNone || mode == compatModeFleet
+}
+
+// generateFleetSecretObj builds a secret in the layout Rancher Fleet consumes:
+// always a kubernetes.io/dockerconfigjson secret, with explicit username and
+// password fields next to auth, and labelled with the compat mode. The config
+// is marshalled, so credentials with quotes or backslashes stay valid JSON.
+func generateFleetSecretObj(token AuthToken, isJSONCfg bool, secretName string) (*api.Secret, error) {
+	username, password, err := splitCredentials(string(token.AccessToken), isJSONCfg)
+	if err != nil {
+		return nil, err
+	}
+	config, err := json.Marshal(dockerConfigJSON{Auths: map[string]dockerConfigEntry{
+		token.Endpoint: {
+			Username: username,
+			Password: password,
+			Auth:     base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+			Email:    "none",
+		},
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.Secret{
+		ObjectMeta: api.ObjectMeta{
+			Name:   secretName,
+			Labels: map[string]string{compatModeLabel: compatModeFleet},
+		},
+		Data: map[string][]byte{
+			".dockerconfigjson": config},
+		Type: "kubernetes.io/dockerconfigjson",
+	}, nil
+}
+
+// gcrUsernames are the usernames GCR and Artifact Registry accept with an
+// OAuth access token as the password. Others, such as _json_key, expect a
+// different kind of password.
+var gcrUsernames = []string{gcrUsername, "_token", "_dcgcloud_token"}
+
+func validGCRUsername(username string) bool {
+	for _, valid := range gcrUsernames {
+		if username == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// splitCredentials returns the username and password behind a provider token.
+// JSON config tokens (ECR) are already base64 encoded "user:password" pairs,
+// dockercfg tokens (GCR) are bare OAuth access tokens.
+func splitCredentials(accessToken string, isJSONCfg bool) (string, string, error) {
+	if !isJSONCfg {
+		return *argGCRUsername, accessToken, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(accessToken)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to decode authorization token: %v", err)
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("authorization token is not in user:password form")
+	}
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+func TestGenerateFleetSecretObjECR(t *testing.T) {
+	token := AuthToken{
+		AccessToken: redactedString(base64.StdEncoding.EncodeToString([]byte("AWS:fakePassword"))),
+		Endpoint:    "fakeEndpoint",
+	}
+
+	secret, err := generateFleetSecretObj(token, true, "fleet-secret")
+	assert.Nil(t, err)
+	assert.Equal(t, "fleet-secret", secret.Name)
+	assert.Equal(t, map[string]string{compatModeLabel: compatModeFleet}, secret.Labels)
+	assert.Equal(t, api.SecretType("kubernetes.io/dockerconfigjson"), secret.Type)
+	assert.Equal(t, map[string][]byte{
+		".dockerconfigjson": []byte(fmt.Sprintf(`{"auths":{"fakeEndpoint":{"username":"AWS","password":"fakePassword","auth":"%s","email":"none"}}}`, string(token.AccessToken))),
+	}, secret.Data)
+}
+
+func TestGenerateFleetSecretObjEscapesCredentials(t *testing.T) {
+	token := AuthToken{
+		AccessToken: redactedString(base64.StdEncoding.EncodeToString([]byte(`AWS:pass"word\`))),
+		Endpoint:    "fakeEndpoint",
+	}
+
+	secret, err := generateFleetSecretObj(token, true, "fleet-secret")
+	assert.Nil(t, err)
+
+	var config dockerConfigJSON
+	assert.Nil(t, json.Unmarshal(secret.Data[".dockerconfigjson"], &config))
+	assert.Equal(t, `pass"word\`, config.Auths["fakeEndpoint"].Password)
+}
+
+func TestGenerateFleetSecretObjGCR(t *testing.T) {
+	token := AuthToken{AccessToken: "fakeToken", Endpoint: "fakeEndpoint"}
+
+	secret, err := generateFleetSecretObj(token, false, "fleet-secret")
+	assert.Nil(t, err)
+	assert.Equal(t, api.SecretType("kubernetes.io/dockerconfigjson"), secret.Type)
+
+	auth := base64.StdEncoding.EncodeToString([]byte("oauth2accesstoken:fakeToken"))
+	assert.Equal(t, map[string][]byte{
+		".dockerconfigjson": []byte(fmt.Sprintf(`{"auths":{"fakeEndpoint":{"username":"oauth2accesstoken","password":"fakeToken","auth":"%s","email":"none"}}}`, auth)),
+	}, secret.Data)
+}
+
+func TestGenerateFleetSecretObjInvalidToken(t *testing.T) {
+	_, err := generateFleetSecretObj(AuthToken{AccessToken: "not base64!", Endpoint: "fakeEndpoint"}, true, "fleet-secret")
+	assert.NotNil(t, err)
+
+	_, err = generateFleetSecretObj(AuthToken{AccessToken: redactedString(base64.StdEncoding.EncodeToString([]byte("nocolon"))), Endpoint: "fakeEndpoint"}, true, "fleet-secret")
+	assert.NotNil(t, err)
+}
+
+func TestProcessFleetCompatMode(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	ecrClient := newFakeEcrClient()
+	*argGCRURL = "fakeEndpoint"
+	gcrClient := newFakeGcrClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: gcrClient}
+
+	*argCompatMode = compatModeFleet
+	defer func() { *argCompatMode = compatModeNone }()
+
+	// The fake ECR token is not a user:password pair, so only GCR can be rendered
+	err := c.process()
+	assert.NotNil(t, err)
+
+	secret, err := c.kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, api.SecretType("kubernetes.io/dockerconfigjson"), secret.Type)
+	assert.Equal(t, compatModeFleet, secret.Labels[compatModeLabel])
+	_, ok := secret.Data[".dockercfg"]
+	assert.False(t, ok)
+}
+
+func TestProcessArtifactRegistryUsername(t *testing.T) {
+	*argGCRURL = "https://us-docker.pkg.dev"
+	*argGCRUsername = "_dcgcloud_token"
+	*argCombineSecrets = combineSecretsDual
+	defer func() {
+		*argGCRURL = "fakeEndpoint"
+		*argGCRUsername = gcrUsername
+		*argCombineSecrets = combineSecretsOff
+	}()
+
+	c := &controller{kubeClient: newFakeKubeClient(), ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	secret, err := c.kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"us-docker.pkg.dev":{"username":"_dcgcloud_token","password":"fakeToken","email":"none"}}`, string(secret.Data[".dockercfg"]))
+
+	// The combined secret's auth pairs the same username with the access token
+	secret, err = c.kubeClient.Secrets("namespace1").Get(*argCombinedSecretName)
+	assert.Nil(t, err)
+	var config dockerConfigJSON
+	assert.Nil(t, json.Unmarshal(secret.Data[".dockerconfigjson"], &config))
+	auth, err := base64.StdEncoding.DecodeString(config.Auths["us-docker.pkg.dev"].Auth)
+	assert.Nil(t, err)
+	assert.Equal(t, "_dcgcloud_token:fakeToken", string(auth))
+}
+
+func TestValidGCRUsername(t *testing.T) {
+	assert.True(t, validGCRUsername("oauth2accesstoken"))
+	assert.True(t, validGCRUsername("_token"))
+	assert.True(t, validGCRUsername("_dcgcloud_token"))
+	assert.False(t, validGCRUsername("_json_key"))
+	assert.False(t, validGCRUsername(""))
+}
@@ -0,0 +1,115 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+// credentialFilePollInterval is how often --watch-credential-files are checked
+const credentialFilePollInterval = 10 * time.Second
+
+// credentialFileWatcher notices changes to credential files by comparing
+// their content on every check. Kubernetes updates a mounted secret by
+// swapping a symlink, which reading the path follows. The files are polled
+// rather than watched with fsnotify, which isn't among the vendored
+// dependencies; a change is picked up within credentialFilePollInterval.
+type credentialFileWatcher struct {
+	paths    []string
+	versions map[string][sha256.Size]byte
+}
+
+func newCredentialFileWatcher(paths []string) *credentialFileWatcher {
+	w := &credentialFileWatcher{paths: paths, versions: map[string][sha256.Size]byte{}}
+	w.changed()
+	return w
+}
+
+// changed reports whether any file changed, appeared or disappeared since
+// the last check
+func (w *credentialFileWatcher) changed() bool {
+	changed := false
+	for _, path := range w.paths {
+		// A missing file hashes like an empty one, which is no use as credentials either
+		data, _ := ioutil.ReadFile(path)
+		version := sha256.Sum256(data)
+		if version != w.versions[path] {
+			w.versions[path] = version
+			changed = true
+		}
+	}
+	return changed
+}
+
+// watchCredentialFiles calls reload whenever the watched files change, then
+// triggers a refresh of every namespace. reload runs between refreshes, so
+// it can swap the controller's clients.
+func (c *controller) watchCredentialFiles(w *credentialFileWatcher, reload func(), stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-c.after(credentialFilePollInterval):
+		case <-stopCh:
+			return
+		}
+		if !w.changed() {
+			continue
+		}
+
+		log.Print("Credential files changed, reloading credentials")
+		c.processLock.Lock()
+		reload()
+		c.processLock.Unlock()
+
+		select {
+		case c.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// reloadEcrClient replaces the ECR client with one using the current AWS
+// credentials, keeping the previous client when they can't be loaded
+func (c *controller) reloadEcrClient() {
+	// The role is assumed again with the new credentials
+	assumedRole := assumedRoleCredentials
+	assumedRoleCredentials = nil
+	client, err := buildEcrClient()
+	if err != nil {
+		log.Printf("Failed to reload AWS credentials, keeping the previous ones: %v", err)
+		assumedRoleCredentials = assumedRole
+		return
+	}
+	c.ecrClient = client
+	if c.ecrRepositories != nil {
+		c.ecrRepositories = client
+	}
+	// The regional clients are created again with the new credentials
+	c.regionalEcrClients = nil
+	// and tokens fetched with the old ones aren't reused
+	c.ecrTokens = nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/util/clock"
+)
+
+func TestCredentialFileWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credwatch")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "credentials")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("[default]\naws_access_key_id = OLD\n"), 0600))
+
+	w := newCredentialFileWatcher([]string{path})
+	assert.False(t, w.changed())
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("[default]\naws_access_key_id = NEW\n"), 0600))
+	assert.True(t, w.changed())
+	assert.False(t, w.changed())
+
+	assert.Nil(t, os.Remove(path))
+	assert.True(t, w.changed())
+}
+
+func TestWatchCredentialFilesTriggersRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credwatch")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "credentials")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("old"), 0600))
+
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	c := &controller{clock: fakeClock, trigger: make(chan struct{}, 1)}
+	reloads := 0
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go c.watchCredentialFiles(newCredentialFileWatcher([]string{path}), func() { reloads++ }, stopCh)
+
+	// An unchanged file doesn't trigger anything
+	waitForTimer(t, fakeClock)
+	fakeClock.Step(credentialFilePollInterval)
+	waitForTimer(t, fakeClock)
+	assert.Equal(t, 0, len(c.trigger))
+
+	// A rotated file reloads the credentials, then forces a refresh of every namespace
+	assert.Nil(t, ioutil.WriteFile(path, []byte("new"), 0600))
+	fakeClock.Step(credentialFilePollInterval)
+	select {
+	case <-c.trigger:
+	case <-time.After(5 * time.Second):
+		t.Fatal("changed credential file didn't trigger a refresh")
+	}
+	c.processLock.Lock()
+	assert.Equal(t, 1, reloads)
+	c.processLock.Unlock()
+}
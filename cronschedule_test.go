@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util/clock"
+)
+
+func TestParseScheduleNextRun(t *testing.T) {
+	// Saturday
+	now := time.Date(2016, 10, 1, 10, 30, 0, 0, time.UTC)
+
+	schedule, err := parseSchedule("@hourly")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2016, 10, 1, 11, 0, 0, 0, time.UTC), schedule.Next(now))
+
+	// Business hours skip the weekend
+	schedule, err = parseSchedule("0 9-17 * * 1-5")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2016, 10, 3, 9, 0, 0, 0, time.UTC), schedule.Next(now))
+	assert.Equal(t, time.Date(2016, 10, 3, 17, 0, 0, 0, time.UTC), schedule.Next(time.Date(2016, 10, 3, 16, 0, 0, 0, time.UTC)))
+
+	_, err = parseSchedule("0 9-17 * *")
+	assert.NotNil(t, err)
+	_, err = parseSchedule("")
+	assert.NotNil(t, err)
+}
+
+func TestRunOnCronSchedule(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 10, 30, 0, 0, time.UTC))
+	ecrClient := &flakyEcrClient{}
+	c := &controller{kubeClient: newFakeKubeClient(), ecrClient: ecrClient, gcrClient: newFakeGcrClient(), clock: fakeClock}
+	c.cronSchedule, _ = parseSchedule("@hourly")
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go c.run(stopCh)
+
+	waitForTimer(t, fakeClock)
+	assert.Equal(t, 1, ecrClient.calls)
+
+	// The next refresh is at the top of the hour, not a refresh interval later
+	fakeClock.Step(29 * time.Minute)
+	assert.Equal(t, 1, ecrClient.calls)
+	fakeClock.Step(time.Minute)
+	waitForTimer(t, fakeClock)
+	assert.Equal(t, 2, ecrClient.calls)
+}
+
+func TestRunTriggerRefreshesEveryNamespace(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient(), clock: fakeClock}
+	c.schedule = &refreshSchedule{}
+	c.trigger = make(chan struct{})
+
+	stopCh := make(chan struct{})
+	go c.run(stopCh)
+	waitForTimer(t, fakeClock)
+
+	// Nothing is due, but a trigger refreshes anyway. Stopping blocks until
+	// the triggered refresh has finished.
+	kubeClient.secrets["namespace1"].Delete(*argGCRSecretName)
+	c.trigger <- struct{}{}
+	stopCh <- struct{}{}
+
+	_, err := kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(c.schedule.due([]api.Namespace{{ObjectMeta: api.ObjectMeta{Name: "namespace1"}}}, fakeClock.Now())))
+}
@@ -0,0 +1,99 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"sort"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+// namespaceCursor spreads the namespaces over several refreshes when
+// --namespaces-per-cycle is set. Each refresh takes the next size namespaces
+// in name order after the cursor, wrapping around at the end, so every
+// namespace is refreshed once every few cycles.
+type namespaceCursor struct {
+	size int
+
+	// last is the name of the last namespace taken
+	last string
+
+	// seen holds the namespaces that existed at the previous refresh, nil
+	// before the first one
+	seen map[string]bool
+
+	// all makes the next refresh take every namespace, e.g. after SIGHUP,
+	// leaving the cursor where it is
+	all bool
+}
+
+// next returns the namespaces to refresh this cycle, in their original
+// order. Namespaces created since the previous refresh jump the queue and
+// are refreshed on top of the slice, so they don't wait for the cursor.
+func (c *namespaceCursor) next(namespaces []api.Namespace) []api.Namespace {
+	names := []string{}
+	for _, namespace := range namespaces {
+		names = append(names, namespace.Name)
+	}
+	sort.Strings(names)
+
+	take := map[string]bool{}
+	if c.all {
+		c.all = false
+		for _, name := range names {
+			take[name] = true
+		}
+	} else if c.seen != nil {
+		for _, name := range names {
+			if !c.seen[name] {
+				take[name] = true
+			}
+		}
+	}
+
+	// Start at the first namespace after the cursor, which may have been deleted
+	start := sort.SearchStrings(names, c.last)
+	if start < len(names) && names[start] == c.last {
+		start++
+	}
+	for i := 0; i < c.size && i < len(names) && len(take) < len(names); i++ {
+		name := names[(start+i)%len(names)]
+		take[name] = true
+		c.last = name
+	}
+
+	c.seen = map[string]bool{}
+	for _, name := range names {
+		c.seen[name] = true
+	}
+
+	slice := []api.Namespace{}
+	for _, namespace := range namespaces {
+		if take[namespace.Name] {
+			slice = append(slice, namespace)
+		}
+	}
+	return slice
+}
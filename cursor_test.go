@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+func namespacesNamed(names ...string) []api.Namespace {
+	namespaces := []api.Namespace{}
+	for _, name := range names {
+		namespaces = append(namespaces, api.Namespace{ObjectMeta: api.ObjectMeta{Name: name}})
+	}
+	return namespaces
+}
+
+func namespaceNames(namespaces []api.Namespace) []string {
+	names := []string{}
+	for _, namespace := range namespaces {
+		names = append(names, namespace.Name)
+	}
+	return names
+}
+
+func TestNamespaceCursorAdvancesAndWraps(t *testing.T) {
+	cursor := &namespaceCursor{size: 2}
+	namespaces := namespacesNamed("e", "c", "a", "d", "b")
+
+	assert.Equal(t, []string{"a", "b"}, namespaceNames(cursor.next(namespaces)))
+	assert.Equal(t, []string{"c", "d"}, namespaceNames(cursor.next(namespaces)))
+	// The slice wraps around, keeping the namespaces' original order
+	assert.Equal(t, []string{"e", "a"}, namespaceNames(cursor.next(namespaces)))
+	assert.Equal(t, []string{"c", "b"}, namespaceNames(cursor.next(namespaces)))
+}
+
+func TestNamespaceCursorNewNamespacesJumpTheQueue(t *testing.T) {
+	cursor := &namespaceCursor{size: 2}
+	assert.Equal(t, []string{"a", "b"}, namespaceNames(cursor.next(namespacesNamed("a", "b", "c", "d"))))
+
+	// z is new, so it's refreshed now on top of the slice
+	assert.Equal(t, []string{"c", "d", "z"}, namespaceNames(cursor.next(namespacesNamed("a", "b", "c", "d", "z"))))
+
+	// The cursor's namespace was deleted, the next one still follows it
+	assert.Equal(t, []string{"a", "z"}, namespaceNames(cursor.next(namespacesNamed("a", "b", "c", "z"))))
+}
+
+func TestProcessNamespacesPerCycle(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient(), cursor: &namespaceCursor{size: 1}}
+
+	// kube-system is always skipped, so it takes a cycle of its own
+	assert.Nil(t, c.process())
+	assert.Nil(t, c.process())
+	_, err := kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	_, err = kubeClient.Secrets("namespace2").Get(*argAWSSecretName)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, c.process())
+	_, err = kubeClient.Secrets("namespace2").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+}
+
+func TestNamespaceCursorAll(t *testing.T) {
+	cursor := &namespaceCursor{size: 1}
+	namespaces := namespacesNamed("a", "b", "c")
+	assert.Equal(t, []string{"a"}, namespaceNames(cursor.next(namespaces)))
+
+	// A triggered refresh takes everything once, then the cursor carries on
+	cursor.all = true
+	assert.Equal(t, []string{"a", "b", "c"}, namespaceNames(cursor.next(namespaces)))
+	assert.Equal(t, []string{"b"}, namespaceNames(cursor.next(namespaces)))
+}
@@ -0,0 +1,70 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+var secretDataKeyPattern = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+
+func validSecretDataKey(key string) bool {
+	return secretDataKeyPattern.MatchString(key)
+}
+
+// applySecretDataKey copies the docker config to --secret-data-key for
+// consumers that expect a different key, e.g. config.json. The copy is always
+// in config.json format, so a legacy .dockercfg is wrapped in "auths".
+//
+// With --secret-data-key-only the standard key is dropped. Kubernetes only
+// accepts a dockerconfigjson secret with a .dockerconfigjson key, so the secret
+// becomes Opaque unless that's the key asked for.
+func applySecretDataKey(secret *api.Secret) {
+	if *argSecretDataKey == "" {
+		return
+	}
+
+	config, ok := secret.Data[api.DockerConfigJsonKey]
+	if !ok {
+		config = []byte(fmt.Sprintf(`{"auths":%s}`, secret.Data[api.DockerConfigKey]))
+	}
+
+	if *argSecretDataKeyOnly {
+		secret.Data = map[string][]byte{}
+		secret.Type = api.SecretTypeOpaque
+		if *argSecretDataKey == api.DockerConfigJsonKey {
+			secret.Type = api.SecretTypeDockerConfigJson
+		}
+	}
+	secret.Data[*argSecretDataKey] = config
+}
+
+// usableForPulls reports whether the kubelet can use the secret as an image pull secret
+func usableForPulls(secret *api.Secret) bool {
+	return secret.Type == api.SecretTypeDockercfg || secret.Type == api.SecretTypeDockerConfigJson
+}
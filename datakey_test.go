@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+func TestValidSecretDataKey(t *testing.T) {
+	assert.True(t, validSecretDataKey("config.json"))
+	assert.True(t, validSecretDataKey(".dockerconfigjson"))
+	assert.False(t, validSecretDataKey("docker/config.json"))
+	assert.False(t, validSecretDataKey(""))
+}
+
+func TestApplySecretDataKey(t *testing.T) {
+	*argSecretDataKey = "config.json"
+	defer func() { *argSecretDataKey = "" }()
+
+	secret := generateSecretObj("fakeToken", "fakeEndpoint", true, "secretName")
+	applySecretDataKey(secret)
+
+	assert.Equal(t, api.SecretTypeDockerConfigJson, secret.Type)
+	assert.Equal(t, secret.Data[".dockerconfigjson"], secret.Data["config.json"])
+	assert.True(t, usableForPulls(secret))
+}
+
+func TestApplySecretDataKeyWrapsDockercfg(t *testing.T) {
+	*argSecretDataKey = "config.json"
+	defer func() { *argSecretDataKey = "" }()
+
+	secret := generateSecretObj("fakeToken", "fakeEndpoint", false, "secretName")
+	applySecretDataKey(secret)
+
+	assert.Equal(t, api.SecretTypeDockercfg, secret.Type)
+	assert.Equal(t, `{"auths":{"fakeEndpoint":{"username":"oauth2accesstoken","password":"fakeToken","email":"none"}}}`, string(secret.Data["config.json"]))
+}
+
+func TestApplySecretDataKeyOnly(t *testing.T) {
+	*argSecretDataKey = "config.json"
+	*argSecretDataKeyOnly = true
+	defer func() {
+		*argSecretDataKey = ""
+		*argSecretDataKeyOnly = false
+	}()
+
+	secret := generateSecretObj("fakeToken", "fakeEndpoint", true, "secretName")
+	applySecretDataKey(secret)
+
+	assert.Equal(t, api.SecretTypeOpaque, secret.Type)
+	assert.Equal(t, 1, len(secret.Data))
+	assert.Equal(t, `{"auths":{"fakeEndpoint":{"auth":"fakeToken","email":"none"}}}`, string(secret.Data["config.json"]))
+	assert.False(t, usableForPulls(secret))
+
+	// The standard key alone keeps the dockerconfigjson type
+	*argSecretDataKey = ".dockerconfigjson"
+	secret = generateSecretObj("fakeToken", "fakeEndpoint", false, "secretName")
+	applySecretDataKey(secret)
+
+	assert.Equal(t, api.SecretTypeDockerConfigJson, secret.Type)
+	assert.Equal(t, 1, len(secret.Data))
+	assert.False(t, dockerConfigCorrupt(secret))
+}
+
+func TestProcessWithSecretDataKeyOnly(t *testing.T) {
+	*argSecretDataKey = "config.json"
+	*argSecretDataKeyOnly = true
+	defer func() {
+		*argSecretDataKey = ""
+		*argSecretDataKeyOnly = false
+	}()
+
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	secret, err := c.kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, api.SecretTypeOpaque, secret.Type)
+	assert.NotNil(t, secret.Data["config.json"])
+
+	// Opaque secrets aren't added to the service account
+	serviceAccount, err := c.kubeClient.ServiceAccounts("namespace1").Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(serviceAccount.ImagePullSecrets))
+}
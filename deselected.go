@@ -0,0 +1,91 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"log"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/labels"
+)
+
+// allNamespaces lists every namespace in the cluster, ignoring --namespaces,
+// the selector, exclusions and opt-in annotations
+func (c *controller) allNamespaces() ([]api.Namespace, error) {
+	if c.cache != nil {
+		return c.cache.listNamespaces(), nil
+	}
+
+	list, err := c.kubeClient.Namespaces().List(api.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// cleanupDeselectedNamespaces removes this instance's managed secrets, with
+// their service account references, from the namespaces it no longer
+// refreshes: ones that dropped the selector label or enabled annotation, or
+// were added to --excluded-namespaces. Secrets it didn't create are left alone.
+func (c *controller) cleanupDeselectedNamespaces() error {
+	selected, err := c.listNamespaces()
+	if err != nil {
+		return err
+	}
+	isSelected := map[string]bool{}
+	for _, namespace := range selected {
+		isSelected[namespace.GetName()] = !namespaceExcluded(namespace.GetName())
+	}
+
+	namespaces, err := c.allNamespaces()
+	if err != nil {
+		return err
+	}
+
+	selector := labels.SelectorFromSet(labels.Set{managedByLabel: managedByValue})
+	for _, namespace := range namespaces {
+		if isSelected[namespace.GetName()] {
+			continue
+		}
+
+		secrets, err := c.kubeClient.Secrets(namespace.GetName()).List(api.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return err
+		}
+
+		for _, secret := range secrets.Items {
+			if ownedByOtherInstance(&secret) {
+				continue
+			}
+
+			if err := c.removeSecret(namespace.GetName(), secret.Name); err != nil {
+				return err
+			}
+			log.Printf("Removed secret %s/%s from deselected namespace", namespace.GetName(), secret.Name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+func TestProcessCleanupDeselectedNamespaces(t *testing.T) {
+	*argNamespaceSelector = "registry-creds=enabled"
+	defer func() { *argNamespaceSelector = "" }()
+	*argCleanupDeselected = true
+	defer func() { *argCleanupDeselected = false }()
+
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	enabled := map[string]string{"registry-creds": "enabled"}
+	kubeClient.namespaces.store["namespace1"] = api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace1", Labels: enabled}}
+	kubeClient.namespaces.store["namespace2"] = api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace2", Labels: enabled}}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	// A secret the controller didn't create stays, as does its reference
+	kubeClient.secrets["namespace2"].store["user-secret"] = &api.Secret{ObjectMeta: api.ObjectMeta{Name: "user-secret"}}
+	serviceAccount, err := kubeClient.ServiceAccounts("namespace2").Get("default")
+	assert.Nil(t, err)
+	serviceAccount.ImagePullSecrets = append(serviceAccount.ImagePullSecrets, api.LocalObjectReference{Name: "user-secret"})
+	_, err = kubeClient.ServiceAccounts("namespace2").Update(serviceAccount)
+	assert.Nil(t, err)
+
+	kubeClient.namespaces.store["namespace2"] = api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace2"}}
+	err = c.process()
+	assert.Nil(t, err)
+
+	_, err = kubeClient.Secrets("namespace2").Get(*argAWSSecretName)
+	assert.NotNil(t, err)
+	_, err = kubeClient.Secrets("namespace2").Get(*argGCRSecretName)
+	assert.NotNil(t, err)
+	_, err = kubeClient.Secrets("namespace2").Get("user-secret")
+	assert.Nil(t, err)
+	serviceAccount, err = kubeClient.ServiceAccounts("namespace2").Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, []api.LocalObjectReference{{Name: "user-secret"}}, serviceAccount.ImagePullSecrets)
+
+	_, err = kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	serviceAccount, err = kubeClient.ServiceAccounts("namespace1").Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(serviceAccount.ImagePullSecrets))
+}
+
+func TestProcessCleanupExcludedNamespace(t *testing.T) {
+	defer func(excluded []string) { *argExcludedNamespaces = excluded }(*argExcludedNamespaces)
+	*argCleanupDeselected = true
+	defer func() { *argCleanupDeselected = false }()
+
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	*argExcludedNamespaces = append(*argExcludedNamespaces, "namespace1")
+	err = c.process()
+	assert.Nil(t, err)
+
+	_, err = kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.NotNil(t, err)
+	serviceAccount, err := kubeClient.ServiceAccounts("namespace1").Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(serviceAccount.ImagePullSecrets))
+
+	_, err = kubeClient.Secrets("namespace2").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,113 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+const (
+	// distributionDirect writes the provider's secret to every namespace
+	distributionDirect = "direct"
+	// distributionReplicated writes the provider's secret only to
+	// --replication-source-namespace, and copies of it to every namespace
+	distributionReplicated = "replicated"
+
+	// replicatedFromAnnotation names the namespace/name of the source secret a replica was copied from
+	replicatedFromAnnotation = "registry-creds.io/replicated-from"
+)
+
+// parseSecretDistribution parses --secret-distribution, a list of
+// provider=mode pairs such as aws=replicated. Providers not listed are
+// distributed directly.
+func parseSecretDistribution(entries []string) (map[string]string, error) {
+	distribution := map[string]string{}
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q must be provider=mode", entry)
+		}
+		provider, mode := parts[0], parts[1]
+		if !knownProvider(provider) {
+			return nil, fmt.Errorf("unknown provider %q, must be one of: %s", provider, strings.Join(knownProviders, ", "))
+		}
+		if mode != distributionDirect && mode != distributionReplicated {
+			return nil, fmt.Errorf("unknown mode %q for provider %s, must be one of: %s, %s", mode, provider, distributionDirect, distributionReplicated)
+		}
+		distribution[provider] = mode
+	}
+	return distribution, nil
+}
+
+// replicated reports whether a provider's secret is replicated from the source namespace
+func replicated(provider string) bool {
+	// validateParams already checked the pairs
+	distribution, _ := parseSecretDistribution(*argSecretDistribution)
+	return distribution[provider] == distributionReplicated
+}
+
+// writeReplicatedSecret writes a generated secret to the source namespace,
+// then copies the secret as stored there to the other namespaces. Only the
+// source is written from the provider's token; the copies carry the
+// replicated-from annotation and are referenced from the service accounts as
+// usual. The source namespace's service accounts are left alone.
+func (c *controller) writeReplicatedSecret(newSecret *api.Secret, provider string, namespaces []api.Namespace) error {
+	sourceNamespace := *argReplicationSourceNamespace
+
+	applySecretDataKey(newSecret)
+	markManaged(newSecret, provider)
+	if err := c.ensureSecret(sourceNamespace, newSecret); err != nil {
+		return fmt.Errorf("writing source secret %s/%s: %v", sourceNamespace, newSecret.Name, err)
+	}
+
+	source, err := c.kubeClient.Secrets(sourceNamespace).Get(newSecret.Name)
+	if err != nil {
+		return fmt.Errorf("reading source secret %s/%s: %v", sourceNamespace, newSecret.Name, err)
+	}
+	replica := &api.Secret{
+		ObjectMeta: api.ObjectMeta{
+			Name:        source.Name,
+			Labels:      copyStringMap(source.Labels),
+			Annotations: copyStringMap(source.Annotations),
+		},
+		Data: source.Data,
+		Type: source.Type,
+	}
+	if replica.Annotations == nil {
+		replica.Annotations = map[string]string{}
+	}
+	replica.Annotations[replicatedFromAnnotation] = sourceNamespace + "/" + source.Name
+
+	targets := []api.Namespace{}
+	for _, namespace := range namespaces {
+		if namespace.GetName() != sourceNamespace {
+			targets = append(targets, namespace)
+		}
+	}
+	return c.writeSecret(replica, targets)
+}
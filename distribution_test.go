@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+func TestParseSecretDistribution(t *testing.T) {
+	distribution, err := parseSecretDistribution([]string{"aws=replicated", "gcr=direct"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{providerAWS: distributionReplicated, providerGCR: distributionDirect}, distribution)
+
+	_, err = parseSecretDistribution([]string{"aws"})
+	assert.NotNil(t, err)
+	_, err = parseSecretDistribution([]string{"quay=direct"})
+	assert.NotNil(t, err)
+	_, err = parseSecretDistribution([]string{"aws=copied"})
+	assert.NotNil(t, err)
+}
+
+func TestProcessReplicatedAndDirectProviders(t *testing.T) {
+	defer func(distribution []string) { *argSecretDistribution = distribution }(*argSecretDistribution)
+	*argSecretDistribution = []string{"aws=replicated"}
+	*argReplicationSourceNamespace = "registry-creds"
+	defer func() { *argReplicationSourceNamespace = "" }()
+
+	kubeClient := newFakeKubeClient()
+	kubeClient.secrets["registry-creds"] = &fakeSecrets{store: map[string]*api.Secret{}}
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	// The replicated provider's source secret is only in the source namespace
+	source, err := kubeClient.Secrets("registry-creds").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, "", source.Annotations[replicatedFromAnnotation])
+	_, err = kubeClient.Secrets("registry-creds").Get(*argGCRSecretName)
+	assert.NotNil(t, err)
+
+	for _, namespace := range []string{"namespace1", "namespace2"} {
+		// Every other namespace gets a copy of the source
+		replica, err := kubeClient.Secrets(namespace).Get(*argAWSSecretName)
+		assert.Nil(t, err)
+		assert.Equal(t, "registry-creds/"+*argAWSSecretName, replica.Annotations[replicatedFromAnnotation])
+		assert.Equal(t, source.Data, replica.Data)
+		assert.Equal(t, source.Type, replica.Type)
+
+		// The direct provider is written straight to each namespace
+		direct, err := kubeClient.Secrets(namespace).Get(*argGCRSecretName)
+		assert.Nil(t, err)
+		assert.Equal(t, "", direct.Annotations[replicatedFromAnnotation])
+
+		serviceAccount, err := kubeClient.ServiceAccounts(namespace).Get("default")
+		assert.Nil(t, err)
+		assert.Equal(t, []api.LocalObjectReference{{Name: *argGCRSecretName}, {Name: *argAWSSecretName}}, serviceAccount.ImagePullSecrets)
+	}
+}
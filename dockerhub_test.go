@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+func TestProcessWithDockerHub(t *testing.T) {
+	*argDockerHubUser = "someuser"
+	*argDockerHubPassword = "first"
+	defer func() {
+		*argDockerHubUser = ""
+		*argDockerHubPassword = ""
+	}()
+
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	for _, namespace := range []string{"namespace1", "namespace2"} {
+		secret, err := kubeClient.Secrets(namespace).Get(*argDockerHubSecretName)
+		assert.Nil(t, err)
+		assert.Equal(t, api.SecretType("kubernetes.io/dockerconfigjson"), secret.Type)
+		assert.Contains(t, string(secret.Data[".dockerconfigjson"]), `"https://index.docker.io/v1/":{"auth":"`+base64.StdEncoding.EncodeToString([]byte("someuser:first"))+`"`)
+
+		serviceAccount, err := kubeClient.ServiceAccounts(namespace).Get("default")
+		assert.Nil(t, err)
+		assert.Contains(t, serviceAccount.ImagePullSecrets, api.LocalObjectReference{Name: *argDockerHubSecretName})
+	}
+
+	// A rotated password is written by the next refresh
+	*argDockerHubPassword = "second"
+	err = c.process()
+	assert.Nil(t, err)
+
+	secret, err := kubeClient.Secrets("namespace1").Get(*argDockerHubSecretName)
+	assert.Nil(t, err)
+	assert.Contains(t, string(secret.Data[".dockerconfigjson"]), base64.StdEncoding.EncodeToString([]byte("someuser:second")))
+
+	serviceAccount, err := kubeClient.ServiceAccounts("namespace1").Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(serviceAccount.ImagePullSecrets))
+}
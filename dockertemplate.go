@@ -0,0 +1,106 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"text/template"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+// dockerConfigTemplateData is what a --dockerconfig-template is rendered with
+type dockerConfigTemplateData struct {
+	Endpoint string
+	Username string
+	Token    string
+
+	// Auth is the base64 encoded username:token pair docker expects in "auth"
+	Auth string
+}
+
+// loadDockerConfigTemplate parses the template file and renders it once with
+// sample values, so a template that doesn't produce valid JSON is caught at startup
+func loadDockerConfigTemplate(path string) (*template.Template, error) {
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := template.New(path).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return nil, err
+	}
+
+	sample := dockerConfigTemplateData{Endpoint: "registry.example.com", Username: "user", Token: "token"}
+	sample.Auth = base64.StdEncoding.EncodeToString([]byte(sample.Username + ":" + sample.Token))
+	if _, err := renderDockerConfigTemplate(tmpl, sample); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+func renderDockerConfigTemplate(tmpl *template.Template, data dockerConfigTemplateData) ([]byte, error) {
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return nil, err
+	}
+	if !json.Valid(rendered.Bytes()) {
+		return nil, fmt.Errorf("template %s doesn't render valid JSON", tmpl.Name())
+	}
+	return rendered.Bytes(), nil
+}
+
+// generateTemplateSecretObj builds a kubernetes.io/dockerconfigjson secret
+// whose docker config is rendered from --dockerconfig-template
+func generateTemplateSecretObj(tmpl *template.Template, token AuthToken, isJSONCfg bool, secretName string) (*api.Secret, error) {
+	username, password, err := splitCredentials(string(token.AccessToken), isJSONCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := renderDockerConfigTemplate(tmpl, dockerConfigTemplateData{
+		Endpoint: token.Endpoint,
+		Username: username,
+		Token:    password,
+		Auth:     base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.Secret{
+		ObjectMeta: api.ObjectMeta{
+			Name: secretName,
+		},
+		Data: map[string][]byte{
+			api.DockerConfigJsonKey: config},
+		Type: api.SecretTypeDockerConfigJson,
+	}, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+const identityTokenTemplate = `{"auths":{"{{.Endpoint}}":{"auth":"{{.Auth}}","identitytoken":"{{.Token}}"}}}`
+
+func writeTemplateFile(t *testing.T, dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadDockerConfigTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerconfig-template")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = loadDockerConfigTemplate(writeTemplateFile(t, dir, "valid", identityTokenTemplate))
+	assert.Nil(t, err)
+
+	_, err = loadDockerConfigTemplate(writeTemplateFile(t, dir, "unparsable", `{"auths":{"{{.Endpoint}"}}`))
+	assert.NotNil(t, err)
+
+	_, err = loadDockerConfigTemplate(writeTemplateFile(t, dir, "invalid-json", `{"auths":{{.Endpoint}}}`))
+	assert.NotNil(t, err)
+
+	_, err = loadDockerConfigTemplate(writeTemplateFile(t, dir, "unknown-field", `{"auths":{"{{.Host}}":{}}}`))
+	assert.NotNil(t, err)
+
+	_, err = loadDockerConfigTemplate(filepath.Join(dir, "missing"))
+	assert.NotNil(t, err)
+}
+
+func TestProcessDockerConfigTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerconfig-template")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	tmpl, err := loadDockerConfigTemplate(writeTemplateFile(t, dir, "identitytoken", identityTokenTemplate))
+	assert.Nil(t, err)
+
+	*argGCRURL = "fakeEndpoint"
+	c := &controller{kubeClient: newFakeKubeClient(), ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+	c.disabledProviders = map[string]bool{providerAWS: true}
+	c.dockerConfigTemplate = tmpl
+
+	err = c.process()
+	assert.Nil(t, err)
+
+	secret, err := c.kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, api.SecretTypeDockerConfigJson, secret.Type)
+	assert.Equal(t,
+		`{"auths":{"fakeEndpoint":{"auth":"b2F1dGgyYWNjZXNzdG9rZW46ZmFrZVRva2Vu","identitytoken":"fakeToken"}}}`,
+		string(secret.Data[api.DockerConfigJsonKey]))
+}
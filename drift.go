@@ -0,0 +1,158 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sort"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+const (
+	driftSecretMissing    = "SecretMissing"
+	driftSecretOutOfDate  = "SecretOutOfDate"
+	driftReferenceMissing = "ReferenceMissing"
+)
+
+// driftEntry is one difference between the cluster and what a refresh would write
+type driftEntry struct {
+	Namespace      string `json:"namespace"`
+	Secret         string `json:"secret"`
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+	Drift          string `json:"drift"`
+}
+
+// driftReport collects the drift found by a --drift-report run, which
+// records what it would write instead of writing it
+type driftReport struct {
+	Entries []driftEntry `json:"entries"`
+}
+
+func (r *driftReport) add(entry driftEntry) {
+	r.Entries = append(r.Entries, entry)
+}
+
+// byDriftEntry orders entries by namespace, secret and service account
+type byDriftEntry []driftEntry
+
+func (b byDriftEntry) Len() int {
+	return len(b)
+}
+
+func (b byDriftEntry) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+func (b byDriftEntry) Less(i, j int) bool {
+	if b[i].Namespace != b[j].Namespace {
+		return b[i].Namespace < b[j].Namespace
+	}
+	if b[i].Secret != b[j].Secret {
+		return b[i].Secret < b[j].Secret
+	}
+	return b[i].ServiceAccount < b[j].ServiceAccount
+}
+
+// write saves the report as JSON, sorted so repeated runs are easy to diff
+func (r *driftReport) write(path string) error {
+	entries := append([]driftEntry{}, r.Entries...)
+	sort.Stable(byDriftEntry(entries))
+
+	data, err := json.MarshalIndent(driftReport{Entries: entries}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// logDryRun logs each entry as the change a --dry-run refresh would have made
+func (r *driftReport) logDryRun() {
+	entries := append([]driftEntry{}, r.Entries...)
+	sort.Stable(byDriftEntry(entries))
+
+	for _, entry := range entries {
+		switch entry.Drift {
+		case driftSecretMissing:
+			log.Printf("Dry run: would create secret %s/%s", entry.Namespace, entry.Secret)
+		case driftSecretOutOfDate:
+			log.Printf("Dry run: would update secret %s/%s", entry.Namespace, entry.Secret)
+		case driftReferenceMissing:
+			log.Printf("Dry run: would add secret %s to service account %s/%s", entry.Secret, entry.Namespace, entry.ServiceAccount)
+		}
+	}
+	log.Printf("Dry run: %d changes, nothing written", len(entries))
+}
+
+// secretDrifted reports whether an existing secret differs from the generated
+// one in a way that matters for a drift report. Tokens change on every fetch,
+// so unlike secretUpToDate the docker config is compared by its registry
+// hosts rather than byte for byte.
+func secretDrifted(existing, generated *api.Secret) bool {
+	if dockerConfigCorrupt(existing) || existing.Type != generated.Type {
+		return true
+	}
+	if !reflect.DeepEqual(dataKeys(existing), dataKeys(generated)) {
+		return true
+	}
+	return !reflect.DeepEqual(dockerConfigHosts(existing), dockerConfigHosts(generated))
+}
+
+func dataKeys(secret *api.Secret) []string {
+	keys := []string{}
+	for key := range secret.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// dockerConfigHosts returns the sorted registry hosts of a secret's docker config
+func dockerConfigHosts(secret *api.Secret) []string {
+	hosts := []string{}
+	if data, ok := secret.Data[api.DockerConfigJsonKey]; ok {
+		var config struct {
+			Auths map[string]json.RawMessage `json:"auths"`
+		}
+		if json.Unmarshal(data, &config) == nil {
+			for host := range config.Auths {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	if data, ok := secret.Data[api.DockerConfigKey]; ok {
+		config := map[string]json.RawMessage{}
+		if json.Unmarshal(data, &config) == nil {
+			for host := range config {
+				hosts = append(hosts, "dockercfg:"+host)
+			}
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
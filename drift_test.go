@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+func TestProcessDriftReport(t *testing.T) {
+	defer func(url string) { *argGCRURL = url }(*argGCRURL)
+	*argGCRURL = "fakeGCREndpoint"
+
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient(), drift: &driftReport{}}
+
+	// namespace1 has a current AWS secret, only with an older token, and no GCR secret
+	awsSecret := generateSecretObj("b2xkZXI6dG9rZW4=", "fakeEndpoint", true, *argAWSSecretName)
+	kubeClient.secrets["namespace1"].store[*argAWSSecretName] = awsSecret
+	kubeClient.serviceaccounts["namespace1"].store["default"].ImagePullSecrets = []api.LocalObjectReference{{Name: *argAWSSecretName}}
+
+	// namespace2 has a GCR secret for the wrong registry and no AWS secret
+	gcrSecret := generateSecretObj("fakeToken", "oldGCREndpoint", false, *argGCRSecretName)
+	kubeClient.secrets["namespace2"].store[*argGCRSecretName] = gcrSecret
+	kubeClient.serviceaccounts["namespace2"].store["default"].ImagePullSecrets = []api.LocalObjectReference{{Name: *argAWSSecretName}, {Name: *argGCRSecretName}}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	dir, err := ioutil.TempDir("", "drift-report")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "drift.json")
+	assert.Nil(t, c.drift.write(path))
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	var report driftReport
+	assert.Nil(t, json.Unmarshal(data, &report))
+	assert.Equal(t, []driftEntry{
+		{Namespace: "namespace1", Secret: *argGCRSecretName, Drift: driftSecretMissing},
+		{Namespace: "namespace1", Secret: *argGCRSecretName, ServiceAccount: "default", Drift: driftReferenceMissing},
+		{Namespace: "namespace2", Secret: *argAWSSecretName, Drift: driftSecretMissing},
+		{Namespace: "namespace2", Secret: *argGCRSecretName, Drift: driftSecretOutOfDate},
+	}, report.Entries)
+
+	// Nothing is fixed
+	_, err = kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.NotNil(t, err)
+	_, err = kubeClient.Secrets("namespace2").Get(*argAWSSecretName)
+	assert.NotNil(t, err)
+	secret, err := kubeClient.Secrets("namespace2").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, gcrSecret, secret)
+	serviceAccount, err := kubeClient.ServiceAccounts("namespace1").Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, []api.LocalObjectReference{{Name: *argAWSSecretName}}, serviceAccount.ImagePullSecrets)
+}
+
+func TestProcessDryRun(t *testing.T) {
+	*argDryRun = true
+	defer func() { *argDryRun = false }()
+
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	// namespace1 has an AWS secret with an older token, which a refresh would update
+	awsSecret := generateSecretObj("b2xkZXI6dG9rZW4=", "fakeEndpoint", true, *argAWSSecretName)
+	kubeClient.secrets["namespace1"].store[*argAWSSecretName] = awsSecret
+	kubeClient.serviceaccounts["namespace1"].store["default"].ImagePullSecrets = []api.LocalObjectReference{{Name: *argAWSSecretName}}
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	logged := out.String()
+	assert.Contains(t, logged, "Dry run: would update secret namespace1/"+*argAWSSecretName)
+	assert.Contains(t, logged, "Dry run: would create secret namespace1/"+*argGCRSecretName)
+	assert.Contains(t, logged, "Dry run: would add secret "+*argGCRSecretName+" to service account namespace1/default")
+	assert.Contains(t, logged, "Dry run: would create secret namespace2/"+*argAWSSecretName)
+	assert.NotContains(t, logged, "Dry run: would add secret "+*argAWSSecretName+" to service account namespace1/default")
+
+	// Nothing is written
+	secret, err := kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, awsSecret, secret)
+	_, err = kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.NotNil(t, err)
+	_, err = kubeClient.Secrets("namespace2").Get(*argAWSSecretName)
+	assert.NotNil(t, err)
+	serviceAccount, err := kubeClient.ServiceAccounts("namespace2").Get("default")
+	assert.Nil(t, err)
+	assert.Empty(t, serviceAccount.ImagePullSecrets)
+}
@@ -0,0 +1,149 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+// awsAccountAnnotation pins a namespace to one of the AWS accounts in the
+// awsaccount env variable, e.g. registry-creds.io/aws-account: 123456789012
+const awsAccountAnnotation = "registry-creds.io/aws-account"
+
+// awsAccount is an entry of the awsaccount env variable, an account
+// optionally followed by the region of its registry, e.g. 123456789012:eu-west-1
+type awsAccount struct {
+	ID     string
+	Region string
+}
+
+// awsAccounts returns the entries of the awsaccount env variable, which may
+// list several comma separated accounts. Region is --aws-region unless given.
+func awsAccounts() []awsAccount {
+	accounts := []awsAccount{}
+	for _, entry := range strings.Split(awsAccountID, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		account := awsAccount{ID: entry, Region: *argAWSRegion}
+		if i := strings.Index(entry, ":"); i >= 0 {
+			account = awsAccount{ID: entry[:i], Region: entry[i+1:]}
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts
+}
+
+// validateAWSAccounts checks every awsaccount entry names an account, and a
+// region when it has one. The first account's registry goes in the AWS
+// secret, so it must be in --aws-region.
+func validateAWSAccounts() error {
+	for i, account := range awsAccounts() {
+		if account.ID == "" || account.Region == "" {
+			return fmt.Errorf("invalid entry %q, must be an account or account:region", account.ID+":"+account.Region)
+		}
+		if i == 0 && account.Region != *argAWSRegion {
+			return fmt.Errorf("the first account %s must be in aws-region %s, not %s", account.ID, *argAWSRegion, account.Region)
+		}
+	}
+	return nil
+}
+
+// awsAccountIDs returns the accounts in the awsaccount env variable, whatever their region
+func awsAccountIDs() []string {
+	ids := []string{}
+	for _, account := range awsAccounts() {
+		ids = append(ids, account.ID)
+	}
+	return ids
+}
+
+// regionAccountIDs returns the accounts in the awsaccount env variable whose registry is in region
+func regionAccountIDs(region string) []string {
+	ids := []string{}
+	for _, account := range awsAccounts() {
+		if account.Region == region {
+			ids = append(ids, account.ID)
+		}
+	}
+	return ids
+}
+
+// awsAccountRegions returns the regions other than --aws-region of the
+// accounts in the awsaccount env variable, in the order they're listed
+func awsAccountRegions() []string {
+	seen := map[string]bool{*argAWSRegion: true}
+	regions := []string{}
+	for _, account := range awsAccounts() {
+		if !seen[account.Region] {
+			seen[account.Region] = true
+			regions = append(regions, account.Region)
+		}
+	}
+	return regions
+}
+
+// ecrAccount returns the AWS account of an ECR registry host, e.g.
+// 123456789012.dkr.ecr.us-east-1.amazonaws.com, or "" for any other host
+func ecrAccount(host string) string {
+	i := strings.Index(host, ".dkr.ecr.")
+	if i <= 0 {
+		return ""
+	}
+	return host[:i]
+}
+
+// namespaceAWSAccount reads the namespace's AWS account annotation. ok is
+// false when the annotation names an account that isn't configured.
+func namespaceAWSAccount(namespace api.Namespace) (account string, ok bool) {
+	account, pinned := namespace.Annotations[awsAccountAnnotation]
+	if !pinned {
+		return "", true
+	}
+	for _, configured := range awsAccountIDs() {
+		if account == configured {
+			return account, true
+		}
+	}
+	log.Printf("Namespace %s is pinned by %s to AWS account %q, which isn't configured", namespace.Name, awsAccountAnnotation, account)
+	return account, false
+}
+
+// pinnedAuths returns the combined auths without the ECR registries of
+// accounts other than account. Entries for other providers are kept.
+func pinnedAuths(auths map[string]dockerConfigEntry, account string) map[string]dockerConfigEntry {
+	pinned := map[string]dockerConfigEntry{}
+	for host, entry := range auths {
+		if hostAccount := ecrAccount(host); hostAccount != "" && hostAccount != account {
+			continue
+		}
+		pinned[host] = entry
+	}
+	return pinned
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+const (
+	ecrHost1 = "111111111111.dkr.ecr.us-east-1.amazonaws.com"
+	ecrHost2 = "222222222222.dkr.ecr.eu-west-1.amazonaws.com"
+)
+
+// multiAccountEcrClient returns a token for each of two accounts
+type multiAccountEcrClient struct{}
+
+func (f *multiAccountEcrClient) GetAuthorizationToken(input *ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error) {
+	return &ecr.GetAuthorizationTokenOutput{
+		AuthorizationData: []*ecr.AuthorizationData{
+			{AuthorizationToken: aws.String("token1"), ProxyEndpoint: aws.String("https://" + ecrHost1)},
+			{AuthorizationToken: aws.String("token2"), ProxyEndpoint: aws.String("https://" + ecrHost2)},
+		},
+	}, nil
+}
+
+func TestAWSAccountIDs(t *testing.T) {
+	defer func(accountID string) { awsAccountID = accountID }(awsAccountID)
+
+	awsAccountID = "111111111111, 222222222222,"
+	assert.Equal(t, []string{"111111111111", "222222222222"}, awsAccountIDs())
+
+	awsAccountID = ""
+	assert.Equal(t, []string{}, awsAccountIDs())
+}
+
+func TestAWSAccountRegions(t *testing.T) {
+	defer func(accountID string) { awsAccountID = accountID }(awsAccountID)
+	defer func(region string) { *argAWSRegion = region }(*argAWSRegion)
+	*argAWSRegion = "us-east-1"
+
+	awsAccountID = "111111111111,222222222222:eu-west-1,333333333333:us-east-1,444444444444:eu-west-1"
+	assert.Nil(t, validateAWSAccounts())
+	assert.Equal(t, []string{"111111111111", "222222222222", "333333333333", "444444444444"}, awsAccountIDs())
+	assert.Equal(t, []string{"111111111111", "333333333333"}, regionAccountIDs("us-east-1"))
+	assert.Equal(t, []string{"222222222222", "444444444444"}, regionAccountIDs("eu-west-1"))
+	assert.Equal(t, []string{"eu-west-1"}, awsAccountRegions())
+
+	awsAccountID = "111111111111:eu-west-1,222222222222"
+	assert.NotNil(t, validateAWSAccounts())
+	awsAccountID = "111111111111,222222222222:"
+	assert.NotNil(t, validateAWSAccounts())
+}
+
+func TestValidateParamsAWSAccountRegionFromEnv(t *testing.T) {
+	defer func(accountID string) { awsAccountID = accountID }(awsAccountID)
+	defer func(region *string) { argAWSRegion = region }(argAWSRegion)
+	for _, env := range []string{"awsaccount", "awsregion"} {
+		if value, ok := os.LookupEnv(env); ok {
+			defer os.Setenv(env, value)
+		} else {
+			defer os.Unsetenv(env)
+		}
+	}
+
+	// The first account is checked against the awsregion env variable, not the flag default
+	os.Setenv("awsaccount", "111111111111:eu-west-1")
+	os.Setenv("awsregion", "eu-west-1")
+	validateParams()
+	assert.Equal(t, "eu-west-1", *argAWSRegion)
+	assert.Nil(t, validateAWSAccounts())
+}
+
+func TestProcessAWSAccountsInSeveralRegions(t *testing.T) {
+	defer func(accountID string) { awsAccountID = accountID }(awsAccountID)
+	defer func(region string) { *argAWSRegion = region }(*argAWSRegion)
+	*argAWSRegion = "us-east-1"
+	awsAccountID = "111111111111,222222222222,333333333333:eu-west-1"
+	*argAWSSecretRegistries = awsSecretRegistriesAll
+	defer func() { *argAWSSecretRegistries = awsSecretRegistriesFirst }()
+
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: &regionalEcrClient{region: "us-east-1"}, gcrClient: newFakeGcrClient()}
+	c.newRegionalEcrClient = func(region string) (ecrInterface, error) {
+		return &regionalEcrClient{region: region}, nil
+	}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	secret, err := kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	var config dockerConfigJSON
+	assert.Nil(t, json.Unmarshal(secret.Data[".dockerconfigjson"], &config))
+	assert.Equal(t, map[string]dockerConfigEntry{
+		"111111111111.dkr.ecr.us-east-1.amazonaws.com": {Auth: "token-us-east-1", Email: "none"},
+		"222222222222.dkr.ecr.us-east-1.amazonaws.com": {Auth: "token-us-east-1-222222222222", Email: "none"},
+		"333333333333.dkr.ecr.eu-west-1.amazonaws.com": {Auth: "token-eu-west-1-333333333333", Email: "none"},
+	}, config.Auths)
+
+	// One secret holds every account, referenced once
+	serviceAccount, err := kubeClient.ServiceAccounts("namespace1").Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, []api.LocalObjectReference{{Name: *argGCRSecretName}, {Name: *argAWSSecretName}}, serviceAccount.ImagePullSecrets)
+}
+
+func TestEcrAccount(t *testing.T) {
+	assert.Equal(t, "111111111111", ecrAccount(ecrHost1))
+	assert.Equal(t, "", ecrAccount("gcr.io"))
+	assert.Equal(t, "", ecrAccount("fakeEndpoint"))
+}
+
+func TestProcessPinnedAWSAccounts(t *testing.T) {
+	defer func(accountID string) { awsAccountID = accountID }(awsAccountID)
+	awsAccountID = "111111111111,222222222222"
+	*argCombineSecrets = combineSecretsCombined
+	defer func() { *argCombineSecrets = combineSecretsOff }()
+	*argGCRURL = "fakeGCREndpoint"
+
+	kubeClient := newFakeKubeClient()
+	kubeClient.namespaces.store["namespace1"] = api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace1", Annotations: map[string]string{awsAccountAnnotation: "111111111111"}}}
+	kubeClient.namespaces.store["namespace2"] = api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace2", Annotations: map[string]string{awsAccountAnnotation: "222222222222"}}}
+	kubeClient.namespaces.store["namespace3"] = api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace3", Annotations: map[string]string{awsAccountAnnotation: "333333333333"}}}
+	kubeClient.secrets["namespace3"] = &fakeSecrets{store: map[string]*api.Secret{}}
+	c := &controller{kubeClient: kubeClient, ecrClient: &multiAccountEcrClient{}, gcrClient: newFakeGcrClient()}
+
+	skipped := skippedCount(t, skipReasonUnknownAWSAccount)
+	err := c.process()
+	assert.Nil(t, err)
+	assert.Equal(t, skipped+1, skippedCount(t, skipReasonUnknownAWSAccount))
+
+	auths := func(namespace string) map[string]dockerConfigEntry {
+		secret, err := kubeClient.Secrets(namespace).Get(*argCombinedSecretName)
+		assert.Nil(t, err)
+		var config dockerConfigJSON
+		assert.Nil(t, json.Unmarshal(secret.Data[".dockerconfigjson"], &config))
+		return config.Auths
+	}
+
+	// Each pinned namespace only gets its own account's registry, plus the other providers
+	pinned1 := auths("namespace1")
+	assert.Equal(t, 2, len(pinned1))
+	assert.Equal(t, "token1", pinned1[ecrHost1].Auth)
+	assert.Contains(t, pinned1, "fakeGCREndpoint")
+
+	pinned2 := auths("namespace2")
+	assert.Equal(t, 2, len(pinned2))
+	assert.Equal(t, "token2", pinned2[ecrHost2].Auth)
+	assert.Contains(t, pinned2, "fakeGCREndpoint")
+
+	// A namespace pinned to an account that isn't configured gets nothing
+	_, err = kubeClient.Secrets("namespace3").Get(*argCombinedSecretName)
+	assert.NotNil(t, err)
+}
+
+func TestProcessAWSSecretAllRegistries(t *testing.T) {
+	defer func(accountID string) { awsAccountID = accountID }(awsAccountID)
+	awsAccountID = "111111111111,222222222222"
+
+	secretConfig := func(c *controller) map[string]dockerConfigEntry {
+		secret, err := c.kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+		assert.Nil(t, err)
+		var config dockerConfigJSON
+		assert.Nil(t, json.Unmarshal(secret.Data[".dockerconfigjson"], &config))
+		return config.Auths
+	}
+
+	// By default only the first registry goes in the AWS secret
+	c := &controller{kubeClient: newFakeKubeClient(), ecrClient: &multiAccountEcrClient{}, gcrClient: newFakeGcrClient()}
+	assert.Nil(t, c.process())
+	assert.Equal(t, map[string]dockerConfigEntry{ecrHost1: {Auth: "token1", Email: "none"}}, secretConfig(c))
+
+	*argAWSSecretRegistries = awsSecretRegistriesAll
+	defer func() { *argAWSSecretRegistries = awsSecretRegistriesFirst }()
+
+	c = &controller{kubeClient: newFakeKubeClient(), ecrClient: &multiAccountEcrClient{}, gcrClient: newFakeGcrClient()}
+	assert.Nil(t, c.process())
+	assert.Equal(t, map[string]dockerConfigEntry{
+		ecrHost1: {Auth: "token1", Email: "none"},
+		ecrHost2: {Auth: "token2", Email: "none"},
+	}, secretConfig(c))
+}
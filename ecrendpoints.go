@@ -0,0 +1,77 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// parseECREndpoints parses --ecr-endpoints, a list of region=endpoint pairs
+// for partitions such as GovCloud or China whose ECR endpoints the SDK can't
+// derive, into a region to endpoint map
+func parseECREndpoints(entries []string) (map[string]string, error) {
+	endpoints := map[string]string{}
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%q must be region=endpoint", entry)
+		}
+		region, endpoint := parts[0], parts[1]
+		if _, ok := endpoints[region]; ok {
+			return nil, fmt.Errorf("region %s is listed more than once", region)
+		}
+		if err := validateECREndpoint(endpoint); err != nil {
+			return nil, err
+		}
+		endpoints[region] = endpoint
+	}
+	return endpoints, nil
+}
+
+// validateECREndpoint checks an endpoint is an absolute URL the SDK can call
+func validateECREndpoint(endpoint string) error {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint %q: %v", endpoint, err)
+	}
+	if parsed.Scheme != "https" && parsed.Scheme != "http" {
+		return fmt.Errorf("invalid endpoint %q: must start with https:// or http://", endpoint)
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("invalid endpoint %q: missing host", endpoint)
+	}
+	return nil
+}
+
+// ecrEndpoint returns the ECR service endpoint for a region: its entry in
+// endpoints, else --aws-endpoint. Empty means the SDK's default endpoint.
+func ecrEndpoint(region string, endpoints map[string]string) string {
+	if endpoint, ok := endpoints[region]; ok {
+		return endpoint
+	}
+	return *argAWSEndpoint
+}
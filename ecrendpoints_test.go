@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseECREndpoints(t *testing.T) {
+	endpoints, err := parseECREndpoints([]string{
+		"us-gov-west-1=https://ecr.us-gov-west-1.amazonaws.com",
+		"cn-north-1=https://api.ecr.cn-north-1.amazonaws.com.cn",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"us-gov-west-1": "https://ecr.us-gov-west-1.amazonaws.com",
+		"cn-north-1":    "https://api.ecr.cn-north-1.amazonaws.com.cn",
+	}, endpoints)
+
+	_, err = parseECREndpoints([]string{"us-gov-west-1"})
+	assert.NotNil(t, err)
+	_, err = parseECREndpoints([]string{"=https://ecr.internal"})
+	assert.NotNil(t, err)
+	_, err = parseECREndpoints([]string{"us-gov-west-1=ecr.us-gov-west-1.amazonaws.com"})
+	assert.NotNil(t, err)
+	_, err = parseECREndpoints([]string{"us-gov-west-1=https://a.internal", "us-gov-west-1=https://b.internal"})
+	assert.NotNil(t, err)
+}
+
+func TestNewEcrClientEndpointPerRegion(t *testing.T) {
+	region := *argAWSRegion
+	*argECREndpoints = []string{
+		"us-gov-west-1=https://ecr.us-gov-west-1.amazonaws.com",
+		"cn-north-1=https://api.ecr.cn-north-1.amazonaws.com.cn",
+	}
+	*argAWSEndpoint = "https://ecr.internal"
+	defer func() {
+		*argAWSRegion = region
+		*argECREndpoints = nil
+		*argAWSEndpoint = ""
+	}()
+
+	for region, expected := range map[string]string{
+		"us-gov-west-1": "https://ecr.us-gov-west-1.amazonaws.com",
+		"cn-north-1":    "https://api.ecr.cn-north-1.amazonaws.com.cn",
+		"eu-west-1":     "https://ecr.internal",
+	} {
+		*argAWSRegion = region
+		client := newEcrClient().(*ecr.ECR)
+		assert.Equal(t, expected, client.Endpoint, region)
+	}
+
+	// Without an override the SDK derives the endpoint from the region
+	*argAWSEndpoint = ""
+	*argAWSRegion = "eu-west-1"
+	client := newEcrClient().(*ecr.ECR)
+	assert.Equal(t, "https://ecr.eu-west-1.amazonaws.com", client.Endpoint)
+}
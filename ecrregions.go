@@ -0,0 +1,126 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"log"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+// nodeRegionLabels are the node labels holding the node's region, the GA one
+// first, then the beta one older clusters set
+var nodeRegionLabels = []string{"topology.kubernetes.io/region", "failure-domain.beta.kubernetes.io/region"}
+
+// nodeRegions returns the distinct regions the nodes are labelled with, sorted
+func nodeRegions(nodes []api.Node) []string {
+	seen := map[string]bool{}
+	regions := []string{}
+	for _, node := range nodes {
+		for _, label := range nodeRegionLabels {
+			region := node.Labels[label]
+			if region == "" {
+				continue
+			}
+			if !seen[region] {
+				seen[region] = true
+				regions = append(regions, region)
+			}
+			break
+		}
+	}
+	sort.Strings(regions)
+	return regions
+}
+
+// ecrRegions returns the regions other than --aws-region that the cluster's
+// nodes run in, read again on every refresh so added or removed regions are
+// picked up. A failed node list is logged and leaves out the other regions.
+func (c *controller) ecrRegions() []string {
+	if !*argAWSRegionsFromNodes {
+		return nil
+	}
+
+	nodes, err := c.kubeClient.Nodes().List(api.ListOptions{})
+	if err != nil {
+		log.Printf("Failed to list nodes for their regions, only using %s: %v", *argAWSRegion, err)
+		return nil
+	}
+
+	regions := []string{}
+	for _, region := range nodeRegions(nodes.Items) {
+		if region != *argAWSRegion {
+			regions = append(regions, region)
+		}
+	}
+	return regions
+}
+
+// regionalECRTokens fetches the ECR tokens of every region in ecrRegions, for
+// the registries in params, and of the accounts in awsaccount whose registry
+// is in another region. Like the other accounts' tokens, they only go in the
+// combined secret, or the AWS secret with --aws-secret-registries=all.
+func (c *controller) regionalECRTokens(params *ecr.GetAuthorizationTokenInput) ([]AuthToken, error) {
+	registries := map[string][]string{}
+	regions := []string{}
+	for _, region := range c.ecrRegions() {
+		registries[region] = aws.StringValueSlice(params.RegistryIds)
+		regions = append(regions, region)
+	}
+	for _, region := range awsAccountRegions() {
+		if _, ok := registries[region]; !ok {
+			regions = append(regions, region)
+		}
+		registries[region] = append(registries[region], regionAccountIDs(region)...)
+	}
+
+	tokens := []AuthToken{}
+	for _, region := range regions {
+		client, ok := c.regionalEcrClients[region]
+		if !ok {
+			var err error
+			client, err = c.newRegionalEcrClient(region)
+			if err != nil {
+				return nil, err
+			}
+			if c.regionalEcrClients == nil {
+				c.regionalEcrClients = map[string]ecrInterface{}
+			}
+			c.regionalEcrClients[region] = client
+		}
+
+		resp, err := c.getECRToken(client, region, &ecr.GetAuthorizationTokenInput{RegistryIds: aws.StringSlice(registries[region])})
+		if err != nil {
+			return nil, err
+		}
+		for _, token := range resp.AuthorizationData {
+			tokens = append(tokens, ecrAuthToken(token))
+		}
+	}
+	return tokens, nil
+}
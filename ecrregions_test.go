@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+// regionalEcrClient returns a token for the registry of each requested account
+// in its region, account 111111111111 when none is requested
+type regionalEcrClient struct {
+	region string
+	calls  int
+}
+
+func (r *regionalEcrClient) GetAuthorizationToken(input *ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error) {
+	r.calls++
+	accounts := aws.StringValueSlice(input.RegistryIds)
+	if len(accounts) == 0 {
+		accounts = []string{"111111111111"}
+	}
+
+	output := &ecr.GetAuthorizationTokenOutput{}
+	for _, account := range accounts {
+		token := "token-" + r.region
+		if account != "111111111111" {
+			token += "-" + account
+		}
+		output.AuthorizationData = append(output.AuthorizationData, &ecr.AuthorizationData{
+			AuthorizationToken: aws.String(token),
+			ProxyEndpoint:      aws.String(fmt.Sprintf("https://%s.dkr.ecr.%s.amazonaws.com", account, r.region)),
+		})
+	}
+	return output, nil
+}
+
+func regionNode(name, label, region string) api.Node {
+	return api.Node{ObjectMeta: api.ObjectMeta{Name: name, Labels: map[string]string{label: region}}}
+}
+
+func TestNodeRegions(t *testing.T) {
+	nodes := []api.Node{
+		regionNode("node1", "topology.kubernetes.io/region", "us-west-2"),
+		regionNode("node2", "failure-domain.beta.kubernetes.io/region", "eu-west-1"),
+		regionNode("node3", "topology.kubernetes.io/region", "us-west-2"),
+		{ObjectMeta: api.ObjectMeta{Name: "unlabelled"}},
+	}
+	assert.Equal(t, []string{"eu-west-1", "us-west-2"}, nodeRegions(nodes))
+}
+
+func TestProcessAWSRegionsFromNodes(t *testing.T) {
+	defer func(region string) { *argAWSRegion = region }(*argAWSRegion)
+	*argAWSRegion = "us-east-1"
+	*argAWSRegionsFromNodes = true
+	defer func() { *argAWSRegionsFromNodes = false }()
+	*argCombineSecrets = combineSecretsCombined
+	defer func() { *argCombineSecrets = combineSecretsOff }()
+
+	kubeClient := newFakeKubeClient()
+	kubeClient.Nodes()
+	kubeClient.nodes.items = []api.Node{
+		regionNode("node1", "topology.kubernetes.io/region", "us-east-1"),
+		regionNode("node2", "topology.kubernetes.io/region", "eu-west-1"),
+	}
+	regional := map[string]*regionalEcrClient{}
+	c := &controller{kubeClient: kubeClient, ecrClient: &regionalEcrClient{region: "us-east-1"}, gcrClient: newFakeGcrClient()}
+	c.newRegionalEcrClient = func(region string) (ecrInterface, error) {
+		regional[region] = &regionalEcrClient{region: region}
+		return regional[region], nil
+	}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	// --aws-region keeps using the main client, only the other region gets its own
+	assert.Equal(t, []string{"eu-west-1"}, mapKeys(regional))
+
+	secret, err := kubeClient.Secrets("namespace1").Get(*argCombinedSecretName)
+	assert.Nil(t, err)
+	var config dockerConfigJSON
+	assert.Nil(t, json.Unmarshal(secret.Data[".dockerconfigjson"], &config))
+	assert.Equal(t, "token-us-east-1", config.Auths["111111111111.dkr.ecr.us-east-1.amazonaws.com"].Auth)
+	assert.Equal(t, "token-eu-west-1", config.Auths["111111111111.dkr.ecr.eu-west-1.amazonaws.com"].Auth)
+
+	// Nodes in a new region are picked up on the next refresh, and clients are reused
+	kubeClient.nodes.items = append(kubeClient.nodes.items, regionNode("node3", "topology.kubernetes.io/region", "ap-southeast-2"))
+	err = c.process()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ap-southeast-2", "eu-west-1"}, mapKeys(regional))
+	assert.Equal(t, 2, regional["eu-west-1"].calls)
+	assert.Equal(t, 1, regional["ap-southeast-2"].calls)
+}
+
+func mapKeys(clients map[string]*regionalEcrClient) []string {
+	keys := []string{}
+	for key := range clients {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
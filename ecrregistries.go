@@ -0,0 +1,122 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"log"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+const (
+	// awsSecretRegistriesFirst puts only the first registry ECR returned a
+	// token for in the AWS secret, the others only go in the combined secret
+	awsSecretRegistriesFirst = "first"
+	// awsSecretRegistriesAll puts every registry in the AWS secret
+	awsSecretRegistriesAll = "all"
+)
+
+func validAWSSecretRegistries(mode string) bool {
+	return mode == awsSecretRegistriesFirst || mode == awsSecretRegistriesAll
+}
+
+// generateAllRegistriesSecretObj builds the AWS secret with an auths entry for
+// every registry ECR returned a token for, with --aws-secret-registries=all
+func generateAllRegistriesSecretObj(token AuthToken, secretName string) (*api.Secret, error) {
+	auths := map[string]dockerConfigEntry{}
+	for _, registry := range append([]AuthToken{token}, token.Registries...) {
+		entry, err := newDockerConfigEntry(registry, true)
+		if err != nil {
+			return nil, err
+		}
+		auths[registry.Endpoint] = entry
+	}
+	return generateCombinedSecretObj(auths, secretName)
+}
+
+// ecrRepositoryInterface lists repositories, used by --aws-discover-registries
+// to find registries that aren't in awsaccount
+type ecrRepositoryInterface interface {
+	DescribeRepositories(input *ecr.DescribeRepositoriesInput) (*ecr.DescribeRepositoriesOutput, error)
+}
+
+// discoverECRRegistries returns the IDs of the registries holding the
+// repositories the credentials can see, following every page of results
+func discoverECRRegistries(client ecrRepositoryInterface) ([]string, error) {
+	seen := map[string]bool{}
+	input := &ecr.DescribeRepositoriesInput{}
+	for {
+		resp, err := client.DescribeRepositories(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, repository := range resp.Repositories {
+			if repository.RegistryId != nil && *repository.RegistryId != "" {
+				seen[*repository.RegistryId] = true
+			}
+		}
+		if resp.NextToken == nil || *resp.NextToken == "" {
+			break
+		}
+		input = &ecr.DescribeRepositoriesInput{NextToken: resp.NextToken}
+	}
+
+	registries := make([]string, 0, len(seen))
+	for registry := range seen {
+		registries = append(registries, registry)
+	}
+	sort.Strings(registries)
+	return registries, nil
+}
+
+// ecrRegistryIDs returns the registries to fetch a token for: the accounts in
+// awsaccount, followed by any other registries discovered when
+// --aws-discover-registries is set. A failed discovery is logged and the
+// configured accounts are used on their own.
+func (c *controller) ecrRegistryIDs() []string {
+	registries := regionAccountIDs(*argAWSRegion)
+	if c.ecrRepositories == nil {
+		return registries
+	}
+
+	discovered, err := discoverECRRegistries(c.ecrRepositories)
+	if err != nil {
+		log.Printf("Failed to discover ECR registries, using the configured accounts only: %v", err)
+		return registries
+	}
+
+	configured := map[string]bool{}
+	for _, registry := range registries {
+		configured[registry] = true
+	}
+	for _, registry := range discovered {
+		if !configured[registry] {
+			registries = append(registries, registry)
+		}
+	}
+	return registries
+}
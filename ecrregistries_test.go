@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/stretchr/testify/assert"
+)
+
+// pagedRepositoryClient serves one page of repositories per call, keyed by
+// NextToken, and fails while err is set
+type pagedRepositoryClient struct {
+	pages map[string]*ecr.DescribeRepositoriesOutput
+	err   error
+	calls int
+}
+
+func (p *pagedRepositoryClient) DescribeRepositories(input *ecr.DescribeRepositoriesInput) (*ecr.DescribeRepositoriesOutput, error) {
+	p.calls++
+	if p.err != nil {
+		return nil, p.err
+	}
+	return p.pages[aws.StringValue(input.NextToken)], nil
+}
+
+// registryRecordingEcrClient records the registries each token is requested for
+type registryRecordingEcrClient struct {
+	fakeEcrClient
+	registries []string
+}
+
+func (r *registryRecordingEcrClient) GetAuthorizationToken(input *ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error) {
+	r.registries = aws.StringValueSlice(input.RegistryIds)
+	return r.fakeEcrClient.GetAuthorizationToken(input)
+}
+
+func newPagedRepositoryClient() *pagedRepositoryClient {
+	return &pagedRepositoryClient{pages: map[string]*ecr.DescribeRepositoriesOutput{
+		"": {
+			Repositories: []*ecr.Repository{
+				{RegistryId: aws.String("333333333333"), RepositoryName: aws.String("app")},
+				{RegistryId: aws.String("111111111111"), RepositoryName: aws.String("base")},
+			},
+			NextToken: aws.String("page2"),
+		},
+		"page2": {
+			Repositories: []*ecr.Repository{
+				{RegistryId: aws.String("222222222222"), RepositoryName: aws.String("shared")},
+				{RegistryId: aws.String("333333333333"), RepositoryName: aws.String("worker")},
+			},
+		},
+	}}
+}
+
+func TestDiscoverECRRegistries(t *testing.T) {
+	client := newPagedRepositoryClient()
+	registries, err := discoverECRRegistries(client)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"111111111111", "222222222222", "333333333333"}, registries)
+	assert.Equal(t, 2, client.calls)
+
+	client.err = fmt.Errorf("AccessDeniedException")
+	_, err = discoverECRRegistries(client)
+	assert.NotNil(t, err)
+}
+
+func TestGetECRAuthorizationKeyDiscoversRegistries(t *testing.T) {
+	defer func(accountID string) { awsAccountID = accountID }(awsAccountID)
+	awsAccountID = "222222222222"
+
+	ecrClient := &registryRecordingEcrClient{}
+	repositories := newPagedRepositoryClient()
+	c := &controller{ecrClient: ecrClient}
+
+	// Without discovery only the configured account is requested
+	_, err := c.getECRAuthorizationKey()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"222222222222"}, ecrClient.registries)
+
+	// The configured account stays first, so it's still the AWS secret's registry
+	c.ecrRepositories = repositories
+	_, err = c.getECRAuthorizationKey()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"222222222222", "111111111111", "333333333333"}, ecrClient.registries)
+
+	// A failed discovery falls back to the configured account
+	repositories.err = fmt.Errorf("AccessDeniedException")
+	_, err = c.getECRAuthorizationKey()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"222222222222"}, ecrClient.registries)
+}
@@ -0,0 +1,107 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// ecrTokenReuseThreshold is how much of an ECR token's lifetime must be left
+// for a later process() to reuse it when --refresh-threshold isn't set. ECR
+// tokens are valid for twelve hours, so with the default refresh interval
+// most refreshes within the first six reuse the token.
+const ecrTokenReuseThreshold = 0.5
+
+// cachedECRToken is a GetAuthorizationToken response and when it was fetched
+type cachedECRToken struct {
+	resp      *ecr.GetAuthorizationTokenOutput
+	fetchedAt time.Time
+	expiresAt time.Time
+}
+
+// ecrTokenCache keeps the ECR tokens fetched by account and region, so short
+// refresh intervals don't call GetAuthorizationToken, which AWS rate-limits,
+// every cycle
+type ecrTokenCache map[string]cachedECRToken
+
+// ecrTokenCacheKey identifies a request by its region and registry IDs
+func ecrTokenCacheKey(region string, registryIDs []string) string {
+	sorted := append([]string{}, registryIDs...)
+	sort.Strings(sorted)
+	return region + "/" + strings.Join(sorted, ",")
+}
+
+// fresh reports whether the cached token still has more than the reuse
+// threshold of its lifetime left at now
+func (t cachedECRToken) fresh(now time.Time) bool {
+	threshold := *argRefreshThreshold
+	if threshold <= 0 {
+		threshold = ecrTokenReuseThreshold
+	}
+	return float64(t.expiresAt.Sub(now)) > threshold*float64(t.expiresAt.Sub(t.fetchedAt))
+}
+
+// tokenExpiry returns when the first of the response's tokens expires, or false
+// if any of them has no expiry, in which case the response isn't cached
+func tokenExpiry(resp *ecr.GetAuthorizationTokenOutput) (time.Time, bool) {
+	var expiresAt time.Time
+	for _, data := range resp.AuthorizationData {
+		if data.ExpiresAt == nil {
+			return time.Time{}, false
+		}
+		if expiresAt.IsZero() || data.ExpiresAt.Before(expiresAt) {
+			expiresAt = *data.ExpiresAt
+		}
+	}
+	return expiresAt, !expiresAt.IsZero()
+}
+
+// getECRToken calls GetAuthorizationToken on the region's client, unless a
+// token for the same region and registries is cached and still fresh
+func (c *controller) getECRToken(client ecrInterface, region string, params *ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error) {
+	key := ecrTokenCacheKey(region, aws.StringValueSlice(params.RegistryIds))
+	now := c.now()
+	if cached, ok := c.ecrTokens[key]; ok && cached.fresh(now) {
+		return cached.resp, nil
+	}
+
+	resp, err := client.GetAuthorizationToken(params)
+	if err != nil {
+		return nil, err
+	}
+
+	if expiresAt, ok := tokenExpiry(resp); ok && expiresAt.After(now) {
+		if c.ecrTokens == nil {
+			c.ecrTokens = ecrTokenCache{}
+		}
+		c.ecrTokens[key] = cachedECRToken{resp: resp, fetchedAt: now, expiresAt: expiresAt}
+	}
+	return resp, nil
+}
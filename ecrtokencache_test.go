@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util/clock"
+)
+
+func TestProcessReusesCachedECRToken(t *testing.T) {
+	start := time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFakeClock(start)
+	ecrClient := &expiringEcrClient{clock: fakeClock}
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	err := c.process()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, ecrClient.calls)
+
+	// A namespace created since gets the cached token
+	kubeClient.namespaces.store["namespace3"] = api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace3"}}
+	kubeClient.secrets["namespace3"] = &fakeSecrets{store: map[string]*api.Secret{}}
+	kubeClient.serviceaccounts["namespace3"] = &fakeServiceAccounts{store: map[string]*api.ServiceAccount{
+		"default": {ObjectMeta: api.ObjectMeta{Name: "default"}},
+	}}
+	fakeClock.Step(time.Hour)
+	err = c.process()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, ecrClient.calls)
+	_, err = kubeClient.Secrets("namespace3").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+
+	// Less than half the lifetime is left, so a new token is fetched
+	fakeClock.Step(6 * time.Hour)
+	err = c.process()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, ecrClient.calls)
+}
+
+func TestProcessDoesNotCacheTokenWithoutExpiry(t *testing.T) {
+	ecrClient := &flakyEcrClient{}
+	c := &controller{kubeClient: newFakeKubeClient(), ecrClient: ecrClient, gcrClient: newFakeGcrClient()}
+
+	for i := 0; i < 2; i++ {
+		err := c.process()
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 2, ecrClient.calls)
+}
+
+func TestECRTokenCacheKey(t *testing.T) {
+	assert.Equal(t, ecrTokenCacheKey("us-east-1", []string{"222222222222", "111111111111"}), ecrTokenCacheKey("us-east-1", []string{"111111111111", "222222222222"}))
+	assert.NotEqual(t, ecrTokenCacheKey("us-east-1", []string{"111111111111"}), ecrTokenCacheKey("eu-west-1", []string{"111111111111"}))
+}
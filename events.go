@@ -0,0 +1,85 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/record"
+	"k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+// eventSink writes events through the API, moving them into namespace when
+// --event-namespace is set. The involved object still names the secret or
+// service account, only the event itself lives elsewhere.
+type eventSink struct {
+	client    unversioned.EventNamespacer
+	namespace string
+}
+
+func (s *eventSink) target(event *api.Event) unversioned.EventInterface {
+	if s.namespace != "" {
+		event.Namespace = s.namespace
+	}
+	return s.client.Events(event.Namespace)
+}
+
+func (s *eventSink) Create(event *api.Event) (*api.Event, error) {
+	return s.target(event).Create(event)
+}
+
+func (s *eventSink) Update(event *api.Event) (*api.Event, error) {
+	return s.target(event).Update(event)
+}
+
+func (s *eventSink) Patch(event *api.Event, data []byte) (*api.Event, error) {
+	return s.target(event).Patch(event, data)
+}
+
+func newEventRecorder(client unversioned.EventNamespacer) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&eventSink{client: client, namespace: *argEventNamespace})
+	return broadcaster.NewRecorder(api.EventSource{Component: "registry-creds"})
+}
+
+// objectReference builds the event reference by hand, since objects we
+// generate have no self link for api.GetReference to read the version from
+func objectReference(kind, namespace string, meta api.ObjectMeta) *api.ObjectReference {
+	return &api.ObjectReference{
+		Kind:            kind,
+		APIVersion:      "v1",
+		Namespace:       namespace,
+		Name:            meta.Name,
+		UID:             meta.UID,
+		ResourceVersion: meta.ResourceVersion,
+	}
+}
+
+// recordEvent is a no-op when the controller has no recorder, as in most tests
+func (c *controller) recordEvent(ref *api.ObjectReference, eventtype, reason, messageFmt string, args ...interface{}) {
+	if c.recorder == nil {
+		return
+	}
+	c.recorder.Eventf(ref, eventtype, reason, messageFmt, args...)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+// receiveEvents waits for n events, since the broadcaster delivers them asynchronously
+func receiveEvents(t *testing.T, kubeClient *fakeKubeClient, n int) []*api.Event {
+	events := []*api.Event{}
+	for len(events) < n {
+		select {
+		case event := <-kubeClient.events:
+			events = append(events, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d events, expected %d", len(events), n)
+		}
+	}
+	return events
+}
+
+func TestProcessRecordsEvents(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+	c.recorder = newEventRecorder(kubeClient)
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	// Two secrets and two service account updates in each of the two namespaces
+	for _, event := range receiveEvents(t, kubeClient, 8) {
+		assert.Equal(t, event.InvolvedObject.Namespace, event.Namespace)
+		assert.Equal(t, api.EventTypeNormal, event.Type)
+		assert.Equal(t, "registry-creds", event.Source.Component)
+	}
+}
+
+func TestEventNamespace(t *testing.T) {
+	*argEventNamespace = "audit"
+	defer func() { *argEventNamespace = "" }()
+
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+	c.recorder = newEventRecorder(kubeClient)
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	involved := map[string]bool{}
+	for _, event := range receiveEvents(t, kubeClient, 8) {
+		assert.Equal(t, "audit", event.Namespace)
+		involved[event.InvolvedObject.Kind+" "+event.InvolvedObject.Namespace+"/"+event.InvolvedObject.Name] = true
+	}
+
+	// The events still name the objects they are about
+	assert.True(t, involved["Secret namespace1/"+*argGCRSecretName])
+	assert.True(t, involved["Secret namespace2/"+*argAWSSecretName])
+	assert.True(t, involved["ServiceAccount namespace1/default"])
+	assert.True(t, involved["ServiceAccount namespace2/default"])
+}
@@ -0,0 +1,94 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"log"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+// The token lifetime is stored on each per-provider secret when
+// --refresh-threshold is set, so it survives restarts
+const (
+	tokenIssuedAtAnnotation  = "registry-creds.io/token-issued-at"
+	tokenExpiresAtAnnotation = "registry-creds.io/token-expires-at"
+)
+
+// annotateTokenExpiry records when the secret's token was fetched and when it
+// expires. Tokens without a known expiry are left unannotated, so they're
+// always refreshed.
+func annotateTokenExpiry(secret *api.Secret, issuedAt, expiresAt time.Time) {
+	if expiresAt.IsZero() || !expiresAt.After(issuedAt) {
+		return
+	}
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Annotations[tokenIssuedAtAnnotation] = issuedAt.UTC().Format(time.RFC3339)
+	secret.Annotations[tokenExpiresAtAnnotation] = expiresAt.UTC().Format(time.RFC3339)
+}
+
+// tokenLifeRemaining returns the fraction of the secret's token lifetime left
+// at now, or false if the secret doesn't record its token's lifetime
+func tokenLifeRemaining(secret *api.Secret, now time.Time) (float64, bool) {
+	issuedAt, err := time.Parse(time.RFC3339, secret.Annotations[tokenIssuedAtAnnotation])
+	if err != nil {
+		return 0, false
+	}
+	expiresAt, err := time.Parse(time.RFC3339, secret.Annotations[tokenExpiresAtAnnotation])
+	if err != nil || !expiresAt.After(issuedAt) {
+		return 0, false
+	}
+	return float64(expiresAt.Sub(now)) / float64(expiresAt.Sub(issuedAt)), true
+}
+
+// tokenFresh reports whether the provider's secret in every namespace still
+// has more than --refresh-threshold of its token's lifetime left, in which
+// case there's no need to fetch a new token
+func (c *controller) tokenFresh(secretGenerator SecretGenerator, namespaces []api.Namespace) bool {
+	if *argRefreshThreshold <= 0 {
+		return false
+	}
+
+	now := c.now()
+	for _, namespace := range namespaces {
+		if namespaceExcluded(namespace.GetName()) || c.namespaceBlocked(namespace.GetName()) {
+			continue
+		}
+
+		secret, err := c.getSecret(namespace.GetName(), secretGenerator.SecretName)
+		if err != nil {
+			return false
+		}
+		remaining, ok := tokenLifeRemaining(secret, now)
+		if !ok || remaining <= *argRefreshThreshold {
+			return false
+		}
+	}
+	log.Printf("Token for %s has more than %v of its lifetime left, skipping", secretGenerator.Provider, *argRefreshThreshold)
+	return true
+}
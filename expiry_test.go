@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/util/clock"
+)
+
+// expiringEcrClient hands out tokens valid for twelve hours, like ECR, and counts calls
+type expiringEcrClient struct {
+	clock clock.Clock
+	calls int
+}
+
+func (e *expiringEcrClient) GetAuthorizationToken(input *ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error) {
+	e.calls++
+	return &ecr.GetAuthorizationTokenOutput{
+		AuthorizationData: []*ecr.AuthorizationData{
+			&ecr.AuthorizationData{
+				AuthorizationToken: aws.String("fakeToken"),
+				ProxyEndpoint:      aws.String("fakeEndpoint"),
+				ExpiresAt:          aws.Time(e.clock.Now().Add(12 * time.Hour)),
+			},
+		},
+	}, nil
+}
+
+func TestProcessSkipsFreshToken(t *testing.T) {
+	*argRefreshThreshold = 0.25
+	defer func() { *argRefreshThreshold = 0 }()
+
+	start := time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFakeClock(start)
+	ecrClient := &expiringEcrClient{clock: fakeClock}
+	c := &controller{kubeClient: newFakeKubeClient(), ecrClient: ecrClient, gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	err := c.process()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, ecrClient.calls)
+
+	secret, err := c.kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, "2016-10-01T00:00:00Z", secret.Annotations[tokenIssuedAtAnnotation])
+	assert.Equal(t, "2016-10-01T12:00:00Z", secret.Annotations[tokenExpiresAtAnnotation])
+
+	// Half the lifetime is left, so the token isn't fetched again
+	fakeClock.Step(6 * time.Hour)
+	err = c.process()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, ecrClient.calls)
+}
+
+func TestProcessRefreshesTokenNearExpiry(t *testing.T) {
+	*argRefreshThreshold = 0.25
+	defer func() { *argRefreshThreshold = 0 }()
+
+	start := time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFakeClock(start)
+	ecrClient := &expiringEcrClient{clock: fakeClock}
+	c := &controller{kubeClient: newFakeKubeClient(), ecrClient: ecrClient, gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	// Two of twelve hours are left, below the threshold
+	fakeClock.Step(10 * time.Hour)
+	err = c.process()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, ecrClient.calls)
+
+	secret, err := c.kubeClient.Secrets("namespace2").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, "2016-10-01T10:00:00Z", secret.Annotations[tokenIssuedAtAnnotation])
+	assert.Equal(t, "2016-10-01T22:00:00Z", secret.Annotations[tokenExpiresAtAnnotation])
+}
+
+func TestTokenLifeRemaining(t *testing.T) {
+	secret := generateSecretObj("fakeToken", "fakeEndpoint", true, "secretName")
+	issuedAt := time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	_, ok := tokenLifeRemaining(secret, issuedAt)
+	assert.False(t, ok)
+
+	// Without an expiry nothing is recorded
+	annotateTokenExpiry(secret, issuedAt, time.Time{})
+	assert.Nil(t, secret.Annotations)
+
+	annotateTokenExpiry(secret, issuedAt, issuedAt.Add(4*time.Hour))
+	remaining, ok := tokenLifeRemaining(secret, issuedAt.Add(time.Hour))
+	assert.True(t, ok)
+	assert.Equal(t, 0.75, remaining)
+}
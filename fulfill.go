@@ -0,0 +1,154 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/labels"
+)
+
+// fulfillPattern maps image pull secret names matching a glob to the
+// provider whose credentials the secret is created with
+type fulfillPattern struct {
+	pattern  string
+	provider string
+}
+
+// parseFulfillPatterns parses --fulfill-pull-secrets, a list of
+// pattern=provider pairs such as registry-creds-ecr*=aws
+func parseFulfillPatterns(entries []string) ([]fulfillPattern, error) {
+	patterns := []fulfillPattern{}
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%q must be pattern=provider", entry)
+		}
+		pattern, provider := parts[0], parts[1]
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		if !knownProvider(provider) {
+			return nil, fmt.Errorf("unknown provider %q for pattern %q, must be one of: %s", provider, pattern, strings.Join(knownProviders, ", "))
+		}
+		patterns = append(patterns, fulfillPattern{pattern: pattern, provider: provider})
+	}
+	return patterns, nil
+}
+
+// fulfillProvider returns the provider of the first pattern name matches,
+// or "" when it matches none
+func fulfillProvider(patterns []fulfillPattern, name string) string {
+	for _, p := range patterns {
+		if matched, _ := path.Match(p.pattern, name); matched {
+			return p.provider
+		}
+	}
+	return ""
+}
+
+// fulfillPullSecrets writes the provider's credentials under every image
+// pull secret name that a service account references, that matches one of
+// the provider's --fulfill-pull-secrets patterns, and that has no secret
+// behind it yet. newSecret must be the generated secret before
+// writeSecretFormats, which changes it in place. Secrets created this way are
+// refreshed like the provider's own; a secret someone else created under a
+// matching name is left alone.
+func (c *controller) fulfillPullSecrets(newSecret *api.Secret, provider string, namespaces []api.Namespace) error {
+	// validateParams already checked the patterns
+	patterns, _ := parseFulfillPatterns(*argFulfillPullSecrets)
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	for _, namespace := range namespaces {
+		if namespaceExcluded(namespace.GetName()) || c.namespaceBlocked(namespace.GetName()) {
+			continue
+		}
+
+		names, err := c.fulfillableNames(namespace.GetName(), patterns, provider, newSecret.Name)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			secret := &api.Secret{
+				ObjectMeta: api.ObjectMeta{
+					Name:        name,
+					Labels:      copyStringMap(newSecret.Labels),
+					Annotations: copyStringMap(newSecret.Annotations),
+				},
+				Data: map[string][]byte{},
+				Type: newSecret.Type,
+			}
+			for key, value := range newSecret.Data {
+				secret.Data[key] = value
+			}
+			// Only the provider's own secret moves with a rename
+			delete(secret.Annotations, secretNameAnnotation)
+			applySecretDataKey(secret)
+			markManaged(secret, provider)
+			if err := c.ensureSecret(namespace.GetName(), secret); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fulfillableNames returns the image pull secret names referenced from the
+// namespace's service accounts that the provider should write: those
+// matching one of its patterns whose secret is missing or already ours
+func (c *controller) fulfillableNames(namespace string, patterns []fulfillPattern, provider, ownName string) ([]string, error) {
+	serviceAccounts, err := c.listServiceAccounts(namespace, labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	names := []string{}
+	for _, serviceAccount := range serviceAccounts {
+		for _, imagePullSecret := range serviceAccount.ImagePullSecrets {
+			name := imagePullSecret.Name
+			if seen[name] || name == ownName || fulfillProvider(patterns, name) != provider {
+				continue
+			}
+			seen[name] = true
+
+			// Like writeSecretOnce, a secret that can't be read is created
+			existing, err := c.getSecret(namespace, name)
+			if err == nil && (existing.Annotations[providerAnnotation] != provider || existing.Labels[managedByLabel] != managedByValue || ownedByOtherInstance(existing)) {
+				log.Printf("Not fulfilling image pull secret %s/%s, a secret the controller doesn't manage already exists", namespace, name)
+				continue
+			}
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
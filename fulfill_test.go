@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+func TestParseFulfillPatterns(t *testing.T) {
+	patterns, err := parseFulfillPatterns([]string{"registry-creds-ecr*=aws", "registry-creds-gcr=gcr"})
+	assert.Nil(t, err)
+	assert.Equal(t, providerAWS, fulfillProvider(patterns, "registry-creds-ecr-prod"))
+	assert.Equal(t, providerGCR, fulfillProvider(patterns, "registry-creds-gcr"))
+	assert.Equal(t, "", fulfillProvider(patterns, "registry-creds-gcr-prod"))
+
+	for _, entry := range []string{"registry-creds-ecr", "=aws", "registry-creds-ecr*=quay", "[=aws"} {
+		_, err := parseFulfillPatterns([]string{entry})
+		assert.NotNil(t, err, entry)
+	}
+}
+
+func TestProcessFulfillsDeclaredPullSecrets(t *testing.T) {
+	*argFulfillPullSecrets = []string{"registry-creds-ecr*=aws", "registry-creds-gcr*=gcr"}
+	defer func() { *argFulfillPullSecrets = nil }()
+
+	kubeClient := newFakeKubeClient()
+	kubeClient.serviceaccounts["namespace1"].store["builder"] = &api.ServiceAccount{
+		ObjectMeta: api.ObjectMeta{Name: "builder"},
+		ImagePullSecrets: []api.LocalObjectReference{
+			{Name: "registry-creds-ecr"},
+			{Name: "registry-creds-ecr-manual"},
+			{Name: "unrelated"},
+		},
+	}
+	manual := &api.Secret{
+		ObjectMeta: api.ObjectMeta{Name: "registry-creds-ecr-manual"},
+		Data:       map[string][]byte{".dockerconfigjson": []byte(`{"auths":{"example.com":{"auth":"bWFudWFs"}}}`)},
+		Type:       api.SecretTypeDockerConfigJson,
+	}
+	kubeClient.secrets["namespace1"].store[manual.Name] = manual
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	// The declared secret is created with the AWS credentials
+	own, err := kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	fulfilled, err := kubeClient.Secrets("namespace1").Get("registry-creds-ecr")
+	assert.Nil(t, err)
+	assert.Equal(t, own.Data, fulfilled.Data)
+	assert.Equal(t, own.Type, fulfilled.Type)
+	assert.Equal(t, managedByValue, fulfilled.Labels[managedByLabel])
+	assert.Equal(t, providerAWS, fulfilled.Annotations[providerAnnotation])
+
+	// A secret someone else created isn't touched, and unmatched names aren't created
+	existing, err := kubeClient.Secrets("namespace1").Get("registry-creds-ecr-manual")
+	assert.Nil(t, err)
+	assert.Equal(t, manual.Data, existing.Data)
+	_, err = kubeClient.Secrets("namespace1").Get("unrelated")
+	assert.NotNil(t, err)
+
+	// The fulfilled secret is kept up to date on later refreshes
+	stale := *fulfilled
+	stale.Data = map[string][]byte{".dockerconfigjson": []byte(`{"auths":{"fakeEndpoint":{"auth":"c3RhbGU6dG9rZW4="}}}`)}
+	_, err = kubeClient.Secrets("namespace1").Update(&stale)
+	assert.Nil(t, err)
+
+	err = c.process()
+	assert.Nil(t, err)
+	fulfilled, err = kubeClient.Secrets("namespace1").Get("registry-creds-ecr")
+	assert.Nil(t, err)
+	assert.Equal(t, own.Data, fulfilled.Data)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util/clock"
+)
+
+func TestProcessWithGHCRTokenFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "ghcr-token")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+	assert.Nil(t, ioutil.WriteFile(file.Name(), []byte("ghp_first\n"), 0600))
+
+	*argGHCRUser = "someuser"
+	*argGHCRTokenFile = file.Name()
+	defer func() {
+		*argGHCRUser = ""
+		*argGHCRTokenFile = ""
+	}()
+
+	kubeClient := newFakeKubeClient()
+	// The fake clock skips the backoff of the failing refresh's token retries
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient(), clock: clock.NewFakeClock(time.Now())}
+
+	err = c.process()
+	assert.Nil(t, err)
+
+	for _, namespace := range []string{"namespace1", "namespace2"} {
+		secret, err := kubeClient.Secrets(namespace).Get(*argGHCRSecretName)
+		assert.Nil(t, err)
+		assert.Equal(t, api.SecretType("kubernetes.io/dockerconfigjson"), secret.Type)
+		assert.Contains(t, string(secret.Data[".dockerconfigjson"]), `"ghcr.io":{"auth":"`+base64.StdEncoding.EncodeToString([]byte("someuser:ghp_first"))+`"`)
+
+		serviceAccount, err := kubeClient.ServiceAccounts(namespace).Get("default")
+		assert.Nil(t, err)
+		assert.Contains(t, serviceAccount.ImagePullSecrets, api.LocalObjectReference{Name: *argGHCRSecretName})
+	}
+
+	// A rotated token is picked up by the next refresh
+	assert.Nil(t, ioutil.WriteFile(file.Name(), []byte("ghp_second"), 0600))
+	err = c.process()
+	assert.Nil(t, err)
+	secret, err := kubeClient.Secrets("namespace1").Get(*argGHCRSecretName)
+	assert.Nil(t, err)
+	assert.Contains(t, string(secret.Data[".dockerconfigjson"]), base64.StdEncoding.EncodeToString([]byte("someuser:ghp_second")))
+
+	// An unreadable token fails the provider and leaves its secret alone
+	assert.Nil(t, os.Remove(file.Name()))
+	err = c.process()
+	assert.NotNil(t, err)
+	secret, err = kubeClient.Secrets("namespace1").Get(*argGHCRSecretName)
+	assert.Nil(t, err)
+	assert.Contains(t, string(secret.Data[".dockerconfigjson"]), base64.StdEncoding.EncodeToString([]byte("someuser:ghp_second")))
+}
@@ -0,0 +1,181 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// providerStatus is what /readyz reports for a provider
+type providerStatus struct {
+	Healthy     bool      `json:"healthy"`
+	LastSuccess time.Time `json:"lastSuccess,omitempty"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// providerHealth tracks providerStatus per provider, updated by process()
+type providerHealth struct {
+	sync.Mutex
+	providers map[string]providerStatus
+
+	// awaitingStartup keeps /readyz unready until a refresh succeeds in full,
+	// set for --startup-probe-grace
+	awaitingStartup bool
+
+	// lastProcessSuccess is when a process() last completed without errors
+	// or with at least one provider refreshed, for /healthz
+	lastProcessSuccess time.Time
+}
+
+func (h *providerHealth) recordProcessSuccess(now time.Time) {
+	h.Lock()
+	defer h.Unlock()
+	h.lastProcessSuccess = now
+}
+
+// alive reports whether a process() has made progress no longer than maxStaleness ago
+func (h *providerHealth) alive(now time.Time, maxStaleness time.Duration) (bool, time.Time) {
+	h.Lock()
+	defer h.Unlock()
+	return !h.lastProcessSuccess.IsZero() && now.Sub(h.lastProcessSuccess) <= maxStaleness, h.lastProcessSuccess
+}
+
+func (h *providerHealth) setAwaitingStartup(awaiting bool) {
+	h.Lock()
+	defer h.Unlock()
+	h.awaitingStartup = awaiting
+}
+
+func (h *providerHealth) recordSuccess(provider string, now time.Time) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.providers == nil {
+		h.providers = map[string]providerStatus{}
+	}
+	h.providers[provider] = providerStatus{LastSuccess: now}
+}
+
+func (h *providerHealth) recordFailure(provider string, err error) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.providers == nil {
+		h.providers = map[string]providerStatus{}
+	}
+	status := h.providers[provider]
+	status.LastError = err.Error()
+	h.providers[provider] = status
+}
+
+// ready reports whether enough providers are healthy: all of them when
+// requireAll is set, otherwise at least one, and never while awaiting startup. A provider stays healthy while
+// its last success is no older than maxStaleness, so brief outages don't flap.
+func (h *providerHealth) ready(requireAll bool, now time.Time, maxStaleness time.Duration) (bool, map[string]providerStatus) {
+	h.Lock()
+	defer h.Unlock()
+
+	providers := map[string]providerStatus{}
+	healthy := 0
+	for provider, status := range h.providers {
+		status.Healthy = !status.LastSuccess.IsZero() && now.Sub(status.LastSuccess) <= maxStaleness
+		if status.Healthy {
+			healthy++
+		}
+		providers[provider] = status
+	}
+
+	if h.awaitingStartup {
+		return false, providers
+	}
+	if requireAll {
+		return healthy > 0 && healthy == len(providers), providers
+	}
+	return healthy > 0, providers
+}
+
+// readinessMaxStaleness defaults to three refresh intervals
+func readinessMaxStaleness() time.Duration {
+	if *argReadinessMaxStaleness > 0 {
+		return *argReadinessMaxStaleness
+	}
+	return 3 * globalRefreshInterval()
+}
+
+// livenessMaxStaleness defaults to three refresh intervals
+func livenessMaxStaleness() time.Duration {
+	if *argLivenessMaxStaleness > 0 {
+		return *argLivenessMaxStaleness
+	}
+	return 3 * globalRefreshInterval()
+}
+
+// healthzHandler fails until a refresh has succeeded, and again once the last
+// successful one is older than --liveness-max-staleness, so a controller stuck
+// without refreshing is restarted
+func (c *controller) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	alive, lastSuccess := c.health.alive(c.now(), livenessMaxStaleness())
+
+	w.Header().Set("Content-Type", "application/json")
+	if !alive {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(struct {
+		LastSuccess time.Time `json:"lastSuccess,omitempty"`
+	}{lastSuccess})
+}
+
+func (c *controller) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ready, providers := c.health.ready(*argReadinessRequiresAllProviders, c.now(), readinessMaxStaleness())
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(providers)
+}
+
+func (c *controller) serveHealth(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", c.healthzHandler)
+	mux.HandleFunc("/readyz", c.readyzHandler)
+	if *argMetricsPort == 0 {
+		mux.Handle("/metrics", prometheus.Handler())
+	}
+	if c.adminToken != "" {
+		mux.HandleFunc("/prune", c.pruneHandler(c.adminToken))
+	}
+
+	log.Printf("Serving health checks and metrics on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("Health server failed: %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util/clock"
+)
+
+func getReadyz(c *controller) (int, map[string]providerStatus) {
+	w := httptest.NewRecorder()
+	c.readyzHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+
+	providers := map[string]providerStatus{}
+	json.Unmarshal(w.Body.Bytes(), &providers)
+	return w.Code, providers
+}
+
+func TestReadyzBeforeFirstProcess(t *testing.T) {
+	c := &controller{}
+
+	code, providers := getReadyz(c)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, 0, len(providers))
+}
+
+func TestReadyzAnyProvider(t *testing.T) {
+	c := &controller{}
+	c.health.recordSuccess(providerGCR, c.now())
+	c.health.recordFailure(providerAWS, fmt.Errorf("access denied"))
+
+	code, providers := getReadyz(c)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, providers[providerGCR].Healthy)
+	assert.False(t, providers[providerAWS].Healthy)
+	assert.Equal(t, "access denied", providers[providerAWS].LastError)
+}
+
+func TestReadyzRequiresAllProviders(t *testing.T) {
+	*argReadinessRequiresAllProviders = true
+	defer func() { *argReadinessRequiresAllProviders = false }()
+
+	c := &controller{}
+	c.health.recordSuccess(providerGCR, c.now())
+	c.health.recordFailure(providerAWS, fmt.Errorf("access denied"))
+
+	code, _ := getReadyz(c)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	c.health.recordSuccess(providerAWS, c.now())
+
+	code, _ = getReadyz(c)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestReadyzMaxStaleness(t *testing.T) {
+	*argReadinessMaxStaleness = 3 * time.Hour
+	defer func() { *argReadinessMaxStaleness = 0 }()
+
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	c := &controller{clock: fakeClock}
+	c.health.recordSuccess(providerGCR, c.now())
+
+	// A failed refresh inside the staleness window doesn't flip readiness
+	fakeClock.Step(time.Hour)
+	c.health.recordFailure(providerGCR, fmt.Errorf("temporary outage"))
+	code, providers := getReadyz(c)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, providers[providerGCR].Healthy)
+	assert.Equal(t, "temporary outage", providers[providerGCR].LastError)
+
+	// Exactly at the threshold is still ready
+	fakeClock.Step(2 * time.Hour)
+	code, _ = getReadyz(c)
+	assert.Equal(t, http.StatusOK, code)
+
+	// Past the threshold is stale
+	fakeClock.Step(time.Nanosecond)
+	code, providers = getReadyz(c)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, providers[providerGCR].Healthy)
+
+	// A new success clears it
+	c.health.recordSuccess(providerGCR, c.now())
+	code, providers = getReadyz(c)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "", providers[providerGCR].LastError)
+}
+
+func TestReadinessMaxStalenessDefault(t *testing.T) {
+	assert.Equal(t, 3*time.Duration(*argRefreshMinutes)*time.Minute, readinessMaxStaleness())
+}
+
+func TestProcessRecordsProviderHealth(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	ecrClient := newFakeEcrClient()
+	gcrClient := newFakeGcrClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: gcrClient}
+
+	// The fake ECR token can't be rendered in fleet mode, so only GCR succeeds
+	*argCompatMode = compatModeFleet
+	defer func() { *argCompatMode = compatModeNone }()
+
+	err := c.process()
+	assert.NotNil(t, err)
+
+	_, providers := c.health.ready(true, c.now(), readinessMaxStaleness())
+	assert.True(t, providers[providerGCR].Healthy)
+	assert.False(t, providers[providerAWS].Healthy)
+	assert.NotEqual(t, "", providers[providerAWS].LastError)
+}
+
+func TestHealthz(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	ecrClient := &flakyEcrClient{}
+	c := &controller{kubeClient: newFakeKubeClient(), ecrClient: ecrClient, gcrClient: newFakeGcrClient(), clock: fakeClock}
+	// With ECR the only provider, its failures are failed refreshes
+	c.disabledProviders = map[string]bool{providerGCR: true}
+
+	getHealthz := func() int {
+		w := httptest.NewRecorder()
+		c.healthzHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+		return w.Code
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, getHealthz())
+
+	assert.Nil(t, c.process())
+	assert.Equal(t, http.StatusOK, getHealthz())
+
+	// Failed refreshes are tolerated for three refresh intervals. The token
+	// retries' backoff moves the clock on, so it's set to the deadline after.
+	succeeded := fakeClock.Now()
+	ecrClient.err = fmt.Errorf("access denied")
+	assert.NotNil(t, c.process())
+	fakeClock.SetTime(succeeded.Add(3 * globalRefreshInterval()))
+	assert.Equal(t, http.StatusOK, getHealthz())
+
+	fakeClock.Step(time.Second)
+	assert.Equal(t, http.StatusServiceUnavailable, getHealthz())
+
+	ecrClient.err = nil
+	assert.Nil(t, c.process())
+	assert.Equal(t, http.StatusOK, getHealthz())
+}
+
+func TestRunReportsPartialFailureOnReadyz(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	ecrClient := &flakyEcrClient{}
+	c := &controller{kubeClient: newFakeKubeClient(), ecrClient: ecrClient, gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	stopCh := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- c.run(stopCh) }()
+	waitForTimer(t, fakeClock)
+
+	// ECR fails in every refresh after startup, GCR keeps the controller ready
+	ecrClient.err = fmt.Errorf("throttled")
+	for i := 0; i < 4; i++ {
+		fakeClock.Step(globalRefreshInterval())
+		waitForTimer(t, fakeClock)
+	}
+
+	code, providers := getReadyz(c)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, providers[providerGCR].Healthy)
+	assert.False(t, providers[providerAWS].Healthy)
+	assert.Equal(t, "throttled", providers[providerAWS].LastError)
+
+	// GCR still refreshing keeps the pod alive past the liveness staleness
+	w := httptest.NewRecorder()
+	c.healthzHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	close(stopCh)
+	assert.Nil(t, <-done)
+}
+
+func TestHealthzWithNothingDue(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	kubeClient := newFakeKubeClient()
+	kubeClient.namespaces.store = map[string]api.Namespace{}
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient(), clock: fakeClock, schedule: &refreshSchedule{}}
+
+	assert.Nil(t, c.process())
+	w := httptest.NewRecorder()
+	c.healthzHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
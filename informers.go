@@ -0,0 +1,187 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/client/cache"
+	"k8s.io/kubernetes/pkg/fields"
+	"k8s.io/kubernetes/pkg/labels"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+// informerCache keeps local copies of namespaces, service accounts and the
+// managed secrets so that process() does not have to list them every refresh
+type informerCache struct {
+	namespaces      cache.Store
+	serviceAccounts cache.Store
+	secrets         map[string]cache.Store
+	controllers     []*cache.Controller
+}
+
+func newInformerCache(kubeClient kubeInterface, secretNames []string) *informerCache {
+	ic := &informerCache{secrets: map[string]cache.Store{}}
+
+	ic.namespaces = ic.addInformer(&cache.ListWatch{
+		ListFunc: func(options api.ListOptions) (runtime.Object, error) {
+			return kubeClient.Namespaces().List(options)
+		},
+		WatchFunc: func(options api.ListOptions) (watch.Interface, error) {
+			return kubeClient.Namespaces().Watch(options)
+		},
+	}, &api.Namespace{})
+
+	ic.serviceAccounts = ic.addInformer(&cache.ListWatch{
+		ListFunc: func(options api.ListOptions) (runtime.Object, error) {
+			return kubeClient.ServiceAccounts(api.NamespaceAll).List(options)
+		},
+		WatchFunc: func(options api.ListOptions) (watch.Interface, error) {
+			return kubeClient.ServiceAccounts(api.NamespaceAll).Watch(options)
+		},
+	}, &api.ServiceAccount{})
+
+	// Only watch the secrets this controller manages, not every secret in the cluster
+	for _, secretName := range secretNames {
+		selector := fields.OneTermEqualSelector("metadata.name", secretName)
+		ic.secrets[secretName] = ic.addInformer(&cache.ListWatch{
+			ListFunc: func(options api.ListOptions) (runtime.Object, error) {
+				options.FieldSelector = selector
+				return kubeClient.Secrets(api.NamespaceAll).List(options)
+			},
+			WatchFunc: func(options api.ListOptions) (watch.Interface, error) {
+				options.FieldSelector = selector
+				return kubeClient.Secrets(api.NamespaceAll).Watch(options)
+			},
+		}, &api.Secret{})
+	}
+
+	return ic
+}
+
+func (ic *informerCache) addInformer(lw cache.ListerWatcher, objType runtime.Object) cache.Store {
+	store, controller := cache.NewInformer(lw, objType, 0, cache.ResourceEventHandlerFuncs{})
+	ic.controllers = append(ic.controllers, controller)
+	return store
+}
+
+// run starts the informers and blocks until their initial lists have been
+// loaded, or returns an error if stopCh is closed first
+func (ic *informerCache) run(stopCh <-chan struct{}) error {
+	for _, controller := range ic.controllers {
+		go controller.Run(stopCh)
+	}
+
+	for !ic.hasSynced() {
+		select {
+		case <-stopCh:
+			return fmt.Errorf("stopped before the informer cache synced")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	log.Print("Informer cache synced")
+	return nil
+}
+
+func (ic *informerCache) hasSynced() bool {
+	for _, controller := range ic.controllers {
+		if !controller.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+func (ic *informerCache) listNamespaces() []api.Namespace {
+	namespaces := []api.Namespace{}
+	for _, obj := range ic.namespaces.List() {
+		namespaces = append(namespaces, *obj.(*api.Namespace))
+	}
+	return namespaces
+}
+
+// getSecret returns a copy of the cached secret, since the informer owns the
+// original and writes change the secret they're given
+func (ic *informerCache) getSecret(namespace, name string) (*api.Secret, error) {
+	store, ok := ic.secrets[name]
+	if !ok {
+		return nil, errors.NewNotFound(api.Resource("secrets"), name)
+	}
+
+	obj, exists, err := store.GetByKey(namespace + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.NewNotFound(api.Resource("secrets"), name)
+	}
+	return copySecret(obj.(*api.Secret)), nil
+}
+
+// getServiceAccount returns a copy of the cached object, since the informer
+// owns the original and process() appends to ImagePullSecrets
+func (ic *informerCache) getServiceAccount(namespace, name string) (*api.ServiceAccount, error) {
+	obj, exists, err := ic.serviceAccounts.GetByKey(namespace + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.NewNotFound(api.Resource("serviceaccounts"), name)
+	}
+
+	serviceAccount := *obj.(*api.ServiceAccount)
+	serviceAccount.ImagePullSecrets = append([]api.LocalObjectReference(nil), serviceAccount.ImagePullSecrets...)
+	return &serviceAccount, nil
+}
+
+// listServiceAccounts returns copies of the cached service accounts in a namespace that match selector
+func (ic *informerCache) listServiceAccounts(namespace string, selector labels.Selector) []*api.ServiceAccount {
+	serviceAccounts := []*api.ServiceAccount{}
+	for _, obj := range ic.serviceAccounts.List() {
+		serviceAccount := *obj.(*api.ServiceAccount)
+		if serviceAccount.Namespace != namespace || !selector.Matches(labels.Set(serviceAccount.Labels)) {
+			continue
+		}
+		serviceAccount.ImagePullSecrets = append([]api.LocalObjectReference(nil), serviceAccount.ImagePullSecrets...)
+		serviceAccounts = append(serviceAccounts, &serviceAccount)
+	}
+	return serviceAccounts
+}
+
+func (ic *informerCache) recordWrite(obj interface{}) {
+	switch o := obj.(type) {
+	case *api.ServiceAccount:
+		ic.serviceAccounts.Update(o)
+	case *api.Secret:
+		if store, ok := ic.secrets[o.Name]; ok {
+			store.Update(o)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/cache"
+	"k8s.io/kubernetes/pkg/labels"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+func newFakeInformerCache(objs ...interface{}) *informerCache {
+	ic := &informerCache{
+		namespaces:      cache.NewStore(cache.MetaNamespaceKeyFunc),
+		serviceAccounts: cache.NewStore(cache.MetaNamespaceKeyFunc),
+		secrets: map[string]cache.Store{
+			*argAWSSecretName: cache.NewStore(cache.MetaNamespaceKeyFunc),
+			*argGCRSecretName: cache.NewStore(cache.MetaNamespaceKeyFunc),
+		},
+	}
+
+	for _, obj := range objs {
+		switch o := obj.(type) {
+		case *api.Namespace:
+			ic.namespaces.Add(o)
+		case *api.ServiceAccount:
+			ic.serviceAccounts.Add(o)
+		case *api.Secret:
+			ic.secrets[o.Name].Add(o)
+		}
+	}
+	return ic
+}
+
+func TestProcessWithInformerCache(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	ecrClient := newFakeEcrClient()
+	gcrClient := newFakeGcrClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: gcrClient}
+
+	// Only namespace1 is known to the cache, so namespace2 must not be touched
+	c.cache = newFakeInformerCache(
+		&api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace1"}},
+		&api.ServiceAccount{ObjectMeta: api.ObjectMeta{Name: "default", Namespace: "namespace1"}},
+	)
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	_, err = c.kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+	_, err = c.kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+
+	_, err = c.kubeClient.Secrets("namespace2").Get(*argGCRSecretName)
+	assert.NotNil(t, err)
+	_, err = c.kubeClient.Secrets("namespace2").Get(*argAWSSecretName)
+	assert.NotNil(t, err)
+
+	serviceAccount, err := c.kubeClient.ServiceAccounts("namespace1").Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(serviceAccount.ImagePullSecrets))
+}
+
+func TestProcessWithInformerCacheSkipsUnchanged(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	ecrClient := newFakeEcrClient()
+	*argGCRURL = "fakeEndpoint"
+	gcrClient := newFakeGcrClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: gcrClient}
+
+	current := generateSecretObj("fakeToken", "fakeEndpoint", false, *argGCRSecretName)
+	current.Namespace = "namespace1"
+	annotateSecretName(current, *argGCRSecretName)
+	markManaged(current, providerGCR)
+	cachedServiceAccount := &api.ServiceAccount{
+		ObjectMeta:       api.ObjectMeta{Name: "default", Namespace: "namespace1"},
+		ImagePullSecrets: []api.LocalObjectReference{{Name: *argGCRSecretName}, {Name: *argAWSSecretName}},
+	}
+	c.cache = newFakeInformerCache(
+		&api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace1"}},
+		cachedServiceAccount,
+		current,
+	)
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	// The GCR secret was already current, so it is not written
+	_, err = c.kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.NotNil(t, err)
+
+	// The AWS secret was missing from the cache, so it is created
+	_, err = c.kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+
+	// Both references were already present, so the service account is not written
+	serviceAccount, err := c.kubeClient.ServiceAccounts("namespace1").Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(serviceAccount.ImagePullSecrets))
+}
+
+func TestInformerCacheServiceAccountIsCopied(t *testing.T) {
+	cached := &api.ServiceAccount{
+		ObjectMeta:       api.ObjectMeta{Name: "default", Namespace: "namespace1"},
+		ImagePullSecrets: []api.LocalObjectReference{{Name: "someOtherSecret"}},
+	}
+	ic := newFakeInformerCache(cached)
+
+	serviceAccount, err := ic.getServiceAccount("namespace1", "default")
+	assert.Nil(t, err)
+	serviceAccount.ImagePullSecrets[0].Name = "changed"
+
+	assert.Equal(t, "someOtherSecret", cached.ImagePullSecrets[0].Name)
+
+	_, err = ic.getServiceAccount("namespace2", "default")
+	assert.NotNil(t, err)
+}
+
+func TestInformerCacheSecretIsCopied(t *testing.T) {
+	cached := &api.Secret{
+		ObjectMeta: api.ObjectMeta{Name: *argAWSSecretName, Namespace: "namespace1", Labels: map[string]string{"app": "web"}},
+		Data:       map[string][]byte{api.DockerConfigKey: []byte("{}")},
+	}
+	ic := newFakeInformerCache(cached)
+
+	secret, err := ic.getSecret("namespace1", *argAWSSecretName)
+	assert.Nil(t, err)
+	secret.Labels["app"] = "changed"
+	secret.Data[api.DockerConfigKey] = []byte("changed")
+
+	assert.Equal(t, "web", cached.Labels["app"])
+	assert.Equal(t, "{}", string(cached.Data[api.DockerConfigKey]))
+}
+
+func TestInformerCacheRunStopsBeforeSync(t *testing.T) {
+	ic := &informerCache{}
+	// A list that always fails keeps the informer from ever syncing
+	ic.addInformer(&cache.ListWatch{
+		ListFunc: func(options api.ListOptions) (runtime.Object, error) {
+			return nil, fmt.Errorf("unavailable")
+		},
+		WatchFunc: func(options api.ListOptions) (watch.Interface, error) {
+			return nil, fmt.Errorf("unavailable")
+		},
+	}, &api.Namespace{})
+
+	stopCh := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- ic.run(stopCh) }()
+	close(stopCh)
+
+	select {
+	case err := <-done:
+		assert.NotNil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("run didn't return after stopCh was closed")
+	}
+}
+
+func TestInformerCacheListServiceAccounts(t *testing.T) {
+	ic := newFakeInformerCache(
+		&api.ServiceAccount{ObjectMeta: api.ObjectMeta{Name: "app", Namespace: "namespace1", Labels: map[string]string{"pull-secrets": "inject"}}},
+		&api.ServiceAccount{ObjectMeta: api.ObjectMeta{Name: "other", Namespace: "namespace1"}},
+		&api.ServiceAccount{ObjectMeta: api.ObjectMeta{Name: "app", Namespace: "namespace2", Labels: map[string]string{"pull-secrets": "inject"}}},
+	)
+
+	serviceAccounts := ic.listServiceAccounts("namespace1", labels.SelectorFromSet(labels.Set{"pull-secrets": "inject"}))
+	assert.Equal(t, 1, len(serviceAccounts))
+	assert.Equal(t, "app", serviceAccounts[0].Name)
+	assert.Equal(t, "namespace1", serviceAccounts[0].Namespace)
+}
+
+func TestGetSecretFallsBackOnCacheMiss(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, cache: newFakeInformerCache()}
+
+	// The secret was written, but the watch event hasn't reached the cache yet
+	secret := &api.Secret{ObjectMeta: api.ObjectMeta{Name: *argAWSSecretName, Namespace: "namespace1"}}
+	_, err := kubeClient.Secrets("namespace1").Create(secret)
+	assert.Nil(t, err)
+
+	found, err := c.getSecret("namespace1", *argAWSSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, *argAWSSecretName, found.Name)
+
+	// Neither has it
+	_, err = c.getSecret("namespace2", *argAWSSecretName)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,235 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+// timeoutKubeClient gives up on secret, service account and namespace calls
+// that take longer than timeout. The vendored client can't cancel a request,
+// so a hung call is left to finish in the background while the refresh
+// carries on with the next namespace.
+type timeoutKubeClient struct {
+	kubeInterface
+	timeout time.Duration
+}
+
+func newTimeoutKubeClient(client kubeInterface, timeout time.Duration) *timeoutKubeClient {
+	return &timeoutKubeClient{kubeInterface: client, timeout: timeout}
+}
+
+// kubeCallTimeoutError is returned for a call that didn't finish within --kube-call-timeout
+type kubeCallTimeoutError struct {
+	operation string
+	timeout   time.Duration
+}
+
+func (e *kubeCallTimeoutError) Error() string {
+	return fmt.Sprintf("%s took longer than %v", e.operation, e.timeout)
+}
+
+func isKubeCallTimeout(err error) bool {
+	_, ok := err.(*kubeCallTimeoutError)
+	return ok
+}
+
+// callWithTimeout runs call, returning a kubeCallTimeoutError if it doesn't
+// finish in time. The vendored client can't cancel a request, so a timed out
+// call isn't stopped: its goroutine keeps running until the API server
+// answers, and a Create or Update may still be applied after the timeout was
+// reported. The next refresh reads whatever it left behind.
+func callWithTimeout(timeout time.Duration, operation string, call func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- call()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return &kubeCallTimeoutError{operation: operation, timeout: timeout}
+	}
+}
+
+func (t *timeoutKubeClient) Secrets(namespace string) unversioned.SecretsInterface {
+	return &timeoutSecrets{SecretsInterface: t.kubeInterface.Secrets(namespace), namespace: namespace, timeout: t.timeout}
+}
+
+func (t *timeoutKubeClient) ServiceAccounts(namespace string) unversioned.ServiceAccountsInterface {
+	return &timeoutServiceAccounts{ServiceAccountsInterface: t.kubeInterface.ServiceAccounts(namespace), namespace: namespace, timeout: t.timeout}
+}
+
+func (t *timeoutKubeClient) Namespaces() unversioned.NamespaceInterface {
+	return &timeoutNamespaces{NamespaceInterface: t.kubeInterface.Namespaces(), timeout: t.timeout}
+}
+
+func (t *timeoutKubeClient) PatchServiceAccount(namespace, name string, pt api.PatchType, data []byte) ([]byte, error) {
+	var result []byte
+	err := callWithTimeout(t.timeout, fmt.Sprintf("patching service account %s/%s", namespace, name), func() (err error) {
+		result, err = t.kubeInterface.PatchServiceAccount(namespace, name, pt, data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+type timeoutSecrets struct {
+	unversioned.SecretsInterface
+	namespace string
+	timeout   time.Duration
+}
+
+func (t *timeoutSecrets) Create(secret *api.Secret) (*api.Secret, error) {
+	var result *api.Secret
+	err := callWithTimeout(t.timeout, fmt.Sprintf("creating secret %s/%s", t.namespace, secret.Name), func() (err error) {
+		result, err = t.SecretsInterface.Create(secret)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (t *timeoutSecrets) Update(secret *api.Secret) (*api.Secret, error) {
+	var result *api.Secret
+	err := callWithTimeout(t.timeout, fmt.Sprintf("updating secret %s/%s", t.namespace, secret.Name), func() (err error) {
+		result, err = t.SecretsInterface.Update(secret)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (t *timeoutSecrets) Delete(name string) error {
+	return callWithTimeout(t.timeout, fmt.Sprintf("deleting secret %s/%s", t.namespace, name), func() error {
+		return t.SecretsInterface.Delete(name)
+	})
+}
+
+func (t *timeoutSecrets) List(opts api.ListOptions) (*api.SecretList, error) {
+	var result *api.SecretList
+	err := callWithTimeout(t.timeout, fmt.Sprintf("listing secrets in %s", t.namespace), func() (err error) {
+		result, err = t.SecretsInterface.List(opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (t *timeoutSecrets) Get(name string) (*api.Secret, error) {
+	var result *api.Secret
+	err := callWithTimeout(t.timeout, fmt.Sprintf("getting secret %s/%s", t.namespace, name), func() (err error) {
+		result, err = t.SecretsInterface.Get(name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+type timeoutServiceAccounts struct {
+	unversioned.ServiceAccountsInterface
+	namespace string
+	timeout   time.Duration
+}
+
+func (t *timeoutServiceAccounts) Update(serviceAccount *api.ServiceAccount) (*api.ServiceAccount, error) {
+	var result *api.ServiceAccount
+	err := callWithTimeout(t.timeout, fmt.Sprintf("updating service account %s/%s", t.namespace, serviceAccount.Name), func() (err error) {
+		result, err = t.ServiceAccountsInterface.Update(serviceAccount)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (t *timeoutServiceAccounts) List(opts api.ListOptions) (*api.ServiceAccountList, error) {
+	var result *api.ServiceAccountList
+	err := callWithTimeout(t.timeout, fmt.Sprintf("listing service accounts in %s", t.namespace), func() (err error) {
+		result, err = t.ServiceAccountsInterface.List(opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (t *timeoutServiceAccounts) Get(name string) (*api.ServiceAccount, error) {
+	var result *api.ServiceAccount
+	err := callWithTimeout(t.timeout, fmt.Sprintf("getting service account %s/%s", t.namespace, name), func() (err error) {
+		result, err = t.ServiceAccountsInterface.Get(name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+type timeoutNamespaces struct {
+	unversioned.NamespaceInterface
+	timeout time.Duration
+}
+
+func (t *timeoutNamespaces) List(opts api.ListOptions) (*api.NamespaceList, error) {
+	var result *api.NamespaceList
+	err := callWithTimeout(t.timeout, "listing namespaces", func() (err error) {
+		result, err = t.NamespaceInterface.List(opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (t *timeoutNamespaces) Get(name string) (*api.Namespace, error) {
+	var result *api.Namespace
+	err := callWithTimeout(t.timeout, fmt.Sprintf("getting namespace %s", name), func() (err error) {
+		result, err = t.NamespaceInterface.Get(name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/util/clock"
+)
+
+// hangingKubeClient blocks every secret create in one namespace until released
+type hangingKubeClient struct {
+	*fakeKubeClient
+	namespace string
+	release   chan struct{}
+}
+
+func (h *hangingKubeClient) Secrets(namespace string) unversioned.SecretsInterface {
+	if namespace == h.namespace {
+		return &hangingSecrets{fakeSecrets: h.fakeKubeClient.secrets[namespace], release: h.release}
+	}
+	return h.fakeKubeClient.Secrets(namespace)
+}
+
+type hangingSecrets struct {
+	*fakeSecrets
+	release chan struct{}
+}
+
+func (h *hangingSecrets) Create(secret *api.Secret) (*api.Secret, error) {
+	<-h.release
+	return secret, nil
+}
+
+func TestProcessKubeCallTimeout(t *testing.T) {
+	hanging := &hangingKubeClient{fakeKubeClient: newFakeKubeClient(), namespace: "namespace1", release: make(chan struct{})}
+	defer close(hanging.release)
+
+	c := &controller{kubeClient: newTimeoutKubeClient(hanging, 10*time.Millisecond), ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	err := c.process()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "creating secret namespace1/")
+	assert.Contains(t, err.Error(), "took longer than 10ms")
+
+	// The hung namespace doesn't stop the others from being refreshed
+	_, err = hanging.Secrets("namespace2").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	_, err = hanging.Secrets("namespace2").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+}
+
+func TestRunSurvivesKubeCallTimeout(t *testing.T) {
+	hanging := &hangingKubeClient{fakeKubeClient: newFakeKubeClient(), namespace: "namespace1", release: make(chan struct{})}
+	defer close(hanging.release)
+
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	ecrClient := &flakyEcrClient{}
+	c := &controller{kubeClient: newTimeoutKubeClient(hanging, 10*time.Millisecond), ecrClient: ecrClient, gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	stopCh := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- c.run(stopCh) }()
+
+	// The timed out namespace fails the refresh, but not the controller
+	waitForTimer(t, fakeClock)
+	fakeClock.Step(globalRefreshInterval())
+	waitForTimer(t, fakeClock)
+	assert.Equal(t, 2, ecrClient.calls)
+
+	close(stopCh)
+	assert.Nil(t, <-done)
+}
+
+func TestCallWithTimeout(t *testing.T) {
+	err := callWithTimeout(time.Second, "fast call", func() error { return nil })
+	assert.Nil(t, err)
+
+	err = callWithTimeout(time.Millisecond, "slow call", func() error {
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	})
+	assert.True(t, isKubeCallTimeout(err))
+}
@@ -27,54 +27,292 @@ package main
 import (
 	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/robfig/cron"
 	flag "github.com/spf13/pflag"
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/errors"
+	_ "k8s.io/kubernetes/pkg/apis/authorization/install"
+	authorizationclient "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset/typed/authorization/unversioned"
+	"k8s.io/kubernetes/pkg/client/record"
 	"k8s.io/kubernetes/pkg/client/restclient"
 	"k8s.io/kubernetes/pkg/client/unversioned"
 	kubectl_util "k8s.io/kubernetes/pkg/kubectl/cmd/util"
+	"k8s.io/kubernetes/pkg/labels"
+	"k8s.io/kubernetes/pkg/util/clock"
+	utilerrors "k8s.io/kubernetes/pkg/util/errors"
+	"k8s.io/kubernetes/pkg/util/validation"
+	"k8s.io/kubernetes/pkg/util/wait"
 )
 
 const (
-	dockerCfgTemplate  = `{"%s":{"username":"oauth2accesstoken","password":"%s","email":"none"}}`
+	providerAWS       = "aws"
+	providerGCR       = "gcr"
+	providerACR       = "acr"
+	providerDockerHub = "dockerhub"
+	providerGHCR      = "ghcr"
+)
+
+// knownProviders lists every provider the controller supports
+var knownProviders = []string{providerAWS, providerGCR, providerACR, providerDockerHub, providerGHCR}
+
+func knownProvider(name string) bool {
+	for _, provider := range knownProviders {
+		if name == provider {
+			return true
+		}
+	}
+	return false
+}
+
+// secretWriteBackoff is the wait before the first secret write retry, doubling after each
+const secretWriteBackoff = 100 * time.Millisecond
+
+const (
+	dockerCfgTemplate  = `{"%s":{"username":"%s","password":"%s","email":"none"}}`
 	dockerJSONTemplate = `{"auths":{"%s":{"auth":"%s","email":"none"}}}`
 )
 
 var (
-	flags               = flag.NewFlagSet("", flag.ContinueOnError)
-	cluster             = flags.Bool("use-kubernetes-cluster-service", true, `If true, use the built in kubernetes cluster for creating the client`)
-	argKubecfgFile      = flags.String("kubecfg-file", "", `Location of kubecfg file for access to kubernetes master service; --kube_master_url overrides the URL part of this; if neither this nor --kube_master_url are provided, defaults to service account tokens`)
-	argKubeMasterURL    = flags.String("kube-master-url", "", `URL to reach kubernetes master. Env variables in this flag will be expanded.`)
-	argAWSSecretName    = flags.String("aws-secret-name", "awsecr-cred", `Default aws secret name`)
-	argGCRSecretName    = flags.String("gcr-secret-name", "gcr-secret", `Default gcr secret name`)
-	argDefaultNamespace = flags.String("default-namespace", "default", `Default namespace`)
-	argGCRURL           = flags.String("gcr-url", "https://gcr.io", `Default GCR URL`)
-	argAWSRegion        = flags.String("aws-region", "us-east-1", `Default AWS region`)
-	argRefreshMinutes   = flags.Int("refresh-mins", 60, `Default time to wait before refreshing (60 minutes)`)
+	flags                            = flag.NewFlagSet("", flag.ContinueOnError)
+	cluster                          = flags.Bool("use-kubernetes-cluster-service", true, `If true, use the built in kubernetes cluster for creating the client`)
+	argKubecfgFile                   = flags.String("kubecfg-file", "", `Location of kubecfg file for access to kubernetes master service; --kube_master_url overrides the URL part of this; if neither this nor --kube_master_url are provided, defaults to service account tokens`)
+	argKubeMasterURL                 = flags.String("kube-master-url", "", `URL to reach kubernetes master. Env variables in this flag will be expanded.`)
+	argAWSSecretName                 = flags.String("aws-secret-name", "awsecr-cred", `Default aws secret name`)
+	argGCRSecretName                 = flags.String("gcr-secret-name", "gcr-secret", `Default gcr secret name`)
+	argACRSecretName                 = flags.String("acr-secret-name", "acr-cred", `Default acr secret name`)
+	argDockerHubSecretName           = flags.String("dockerhub-secret-name", "dockerhub-cred", `Default dockerhub secret name`)
+	argDockerHubUser                 = flags.String("dockerhub-user", "", `Docker Hub user to write a pull secret for. Requires dockerhub-password`)
+	argDockerHubPassword             = flags.String("dockerhub-password", "", `Password or access token of dockerhub-user`)
+	argGHCRSecretName                = flags.String("ghcr-secret-name", "ghcr-cred", `Default ghcr secret name`)
+	argGHCRUser                      = flags.String("ghcr-user", "", `GitHub user to write a ghcr.io pull secret for. Requires ghcr-token or ghcr-token-file`)
+	argGHCRToken                     = flags.String("ghcr-token", "", `GitHub personal access token of ghcr-user, with the read:packages scope`)
+	argGHCRTokenFile                 = flags.String("ghcr-token-file", "", `File holding the GitHub personal access token of ghcr-user, read again on every refresh`)
+	argACRRegistry                   = flags.String("acr-registry", "", `ACR login server to get credentials for, e.g. myregistry.azurecr.io. Enables ACR together with the ACR_CLIENT_ID, ACR_CLIENT_SECRET and ACR_TENANT_ID environment variables`)
+	argDefaultNamespace              = flags.String("default-namespace", "default", `Default namespace`)
+	argGCRUsername                   = flags.String("gcr-username", gcrUsername, `Username paired with the GCR access token: oauth2accesstoken, _token or _dcgcloud_token`)
+	argTokenRequestHeaders           = flags.StringSlice("token-request-headers", nil, `Extra HTTP headers as key=value pairs to send with GCR token requests, e.g. for an egress proxy`)
+	argGCRURL                        = flags.String("gcr-url", "https://gcr.io", `Default GCR URL`)
+	argAWSRegion                     = flags.String("aws-region", "us-east-1", `Default AWS region`)
+	argAWSAssumeRole                 = flags.String("aws-assume-role", "", `If set, the ARN of an IAM role to assume with the AWS credentials before calling ECR, e.g. for a registry in another account`)
+	argAWSAssumeRoleExternalID       = flags.String("aws-assume-role-external-id", "", `External ID to pass when assuming aws-assume-role`)
+	argAWSEndpoint                   = flags.String("aws-endpoint", "", `If set, the ECR service endpoint to call instead of the SDK's default for aws-region`)
+	argAWSDiscoverRegistries         = flags.Bool("aws-discover-registries", false, `If true, also fetch tokens for the registries of every ECR repository the credentials can list, besides those in awsaccount`)
+	argAWSSecretRegistries           = flags.String("aws-secret-registries", awsSecretRegistriesFirst, `Which registries ECR returned tokens for go in the AWS secret: first (the others only go in the combined secret) or all`)
+	argECREndpoints                  = flags.StringSlice("ecr-endpoints", nil, `ECR service endpoints per region as region=endpoint pairs, e.g. for GovCloud or China regions. Regions not listed use aws-endpoint`)
+	argAWSRegionsFromNodes           = flags.Bool("aws-regions-from-nodes", false, `If true, also fetch ECR tokens for every other region in the nodes' region labels, re-read on every refresh, for the combined secret`)
+	argWatchCredentialFiles          = flags.StringSlice("watch-credential-files", nil, `Credential files, e.g. a mounted AWS credentials file, to check for changes every 10 seconds. A change reloads the AWS credentials and refreshes every namespace`)
+	argWatchNamespaces               = flags.Bool("watch-namespaces", false, `If true, watch for new namespaces and refresh each one straight away instead of on the next refresh`)
+	argReactToPullFailures           = flags.Bool("react-to-pull-failures", false, `If true, watch pod events for images the registry refused to pull with the credentials, and refresh that namespace straight away`)
+	argPullFailureCooldown           = flags.Duration("pull-failure-cooldown", 5*time.Minute, `With react-to-pull-failures, the least time between two refreshes of a namespace caused by pull failures`)
+	argAWSCredentialSource           = flags.String("aws-credential-source", awsCredentialSourceChain, `Where to get AWS credentials: irsa, env, profile, imds, or the SDK's default chain`)
+	argRefreshMinutes                = flags.Int("refresh-mins", 60, `Default time to wait before refreshing (60 minutes)`)
+	argRefreshInterval               = flags.Duration("refresh-interval", 0, `Default time to wait before refreshing as a duration, e.g. 30m, instead of refresh-mins (default 1h)`)
+	argStatusLine                    = flags.Bool("status-line", false, `If true, write a single logfmt line to stderr after each refresh with its status, providers, duration and next run`)
+	argSummaryLogInterval            = flags.Duration("summary-log-interval", 0, `If set, log a summary of the refreshes at most this often instead of logging the progress of every refresh. Errors are still logged right away`)
+	argRefreshThreshold              = flags.Float64("refresh-threshold", 0, `If set, skip fetching a provider's token while its secrets' token has more than this fraction of its lifetime left, e.g. 0.25 (0 always fetches)`)
+	argNamespacesPerCycle            = flags.Int("namespaces-per-cycle", 0, `If set, refresh only this many namespaces per refresh, moving on to the next ones each refresh (0 refreshes every namespace)`)
+	argSchedule                      = flags.String("schedule", "", `Cron expression to refresh on instead of every refresh-mins, e.g. "0 9-17 * * 1-5"`)
+	argCombineSecrets                = flags.String("combine-secrets", combineSecretsOff, `Write provider credentials as separate secrets (off), a single combined secret (combined), or both (dual)`)
+	argCombinedSecretName            = flags.String("combined-secret-name", "registry-creds", `Name of the combined secret written when combine-secrets is combined or dual`)
+	argMaxSecretSize                 = flags.Int("max-secret-size", 0, `If set, warn about any secret whose data is larger than this many bytes, e.g. a combined secret bloated by a runaway registry hosts list (0 is unlimited)`)
+	argFailOnMaxSecretSize           = flags.Bool("fail-on-max-secret-size", false, `If true, fail writing a secret over max-secret-size instead of only warning`)
+	argDockerConfigTemplate          = flags.String("dockerconfig-template", "", `If set, a Go template file rendered with .Endpoint, .Username, .Token and .Auth to produce the .dockerconfigjson of each provider secret`)
+	argCompatMode                    = flags.String("compat-mode", compatModeNone, `Adjust generated secrets for a specific consumer: none or fleet`)
+	argHealthPort                    = flags.Int("health-port", 8080, `Port to serve the /healthz and /readyz health endpoints and /metrics on`)
+	argMetricsPort                   = flags.Int("metrics-port", 0, `If set, serve /metrics on this port instead of health-port`)
+	argReadinessRequiresAllProviders = flags.Bool("readiness-requires-all-providers", false, `If true, /readyz requires every provider to be healthy, otherwise any healthy provider is enough`)
+	argEnableGCR                     = flags.Bool("enable-gcr", true, `If false, don't refresh GCR credentials`)
+	argInstanceID                    = flags.String("instance-id", "", `If set, label managed secrets with this ID and only update or clean up secrets carrying it, so several controllers can share a cluster`)
+	argAdoptLabels                   = flags.StringSlice("adopt-labels", nil, `Labels, e.g. managed-by=old-registry-creds, of secrets written by an older version or fork of the controller. Matching secrets are relabelled as managed by this controller, and refreshed and cleaned up like its own`)
+	argStripDisabledProviders        = flags.Bool("strip-existing-managed-secrets-on-disable", false, `If true, delete managed secrets and service account references of providers that are no longer enabled`)
+	argCleanupRenamedSecrets         = flags.Bool("cleanup-renamed-secrets", false, `If true, delete managed secrets written under a previous aws-secret-name or gcr-secret-name, and their service account references, once the secret under the new name is written`)
+	argCleanupDeselected             = flags.Bool("cleanup-deselected-namespaces", false, `If true, delete managed secrets and service account references in namespaces that no longer match the namespace selection, e.g. after their label is removed or they are excluded`)
+	argLivenessMaxStaleness          = flags.Duration("liveness-max-staleness", 0, `How old the last refresh that succeeded in full may get before /healthz fails (defaults to three refresh intervals)`)
+	argReadinessMaxStaleness         = flags.Duration("readiness-max-staleness", 0, `How old a provider's last successful refresh may get before /readyz reports it unhealthy (defaults to three refresh intervals)`)
+	argKubeCallTimeout               = flags.Duration("kube-call-timeout", 0, `If set, how long a single secret, service account or namespace API call may take before it fails that namespace's refresh (0 waits indefinitely)`)
+	argUseInformers                  = flags.Bool("use-informers", false, `If true, serve namespace, service account and secret reads from an informer cache instead of listing them every refresh`)
+	argConcurrency                   = flags.Int("concurrency", 5, `How many namespaces to write secrets to at once`)
+	argMaxRetries                    = flags.Int("max-retries", 3, `How many times to retry a failed provider token request in the same refresh, with exponential backoff starting at a second`)
+	argMaxInflightTokenRequests      = flags.Int("max-inflight-token-requests", 0, `If set, how many provider token requests may be in flight at once across every provider (0 is unlimited)`)
+	argBreakerFailures               = flags.Int("circuit-breaker-failures", 5, `Consecutive token fetch failures after which a provider is skipped for the cooldown (0 disables the circuit breaker)`)
+	argBreakerCooldown               = flags.Duration("circuit-breaker-cooldown", 30*time.Minute, `How long a provider is skipped once its circuit breaker opens`)
+	argEventNamespace                = flags.String("event-namespace", "", `If set, record every event in this namespace instead of the namespace of the object it is about`)
+	argRegistryHostsFile             = flags.String("registry-hosts-file", "", `If set, a file listing one registry host per line that each get an entry in the combined secret with the registry-hosts-provider credential. Reloaded on every refresh`)
+	argRegistryHostsProvider         = flags.String("registry-hosts-provider", providerAWS, `Provider whose credential is used for the hosts in registry-hosts-file and the extra hosts namespace annotation (aws, gcr or acr)`)
+	argNamespacePriorityLabel        = flags.String("namespace-priority-label", "", `If set, refresh namespaces in the order of this label's value in namespace-priority-order, e.g. priority`)
+	argNamespacePriorityOrder        = flags.StringSlice("namespace-priority-order", []string{"high", "medium", "low"}, `Values of namespace-priority-label from highest to lowest priority. Namespaces with other values or without the label come last`)
+	argNamespaces                    = flags.StringSlice("namespaces", nil, `If set, manage only these namespaces, getting each of them instead of listing all namespaces`)
+	argNamespaceSelector             = flags.String("namespace-selector", "", `If set, manage only the namespaces matching this label selector, e.g. registry-creds=enabled`)
+	argNamespacesFromConfigMap       = flags.String("namespaces-from-configmap", "", `If set as namespace/name, manage only the namespaces listed under the "namespaces" key of this ConfigMap, read again on every refresh`)
+	argExcludedNamespaces            = flags.StringSlice("excluded-namespaces", []string{"kube-system"}, `Namespaces that never get secrets or have their service accounts changed. Pass an empty value to manage kube-system too`)
+	argRequireAnnotation             = flags.Bool("require-annotation", false, `If true, only manage namespaces annotated with registry-creds.io/enabled=true`)
+	argOwnerAnnotation               = flags.String("owner-annotation", "", `If set as key=value, only manage namespaces with this annotation, e.g. those provisioned by a tenancy operator`)
+	argBlockedNamespaceRetry         = flags.Duration("blocked-namespace-retry", 0, `If set, a namespace where writing a secret is forbidden (e.g. by a ResourceQuota) is skipped for this long before being tried again, instead of failing the refresh`)
+	argSecretWriteRetries            = flags.Int("secret-write-retries", 3, `How many times to retry writing a secret that another writer changed at the same time`)
+	argSecretFormat                  = flags.String("secret-format", secretFormatDefault, `Docker config format of each secret: default (the provider's usual format) or both (.dockerconfigjson and .dockercfg)`)
+	argSplitSecretFormats            = flags.Bool("split-secret-formats", false, `If true, secret-format=both writes <name> with .dockerconfigjson and <name>-legacy with .dockercfg instead of one secret with both keys`)
+	argKeepPreviousSecrets           = flags.Int("keep-previous-secrets", 0, `If set, keep this many previous versions of each rotated secret as <name>-<timestamp> secrets, deleting older ones (0 keeps none)`)
+	argMergeExistingAuths            = flags.Bool("merge-existing-auths", false, `If true, keep auths entries of an existing secret's .dockerconfigjson for hosts the controller doesn't write, e.g. a registry added by hand`)
+	argSecretDataKey                 = flags.String("secret-data-key", "", `If set, also write the docker config (in config.json format) under this secret data key`)
+	argSecretDataKeyOnly             = flags.Bool("secret-data-key-only", false, `If true, write the docker config only under secret-data-key, making the secret Opaque unless the key is .dockerconfigjson`)
+	argNewNamespaceSAWait            = flags.Duration("new-namespace-sa-wait", 0, `If set, how long to wait for the default service account of a namespace created less than this long ago before failing`)
+	argServiceAccountSelector        = flags.String("service-account-selector", "", `If set, reference the secrets from every service account matching this label selector instead of only the default service account`)
+	argAllServiceAccounts            = flags.Bool("all-service-accounts", false, `If true, reference the secrets from every service account in each namespace instead of only the default service account`)
+	argFulfillPullSecrets            = flags.StringSlice("fulfill-pull-secrets", nil, `Pattern=provider pairs, e.g. registry-creds-ecr*=aws. An image pull secret a service account references by a name matching a pattern, with no secret behind it, is created with that provider's credentials and refreshed from then on`)
+	argSecretDistribution            = flags.StringSlice("secret-distribution", nil, `Provider=mode pairs, e.g. aws=replicated. A direct provider's secret is written to every namespace; a replicated one's only to replication-source-namespace, with copies of it in every other namespace (default direct)`)
+	argReplicationSourceNamespace    = flags.String("replication-source-namespace", "", `Namespace holding the source secret of each replicated provider in secret-distribution`)
+	argServiceAccounts               = flags.StringSlice("service-accounts", []string{"default"}, `Names of the service accounts in each namespace that reference the secrets, unless service-account-selector or all-service-accounts is set. A listed service account missing from a namespace is skipped`)
+	argExcludeServiceAccounts        = flags.StringSlice("exclude-service-accounts", nil, `Names of service accounts that never reference the secrets, even if they match service-account-selector`)
+	argVerifyServiceAccountUpdates   = flags.Bool("verify-service-account-updates", false, `If true, read each changed service account back and add the image pull secret reference again if a concurrent write lost it`)
+	argUsePatch                      = flags.Bool("use-patch", true, `Service accounts' imagePullSecrets are always changed with a merge patch, setting this to false is refused at startup`)
+	argReferenceOnly                 = flags.Bool("reference-only", false, `If true, never create or update the secrets, only reference them from service accounts, for secrets another process (e.g. Vault) provisions`)
+	argMaxPullSecretsPerSA           = flags.Int("max-pull-secrets-per-sa", 0, `If set, a service account that would get more ImagePullSecrets than this references the combined secret instead of one secret per provider (0 is unlimited)`)
+	argListProviders                 = flags.Bool("list-providers", false, `If true, print each supported provider, whether it's enabled and which settings it's missing, then exit`)
+	argOnce                          = flags.Bool("once", false, `If true, refresh once and exit instead of running continuously`)
+	argPrune                         = flags.Bool("prune", false, `If true, remove orphaned managed secrets (of disabled providers or previous secret names) and their service account references in every namespace, print what was removed as JSON, then exit`)
+	argAdminTokenFile                = flags.String("admin-token-file", "", `If set, serve POST /prune on health-port, protected by the bearer token in this file`)
+	argFailOnZeroNamespaces          = flags.Bool("fail-on-zero-namespaces", false, `If true with once, exit non-zero when no namespace is left to refresh, e.g. because the namespace filters exclude every namespace`)
+	argDryRun                        = flags.Bool("dry-run", false, `If true, log the secrets each refresh would create or update and the service accounts it would change instead of writing them`)
+	argDriftReport                   = flags.String("drift-report", "", `If set with once, write a JSON report of missing or out of date secrets and service account references to this path instead of fixing them`)
+	argOnlyProviders                 = flags.StringSlice("only-providers", nil, `Providers to refresh in a --once run, leaving the other providers' secrets untouched`)
+	argSkipPermissionCheck           = flags.Bool("skip-permission-check", false, `If true, don't check the controller's RBAC permissions at startup`)
+	argStartupDelay                  = flags.Duration("startup-delay", 0, `If set, wait this long after starting before the first refresh`)
+	argStartupDelayJitter            = flags.Duration("startup-delay-jitter", 0, `If set, add a random wait of up to this long to startup-delay, so controllers restarted together don't refresh at the same moment`)
+	argSkipInitialReconcile          = flags.Bool("skip-initial-reconcile", false, `If true, wait a full refresh interval before the first refresh instead of refreshing on startup`)
+	argPopulateNewProviders          = flags.Bool("populate-new-providers", false, `If true, on startup refresh every namespace for providers that have no managed secret anywhere yet, e.g. just enabled, even when skip-initial-reconcile or namespaces-per-cycle would delay them`)
+	argStartupProbeGrace             = flags.Duration("startup-probe-grace", 0, `If set, /readyz stays unready until a refresh succeeds for every provider, retrying failed startup refreshes for up to this long before exiting non-zero`)
+	argRequireHealthyStartup         = flags.Bool("require-healthy-providers-at-startup", false, `If true, exit non-zero when any provider fails in the refresh on startup, so the pod restarts instead of running with a broken provider`)
 )
 
 var (
 	awsAccountID string
+
+	// The ACR service principal, from the ACR_* environment variables
+	acrClientID     string
+	acrClientSecret string
+	acrTenantID     string
 )
 
 type controller struct {
+	// processLock serializes process(), so refreshes started by different
+	// triggers never read and write the same objects at the same time
+	processLock sync.Mutex
+
+	// stateLock guards the state namespaces written at the same time share:
+	// summary, blocked, pullSecretOverflow, drift and cycle.skipped
+	stateLock sync.Mutex
+
 	kubeClient kubeInterface
 	ecrClient  ecrInterface
 	gcrClient  gcrInterface
+	cache      *informerCache
+	health     providerHealth
+	breakers   circuitBreakers
+	recorder   record.EventRecorder
+
+	// tokenRequests limits concurrent token requests to --max-inflight-token-requests
+	tokenRequests tokenSemaphore
+
+	// azureClient gets ACR refresh tokens, nil unless ACR is configured
+	azureClient AzureInterface
+
+	// ecrRepositories discovers extra ECR registries when --aws-discover-registries is set
+	ecrRepositories ecrRepositoryInterface
+
+	// newRegionalEcrClient creates the ECR client of a region found on the
+	// nodes with --aws-regions-from-nodes, regionalEcrClients keeps them
+	newRegionalEcrClient func(region string) (ecrInterface, error)
+	regionalEcrClients   map[string]ecrInterface
+
+	// ecrTokens caches ECR tokens across process() calls until they're stale
+	ecrTokens ecrTokenCache
+
+	// schedule limits each process() to the namespaces that are due, every
+	// namespace is refreshed when unset
+	schedule *refreshSchedule
+
+	// cursor limits each process() to a slice of the namespaces when
+	// --namespaces-per-cycle is set
+	cursor *namespaceCursor
+
+	// cronSchedule replaces interval scheduling when --schedule is set
+	cronSchedule cron.Schedule
+
+	// adminToken is the bearer token of the admin endpoints, which are only
+	// served when it's set
+	adminToken string
+
+	// trigger requests an immediate refresh of every namespace, e.g. on SIGHUP
+	trigger chan struct{}
+
+	// pullFailures requests an immediate refresh of one namespace, after a
+	// pod there failed to pull an image with its credentials
+	pullFailures chan string
+
+	// namespacesAdded requests an immediate refresh of a namespace created
+	// since the controller started
+	namespacesAdded chan string
+
+	// disabledProviders are skipped by process(), every provider runs when empty
+	disabledProviders map[string]bool
+
+	// onlyProviders restricts a one-off run to these providers when set
+	onlyProviders map[string]bool
+
+	// pullSecretOverflow collects, per process(), the service accounts that
+	// would go over --max-pull-secrets-per-sa
+	pullSecretOverflow pullSecretOverflow
+
+	// blocked holds the namespaces skipped because secret writes are forbidden
+	blocked blockedNamespaces
+
+	// endpoints records, per process(), the registry endpoint of each
+	// provider that returned a token
+	endpoints map[string]string
+
+	// dockerConfigTemplate renders per-provider secrets when --dockerconfig-template is set
+	dockerConfigTemplate *template.Template
+
+	// drift collects what a --drift-report run would write, nothing is
+	// written when set
+	drift *driftReport
+
+	// cycle records the providers of the last process() for --status-line
+	cycle cycleStatus
+
+	// summary counts the refreshes since lastSummary, logged every --summary-log-interval
+	summary     reconcileSummary
+	lastSummary time.Time
+
+	// clock is swapped for a fake in tests, the real clock is used when unset
+	clock clock.Clock
 }
 
 type kubeInterface interface {
 	Secrets(namespace string) unversioned.SecretsInterface
 	Namespaces() unversioned.NamespaceInterface
 	ServiceAccounts(namespace string) unversioned.ServiceAccountsInterface
+	Events(namespace string) unversioned.EventInterface
+	Nodes() unversioned.NodeInterface
+	ConfigMaps(namespace string) unversioned.ConfigMapsInterface
+	PatchServiceAccount(namespace, name string, pt api.PatchType, data []byte) ([]byte, error)
 }
 
 type ecrInterface interface {
@@ -86,7 +324,36 @@ type gcrInterface interface {
 }
 
 func newEcrClient() ecrInterface {
-	return ecr.New(session.New(), aws.NewConfig().WithRegion(*argAWSRegion))
+	client, err := buildEcrClient()
+	if err != nil {
+		log.Fatalf("Failed to load AWS credentials: %v", err)
+	}
+	return client
+}
+
+// buildEcrClient creates an ECR client with the current AWS credentials
+func buildEcrClient() (*ecr.ECR, error) {
+	return buildRegionalEcrClient(*argAWSRegion)
+}
+
+// buildRegionalEcrClient creates an ECR client for a region with the current AWS credentials
+func buildRegionalEcrClient(region string) (*ecr.ECR, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	config, err := awsClientConfig(sess)
+	if err != nil {
+		return nil, err
+	}
+	config = config.WithRegion(region)
+
+	// validateParams already checked the endpoints
+	endpoints, _ := parseECREndpoints(*argECREndpoints)
+	if endpoint := ecrEndpoint(region, endpoints); endpoint != "" {
+		config = config.WithEndpoint(endpoint)
+	}
+	return ecr.New(sess, config), nil
 }
 
 type gcrClient struct{}
@@ -99,7 +366,26 @@ func newGcrClient() gcrInterface {
 	return gcrClient{}
 }
 
-func newKubeClient() kubeInterface {
+// kubeAPIClient adds the calls the typed unversioned client doesn't provide
+type kubeAPIClient struct {
+	*unversioned.Client
+	authorization *authorizationclient.AuthorizationClient
+}
+
+func (k *kubeAPIClient) SelfSubjectAccessReviews() authorizationclient.SelfSubjectAccessReviewInterface {
+	return k.authorization.SelfSubjectAccessReviews()
+}
+
+func (k *kubeAPIClient) PatchServiceAccount(namespace, name string, pt api.PatchType, data []byte) ([]byte, error) {
+	return k.Patch(pt).
+		Namespace(namespace).
+		Resource("serviceaccounts").
+		Name(name).
+		Body(data).
+		DoRaw()
+}
+
+func newKubeClient() *kubeAPIClient {
 	var kubeClient *unversioned.Client
 	var config *restclient.Config
 	var err error
@@ -107,7 +393,7 @@ func newKubeClient() kubeInterface {
 	clientConfig := kubectl_util.DefaultClientConfig(flags)
 
 	if *cluster {
-		if kubeClient, err = unversioned.NewInCluster(); err != nil {
+		if config, err = restclient.InClusterConfig(); err != nil {
 			log.Fatalf("Failed to create client: %v", err)
 		}
 	} else {
@@ -115,18 +401,23 @@ func newKubeClient() kubeInterface {
 		if err != nil {
 			log.Fatalf("error connecting to the client: %v", err)
 		}
-		kubeClient, err = unversioned.New(config)
+	}
 
-		if err != nil {
-			log.Fatalf("Failed to create client: %v", err)
-		}
+	kubeClient, err = unversioned.New(config)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+
+	authorization, err := authorizationclient.NewForConfig(config)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
 	}
 
-	return kubeClient
+	return &kubeAPIClient{Client: kubeClient, authorization: authorization}
 }
 
 func (c *controller) getGCRAuthorizationKey() (AuthToken, error) {
-	ts, err := c.gcrClient.DefaultTokenSource(context.TODO(), "https://www.googleapis.com/auth/cloud-platform")
+	ts, err := c.gcrClient.DefaultTokenSource(tokenRequestContext(), "https://www.googleapis.com/auth/cloud-platform")
 	if err != nil {
 		return AuthToken{}, err
 	}
@@ -136,40 +427,59 @@ func (c *controller) getGCRAuthorizationKey() (AuthToken, error) {
 		return AuthToken{}, err
 	}
 
+	// A misconfigured Workload Identity can hand out an empty token, which
+	// would be written as a secret that silently fails every pull
+	if token == nil || token.AccessToken == "" {
+		return AuthToken{}, fmt.Errorf("GCR token source returned an empty access token, check the GCP credentials or Workload Identity binding")
+	}
+
 	if !token.Valid() {
-		return AuthToken{}, fmt.Errorf("token was invalid")
+		return AuthToken{}, fmt.Errorf("GCR token source returned a token that expired at %v", token.Expiry)
 	}
 
 	if token.Type() != "Bearer" {
-		return AuthToken{}, fmt.Errorf(fmt.Sprintf("expected token type \"Bearer\" but got \"%s\"", token.Type()))
+		return AuthToken{}, fmt.Errorf("expected token type \"Bearer\" but got \"%s\"", token.Type())
 	}
 
 	return AuthToken{
-		AccessToken: token.AccessToken,
-		Endpoint:    *argGCRURL}, nil
+		AccessToken: redactedString(token.AccessToken),
+		Endpoint:    registryHost(*argGCRURL),
+		ExpiresAt:   token.Expiry}, nil
 }
 
 func (c *controller) getECRAuthorizationKey() (AuthToken, error) {
 	params := &ecr.GetAuthorizationTokenInput{
-		RegistryIds: []*string{
-			aws.String(awsAccountID),
-		},
+		RegistryIds: aws.StringSlice(c.ecrRegistryIDs()),
 	}
 
-	resp, err := c.ecrClient.GetAuthorizationToken(params)
+	resp, err := c.getECRToken(c.ecrClient, *argAWSRegion, params)
 
 	if err != nil {
-		// Print the error, cast err to awserr.Error to get the Code and
-		// Message from an error.
-		fmt.Println(err.Error())
+		log.Printf("Failed to get an ECR authorization token: %v", err)
 		return AuthToken{}, err
 	}
 
-	token := resp.AuthorizationData[0]
+	authToken := ecrAuthToken(resp.AuthorizationData[0])
+	for _, token := range resp.AuthorizationData[1:] {
+		authToken.Registries = append(authToken.Registries, ecrAuthToken(token))
+	}
+
+	regional, err := c.regionalECRTokens(params)
+	if err != nil {
+		return AuthToken{}, err
+	}
+	authToken.Registries = append(authToken.Registries, regional...)
+	return authToken, nil
+}
 
-	return AuthToken{
-		AccessToken: *token.AuthorizationToken,
-		Endpoint:    *token.ProxyEndpoint}, err
+func ecrAuthToken(token *ecr.AuthorizationData) AuthToken {
+	authToken := AuthToken{
+		AccessToken: redactedString(*token.AuthorizationToken),
+		Endpoint:    registryHost(*token.ProxyEndpoint)}
+	if token.ExpiresAt != nil {
+		authToken.ExpiresAt = *token.ExpiresAt
+	}
+	return authToken
 }
 
 func generateSecretObj(token string, endpoint string, isJSONCfg bool, secretName string) *api.Secret {
@@ -184,146 +494,1388 @@ func generateSecretObj(token string, endpoint string, isJSONCfg bool, secretName
 		secret.Type = "kubernetes.io/dockerconfigjson"
 	} else {
 		secret.Data = map[string][]byte{
-			".dockercfg": []byte(fmt.Sprintf(dockerCfgTemplate, endpoint, token))}
+			".dockercfg": []byte(fmt.Sprintf(dockerCfgTemplate, endpoint, *argGCRUsername, token))}
 		secret.Type = "kubernetes.io/dockercfg"
 	}
 	return secret
 }
 
 type AuthToken struct {
-	AccessToken string
+	AccessToken redactedString
 	Endpoint    string
+
+	// ExpiresAt is when the provider says the token expires, zero if unknown
+	ExpiresAt time.Time
+
+	// Registries holds the tokens of the other accounts in awsaccount, and
+	// of discovered registries, which only go in the combined secret
+	Registries []AuthToken
 }
 
 type SecretGenerator struct {
 	TokenGenFxn func() (AuthToken, error)
 	IsJSONCfg   bool
 	SecretName  string
+	Provider    string
 }
 
 func (c *controller) process() error {
+	c.processLock.Lock()
+	defer c.processLock.Unlock()
+	c.cycle = cycleStatus{started: c.now()}
+	expireAssumedRoleCredentials()
+
 	secretGenerators := []SecretGenerator{
 		SecretGenerator{
 			TokenGenFxn: c.getGCRAuthorizationKey,
 			IsJSONCfg:   false,
 			SecretName:  *argGCRSecretName,
+			Provider:    providerGCR,
 		},
 		SecretGenerator{
 			TokenGenFxn: c.getECRAuthorizationKey,
 			IsJSONCfg:   true,
 			SecretName:  *argAWSSecretName,
+			Provider:    providerAWS,
 		},
 	}
-	for _, secretGenerator := range secretGenerators {
-		newToken, err := secretGenerator.TokenGenFxn()
-		if err != nil {
-			return err
+	if c.azureClient != nil {
+		secretGenerators = append(secretGenerators, SecretGenerator{
+			TokenGenFxn: c.getACRAuthorizationKey,
+			IsJSONCfg:   true,
+			SecretName:  *argACRSecretName,
+			Provider:    providerACR,
+		})
+	}
+	if dockerHubEnabled() {
+		secretGenerators = append(secretGenerators, SecretGenerator{
+			TokenGenFxn: c.getDockerHubAuthorizationKey,
+			IsJSONCfg:   true,
+			SecretName:  *argDockerHubSecretName,
+			Provider:    providerDockerHub,
+		})
+	}
+	if ghcrEnabled() {
+		secretGenerators = append(secretGenerators, SecretGenerator{
+			TokenGenFxn: c.getGHCRAuthorizationKey,
+			IsJSONCfg:   true,
+			SecretName:  *argGHCRSecretName,
+			Provider:    providerGHCR,
+		})
+	}
+
+	// A dry run records what it would write like a drift report, then logs it
+	if *argDryRun {
+		c.drift = &driftReport{}
+		defer c.drift.logDryRun()
+	}
+
+	namespaces, err := c.dueNamespaces()
+	if err != nil {
+		return err
+	}
+	if len(namespaces) == 0 && *argFailOnZeroNamespaces {
+		return fmt.Errorf("no namespaces to refresh, check the namespace filters")
+	}
+	if c.schedule != nil {
+		// Nothing due still counts as a successful refresh, so /healthz
+		// doesn't fail between schedule ticks or with nothing selected
+		if len(namespaces) == 0 {
+			recordProcess(nil, c.now())
+			c.health.recordProcessSuccess(c.now())
+			return nil
 		}
-		newSecret := generateSecretObj(newToken.AccessToken, newToken.Endpoint, secretGenerator.IsJSONCfg, secretGenerator.SecretName)
+		defer c.schedule.refreshed(namespaces, c.now())
+	}
 
-		// Get all namespaces
-		namespaces, err := c.kubeClient.Namespaces().List(api.ListOptions{})
-		if err != nil {
+	if len(*argAdoptLabels) > 0 && c.drift == nil {
+		if err := c.adoptLegacySecrets(namespaces); err != nil {
 			return err
 		}
+	}
+
+	c.pullSecretOverflow = pullSecretOverflow{}
+	c.endpoints = map[string]string{}
+
+	// A failing provider is recorded and reported, but doesn't stop the others
+	errs := []error{}
+	due := []SecretGenerator{}
+	dueNamespaces := [][]api.Namespace{}
+	for _, secretGenerator := range secretGenerators {
+		if c.disabledProviders[secretGenerator.Provider] {
+			continue
+		}
+		if c.onlyProviders != nil && !c.onlyProviders[secretGenerator.Provider] {
+			continue
+		}
+		c.cycle.providers = append(c.cycle.providers, secretGenerator.Provider)
+		providerNamespaces := namespacesForProvider(namespaces, secretGenerator.Provider)
+
+		if *argReferenceOnly {
+			if err := c.referencePullSecret(secretGenerator.SecretName, providerNamespaces); err != nil {
+				c.providerFailed(secretGenerator.Provider, err)
+				errs = append(errs, err)
+				continue
+			}
+			c.providerSucceeded(secretGenerator.Provider)
+			continue
+		}
+
+		// A token with enough life left counts as a successful refresh
+		if c.drift == nil && c.tokenFresh(secretGenerator, providerNamespaces) {
+			c.providerSucceeded(secretGenerator.Provider)
+			continue
+		}
+
+		if !c.breakers.allow(secretGenerator.Provider, c.now()) {
+			log.Printf("Circuit breaker for %s is open, skipping", secretGenerator.Provider)
+			continue
+		}
+
+		due = append(due, secretGenerator)
+		dueNamespaces = append(dueNamespaces, providerNamespaces)
+	}
 
-		for _, namespace := range namespaces.Items {
+	combinedAuths := map[string]dockerConfigEntry{}
+	combinedProviders := []string{}
+	newSecrets := make([]*api.Secret, len(due))
+	providerErrs := make([]error, len(due))
+	for i, fetched := range c.fetchTokens(due) {
+		newSecrets[i], providerErrs[i] = c.processProvider(due[i], fetched, combinedAuths)
+		if providerErrs[i] == nil && *argCombineSecrets != combineSecretsOff {
+			combinedProviders = append(combinedProviders, due[i].Provider)
+		}
+	}
 
-			if namespace.GetName() == "kube-system" {
+	// Namespaces are the outer loop, so every provider's secret and the
+	// combined secret reach one priority tier before the next tier gets any.
+	// A provider that fails in a tier isn't written to the tiers after it.
+	var combinedErr error
+	for _, tier := range priorityTiers(namespaces) {
+		for i, secretGenerator := range due {
+			if providerErrs[i] != nil || newSecrets[i] == nil {
 				continue
 			}
+			tierNamespaces := namespacesInTier(dueNamespaces[i], tier)
+			// Writing changes the secret in place, each tier starts from the generated one
+			providerErrs[i] = c.writeProviderSecret(copySecret(newSecrets[i]), secretGenerator.Provider, tierNamespaces)
+		}
+		if len(combinedProviders) > 0 && combinedErr == nil {
+			combinedErr = c.processCombined(tier, combinedAuths)
+		}
+	}
 
-			// Check if the secret exists for the namespace
-			_, err := c.kubeClient.Secrets(namespace.GetName()).Get(secretGenerator.SecretName)
+	for i, secretGenerator := range due {
+		if providerErrs[i] != nil {
+			c.providerFailed(secretGenerator.Provider, providerErrs[i])
+			errs = append(errs, providerErrs[i])
+			continue
+		}
+		if newSecrets[i] != nil && !quietProgress() {
+			log.Print("Finished processing secret for: ", secretGenerator.SecretName)
+		}
+		if *argCombineSecrets == combineSecretsOff {
+			c.providerSucceeded(secretGenerator.Provider)
+		}
+	}
 
-			if err != nil {
-				// Secret not found, create
-				_, err := c.kubeClient.Secrets(namespace.GetName()).Create(newSecret)
-				if err != nil {
-					return err
-				}
+	if len(combinedProviders) > 0 {
+		for _, provider := range combinedProviders {
+			if combinedErr != nil {
+				c.providerFailed(provider, combinedErr)
 			} else {
-				// Existing secret needs updated
-				_, err := c.kubeClient.Secrets(namespace.GetName()).Update(newSecret)
-				if err != nil {
-					return err
-				}
+				c.providerSucceeded(provider)
 			}
+		}
+		if combinedErr != nil {
+			errs = append(errs, combinedErr)
+		} else if !quietProgress() {
+			log.Print("Finished processing secret for: ", *argCombinedSecretName)
+		}
+	}
+
+	if err := c.processPullSecretOverflow(combinedAuths); err != nil {
+		errs = append(errs, err)
+	}
+
+	if *argCleanupRenamedSecrets && c.drift == nil {
+		if err := c.cleanupRenamedSecrets(namespaces); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// A one-off run for some providers leaves everything else alone
+	if *argStripDisabledProviders && c.onlyProviders == nil && c.drift == nil {
+		if err := c.cleanupDisabledProviders(); err != nil {
+			errs = append(errs, err)
+		}
+	}
 
-			// Check if ServiceAccount exists
-			serviceAccount, err := c.kubeClient.ServiceAccounts(namespace.GetName()).Get("default")
+	if *argCleanupDeselected && c.onlyProviders == nil && c.drift == nil {
+		if err := c.cleanupDeselectedNamespaces(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	err = utilerrors.NewAggregate(errs)
+	recordProcess(err, c.now())
+	// One provider that keeps failing is a readiness problem, not a reason to
+	// restart a controller that still refreshes the others
+	if err == nil || len(c.cycle.succeeded) > 0 {
+		c.health.recordProcessSuccess(c.now())
+	}
+	c.finishCycle(len(namespaces), err)
+	return err
+}
+
+// processProvider generates a provider's own secret from the token fetched
+// for it, and adds its entry to the combined auths when secrets are combined.
+// The secret is nil when only the combined secret is written.
+func (c *controller) processProvider(secretGenerator SecretGenerator, fetched fetchedToken, combinedAuths map[string]dockerConfigEntry) (*api.Secret, error) {
+	newToken, err := fetched.token, fetched.err
+	if err != nil {
+		c.breakers.recordFailure(secretGenerator.Provider, c.now())
+		return nil, err
+	}
+	c.breakers.recordSuccess(secretGenerator.Provider)
+	c.endpoints[secretGenerator.Provider] = newToken.Endpoint
 
+	// The combined entry is also kept for service accounts over --max-pull-secrets-per-sa
+	if *argCombineSecrets != combineSecretsOff || *argMaxPullSecretsPerSA > 0 {
+		entry, err := newDockerConfigEntry(newToken, secretGenerator.IsJSONCfg)
+		if err != nil {
+			return nil, err
+		}
+		combinedAuths[newToken.Endpoint] = entry
+		for _, registry := range newToken.Registries {
+			registryEntry, err := newDockerConfigEntry(registry, secretGenerator.IsJSONCfg)
 			if err != nil {
-				return err
+				return nil, err
+			}
+			combinedAuths[registry.Endpoint] = registryEntry
+		}
+		if secretGenerator.Provider == *argRegistryHostsProvider {
+			addRegistryHosts(combinedAuths, readRegistryHosts(*argRegistryHostsFile), entry)
+		}
+	}
+
+	if *argCombineSecrets == combineSecretsCombined {
+		return nil, nil
+	}
+
+	newSecret := generateSecretObj(string(newToken.AccessToken), newToken.Endpoint, secretGenerator.IsJSONCfg, secretGenerator.SecretName)
+	if secretGenerator.Provider == providerAWS && *argAWSSecretRegistries == awsSecretRegistriesAll {
+		newSecret, err = generateAllRegistriesSecretObj(newToken, secretGenerator.SecretName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if *argCompatMode == compatModeFleet {
+		newSecret, err = generateFleetSecretObj(newToken, secretGenerator.IsJSONCfg, secretGenerator.SecretName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.dockerConfigTemplate != nil {
+		newSecret, err = generateTemplateSecretObj(c.dockerConfigTemplate, newToken, secretGenerator.IsJSONCfg, secretGenerator.SecretName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if *argRefreshThreshold > 0 {
+		annotateTokenExpiry(newSecret, c.now(), newToken.ExpiresAt)
+	}
+	annotateSecretName(newSecret, secretGenerator.SecretName)
+	return newSecret, nil
+}
+
+// writeProviderSecret writes a provider's own secret to the given namespaces
+func (c *controller) writeProviderSecret(newSecret *api.Secret, provider string, namespaces []api.Namespace) error {
+	if err := c.fulfillPullSecrets(newSecret, provider, namespaces); err != nil {
+		return err
+	}
+	if replicated(provider) {
+		return c.writeReplicatedSecret(newSecret, provider, namespaces)
+	}
+	return c.writeSecretWithExtraHosts(newSecret, provider, namespaces)
+}
+
+// processCombined writes the combined secret. A namespace pinned to an AWS
+// account only gets that account's ECR registries, and one pinned to an
+// account that isn't configured gets no combined secret at all.
+func (c *controller) processCombined(namespaces []api.Namespace, combinedAuths map[string]dockerConfigEntry) error {
+	byAccount := map[string][]api.Namespace{}
+	accounts := []string{}
+	for _, namespace := range namespaces {
+		account, ok := namespaceAWSAccount(namespace)
+		if !ok {
+			recordNamespaceSkipped(skipReasonUnknownAWSAccount)
+			continue
+		}
+		if _, seen := byAccount[account]; !seen {
+			accounts = append(accounts, account)
+		}
+		byAccount[account] = append(byAccount[account], namespace)
+	}
+
+	for _, account := range accounts {
+		auths := combinedAuths
+		if account != "" {
+			auths = pinnedAuths(combinedAuths, account)
+		}
+		newSecret, err := generateCombinedSecretObj(auths, *argCombinedSecretName)
+		if err != nil {
+			return err
+		}
+		if err := c.writeSecretWithExtraHosts(newSecret, combinedProvider, byAccount[account]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSecretWithExtraHosts writes a generated secret, adding the hosts of
+// each namespace's extra hosts annotation when the secret holds the
+// --registry-hosts-provider credential
+func (c *controller) writeSecretWithExtraHosts(newSecret *api.Secret, provider string, namespaces []api.Namespace) error {
+	endpoint, ok := c.endpoints[*argRegistryHostsProvider]
+	if !ok || (provider != *argRegistryHostsProvider && provider != combinedProvider) {
+		return c.writeSecretFormats(newSecret, provider, namespaces)
+	}
+
+	plain := []api.Namespace{}
+	for _, namespace := range namespaces {
+		hosts := namespaceExtraHosts(namespace)
+		if len(hosts) == 0 {
+			plain = append(plain, namespace)
+			continue
+		}
+
+		secret, err := withExtraHosts(newSecret, endpoint, hosts)
+		if err != nil {
+			return fmt.Errorf("adding extra hosts for namespace %s: %v", namespace.Name, err)
+		}
+		if err := c.writeSecretFormats(secret, provider, []api.Namespace{namespace}); err != nil {
+			return err
+		}
+	}
+	return c.writeSecretFormats(newSecret, provider, plain)
+}
+
+// writeSecretFormats writes a generated secret in the --secret-format formats,
+// which may split it into more than one secret
+func (c *controller) writeSecretFormats(newSecret *api.Secret, provider string, namespaces []api.Namespace) error {
+	secrets, err := applySecretFormat(newSecret)
+	if err != nil {
+		return err
+	}
+
+	for _, secret := range secrets {
+		applySecretDataKey(secret)
+		markManaged(secret, provider)
+
+		if err := c.writeSecret(secret, namespaces); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSecret creates or updates the secret in the given namespaces and makes
+// sure the default service account references it. Up to --concurrency
+// namespaces are written at once, and a namespace that fails doesn't stop the
+// others: every namespace's error is returned, in namespace order.
+func (c *controller) writeSecret(newSecret *api.Secret, namespaces []api.Namespace) error {
+	errs := make([]error, len(namespaces))
+	forEachNamespace(namespaces, func(i int, namespace api.Namespace) {
+		errs[i] = c.writeSecretToNamespace(newSecret, namespace)
+	})
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// writeSecretToNamespace writes the secret to one namespace unless it's
+// excluded, blocked or has been deleted since it was listed
+func (c *controller) writeSecretToNamespace(newSecret *api.Secret, namespace api.Namespace) error {
+	if namespaceExcluded(namespace.GetName()) {
+		c.recordNamespaceSkippedOnce(namespace.GetName(), skipReasonExcluded)
+		return nil
+	}
+
+	if c.namespaceBlocked(namespace.GetName()) {
+		recordNamespaceSkipped(skipReasonBlocked)
+		return nil
+	}
+
+	err := c.writeNamespaceSecret(newSecret, namespace)
+	// A namespace deleted since it was listed is simply done
+	if err != nil && c.namespaceGone(namespace.GetName(), err) {
+		log.Printf("Namespace %s was deleted, skipping: %v", namespace.GetName(), err)
+		recordNamespaceSkipped(skipReasonDeleted)
+		return nil
+	}
+	if isKubeCallTimeout(err) {
+		log.Printf("Timed out writing secret %s to namespace %s: %v", newSecret.Name, namespace.GetName(), err)
+	}
+	return err
+}
+
+// writeNamespaceSecret writes the secret to one namespace and references it
+// from the namespace's service accounts
+func (c *controller) writeNamespaceSecret(newSecret *api.Secret, namespace api.Namespace) error {
+	// Someone else provisions the secret, only the references are ours
+	if !*argReferenceOnly {
+		if err := c.ensureSecret(namespace.GetName(), newSecret); err != nil {
+			if c.blockNamespace(namespace, err) {
+				return nil
 			}
+			return err
+		}
+		c.unblockNamespace(namespace.GetName())
+
+		// An Opaque secret can't be used to pull images, so don't reference it
+		if !usableForPulls(newSecret) {
+			return nil
+		}
+	}
+
+	if err := c.waitForDefaultServiceAccount(namespace); err != nil {
+		return err
+	}
+
+	// Check if the service accounts exist
+	serviceAccounts, err := c.targetServiceAccounts(namespace.GetName())
 
-			// Update existing one if image pull secrets already exists for aws ecr token
-			imagePullSecretFound := false
-			for i, imagePullSecret := range serviceAccount.ImagePullSecrets {
-				if imagePullSecret.Name == secretGenerator.SecretName {
-					serviceAccount.ImagePullSecrets[i] = api.LocalObjectReference{Name: secretGenerator.SecretName}
-					imagePullSecretFound = true
-					break
-				}
+	if err != nil {
+		return err
+	}
+
+	for _, serviceAccount := range serviceAccounts {
+		// Append to list of existing service accounts if there isn't one already
+		if !referencesSecret(serviceAccount, newSecret.Name) {
+			if c.drift != nil {
+				c.stateLock.Lock()
+				c.drift.add(driftEntry{Namespace: namespace.GetName(), Secret: newSecret.Name, ServiceAccount: serviceAccount.Name, Drift: driftReferenceMissing})
+				c.stateLock.Unlock()
+				continue
 			}
 
-			// Append to list of existing service accounts if there isn't one already
-			if !imagePullSecretFound {
-				serviceAccount.ImagePullSecrets = append(serviceAccount.ImagePullSecrets, api.LocalObjectReference{Name: secretGenerator.SecretName})
+			if c.exceedsPullSecretLimit(serviceAccount) {
+				log.Printf("Adding %s would give service account %s/%s more than %d image pull secrets, referencing %s instead", newSecret.Name, namespace.GetName(), serviceAccount.Name, *argMaxPullSecretsPerSA, *argCombinedSecretName)
+				c.stateLock.Lock()
+				c.pullSecretOverflow.add(namespace.GetName(), serviceAccount.Name)
+				c.stateLock.Unlock()
+				continue
 			}
 
-			_, err = c.kubeClient.ServiceAccounts(namespace.GetName()).Update(serviceAccount)
+			serviceAccount, err = c.addPullSecretReference(namespace.GetName(), serviceAccount, newSecret.Name)
 			if err != nil {
 				return err
 			}
+			c.recordWrite(serviceAccount)
+			c.recordEvent(objectReference("ServiceAccount", namespace.GetName(), serviceAccount.ObjectMeta), api.EventTypeNormal, "Updated", "Added image pull secret %s", newSecret.Name)
+			c.stateLock.Lock()
+			c.summary.ServiceAccountsUpdated++
+			c.stateLock.Unlock()
 		}
-		log.Print("Finished processing secret for: ", secretGenerator.SecretName)
 	}
 
 	return nil
 }
 
-func validateParams() {
-	awsAccountID = os.Getenv("awsaccount")
-	if len(awsAccountID) == 0 {
-		log.Print("Missing awsaccount env variable, assuming GCR usage")
+// ensureSecret creates the secret in a namespace, or updates it when it's out
+// of date or corrupted. When another writer races us, the create or update
+// fails with AlreadyExists or Conflict, so the whole sequence is retried with
+// a backoff, re-reading the secret from the API server.
+func (c *controller) ensureSecret(namespace string, newSecret *api.Secret) error {
+	if config, ok := newSecret.Data[api.DockerConfigJsonKey]; ok {
+		if err := validateDockerConfig(config); err != nil {
+			return fmt.Errorf("not writing secret %s/%s: %v", namespace, newSecret.Name, err)
+		}
+	}
+	if err := checkSecretSize(namespace, newSecret); err != nil {
+		return fmt.Errorf("not writing secret: %v", err)
 	}
 
-	awsRegionEnv := os.Getenv("awsregion")
+	backoff := secretWriteBackoff
+	for attempt := 0; ; attempt++ {
+		err := c.writeSecretOnce(namespace, newSecret, attempt > 0)
+		if err == nil || !(errors.IsAlreadyExists(err) || errors.IsConflict(err)) || attempt >= *argSecretWriteRetries {
+			return err
+		}
 
-	if len(awsRegionEnv) > 0 {
-		argAWSRegion = &awsRegionEnv
+		log.Printf("Writing secret %s/%s raced with another writer, retrying in %v: %v", namespace, newSecret.Name, backoff, err)
+		c.sleep(backoff)
+		backoff *= 2
 	}
 }
 
-func main() {
-	log.Print("Starting up...")
-	flags.Parse(os.Args)
-
-	validateParams()
-
-	log.Print("Using AWS Account: ", awsAccountID)
-	log.Printf("Using AWS Region: %s", *argAWSRegion)
-	log.Print("Refresh Interval (minutes): ", *argRefreshMinutes)
-
-	kubeClient := newKubeClient()
-	ecrClient := newEcrClient()
-	gcrClient := newGcrClient()
-	c := &controller{kubeClient, ecrClient, gcrClient}
+// writeSecretOnce makes one create or update attempt, reading the existing
+// secret from the API server rather than the informer cache when fresh is set
+func (c *controller) writeSecretOnce(namespace string, newSecret *api.Secret, fresh bool) error {
+	// Check if the secret exists for the namespace
+	var existingSecret *api.Secret
+	var err error
+	if fresh {
+		existingSecret, err = c.kubeClient.Secrets(namespace).Get(newSecret.Name)
+	} else {
+		existingSecret, err = c.getSecret(namespace, newSecret.Name)
+	}
 
-	tick := time.Tick(time.Duration(*argRefreshMinutes) * time.Minute)
+	if err == nil && adoptsSecret(existingSecret) {
+		log.Printf("Adopting secret %s/%s written without an instance ID as instance %q", namespace, newSecret.Name, *argInstanceID)
+	} else if err == nil && ownedByOtherInstance(existingSecret) {
+		return fmt.Errorf("secret %s/%s is managed by registry-creds instance %q", namespace, newSecret.Name, existingSecret.Labels[instanceLabel])
+	}
 
-	// Process once now, then wait for tick
-	c.process()
+	// Entries added to the existing secret by hand survive the update
+	if err == nil && *argMergeExistingAuths && !dockerConfigCorrupt(existingSecret) {
+		if newSecret, err = mergeExistingAuths(existingSecret, newSecret); err != nil {
+			return err
+		}
+	}
 
-	for {
-		select {
-		case <-tick:
-			log.Print("Refreshing credentials...")
-			if err := c.process(); err != nil {
-				log.Fatalf("Failed to load ecr credentials: %v", err)
-			}
+	if c.drift != nil {
+		c.stateLock.Lock()
+		defer c.stateLock.Unlock()
+		if err != nil {
+			c.drift.add(driftEntry{Namespace: namespace, Secret: newSecret.Name, Drift: driftSecretMissing})
+		} else if secretDrifted(existingSecret, newSecret) || (*argDryRun && !secretUpToDate(existingSecret, newSecret)) {
+			c.drift.add(driftEntry{Namespace: namespace, Secret: newSecret.Name, Drift: driftSecretOutOfDate})
 		}
+		return nil
 	}
 
+	if err != nil {
+		// Secret not found, create
+		secret, err := c.kubeClient.Secrets(namespace).Create(stampRefreshed(newSecret, c.now()))
+		if err != nil {
+			return err
+		}
+		c.recordWrite(secret)
+		c.recordEvent(objectReference("Secret", namespace, secret.ObjectMeta), api.EventTypeNormal, "Created", "Created registry credentials %s", newSecret.Name)
+		c.stateLock.Lock()
+		c.summary.SecretsCreated++
+		c.stateLock.Unlock()
+		recordSecretUpdated(newSecret)
+	} else if corrupt := dockerConfigCorrupt(existingSecret); corrupt || !secretUpToDate(existingSecret, newSecret) {
+		// Existing secret needs updated
+		if corrupt {
+			log.Printf("Secret %s/%s has a corrupted docker config, rewriting it", namespace, newSecret.Name)
+		}
+		// A corrupted secret is no use to roll back to
+		if !corrupt && *argKeepPreviousSecrets > 0 {
+			if err := c.backupSecret(namespace, existingSecret); err != nil {
+				return err
+			}
+		}
+		secret, err := c.kubeClient.Secrets(namespace).Update(stampRefreshed(newSecret, c.now()))
+		if err != nil {
+			return err
+		}
+		c.recordWrite(secret)
+		c.recordEvent(objectReference("Secret", namespace, secret.ObjectMeta), api.EventTypeNormal, "Updated", "Refreshed registry credentials %s", newSecret.Name)
+		c.stateLock.Lock()
+		c.summary.SecretsUpdated++
+		c.stateLock.Unlock()
+		recordSecretUpdated(newSecret)
+	} else {
+		c.stateLock.Lock()
+		c.summary.SecretsUnchanged++
+		c.stateLock.Unlock()
+	}
+	return nil
+}
+
+func (c *controller) now() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock.Now()
+}
+
+func (c *controller) sleep(d time.Duration) {
+	if c.clock == nil {
+		time.Sleep(d)
+		return
+	}
+	c.clock.Sleep(d)
+}
+
+func (c *controller) after(d time.Duration) <-chan time.Time {
+	if c.clock == nil {
+		return time.After(d)
+	}
+	return c.clock.After(d)
+}
+
+// listNamespaces returns every namespace the controller manages, from the
+// informer cache when enabled, or only those in --namespaces or
+// --namespaces-from-configmap when set
+func (c *controller) listNamespaces() ([]api.Namespace, error) {
+	var namespaces []api.Namespace
+	if len(*argNamespaces) > 0 || *argNamespacesFromConfigMap != "" {
+		listed, err := c.getListedNamespaces()
+		if err != nil {
+			return nil, err
+		}
+		namespaces = listed
+	} else if c.cache != nil {
+		namespaces = c.cache.listNamespaces()
+	} else {
+		list, err := c.kubeClient.Namespaces().List(api.ListOptions{LabelSelector: namespaceSelector()})
+		if err != nil {
+			return nil, err
+		}
+		namespaces = list.Items
+	}
+
+	owned, err := filterOwnedNamespaces(filterOptedInNamespaces(filterSelectedNamespaces(c.filterTerminatingNamespaces(namespaces))))
+	if err != nil {
+		return nil, err
+	}
+	return sortNamespacesByPriority(owned), nil
+}
+
+// dueNamespaces returns the namespaces to refresh in this process()
+func (c *controller) dueNamespaces() ([]api.Namespace, error) {
+	namespaces, err := c.listNamespaces()
+	if err != nil {
+		return nil, err
+	}
+	if c.cursor != nil {
+		return c.cursor.next(namespaces), nil
+	}
+	if c.schedule != nil {
+		return c.schedule.due(namespaces, c.now()), nil
+	}
+	return namespaces, nil
+}
+
+// getSecret fetches a secret, from the informer cache when enabled. A secret
+// the cache doesn't have, because it isn't watched or the watch hasn't caught
+// up yet, is fetched from the API server, so a create doesn't fail on a secret
+// that already exists.
+func (c *controller) getSecret(namespace, name string) (*api.Secret, error) {
+	if c.cache != nil {
+		secret, err := c.cache.getSecret(namespace, name)
+		if !errors.IsNotFound(err) {
+			return secret, err
+		}
+	}
+	return c.kubeClient.Secrets(namespace).Get(name)
+}
+
+// getServiceAccount fetches a service account, from the informer cache when enabled
+func (c *controller) getServiceAccount(namespace, name string) (*api.ServiceAccount, error) {
+	if c.cache != nil {
+		return c.cache.getServiceAccount(namespace, name)
+	}
+	return c.kubeClient.ServiceAccounts(namespace).Get(name)
+}
+
+// recordWrite stores an object we just wrote in the informer cache, so later reads in
+// the same refresh see it before the watch event arrives
+func (c *controller) recordWrite(obj interface{}) {
+	if c.cache != nil {
+		c.cache.recordWrite(obj)
+	}
+}
+
+// secretUpToDate reports whether an existing secret already holds the generated content
+func secretUpToDate(existing, generated *api.Secret) bool {
+	return existing.Type == generated.Type &&
+		reflect.DeepEqual(existing.Data, generated.Data) &&
+		reflect.DeepEqual(existing.Labels, generated.Labels) &&
+		reflect.DeepEqual(withoutRefreshStamp(existing.Annotations), withoutRefreshStamp(generated.Annotations))
+}
+
+// withoutRefreshStamp drops the last refreshed time, which on its own is no
+// reason to rewrite a secret
+func withoutRefreshStamp(annotations map[string]string) map[string]string {
+	if _, ok := annotations[lastRefreshedAnnotation]; !ok {
+		return annotations
+	}
+	stripped := copyStringMap(annotations)
+	delete(stripped, lastRefreshedAnnotation)
+	if len(stripped) == 0 {
+		return nil
+	}
+	return stripped
+}
+
+// registryHost returns the docker config auths key for a registry endpoint.
+// ECR proxy endpoints and the default GCR URL carry an https:// scheme, which
+// is dropped so the key is the bare host (and port) images are pulled from.
+func registryHost(endpoint string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(endpoint, "https://"), "/")
+}
+
+// validateRegistryURL checks a registry URL is a host, optionally with a port
+// and scheme. A port is preserved exactly as given in the docker config auths
+// key, only an https:// scheme is dropped.
+func validateRegistryURL(registryURL string) error {
+	withScheme := registryURL
+	if !strings.Contains(withScheme, "://") {
+		withScheme = "https://" + withScheme
+	}
+
+	parsed, err := url.Parse(withScheme)
+	if err != nil {
+		return fmt.Errorf("invalid registry URL %q: %v", registryURL, err)
+	}
+	if parsed.Host == "" || parsed.Hostname() == "" {
+		return fmt.Errorf("invalid registry URL %q: missing host", registryURL)
+	}
+	if port := parsed.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid registry URL %q: bad port %q", registryURL, port)
+		}
+	}
+	return nil
+}
+
+// expandEnv replaces ${VAR} references with values from the environment,
+// failing if any referenced variable isn't set
+func expandEnv(value string) (string, error) {
+	missing := []string{}
+	expanded := os.Expand(value, func(name string) string {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("%q references undefined environment variables: %s", value, strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+func validateParams() {
+	// The region is needed to discover and validate the accounts below
+	awsRegionEnv := os.Getenv("awsregion")
+
+	if len(awsRegionEnv) > 0 {
+		argAWSRegion = &awsRegionEnv
+	}
+
+	if err := resolveAWSAccount(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := validateAWSAccounts(); err != nil {
+		log.Fatalf("Invalid awsaccount: %v", err)
+	}
+
+	if err := validateRegistryURL(*argGCRURL); err != nil {
+		log.Fatalf("Invalid gcr-url: %v", err)
+	}
+
+	acrClientID = os.Getenv("ACR_CLIENT_ID")
+	acrClientSecret = os.Getenv("ACR_CLIENT_SECRET")
+	acrTenantID = os.Getenv("ACR_TENANT_ID")
+	if acrClientID != "" || acrClientSecret != "" || acrTenantID != "" {
+		if acrClientID == "" || acrClientSecret == "" || acrTenantID == "" {
+			log.Fatal("ACR_CLIENT_ID, ACR_CLIENT_SECRET and ACR_TENANT_ID must all be set to use ACR")
+		}
+		if *argACRRegistry == "" {
+			log.Fatal("ACR_CLIENT_ID requires acr-registry")
+		}
+	}
+	if *argACRRegistry != "" {
+		if err := validateRegistryURL(*argACRRegistry); err != nil {
+			log.Fatalf("Invalid acr-registry: %v", err)
+		}
+	}
+	if *argDockerHubUser != "" && *argDockerHubPassword == "" {
+		log.Fatal("dockerhub-user requires dockerhub-password")
+	}
+	if *argDockerHubPassword != "" && *argDockerHubUser == "" {
+		log.Fatal("dockerhub-password requires dockerhub-user")
+	}
+	if *argGHCRToken != "" && *argGHCRTokenFile != "" {
+		log.Fatal("Only one of ghcr-token and ghcr-token-file may be set")
+	}
+	if *argGHCRUser != "" && *argGHCRToken == "" && *argGHCRTokenFile == "" {
+		log.Fatal("ghcr-user requires ghcr-token or ghcr-token-file")
+	}
+	if (*argGHCRToken != "" || *argGHCRTokenFile != "") && *argGHCRUser == "" {
+		log.Fatal("ghcr-token and ghcr-token-file require ghcr-user")
+	}
+
+	if !validGCRUsername(*argGCRUsername) {
+		log.Fatalf("Invalid gcr-username %q, must be one of: %s", *argGCRUsername, strings.Join(gcrUsernames, ", "))
+	}
+
+	for _, secretName := range []*string{argAWSSecretName, argGCRSecretName, argACRSecretName, argDockerHubSecretName, argGHCRSecretName, argCombinedSecretName} {
+		expanded, err := expandEnv(*secretName)
+		if err != nil {
+			log.Fatalf("Invalid secret name: %v", err)
+		}
+		*secretName = expanded
+	}
+
+	if flags.Changed("refresh-interval") && flags.Changed("refresh-mins") {
+		log.Fatal("Only one of refresh-interval and refresh-mins may be set")
+	}
+	if *argRefreshInterval < 0 {
+		log.Fatal("refresh-interval can't be negative")
+	}
+	if globalRefreshInterval() <= 0 {
+		log.Fatal("The refresh interval must be positive")
+	}
+	// The vendored ServiceAccount type has no automountServiceAccountToken, so
+	// a full update would clear it on every service account it writes
+	if !*argUsePatch {
+		log.Fatal("use-patch=false isn't supported, a full service account update would clear automountServiceAccountToken")
+	}
+	if globalRefreshInterval() > ecrTokenLifetime {
+		log.Printf("Warning: the refresh interval %v is longer than the %v lifetime of an ECR token, ECR secrets will expire before they're refreshed", globalRefreshInterval(), ecrTokenLifetime)
+	}
+
+	if *argSchedule != "" {
+		if flags.Changed("refresh-mins") || flags.Changed("refresh-interval") {
+			log.Fatal("Only one of schedule and refresh-mins or refresh-interval may be set")
+		}
+		if _, err := parseSchedule(*argSchedule); err != nil {
+			log.Fatalf("Invalid schedule %q: %v", *argSchedule, err)
+		}
+	}
+
+	if *argMetricsPort != 0 && *argMetricsPort == *argHealthPort {
+		log.Fatal("metrics-port can't be the same as health-port")
+	}
+
+	if *argStartupDelay < 0 || *argStartupDelayJitter < 0 {
+		log.Fatal("startup-delay and startup-delay-jitter can't be negative")
+	}
+	if _, err := parseTokenRequestHeaders(*argTokenRequestHeaders); err != nil {
+		log.Fatalf("Invalid token-request-headers: %v", err)
+	}
+	if *argMaxSecretSize < 0 {
+		log.Fatal("max-secret-size can't be negative")
+	}
+	if *argFailOnMaxSecretSize && *argMaxSecretSize == 0 {
+		log.Fatal("fail-on-max-secret-size requires max-secret-size")
+	}
+
+	if *argKeepPreviousSecrets < 0 {
+		log.Fatal("keep-previous-secrets can't be negative")
+	}
+	if *argConcurrency < 1 {
+		log.Fatal("concurrency must be at least 1")
+	}
+	if *argMaxRetries < 0 {
+		log.Fatal("max-retries can't be negative")
+	}
+	if *argMaxInflightTokenRequests < 0 {
+		log.Fatal("max-inflight-token-requests can't be negative")
+	}
+	if *argSummaryLogInterval < 0 {
+		log.Fatal("summary-log-interval can't be negative")
+	}
+	if *argNamespacesPerCycle < 0 {
+		log.Fatal("namespaces-per-cycle can't be negative")
+	}
+	if *argNamespacesPerCycle > 0 && *argOnce {
+		log.Fatal("namespaces-per-cycle can't be used with once, a single refresh would only cover one slice")
+	}
+
+	if *argFailOnZeroNamespaces && !*argOnce {
+		log.Fatal("fail-on-zero-namespaces requires once")
+	}
+
+	if *argPrune && (*argOnce || *argDriftReport != "") {
+		log.Fatal("prune can't be used with once or drift-report")
+	}
+
+	if *argDryRun && (*argDriftReport != "" || *argPrune || *argAdminTokenFile != "") {
+		log.Fatal("dry-run can't be used with drift-report, prune or admin-token-file")
+	}
+	if *argDriftReport != "" && !*argOnce {
+		log.Fatal("drift-report requires once")
+	}
+
+	if len(*argOnlyProviders) > 0 {
+		if !*argOnce {
+			log.Fatal("only-providers requires once")
+		}
+		if *argCombineSecrets != combineSecretsOff {
+			log.Fatal("only-providers can't be used with combine-secrets, the combined secret holds every provider")
+		}
+		if _, err := onlyProviders(*argOnlyProviders, disabledProviders()); err != nil {
+			log.Fatalf("Invalid only-providers: %v", err)
+		}
+	}
+
+	if *argCleanupRenamedSecrets && *argReferenceOnly {
+		log.Fatal("cleanup-renamed-secrets can't be used with reference-only, which writes no secrets")
+	}
+
+	if *argReferenceOnly {
+		if *argCombineSecrets != combineSecretsOff {
+			log.Fatal("reference-only can't be used with combine-secrets")
+		}
+		if *argMaxPullSecretsPerSA > 0 {
+			log.Fatal("reference-only can't be used with max-pull-secrets-per-sa")
+		}
+		if len(*argFulfillPullSecrets) > 0 {
+			log.Fatal("reference-only can't be used with fulfill-pull-secrets")
+		}
+	}
+
+	if _, err := parseAdoptLabels(*argAdoptLabels); err != nil {
+		log.Fatalf("Invalid adopt-labels: %v", err)
+	}
+
+	if _, err := parseFulfillPatterns(*argFulfillPullSecrets); err != nil {
+		log.Fatalf("Invalid fulfill-pull-secrets: %v", err)
+	}
+	if len(*argFulfillPullSecrets) > 0 && *argCombineSecrets == combineSecretsCombined {
+		log.Fatal("fulfill-pull-secrets can't be used with combine-secrets=combined, which writes no provider secrets")
+	}
+
+	distribution, err := parseSecretDistribution(*argSecretDistribution)
+	if err != nil {
+		log.Fatalf("Invalid secret-distribution: %v", err)
+	}
+	for provider, mode := range distribution {
+		if mode != distributionReplicated {
+			continue
+		}
+		if *argReplicationSourceNamespace == "" {
+			log.Fatalf("Replicating %s requires replication-source-namespace", provider)
+		}
+		if *argCombineSecrets == combineSecretsCombined {
+			log.Fatal("Replicated secret-distribution can't be used with combine-secrets=combined, which writes no provider secrets")
+		}
+		if *argSecretFormat == secretFormatBoth {
+			log.Fatal("Replicated secret-distribution can't be used with secret-format=both")
+		}
+		if *argReferenceOnly {
+			log.Fatal("Replicated secret-distribution can't be used with reference-only")
+		}
+		patterns, _ := parseFulfillPatterns(*argFulfillPullSecrets)
+		for _, pattern := range patterns {
+			if pattern.provider == provider {
+				log.Fatalf("fulfill-pull-secrets can't create %s secrets, %s is replicated", provider, provider)
+			}
+		}
+	}
+
+	if !validCombineSecrets(*argCombineSecrets) {
+		log.Fatalf("Invalid combine-secrets %q, must be one of: %s, %s, %s", *argCombineSecrets, combineSecretsOff, combineSecretsCombined, combineSecretsDual)
+	}
+
+	if *argKubeCallTimeout < 0 {
+		log.Fatal("kube-call-timeout can't be negative")
+	}
+
+	if errs := validation.IsValidLabelValue(*argInstanceID); len(errs) > 0 {
+		log.Fatalf("Invalid instance-id %q: %s", *argInstanceID, strings.Join(errs, ", "))
+	}
+
+	if len(*argNamespaces) > 0 && *argUseInformers {
+		log.Fatal("namespaces can't be used with use-informers, the informers list and watch every namespace")
+	}
+
+	if *argNamespacesFromConfigMap != "" {
+		if _, _, err := parseConfigMapRef(*argNamespacesFromConfigMap); err != nil {
+			log.Fatalf("Invalid namespaces-from-configmap: %v", err)
+		}
+		if len(*argNamespaces) > 0 {
+			log.Fatal("Only one of namespaces and namespaces-from-configmap may be set")
+		}
+		if *argUseInformers {
+			log.Fatal("namespaces-from-configmap can't be used with use-informers, the informers list and watch every namespace")
+		}
+	}
+
+	if *argRegistryHostsFile != "" && *argCombineSecrets == combineSecretsOff {
+		log.Fatal("registry-hosts-file requires combine-secrets to be combined or dual")
+	}
+
+	if !knownProvider(*argRegistryHostsProvider) {
+		log.Fatalf("Invalid registry-hosts-provider %q, must be one of: %s", *argRegistryHostsProvider, strings.Join(knownProviders, ", "))
+	}
+
+	if *argAWSEndpoint != "" {
+		if err := validateECREndpoint(*argAWSEndpoint); err != nil {
+			log.Fatalf("Invalid aws-endpoint: %v", err)
+		}
+	}
+
+	if _, err := parseECREndpoints(*argECREndpoints); err != nil {
+		log.Fatalf("Invalid ecr-endpoints: %v", err)
+	}
+
+	if *argRefreshThreshold < 0 || *argRefreshThreshold >= 1 {
+		log.Fatalf("Invalid refresh-threshold %v, must be at least 0 and less than 1", *argRefreshThreshold)
+	}
+
+	if *argRefreshThreshold > 0 && (*argCombineSecrets != combineSecretsOff || *argMaxPullSecretsPerSA > 0) {
+		log.Fatal("refresh-threshold can't be used with combine-secrets or max-pull-secrets-per-sa, the combined secret needs every provider's token")
+	}
+
+	if *argAWSAssumeRole != "" && !validAssumeRoleARN(*argAWSAssumeRole) {
+		log.Fatalf("Invalid aws-assume-role %q, must be an IAM role ARN", *argAWSAssumeRole)
+	}
+	if *argAWSAssumeRoleExternalID != "" && *argAWSAssumeRole == "" {
+		log.Fatal("aws-assume-role-external-id requires aws-assume-role")
+	}
+
+	if !validAWSCredentialSource(*argAWSCredentialSource) {
+		log.Fatalf("Invalid aws-credential-source %q, must be one of: %s, %s, %s, %s, %s", *argAWSCredentialSource, awsCredentialSourceIRSA, awsCredentialSourceEnv, awsCredentialSourceProfile, awsCredentialSourceIMDS, awsCredentialSourceChain)
+	}
+
+	if !validCompatMode(*argCompatMode) {
+		log.Fatalf("Invalid compat-mode %q, must be one of: %s, %s", *argCompatMode, compatModeNone, compatModeFleet)
+	}
+
+	if !validAWSSecretRegistries(*argAWSSecretRegistries) {
+		log.Fatalf("Invalid aws-secret-registries %q, must be one of: %s, %s", *argAWSSecretRegistries, awsSecretRegistriesFirst, awsSecretRegistriesAll)
+	}
+	if *argAWSSecretRegistries == awsSecretRegistriesAll && (*argCompatMode != compatModeNone || *argDockerConfigTemplate != "") {
+		log.Fatal("aws-secret-registries=all can't be used with compat-mode or dockerconfig-template, which write their own format")
+	}
+
+	if *argDockerConfigTemplate != "" {
+		if *argCompatMode != compatModeNone {
+			log.Fatal("dockerconfig-template can't be used with compat-mode")
+		}
+		if _, err := loadDockerConfigTemplate(*argDockerConfigTemplate); err != nil {
+			log.Fatalf("Invalid dockerconfig-template: %v", err)
+		}
+	}
+
+	if *argOwnerAnnotation != "" {
+		if _, _, err := parseOwnerAnnotation(*argOwnerAnnotation); err != nil {
+			log.Fatalf("Invalid owner-annotation: %v", err)
+		}
+	}
+
+	if _, err := labels.Parse(*argNamespaceSelector); err != nil {
+		log.Fatalf("Invalid namespace-selector %q: %v", *argNamespaceSelector, err)
+	}
+
+	if _, err := labels.Parse(*argServiceAccountSelector); err != nil {
+		log.Fatalf("Invalid service-account-selector: %v", err)
+	}
+
+	if *argAllServiceAccounts && *argServiceAccountSelector != "" {
+		log.Fatal("Only one of all-service-accounts and service-account-selector may be set")
+	}
+
+	if len(*argServiceAccounts) == 0 && !*argAllServiceAccounts && *argServiceAccountSelector == "" {
+		log.Fatal("service-accounts can't be empty without all-service-accounts or service-account-selector")
+	}
+
+	if *argSecretDataKey != "" && !validSecretDataKey(*argSecretDataKey) {
+		log.Fatalf("Invalid secret-data-key %q, must consist of alphanumeric characters, '-', '_' or '.'", *argSecretDataKey)
+	}
+
+	if *argRequireHealthyStartup && *argSkipInitialReconcile {
+		log.Fatal("require-healthy-providers-at-startup can't be used with skip-initial-reconcile, there's no refresh on startup")
+	}
+	if *argStartupProbeGrace < 0 {
+		log.Fatal("startup-probe-grace can't be negative")
+	}
+	if *argReactToPullFailures {
+		if *argOnce {
+			log.Fatal("react-to-pull-failures can't be used with once")
+		}
+		if *argSchedule != "" || *argNamespacesPerCycle > 0 {
+			log.Fatal("react-to-pull-failures can't be used with schedule or namespaces-per-cycle, which don't refresh single namespaces")
+		}
+	}
+	if *argWatchNamespaces {
+		if *argOnce {
+			log.Fatal("watch-namespaces can't be used with once")
+		}
+		if *argSchedule != "" || *argNamespacesPerCycle > 0 {
+			log.Fatal("watch-namespaces can't be used with schedule or namespaces-per-cycle, which don't refresh single namespaces")
+		}
+	}
+	if *argPullFailureCooldown < 0 {
+		log.Fatal("pull-failure-cooldown can't be negative")
+	}
+
+	if *argPopulateNewProviders {
+		if *argCombineSecrets != combineSecretsOff || *argMaxPullSecretsPerSA > 0 {
+			log.Fatal("populate-new-providers can't be used with combine-secrets or max-pull-secrets-per-sa, the combined secret needs every provider's token")
+		}
+		if *argReferenceOnly {
+			log.Fatal("populate-new-providers can't be used with reference-only, which writes no secrets")
+		}
+	}
+
+	if *argStartupProbeGrace > 0 && (*argRequireHealthyStartup || *argSkipInitialReconcile) {
+		log.Fatal("startup-probe-grace can't be used with require-healthy-providers-at-startup or skip-initial-reconcile")
+	}
+
+	if *argSecretDataKeyOnly && *argSecretDataKey == "" {
+		log.Fatal("secret-data-key-only requires secret-data-key")
+	}
+
+	if !validSecretFormat(*argSecretFormat) {
+		log.Fatalf("Invalid secret-format %q, must be one of: %s, %s", *argSecretFormat, secretFormatDefault, secretFormatBoth)
+	}
+
+	if *argSplitSecretFormats && *argSecretFormat != secretFormatBoth {
+		log.Fatal("split-secret-formats requires secret-format=both")
+	}
+
+	if *argSecretFormat == secretFormatBoth && *argSecretDataKeyOnly {
+		log.Fatal("secret-format=both can't be used with secret-data-key-only, which drops the standard keys")
+	}
+}
+
+func main() {
+	log.Print("Starting up...")
+	flags.Parse(os.Args)
+
+	validateParams()
+
+	if *argListProviders {
+		if err := listProviders(os.Stdout); err != nil {
+			log.Fatalf("Failed to list providers: %v", err)
+		}
+		return
+	}
+
+	log.Print("Using AWS Account: ", awsAccountID)
+	log.Printf("Using AWS Region: %s", *argAWSRegion)
+	log.Print("Refresh Interval: ", globalRefreshInterval())
+
+	kubeClient := newKubeClient()
+	if *argSkipPermissionCheck {
+		log.Print("Skipping permission check")
+	} else if err := checkPermissions(kubeClient, requiredPermissions()); err != nil {
+		log.Fatalf("Permission check failed: %v", err)
+	}
+
+	ecrClient := newEcrClient()
+	gcrClient := newGcrClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: gcrClient}
+	if *argKubeCallTimeout > 0 {
+		c.kubeClient = newTimeoutKubeClient(kubeClient, *argKubeCallTimeout)
+	}
+	c.tokenRequests = newTokenSemaphore(*argMaxInflightTokenRequests)
+	if *argAWSDiscoverRegistries {
+		// newEcrClient always returns the SDK client, which can list repositories
+		c.ecrRepositories = ecrClient.(ecrRepositoryInterface)
+	}
+	if *argAWSRegionsFromNodes || len(awsAccountRegions()) > 0 {
+		c.newRegionalEcrClient = func(region string) (ecrInterface, error) {
+			return buildRegionalEcrClient(region)
+		}
+	}
+	if acrEnabled() {
+		c.azureClient = newAzureClient(acrTenantID, acrClientID, acrClientSecret)
+	}
+	c.disabledProviders = disabledProviders()
+	c.onlyProviders, _ = onlyProviders(*argOnlyProviders, c.disabledProviders)
+	c.recorder = newEventRecorder(kubeClient)
+
+	if *argDockerConfigTemplate != "" {
+		// validateParams already checked the template
+		c.dockerConfigTemplate, _ = loadDockerConfigTemplate(*argDockerConfigTemplate)
+	}
+
+	if *argUseInformers {
+		log.Print("Using informer cache for reads")
+		secretNames := []string{*argGCRSecretName, *argAWSSecretName, *argACRSecretName, *argDockerHubSecretName, *argGHCRSecretName, *argCombinedSecretName}
+		if *argSplitSecretFormats {
+			for _, name := range secretNames {
+				secretNames = append(secretNames, legacySecretName(name))
+			}
+		}
+		c.cache = newInformerCache(kubeClient, secretNames)
+		if err := c.cache.run(wait.NeverStop); err != nil {
+			log.Fatalf("Failed to start the informer cache: %v", err)
+		}
+	}
+
+	if *argPrune {
+		report, err := c.prune()
+		if err != nil {
+			log.Fatalf("Failed to prune secrets: %v", err)
+		}
+		if err := report.write(os.Stdout); err != nil {
+			log.Fatalf("Failed to write prune report: %v", err)
+		}
+		log.Printf("Pruned %d secrets, exiting", len(report.Removed))
+		return
+	}
+
+	if *argDriftReport != "" {
+		c.drift = &driftReport{}
+		if err := c.process(); err != nil {
+			log.Fatalf("Failed to check credentials: %v", err)
+		}
+		if err := c.drift.write(*argDriftReport); err != nil {
+			log.Fatalf("Failed to write drift report: %v", err)
+		}
+		log.Printf("Wrote drift report to %s, exiting", *argDriftReport)
+		return
+	}
+
+	if *argOnce {
+		err := c.process()
+		c.writeStatusLine(err, time.Time{})
+		if err != nil {
+			log.Fatalf("Failed to refresh credentials: %v", err)
+		}
+		log.Print("Refreshed credentials once, exiting")
+		return
+	}
+
+	if *argAdminTokenFile != "" {
+		token, err := readTokenFile(*argAdminTokenFile)
+		if err != nil {
+			log.Fatalf("Failed to read admin token: %v", err)
+		}
+		c.adminToken = token
+	}
+	go c.serveHealth(fmt.Sprintf(":%d", *argHealthPort))
+	if *argMetricsPort != 0 {
+		go serveMetrics(fmt.Sprintf(":%d", *argMetricsPort))
+	}
+
+	if *argSchedule != "" {
+		// validateParams already checked the expression
+		c.cronSchedule, _ = parseSchedule(*argSchedule)
+		log.Printf("Refreshing on schedule: %s", *argSchedule)
+	}
+
+	c.trigger = make(chan struct{}, 1)
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			select {
+			case c.trigger <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	if *argReactToPullFailures {
+		c.pullFailures = make(chan string)
+		go c.watchPullFailures(wait.NeverStop)
+	}
+	if *argWatchNamespaces {
+		c.namespacesAdded = make(chan string)
+		go c.watchNamespaces(wait.NeverStop)
+	}
+
+	if len(*argWatchCredentialFiles) > 0 {
+		go c.watchCredentialFiles(newCredentialFileWatcher(*argWatchCredentialFiles), c.reloadEcrClient, wait.NeverStop)
+	}
+
+	if err := c.run(wait.NeverStop); err != nil {
+		log.Fatalf("Failed to start: %v", err)
+	}
+}
+
+// run refreshes credentials on startup, then whenever the next namespace is
+// due. It returns an error only when the startup refresh fails and
+// --require-healthy-providers-at-startup is set.
+func (c *controller) run(stopCh <-chan struct{}) error {
+	if *argNamespacesPerCycle > 0 && c.cursor == nil {
+		c.cursor = &namespaceCursor{size: *argNamespacesPerCycle}
+	}
+	if c.schedule == nil && c.cronSchedule == nil && c.cursor == nil {
+		c.schedule = &refreshSchedule{}
+	}
+
+	if *argStartupProbeGrace > 0 {
+		c.health.setAwaitingStartup(true)
+	}
+	if delay := startupDelay(); delay > 0 {
+		log.Printf("Waiting %v before the first refresh", delay)
+		select {
+		case <-c.after(delay):
+		case <-stopCh:
+			return nil
+		}
+	}
+
+	// The first refresh only covers every namespace without these
+	if *argPopulateNewProviders && (*argSkipInitialReconcile || c.cursor != nil) {
+		if err := c.populateNewProviders(); err != nil {
+			log.Printf("Failed to populate newly enabled providers: %v", err)
+		}
+	}
+
+	// With nothing scheduled yet, the first wait is a full refresh interval
+	if *argSkipInitialReconcile {
+		log.Print("Skipping initial refresh")
+	} else {
+		err := c.process()
+		if err != nil && *argRequireHealthyStartup {
+			c.writeStatusLine(err, time.Time{})
+			return fmt.Errorf("providers failed to refresh at startup: %v", err)
+		}
+		c.writeStatusLine(err, c.nextRun(c.now()))
+		if *argStartupProbeGrace > 0 {
+			if err := c.awaitHealthyStartup(stopCh, err); err != nil {
+				return err
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-c.after(c.nextRun(c.now()).Sub(c.now())):
+			if !quietProgress() {
+				log.Print("Refreshing credentials...")
+			}
+		case <-c.trigger:
+			log.Print("Refresh triggered, refreshing credentials in every namespace...")
+			c.refreshEveryNamespaceNext()
+		case namespace := <-c.pullFailures:
+			log.Printf("Refreshing credentials in namespace %s after an image pull failure...", namespace)
+			c.schedule.refreshNow(namespace)
+		case namespace := <-c.namespacesAdded:
+			log.Printf("Refreshing credentials in new namespace %s...", namespace)
+			c.schedule.refreshNow(namespace)
+		case <-stopCh:
+			return nil
+		}
+
+		// process() already counted the failure in the metrics and provider
+		// health, the next refresh tries again
+		err := c.process()
+		if err != nil {
+			log.Printf("Failed to refresh credentials: %v", err)
+		}
+		c.writeStatusLine(err, c.nextRun(c.now()))
+	}
+}
+
+// refreshEveryNamespaceNext makes the next process() refresh every namespace,
+// whether or not it's due
+func (c *controller) refreshEveryNamespaceNext() {
+	if c.schedule != nil {
+		c.schedule.nextRun = nil
+	}
+	if c.cursor != nil {
+		c.cursor.all = true
+	}
+}
+
+// nextRun returns when run() should next refresh: the next cron activation
+// with --schedule, one interval from now with --namespaces-per-cycle,
+// otherwise when the next namespace is due
+func (c *controller) nextRun(now time.Time) time.Time {
+	if c.cronSchedule != nil {
+		return c.cronSchedule.Next(now)
+	}
+	if c.schedule == nil {
+		return now.Add(globalRefreshInterval())
+	}
+	return c.schedule.next(now)
 }
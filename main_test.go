@@ -1,9 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ecr"
@@ -11,7 +13,13 @@ import (
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/api/v1"
 	"k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/fields"
+	"k8s.io/kubernetes/pkg/labels"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/util/clock"
 	"k8s.io/kubernetes/pkg/watch"
 )
 
@@ -19,6 +27,37 @@ type fakeKubeClient struct {
 	secrets         map[string]*fakeSecrets
 	namespaces      *fakeNamespaces
 	serviceaccounts map[string]*fakeServiceAccounts
+	configmaps      map[string]*fakeConfigMaps
+	events          chan *api.Event
+	nodes           *fakeNodes
+}
+
+type fakeNodes struct {
+	items []api.Node
+}
+
+func (f *fakeKubeClient) Nodes() unversioned.NodeInterface {
+	if f.nodes == nil {
+		f.nodes = &fakeNodes{}
+	}
+	return f.nodes
+}
+
+func (f *fakeNodes) List(opts api.ListOptions) (*api.NodeList, error) {
+	return &api.NodeList{Items: f.items}, nil
+}
+func (f *fakeNodes) Get(name string) (*api.Node, error)                  { return nil, nil }
+func (f *fakeNodes) Create(node *api.Node) (*api.Node, error)            { return nil, nil }
+func (f *fakeNodes) Delete(name string) error                            { return nil }
+func (f *fakeNodes) Update(node *api.Node) (*api.Node, error)            { return nil, nil }
+func (f *fakeNodes) UpdateStatus(node *api.Node) (*api.Node, error)      { return nil, nil }
+func (f *fakeNodes) Watch(opts api.ListOptions) (watch.Interface, error) { return nil, nil }
+func (f *fakeNodes) DeleteCollection(options *api.DeleteOptions, listOptions api.ListOptions) error {
+	return nil
+}
+
+type fakeConfigMaps struct {
+	store map[string]*api.ConfigMap
 }
 
 type fakeSecrets struct {
@@ -27,12 +66,23 @@ type fakeSecrets struct {
 
 type fakeServiceAccounts struct {
 	store map[string]*api.ServiceAccount
+	// settings holds fields the vendored API types don't know about, keyed by service account name
+	settings map[string]serviceAccountSettings
+	// patches and patchTypes hold the body and type of every patch sent, in order
+	patches    [][]byte
+	patchTypes []api.PatchType
 }
 
 type fakeNamespaces struct {
 	store map[string]api.Namespace
 }
 
+// fakeEvents passes created events to the test through the client's channel
+type fakeEvents struct {
+	namespace string
+	created   chan *api.Event
+}
+
 func (f *fakeKubeClient) Secrets(namespace string) unversioned.SecretsInterface {
 	return f.secrets[namespace]
 }
@@ -45,6 +95,85 @@ func (f *fakeKubeClient) ServiceAccounts(namespace string) unversioned.ServiceAc
 	return f.serviceaccounts[namespace]
 }
 
+func (f *fakeKubeClient) Events(namespace string) unversioned.EventInterface {
+	return &fakeEvents{namespace: namespace, created: f.events}
+}
+
+func (f *fakeKubeClient) ConfigMaps(namespace string) unversioned.ConfigMapsInterface {
+	if f.configmaps == nil {
+		f.configmaps = map[string]*fakeConfigMaps{}
+	}
+	if _, ok := f.configmaps[namespace]; !ok {
+		f.configmaps[namespace] = &fakeConfigMaps{store: map[string]*api.ConfigMap{}}
+	}
+	return f.configmaps[namespace]
+}
+
+func (f *fakeConfigMaps) Get(name string) (*api.ConfigMap, error) {
+	configMap, ok := f.store[name]
+	if !ok {
+		return nil, errors.NewNotFound(api.Resource("configmaps"), name)
+	}
+	return configMap, nil
+}
+
+func (f *fakeConfigMaps) Create(configMap *api.ConfigMap) (*api.ConfigMap, error) {
+	f.store[configMap.Name] = configMap
+	return configMap, nil
+}
+
+func (f *fakeConfigMaps) List(opts api.ListOptions) (*api.ConfigMapList, error) { return nil, nil }
+func (f *fakeConfigMaps) Delete(name string) error                              { return nil }
+func (f *fakeConfigMaps) Update(configMap *api.ConfigMap) (*api.ConfigMap, error) {
+	return configMap, nil
+}
+func (f *fakeConfigMaps) Watch(opts api.ListOptions) (watch.Interface, error) { return nil, nil }
+
+func (f *fakeKubeClient) PatchServiceAccount(namespace, name string, pt api.PatchType, data []byte) ([]byte, error) {
+	serviceAccounts, ok := f.serviceaccounts[namespace]
+	if !ok {
+		return nil, fmt.Errorf("Namespace: %v not found", namespace)
+	}
+
+	serviceAccount, err := serviceAccounts.Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceAccounts.patches = append(serviceAccounts.patches, data)
+	serviceAccounts.patchTypes = append(serviceAccounts.patchTypes, pt)
+
+	var patch struct {
+		ImagePullSecrets []v1.LocalObjectReference `json:"imagePullSecrets"`
+		serviceAccountSettings
+	}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, err
+	}
+	// Like the API server, a patch that sets a field the vendored types don't know overwrites it
+	if patch.AutomountServiceAccountToken != nil {
+		if serviceAccounts.settings == nil {
+			serviceAccounts.settings = map[string]serviceAccountSettings{}
+		}
+		serviceAccounts.settings[name] = patch.serviceAccountSettings
+	}
+	serviceAccount.ImagePullSecrets = nil
+	for _, imagePullSecret := range patch.ImagePullSecrets {
+		serviceAccount.ImagePullSecrets = append(serviceAccount.ImagePullSecrets, api.LocalObjectReference{Name: imagePullSecret.Name})
+	}
+
+	metadata := serviceAccount.ObjectMeta
+	metadata.Namespace = namespace
+
+	return json.Marshal(map[string]interface{}{
+		"apiVersion":                   "v1",
+		"kind":                         "ServiceAccount",
+		"metadata":                     metadata,
+		"imagePullSecrets":             patch.ImagePullSecrets,
+		"automountServiceAccountToken": serviceAccounts.settings[name].AutomountServiceAccountToken,
+	})
+}
+
 func (f *fakeSecrets) Create(secret *api.Secret) (*api.Secret, error) {
 	_, ok := f.store[secret.Name]
 
@@ -77,22 +206,44 @@ func (f *fakeSecrets) Get(name string) (*api.Secret, error) {
 	return secret, nil
 }
 
-func (f *fakeSecrets) Delete(name string) error                            { return nil }
-func (f *fakeSecrets) List(opts api.ListOptions) (*api.SecretList, error)  { return nil, nil }
+func (f *fakeSecrets) Delete(name string) error {
+	_, ok := f.store[name]
+
+	if !ok {
+		return fmt.Errorf("Secret: %v not found", name)
+	}
+
+	delete(f.store, name)
+	return nil
+}
+
+func (f *fakeSecrets) List(opts api.ListOptions) (*api.SecretList, error) {
+	secrets := []api.Secret{}
+
+	for _, v := range f.store {
+		if opts.LabelSelector != nil && !opts.LabelSelector.Matches(labels.Set(v.Labels)) {
+			continue
+		}
+		secrets = append(secrets, *v)
+	}
+
+	return &api.SecretList{Items: secrets}, nil
+}
+
 func (f *fakeSecrets) Watch(opts api.ListOptions) (watch.Interface, error) { return nil, nil }
 
 func (f *fakeServiceAccounts) Get(name string) (*api.ServiceAccount, error) {
 	serviceAccount, ok := f.store[name]
 
 	if !ok {
-		return nil, fmt.Errorf("Failed to find service account: %v", name)
+		return nil, errors.NewNotFound(api.Resource("serviceaccounts"), name)
 	}
 
 	return serviceAccount, nil
 }
 
 func (f *fakeServiceAccounts) Update(serviceAccount *api.ServiceAccount) (*api.ServiceAccount, error) {
-	serviceAccount, ok := f.store[serviceAccount.Name]
+	_, ok := f.store[serviceAccount.Name]
 
 	if !ok {
 		return nil, fmt.Errorf("Service account: %v not found", serviceAccount.Name)
@@ -117,7 +268,16 @@ func (f *fakeServiceAccounts) Create(serviceAccount *api.ServiceAccount) (*api.S
 	return nil, nil
 }
 func (f *fakeServiceAccounts) List(opts api.ListOptions) (*api.ServiceAccountList, error) {
-	return nil, nil
+	serviceAccounts := []api.ServiceAccount{}
+
+	for _, v := range f.store {
+		if opts.LabelSelector != nil && !opts.LabelSelector.Matches(labels.Set(v.Labels)) {
+			continue
+		}
+		serviceAccounts = append(serviceAccounts, *v)
+	}
+
+	return &api.ServiceAccountList{Items: serviceAccounts}, nil
 }
 func (f *fakeServiceAccounts) Watch(opts api.ListOptions) (watch.Interface, error) { return nil, nil }
 
@@ -125,20 +285,52 @@ func (f *fakeNamespaces) List(opts api.ListOptions) (*api.NamespaceList, error)
 	namespaces := []api.Namespace{}
 
 	for _, v := range f.store {
+		if opts.LabelSelector != nil && !opts.LabelSelector.Matches(labels.Set(v.Labels)) {
+			continue
+		}
 		namespaces = append(namespaces, v)
 	}
 
 	return &api.NamespaceList{Items: namespaces}, nil
 }
 
+func (f *fakeNamespaces) Get(name string) (*api.Namespace, error) {
+	namespace, ok := f.store[name]
+	if !ok {
+		return nil, errors.NewNotFound(api.Resource("namespaces"), name)
+	}
+	return &namespace, nil
+}
+
 func (f *fakeNamespaces) Create(item *api.Namespace) (*api.Namespace, error)   { return nil, nil }
-func (f *fakeNamespaces) Get(name string) (result *api.Namespace, err error)   { return nil, nil }
 func (f *fakeNamespaces) Delete(name string) error                             { return nil }
 func (f *fakeNamespaces) Update(item *api.Namespace) (*api.Namespace, error)   { return nil, nil }
 func (f *fakeNamespaces) Watch(opts api.ListOptions) (watch.Interface, error)  { return nil, nil }
 func (f *fakeNamespaces) Finalize(item *api.Namespace) (*api.Namespace, error) { return nil, nil }
 func (f *fakeNamespaces) Status(item *api.Namespace) (*api.Namespace, error)   { return nil, nil }
 
+func (f *fakeEvents) Create(event *api.Event) (*api.Event, error) {
+	if event.Namespace != f.namespace {
+		return nil, fmt.Errorf("can't create an event with namespace '%v' in namespace '%v'", event.Namespace, f.namespace)
+	}
+	f.created <- event
+	return event, nil
+}
+
+func (f *fakeEvents) Update(event *api.Event) (*api.Event, error)             { return event, nil }
+func (f *fakeEvents) Patch(event *api.Event, data []byte) (*api.Event, error) { return event, nil }
+func (f *fakeEvents) List(opts api.ListOptions) (*api.EventList, error)       { return nil, nil }
+func (f *fakeEvents) Get(name string) (*api.Event, error)                     { return nil, nil }
+func (f *fakeEvents) Watch(opts api.ListOptions) (watch.Interface, error)     { return nil, nil }
+func (f *fakeEvents) Search(objOrRef runtime.Object) (*api.EventList, error)  { return nil, nil }
+func (f *fakeEvents) Delete(name string) error                                { return nil }
+func (f *fakeEvents) DeleteCollection(options *api.DeleteOptions, listOptions api.ListOptions) error {
+	return nil
+}
+func (f *fakeEvents) GetFieldSelector(involvedObjectName, involvedObjectNamespace, involvedObjectKind, involvedObjectUID *string) fields.Selector {
+	return nil
+}
+
 type fakeEcrClient struct{}
 
 func (f *fakeEcrClient) GetAuthorizationToken(input *ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error) {
@@ -170,8 +362,18 @@ func (f *fakeGcrClient) DefaultTokenSource(ctx context.Context, scope ...string)
 	return newFakeTokenSource(), nil
 }
 
+// staticGcrClient hands out a fixed token, e.g. an empty or expired one
+type staticGcrClient struct {
+	token *oauth2.Token
+}
+
+func (f *staticGcrClient) DefaultTokenSource(ctx context.Context, scope ...string) (oauth2.TokenSource, error) {
+	return oauth2.StaticTokenSource(f.token), nil
+}
+
 func newFakeKubeClient() *fakeKubeClient {
 	return &fakeKubeClient{
+		events: make(chan *api.Event, 100),
 		secrets: map[string]*fakeSecrets{
 			"namespace1": &fakeSecrets{
 				store: map[string]*api.Secret{},
@@ -240,25 +442,58 @@ func newFakeGcrClient() *fakeGcrClient {
 	return &fakeGcrClient{}
 }
 
-func TestgetECRAuthorizationKey(t *testing.T) {
+func TestGetECRAuthorizationKey(t *testing.T) {
 	kubeClient := newFakeKubeClient()
 	ecrClient := newFakeEcrClient()
 	gcrClient := newFakeGcrClient()
-	c := &controller{kubeClient, ecrClient, gcrClient}
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: gcrClient}
 
 	token, err := c.getECRAuthorizationKey()
 
-	assert.Equal(t, "fakeToken", token.AccessToken)
+	assert.Equal(t, "fakeToken", string(token.AccessToken))
 	assert.Equal(t, "fakeEndpoint", token.Endpoint)
 	assert.Nil(t, err)
 }
 
+func TestGetGCRAuthorizationKey(t *testing.T) {
+	*argGCRURL = "fakeEndpoint"
+	c := &controller{kubeClient: newFakeKubeClient(), ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	token, err := c.getGCRAuthorizationKey()
+	assert.Nil(t, err)
+	assert.Equal(t, "fakeToken", string(token.AccessToken))
+	assert.Equal(t, "fakeEndpoint", token.Endpoint)
+}
+
+func TestGetGCRAuthorizationKeyUnusableToken(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	// The fake clock skips the backoff of the failing refresh's token retries
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), clock: clock.NewFakeClock(time.Now())}
+
+	c.gcrClient = &staticGcrClient{token: &oauth2.Token{AccessToken: ""}}
+	_, err := c.getGCRAuthorizationKey()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "empty access token")
+
+	c.gcrClient = &staticGcrClient{token: &oauth2.Token{AccessToken: "fakeToken", Expiry: time.Now().Add(-time.Minute)}}
+	_, err = c.getGCRAuthorizationKey()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "expired")
+
+	// The refresh fails instead of writing a useless GCR secret
+	c.gcrClient = &staticGcrClient{token: &oauth2.Token{AccessToken: ""}}
+	err = c.process()
+	assert.NotNil(t, err)
+	_, err = kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.NotNil(t, err)
+}
+
 func TestProcessOnce(t *testing.T) {
 	kubeClient := newFakeKubeClient()
 	ecrClient := newFakeEcrClient()
 	*argGCRURL = "fakeEndpoint"
 	gcrClient := newFakeGcrClient()
-	c := &controller{kubeClient, ecrClient, gcrClient}
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: gcrClient}
 
 	err := c.process()
 	assert.Nil(t, err)
@@ -268,7 +503,7 @@ func TestProcessOnce(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, *argGCRSecretName, secret.Name)
 	assert.Equal(t, map[string][]byte{
-		".dockercfg": []byte(fmt.Sprintf(dockerCfgTemplate, "fakeEndpoint", "fakeToken")),
+		".dockercfg": []byte(fmt.Sprintf(dockerCfgTemplate, "fakeEndpoint", gcrUsername, "fakeToken")),
 	}, secret.Data)
 	assert.Equal(t, api.SecretType("kubernetes.io/dockercfg"), secret.Type)
 
@@ -276,7 +511,7 @@ func TestProcessOnce(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, *argGCRSecretName, secret.Name)
 	assert.Equal(t, map[string][]byte{
-		".dockercfg": []byte(fmt.Sprintf(dockerCfgTemplate, "fakeEndpoint", "fakeToken")),
+		".dockercfg": []byte(fmt.Sprintf(dockerCfgTemplate, "fakeEndpoint", gcrUsername, "fakeToken")),
 	}, secret.Data)
 	assert.Equal(t, api.SecretType("kubernetes.io/dockercfg"), secret.Type)
 
@@ -328,7 +563,7 @@ func TestProcessTwice(t *testing.T) {
 	ecrClient := newFakeEcrClient()
 	*argGCRURL = "fakeEndpoint"
 	gcrClient := newFakeGcrClient()
-	c := &controller{kubeClient, ecrClient, gcrClient}
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: gcrClient}
 	err := c.process()
 	assert.Nil(t, err)
 	// test processing twice for idempotency
@@ -340,7 +575,7 @@ func TestProcessTwice(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, *argGCRSecretName, secret.Name)
 	assert.Equal(t, map[string][]byte{
-		".dockercfg": []byte(fmt.Sprintf(dockerCfgTemplate, "fakeEndpoint", "fakeToken")),
+		".dockercfg": []byte(fmt.Sprintf(dockerCfgTemplate, "fakeEndpoint", gcrUsername, "fakeToken")),
 	}, secret.Data)
 	assert.Equal(t, api.SecretType("kubernetes.io/dockercfg"), secret.Type)
 
@@ -348,7 +583,7 @@ func TestProcessTwice(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, *argGCRSecretName, secret.Name)
 	assert.Equal(t, map[string][]byte{
-		".dockercfg": []byte(fmt.Sprintf(dockerCfgTemplate, "fakeEndpoint", "fakeToken")),
+		".dockercfg": []byte(fmt.Sprintf(dockerCfgTemplate, "fakeEndpoint", gcrUsername, "fakeToken")),
 	}, secret.Data)
 	assert.Equal(t, api.SecretType("kubernetes.io/dockercfg"), secret.Type)
 
@@ -399,7 +634,7 @@ func TestProcessWithExistingSecrets(t *testing.T) {
 	ecrClient := newFakeEcrClient()
 	*argGCRURL = "fakeEndpoint"
 	gcrClient := newFakeGcrClient()
-	c := &controller{kubeClient, ecrClient, gcrClient}
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: gcrClient}
 
 	secretGCR := &api.Secret{
 		ObjectMeta: api.ObjectMeta{
@@ -439,7 +674,7 @@ func TestProcessWithExistingSecrets(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, *argGCRSecretName, secretGCR.Name)
 	assert.Equal(t, map[string][]byte{
-		".dockercfg": []byte(fmt.Sprintf(dockerCfgTemplate, "fakeEndpoint", "fakeToken")),
+		".dockercfg": []byte(fmt.Sprintf(dockerCfgTemplate, "fakeEndpoint", gcrUsername, "fakeToken")),
 	}, secretGCR.Data)
 	assert.Equal(t, secretGCR.Type, api.SecretType("kubernetes.io/dockercfg"))
 
@@ -447,7 +682,7 @@ func TestProcessWithExistingSecrets(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, *argGCRSecretName, secretGCR.Name)
 	assert.Equal(t, map[string][]byte{
-		".dockercfg": []byte(fmt.Sprintf(dockerCfgTemplate, "fakeEndpoint", "fakeToken")),
+		".dockercfg": []byte(fmt.Sprintf(dockerCfgTemplate, "fakeEndpoint", gcrUsername, "fakeToken")),
 	}, secretGCR.Data)
 	assert.Equal(t, api.SecretType("kubernetes.io/dockercfg"), secretGCR.Type)
 
@@ -455,7 +690,7 @@ func TestProcessWithExistingSecrets(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, *argGCRSecretName, secretGCR.Name)
 	assert.Equal(t, map[string][]byte{
-		".dockercfg": []byte(fmt.Sprintf(dockerCfgTemplate, "fakeEndpoint", "fakeToken")),
+		".dockercfg": []byte(fmt.Sprintf(dockerCfgTemplate, "fakeEndpoint", gcrUsername, "fakeToken")),
 	}, secretGCR.Data)
 	assert.Equal(t, secretGCR.Type, api.SecretType("kubernetes.io/dockercfg"))
 
@@ -463,7 +698,7 @@ func TestProcessWithExistingSecrets(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, *argGCRSecretName, secretGCR.Name)
 	assert.Equal(t, map[string][]byte{
-		".dockercfg": []byte(fmt.Sprintf(dockerCfgTemplate, "fakeEndpoint", "fakeToken")),
+		".dockercfg": []byte(fmt.Sprintf(dockerCfgTemplate, "fakeEndpoint", gcrUsername, "fakeToken")),
 	}, secretGCR.Data)
 	assert.Equal(t, api.SecretType("kubernetes.io/dockercfg"), secretGCR.Type)
 
@@ -505,22 +740,26 @@ func TestProcessNoDefaultServiceAccount(t *testing.T) {
 	kubeClient := newFakeKubeClient()
 	ecrClient := newFakeEcrClient()
 	gcrClient := newFakeGcrClient()
-	c := &controller{kubeClient, ecrClient, gcrClient}
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: gcrClient}
 
 	err := c.kubeClient.ServiceAccounts("namespace1").Delete("default")
 	assert.Nil(t, err)
 	err = c.kubeClient.ServiceAccounts("namespace2").Delete("default")
 	assert.Nil(t, err)
 
+	// A missing service account is skipped, the secrets are still written
 	err = c.process()
-	assert.NotNil(t, err)
+	assert.Nil(t, err)
+
+	_, err = c.kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
 }
 
 func TestProcessWithExistingImagePullSecrets(t *testing.T) {
 	kubeClient := newFakeKubeClient()
 	ecrClient := newFakeEcrClient()
 	gcrClient := newFakeGcrClient()
-	c := &controller{kubeClient, ecrClient, gcrClient}
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: gcrClient}
 
 	serviceAccount, err := c.kubeClient.ServiceAccounts("namespace1").Get("default")
 	assert.Nil(t, err)
@@ -562,3 +801,226 @@ func TestAwsRegionFromEnv(t *testing.T) {
 
 	assert.Equal(t, expectedRegion, *argAWSRegion)
 }
+
+func TestValidateRegistryURL(t *testing.T) {
+	assert.Nil(t, validateRegistryURL("https://gcr.io"))
+	assert.Nil(t, validateRegistryURL("registry.internal:5000"))
+	assert.Nil(t, validateRegistryURL("https://registry.internal:5000"))
+
+	assert.NotNil(t, validateRegistryURL(""))
+	assert.NotNil(t, validateRegistryURL("https://:5000"))
+	assert.NotNil(t, validateRegistryURL("registry.internal:0"))
+	assert.NotNil(t, validateRegistryURL("registry.internal:99999"))
+	assert.NotNil(t, validateRegistryURL("registry.internal:port"))
+}
+
+func TestProcessRegistryWithPort(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	ecrClient := newFakeEcrClient()
+	*argGCRURL = "registry.internal:5000"
+	gcrClient := newFakeGcrClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: gcrClient}
+
+	*argCombineSecrets = combineSecretsDual
+	defer func() { *argCombineSecrets = combineSecretsOff }()
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	secret, err := c.kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"registry.internal:5000":{"username":"oauth2accesstoken","password":"fakeToken","email":"none"}}`, string(secret.Data[".dockercfg"]))
+
+	secret, err = c.kubeClient.Secrets("namespace1").Get(*argCombinedSecretName)
+	assert.Nil(t, err)
+	var config dockerConfigJSON
+	assert.Nil(t, json.Unmarshal(secret.Data[".dockerconfigjson"], &config))
+	_, ok := config.Auths["registry.internal:5000"]
+	assert.True(t, ok)
+}
+
+// schemeEcrClient returns the proxy endpoint with a scheme, as ECR does
+type schemeEcrClient struct{}
+
+func (s *schemeEcrClient) GetAuthorizationToken(input *ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error) {
+	return &ecr.GetAuthorizationTokenOutput{
+		AuthorizationData: []*ecr.AuthorizationData{
+			&ecr.AuthorizationData{
+				AuthorizationToken: aws.String("fakeToken"),
+				ProxyEndpoint:      aws.String("https://123456789012.dkr.ecr.us-east-1.amazonaws.com"),
+			},
+		},
+	}, nil
+}
+
+func TestProcessStripsEndpointScheme(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	*argGCRURL = "https://gcr.io"
+	defer func() { *argGCRURL = "fakeEndpoint" }()
+	c := &controller{kubeClient: kubeClient, ecrClient: &schemeEcrClient{}, gcrClient: newFakeGcrClient()}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	secret, err := c.kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"auths":{"123456789012.dkr.ecr.us-east-1.amazonaws.com":{"auth":"fakeToken","email":"none"}}}`, string(secret.Data[".dockerconfigjson"]))
+
+	secret, err = c.kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"gcr.io":{"username":"oauth2accesstoken","password":"fakeToken","email":"none"}}`, string(secret.Data[".dockercfg"]))
+}
+
+func TestRegistryHost(t *testing.T) {
+	assert.Equal(t, "gcr.io", registryHost("https://gcr.io"))
+	assert.Equal(t, "gcr.io", registryHost("https://gcr.io/"))
+	assert.Equal(t, "registry.internal:5000", registryHost("registry.internal:5000"))
+	assert.Equal(t, "http://registry.internal", registryHost("http://registry.internal"))
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("CLUSTER", "prod")
+	defer os.Unsetenv("CLUSTER")
+
+	expanded, err := expandEnv("${CLUSTER}-ecr")
+	assert.Nil(t, err)
+	assert.Equal(t, "prod-ecr", expanded)
+
+	expanded, err = expandEnv("awsecr-cred")
+	assert.Nil(t, err)
+	assert.Equal(t, "awsecr-cred", expanded)
+
+	_, err = expandEnv("${CLUSTER}-${MISSING_VAR}")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "MISSING_VAR")
+}
+
+func TestSecretNameFromEnv(t *testing.T) {
+	os.Setenv("CLUSTER", "prod")
+	defer os.Unsetenv("CLUSTER")
+
+	defaultName := *argAWSSecretName
+	*argAWSSecretName = "${CLUSTER}-ecr"
+	defer func() { *argAWSSecretName = defaultName }()
+
+	for _, secretName := range []*string{argACRSecretName, argDockerHubSecretName, argGHCRSecretName} {
+		defer func(secretName *string, name string) { *secretName = name }(secretName, *secretName)
+	}
+	*argACRSecretName = "${CLUSTER}-acr"
+	*argDockerHubSecretName = "${CLUSTER}-dockerhub"
+	*argGHCRSecretName = "${CLUSTER}-ghcr"
+
+	validateParams()
+
+	assert.Equal(t, "prod-ecr", *argAWSSecretName)
+	assert.Equal(t, "prod-acr", *argACRSecretName)
+	assert.Equal(t, "prod-dockerhub", *argDockerHubSecretName)
+	assert.Equal(t, "prod-ghcr", *argGHCRSecretName)
+}
+
+// racingSecrets fails creates with AlreadyExists and updates with Conflict
+// until races is used up, as if another writer kept getting in first
+type racingSecrets struct {
+	*fakeSecrets
+	races int
+}
+
+func (r *racingSecrets) Create(secret *api.Secret) (*api.Secret, error) {
+	if r.races > 0 {
+		r.races--
+		r.fakeSecrets.store[secret.Name] = &api.Secret{ObjectMeta: api.ObjectMeta{Name: secret.Name}}
+		return nil, errors.NewAlreadyExists(api.Resource("secrets"), secret.Name)
+	}
+	return r.fakeSecrets.Create(secret)
+}
+
+func (r *racingSecrets) Update(secret *api.Secret) (*api.Secret, error) {
+	if r.races > 0 {
+		r.races--
+		delete(r.fakeSecrets.store, secret.Name)
+		return nil, errors.NewConflict(api.Resource("secrets"), secret.Name, fmt.Errorf("the object has been modified"))
+	}
+	return r.fakeSecrets.Update(secret)
+}
+
+type racingKubeClient struct {
+	*fakeKubeClient
+	secrets *racingSecrets
+}
+
+func (r *racingKubeClient) Secrets(namespace string) unversioned.SecretsInterface {
+	return r.secrets
+}
+
+func TestEnsureSecretRetriesRaces(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	kubeClient := &racingKubeClient{
+		fakeKubeClient: newFakeKubeClient(),
+		secrets:        &racingSecrets{fakeSecrets: &fakeSecrets{store: map[string]*api.Secret{}}, races: 3},
+	}
+	c := &controller{kubeClient: kubeClient, clock: fakeClock}
+	start := fakeClock.Now()
+
+	// Create hits AlreadyExists, the update hits Conflict, the next create
+	// hits AlreadyExists again and the final update goes through
+	newSecret := generateSecretObj("fakeToken", "fakeEndpoint", true, "secretName")
+	err := c.ensureSecret("namespace1", newSecret)
+	assert.Nil(t, err)
+
+	secret, err := kubeClient.Secrets("namespace1").Get("secretName")
+	assert.Nil(t, err)
+	assert.Equal(t, newSecret.Data, secret.Data)
+	assert.Equal(t, (100+200+400)*time.Millisecond, fakeClock.Since(start))
+}
+
+func TestEnsureSecretGivesUpAfterRetries(t *testing.T) {
+	*argSecretWriteRetries = 1
+	defer func() { *argSecretWriteRetries = 3 }()
+
+	kubeClient := &racingKubeClient{
+		fakeKubeClient: newFakeKubeClient(),
+		secrets:        &racingSecrets{fakeSecrets: &fakeSecrets{store: map[string]*api.Secret{}}, races: 3},
+	}
+	c := &controller{kubeClient: kubeClient, clock: clock.NewFakeClock(time.Now())}
+
+	err := c.ensureSecret("namespace1", generateSecretObj("fakeToken", "fakeEndpoint", true, "secretName"))
+	assert.True(t, errors.IsConflict(err))
+}
+
+// blockingEcrClient reports each token fetch on entered and waits for release
+type blockingEcrClient struct {
+	fakeEcrClient
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingEcrClient) GetAuthorizationToken(input *ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error) {
+	b.entered <- struct{}{}
+	<-b.release
+	return b.fakeEcrClient.GetAuthorizationToken(input)
+}
+
+func TestProcessRunsDoNotOverlap(t *testing.T) {
+	ecrClient := &blockingEcrClient{entered: make(chan struct{}), release: make(chan struct{})}
+	c := &controller{kubeClient: newFakeKubeClient(), ecrClient: ecrClient, gcrClient: newFakeGcrClient()}
+
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { done <- c.process() }()
+	}
+
+	// One run reaches the token fetch, the other waits for it to finish
+	<-ecrClient.entered
+	select {
+	case <-ecrClient.entered:
+		t.Fatal("a second process() run started while the first was in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ecrClient.release <- struct{}{}
+	assert.Nil(t, <-done)
+
+	<-ecrClient.entered
+	ecrClient.release <- struct{}{}
+	assert.Nil(t, <-done)
+}
@@ -0,0 +1,245 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/labels"
+)
+
+const (
+	managedByLabel     = "app.kubernetes.io/managed-by"
+	managedByValue     = "registry-creds"
+	providerAnnotation = "registry-creds.io/provider"
+	instanceLabel      = "registry-creds.io/instance"
+
+	// lastRefreshedAnnotation records when the controller last wrote a secret
+	lastRefreshedAnnotation = "registry-creds.io/last-refreshed"
+
+	// combinedProvider is the provider annotation of the combined secret
+	combinedProvider = "combined"
+)
+
+// markManaged labels a generated secret as owned by this controller and
+// records which provider it holds credentials for
+func markManaged(secret *api.Secret, provider string) {
+	if secret.Labels == nil {
+		secret.Labels = map[string]string{}
+	}
+	secret.Labels[managedByLabel] = managedByValue
+	if *argInstanceID != "" {
+		secret.Labels[instanceLabel] = *argInstanceID
+	}
+
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Annotations[providerAnnotation] = provider
+}
+
+// stampRefreshed returns a copy of a secret annotated with the time it's
+// written at. The generated secret is left as is, since it's shared between
+// namespaces.
+func stampRefreshed(secret *api.Secret, now time.Time) *api.Secret {
+	stamped := *secret
+	stamped.Annotations = copyStringMap(secret.Annotations)
+	if stamped.Annotations == nil {
+		stamped.Annotations = map[string]string{}
+	}
+	stamped.Annotations[lastRefreshedAnnotation] = now.UTC().Format(time.RFC3339)
+	return &stamped
+}
+
+// ownedByOtherInstance reports whether a secret is managed by another
+// registry-creds controller, one with a different --instance-id. Secrets
+// without the instance label belong to a controller without an instance ID.
+func ownedByOtherInstance(secret *api.Secret) bool {
+	if secret.Labels[managedByLabel] != managedByValue {
+		return false
+	}
+	return secret.Labels[instanceLabel] != *argInstanceID
+}
+
+// adoptsSecret reports whether a managed secret this instance is about to
+// write was left by a controller without an --instance-id, typically this one
+// before the flag was set. Such a secret is taken over on write rather than
+// treated as another instance's, so setting the flag doesn't fail upgrades.
+func adoptsSecret(secret *api.Secret) bool {
+	return *argInstanceID != "" && secret.Labels[managedByLabel] == managedByValue && secret.Labels[instanceLabel] == ""
+}
+
+// disabledProviders returns the providers without credentials configured
+func disabledProviders() map[string]bool {
+	disabled := map[string]bool{}
+	if len(awsAccountID) == 0 {
+		disabled[providerAWS] = true
+	}
+	if !*argEnableGCR {
+		disabled[providerGCR] = true
+	}
+	if !acrEnabled() {
+		disabled[providerACR] = true
+	}
+	if !dockerHubEnabled() {
+		disabled[providerDockerHub] = true
+	}
+	if !ghcrEnabled() {
+		disabled[providerGHCR] = true
+	}
+	return disabled
+}
+
+// onlyProviders parses --only-providers, checking every listed provider is
+// known and enabled. Nil means every enabled provider runs.
+func onlyProviders(names []string, disabled map[string]bool) (map[string]bool, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	only := map[string]bool{}
+	for _, name := range names {
+		if !knownProvider(name) {
+			return nil, fmt.Errorf("unknown provider %q, must be one of: %s", name, strings.Join(knownProviders, ", "))
+		}
+		if disabled[name] {
+			return nil, fmt.Errorf("provider %q is not enabled", name)
+		}
+		only[name] = true
+	}
+	return only, nil
+}
+
+// newProviders returns the enabled providers without a single managed secret
+// in any namespace, i.e. the ones enabled since the controller last ran
+func (c *controller) newProviders() (map[string]bool, error) {
+	namespaces, err := c.listNamespaces()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	selector := labels.SelectorFromSet(labels.Set{managedByLabel: managedByValue})
+	for _, namespace := range namespaces {
+		secrets, err := c.kubeClient.Secrets(namespace.GetName()).List(api.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return nil, err
+		}
+		for _, secret := range secrets.Items {
+			if !ownedByOtherInstance(&secret) {
+				seen[secret.Annotations[providerAnnotation]] = true
+			}
+		}
+	}
+
+	found := map[string]bool{}
+	for _, provider := range knownProviders {
+		if !c.disabledProviders[provider] && !seen[provider] {
+			found[provider] = true
+		}
+	}
+	return found, nil
+}
+
+// cleanupDisabledProviders removes managed secrets whose provider has since
+// been disabled, along with their service account references
+func (c *controller) cleanupDisabledProviders() error {
+	namespaces, err := c.listNamespaces()
+	if err != nil {
+		return err
+	}
+
+	selector := labels.SelectorFromSet(labels.Set{managedByLabel: managedByValue})
+	for _, namespace := range namespaces {
+
+		if namespaceExcluded(namespace.GetName()) {
+			continue
+		}
+
+		secrets, err := c.kubeClient.Secrets(namespace.GetName()).List(api.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return err
+		}
+
+		for _, secret := range secrets.Items {
+			// Another controller's secrets are its own to clean up
+			if ownedByOtherInstance(&secret) {
+				continue
+			}
+
+			provider := secret.Annotations[providerAnnotation]
+			if !c.disabledProviders[provider] {
+				continue
+			}
+
+			if err := c.removeSecret(namespace.GetName(), secret.Name); err != nil {
+				return err
+			}
+			log.Printf("Removed secret %s/%s of disabled provider %s", namespace.GetName(), secret.Name, provider)
+		}
+	}
+
+	return nil
+}
+
+// removeSecret deletes a secret and drops its reference from the service accounts
+func (c *controller) removeSecret(namespace, name string) error {
+	if err := c.kubeClient.Secrets(namespace).Delete(name); err != nil {
+		return err
+	}
+
+	serviceAccounts, err := c.targetServiceAccounts(namespace)
+	if err != nil {
+		return err
+	}
+
+	removeReference := func(imagePullSecrets []api.LocalObjectReference) []api.LocalObjectReference {
+		kept := []api.LocalObjectReference{}
+		for _, imagePullSecret := range imagePullSecrets {
+			if imagePullSecret.Name != name {
+				kept = append(kept, imagePullSecret)
+			}
+		}
+		return kept
+	}
+
+	for _, serviceAccount := range serviceAccounts {
+		// Nothing to write if the service account never referenced it
+		if !referencesSecret(serviceAccount, name) {
+			continue
+		}
+
+		serviceAccount, err = c.editServiceAccountPullSecrets(namespace, serviceAccount, removeReference)
+		if err != nil {
+			return err
+		}
+		c.recordWrite(serviceAccount)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util/clock"
+)
+
+func TestProcessMarksSecretsManaged(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	ecrClient := newFakeEcrClient()
+	gcrClient := newFakeGcrClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: gcrClient}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	secret, err := c.kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, managedByValue, secret.Labels[managedByLabel])
+	assert.Equal(t, providerGCR, secret.Annotations[providerAnnotation])
+
+	secret, err = c.kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, managedByValue, secret.Labels[managedByLabel])
+	assert.Equal(t, providerAWS, secret.Annotations[providerAnnotation])
+}
+
+func TestProcessStampsLastRefreshed(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	secret, err := c.kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, "2016-10-01T00:00:00Z", secret.Annotations[lastRefreshedAnnotation])
+
+	// An unchanged secret isn't rewritten just to move the stamp
+	fakeClock.Step(time.Hour)
+	err = c.process()
+	assert.Nil(t, err)
+	secret, err = c.kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, "2016-10-01T00:00:00Z", secret.Annotations[lastRefreshedAnnotation])
+
+	// A secret written before it was labelled gets the label on the next update
+	secret.Labels = nil
+	secret.Annotations = nil
+	fakeClock.Step(time.Hour)
+	err = c.process()
+	assert.Nil(t, err)
+	secret, err = c.kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, managedByValue, secret.Labels[managedByLabel])
+	assert.Equal(t, providerGCR, secret.Annotations[providerAnnotation])
+	assert.Equal(t, "2016-10-01T02:00:00Z", secret.Annotations[lastRefreshedAnnotation])
+}
+
+func TestProcessStripsDisabledProvider(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	ecrClient := newFakeEcrClient()
+	gcrClient := newFakeGcrClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: gcrClient}
+
+	*argStripDisabledProviders = true
+	defer func() { *argStripDisabledProviders = false }()
+
+	// Secrets this controller does not manage must survive
+	_, err := c.kubeClient.Secrets("namespace1").Create(&api.Secret{
+		ObjectMeta: api.ObjectMeta{Name: "someOtherSecret"},
+	})
+	assert.Nil(t, err)
+
+	err = c.process()
+	assert.Nil(t, err)
+
+	// Toggle GCR off
+	c.disabledProviders = map[string]bool{providerGCR: true}
+	err = c.process()
+	assert.Nil(t, err)
+
+	for _, namespace := range []string{"namespace1", "namespace2"} {
+		_, err = c.kubeClient.Secrets(namespace).Get(*argGCRSecretName)
+		assert.NotNil(t, err)
+		_, err = c.kubeClient.Secrets(namespace).Get(*argAWSSecretName)
+		assert.Nil(t, err)
+
+		serviceAccount, err := c.kubeClient.ServiceAccounts(namespace).Get("default")
+		assert.Nil(t, err)
+		assert.Equal(t, []api.LocalObjectReference{{Name: *argAWSSecretName}}, serviceAccount.ImagePullSecrets)
+	}
+
+	_, err = c.kubeClient.Secrets("namespace1").Get("someOtherSecret")
+	assert.Nil(t, err)
+}
+
+func TestProcessKeepsDisabledProviderWithoutStrip(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	ecrClient := newFakeEcrClient()
+	gcrClient := newFakeGcrClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: gcrClient}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	c.disabledProviders = map[string]bool{providerGCR: true}
+	err = c.process()
+	assert.Nil(t, err)
+
+	_, err = c.kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+}
+
+func TestOnlyProviders(t *testing.T) {
+	only, err := onlyProviders(nil, map[string]bool{})
+	assert.Nil(t, err)
+	assert.Nil(t, only)
+
+	only, err = onlyProviders([]string{providerAWS}, map[string]bool{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{providerAWS: true}, only)
+
+	_, err = onlyProviders([]string{"quay"}, map[string]bool{})
+	assert.NotNil(t, err)
+
+	_, err = onlyProviders([]string{providerAWS}, map[string]bool{providerAWS: true})
+	assert.NotNil(t, err)
+}
+
+func TestProcessOnlyProviders(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+	c.onlyProviders = map[string]bool{providerAWS: true}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	_, err = c.kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	_, err = c.kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.NotNil(t, err)
+
+	serviceAccount, err := c.kubeClient.ServiceAccounts("namespace1").Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, []api.LocalObjectReference{{Name: *argAWSSecretName}}, serviceAccount.ImagePullSecrets)
+}
+
+func TestInstancesDontInterfere(t *testing.T) {
+	*argStripDisabledProviders = true
+	defer func() { *argStripDisabledProviders = false }()
+	defer func() { *argInstanceID = "" }()
+
+	kubeClient := newFakeKubeClient()
+	// Instance a only manages AWS, instance b only GCR
+	a := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient(), disabledProviders: map[string]bool{providerGCR: true}}
+	b := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient(), disabledProviders: map[string]bool{providerAWS: true}}
+
+	*argInstanceID = "a"
+	assert.Nil(t, a.process())
+	*argInstanceID = "b"
+	assert.Nil(t, b.process())
+
+	// Each refresh again, with the other's secrets in place, cleans up nothing
+	*argInstanceID = "a"
+	assert.Nil(t, a.process())
+	*argInstanceID = "b"
+	assert.Nil(t, b.process())
+
+	secret, err := kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, "a", secret.Labels[instanceLabel])
+	secret, err = kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, "b", secret.Labels[instanceLabel])
+
+	// Instance b doesn't take over instance a's secret either
+	b.disabledProviders = map[string]bool{}
+	err = b.process()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), `managed by registry-creds instance "a"`)
+	secret, err = kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, "a", secret.Labels[instanceLabel])
+}
+
+func TestInstanceIDAdoptsUnlabelledSecrets(t *testing.T) {
+	defer func() { *argInstanceID = "" }()
+
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	// A deployment without an instance ID is upgraded to one
+	assert.Nil(t, c.process())
+	secret, err := kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, "", secret.Labels[instanceLabel])
+
+	*argInstanceID = "a"
+	assert.Nil(t, c.process())
+
+	for _, name := range []string{*argAWSSecretName, *argGCRSecretName} {
+		secret, err = kubeClient.Secrets("namespace1").Get(name)
+		assert.Nil(t, err)
+		assert.Equal(t, "a", secret.Labels[instanceLabel])
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"encoding/json"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+// mergeExistingAuths returns a copy of a generated secret whose
+// .dockerconfigjson also keeps the auths entries of the existing secret for
+// hosts the generated secret doesn't have, such as a registry a team added by
+// hand. The generated entries win for every host they cover.
+func mergeExistingAuths(existing, generated *api.Secret) (*api.Secret, error) {
+	existingConfig, ok := existing.Data[api.DockerConfigJsonKey]
+	if !ok {
+		return generated, nil
+	}
+	generatedConfig, ok := generated.Data[api.DockerConfigJsonKey]
+	if !ok {
+		return generated, nil
+	}
+
+	var existingAuths struct {
+		Auths map[string]json.RawMessage `json:"auths"`
+	}
+	if err := json.Unmarshal(existingConfig, &existingAuths); err != nil {
+		return nil, err
+	}
+
+	// Other top level keys of the generated config, e.g. from
+	// --dockerconfig-template, are kept as they are
+	config := map[string]json.RawMessage{}
+	if err := json.Unmarshal(generatedConfig, &config); err != nil {
+		return nil, err
+	}
+	auths := map[string]json.RawMessage{}
+	if raw, ok := config["auths"]; ok {
+		if err := json.Unmarshal(raw, &auths); err != nil {
+			return nil, err
+		}
+	}
+
+	kept := false
+	for host, entry := range existingAuths.Auths {
+		if _, ok := auths[host]; !ok {
+			auths[host] = entry
+			kept = true
+		}
+	}
+	if !kept {
+		return generated, nil
+	}
+
+	rawAuths, err := json.Marshal(auths)
+	if err != nil {
+		return nil, err
+	}
+	config["auths"] = rawAuths
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := *generated
+	merged.Data = map[string][]byte{}
+	for key, value := range generated.Data {
+		merged.Data[key] = value
+	}
+	merged.Data[api.DockerConfigJsonKey] = data
+	return &merged, nil
+}
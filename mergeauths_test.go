@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+func TestProcessMergeExistingAuths(t *testing.T) {
+	*argMergeExistingAuths = true
+	defer func() { *argMergeExistingAuths = false }()
+
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	// A stale token for the managed host, and a registry added by hand
+	existing := &api.Secret{
+		ObjectMeta: api.ObjectMeta{Name: *argAWSSecretName, Namespace: "namespace1"},
+		Data: map[string][]byte{
+			".dockerconfigjson": []byte(`{"auths":{"fakeEndpoint":{"auth":"c3RhbGU6dG9rZW4=","email":"none"},"private.example.com":{"auth":"bWU6c2VjcmV0","email":"team@example.com"}}}`),
+		},
+		Type: "kubernetes.io/dockerconfigjson",
+	}
+	kubeClient.secrets["namespace1"].store[*argAWSSecretName] = existing
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	secret, err := kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	var config dockerConfigJSON
+	assert.Nil(t, json.Unmarshal(secret.Data[".dockerconfigjson"], &config))
+	assert.Equal(t, 2, len(config.Auths))
+	assert.Equal(t, "fakeToken", config.Auths["fakeEndpoint"].Auth)
+	assert.Equal(t, dockerConfigEntry{Auth: "bWU6c2VjcmV0", Email: "team@example.com"}, config.Auths["private.example.com"])
+
+	// Namespaces without the secret just get the managed entry
+	secret, err = kubeClient.Secrets("namespace2").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, generateSecretObj("fakeToken", "fakeEndpoint", true, *argAWSSecretName).Data, secret.Data)
+}
+
+func TestMergeExistingAuthsUnchanged(t *testing.T) {
+	generated := generateSecretObj("fakeToken", "fakeEndpoint", true, "secret")
+	existing := generateSecretObj("staleToken", "fakeEndpoint", true, "secret")
+
+	// Nothing to keep, so the generated secret is used as it is
+	merged, err := mergeExistingAuths(existing, generated)
+	assert.Nil(t, err)
+	assert.Equal(t, generated, merged)
+}
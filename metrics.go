@@ -0,0 +1,101 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+var (
+	processCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "registry_creds_process_total",
+		Help: "Number of refreshes run",
+	})
+	processErrorsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "registry_creds_process_errors_total",
+		Help: "Number of refreshes that failed for at least one provider or namespace",
+	})
+	lastSuccessGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "registry_creds_last_success_timestamp",
+		Help: "Unix time of the last refresh that succeeded",
+	})
+	tokenRequestsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "registry_creds_token_requests_total",
+		Help: "Number of token requests per provider, by result (success or error)",
+	}, []string{"provider", "result"})
+	secretsUpdatedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "registry_creds_secrets_updated_total",
+		Help: "Number of secrets created or updated, per provider",
+	}, []string{"provider"})
+)
+
+func init() {
+	prometheus.MustRegister(processCounter)
+	prometheus.MustRegister(processErrorsCounter)
+	prometheus.MustRegister(lastSuccessGauge)
+	prometheus.MustRegister(tokenRequestsCounter)
+	prometheus.MustRegister(secretsUpdatedCounter)
+}
+
+// recordProcess counts a finished process(), and its time when it succeeded
+func recordProcess(err error, now time.Time) {
+	processCounter.Inc()
+	if err != nil {
+		processErrorsCounter.Inc()
+		return
+	}
+	lastSuccessGauge.Set(float64(now.Unix()))
+}
+
+// recordTokenRequest counts a provider's token request by its result
+func recordTokenRequest(provider string, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	tokenRequestsCounter.WithLabelValues(provider, result).Inc()
+}
+
+// recordSecretUpdated counts a created or updated secret under the provider it was written for
+func recordSecretUpdated(secret *api.Secret) {
+	secretsUpdatedCounter.WithLabelValues(secret.Annotations[providerAnnotation]).Inc()
+}
+
+// serveMetrics serves /metrics on its own port when --metrics-port is set,
+// instead of on --health-port
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", prometheus.Handler())
+
+	log.Printf("Serving metrics on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("Metrics server failed: %v", err)
+	}
+}
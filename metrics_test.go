@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/util/clock"
+)
+
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	assert.Nil(t, counter.Write(m))
+	return m.GetCounter().GetValue()
+}
+
+func TestProcessRecordsMetrics(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	ecrClient := &flakyEcrClient{}
+	c := &controller{kubeClient: newFakeKubeClient(), ecrClient: ecrClient, gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	processes := counterValue(t, processCounter)
+	failures := counterValue(t, processErrorsCounter)
+	ecrSuccesses := counterValue(t, tokenRequestsCounter.WithLabelValues(providerAWS, "success"))
+	ecrErrors := counterValue(t, tokenRequestsCounter.WithLabelValues(providerAWS, "error"))
+	awsUpdates := counterValue(t, secretsUpdatedCounter.WithLabelValues(providerAWS))
+
+	assert.Nil(t, c.process())
+	assert.Equal(t, processes+1, counterValue(t, processCounter))
+	assert.Equal(t, failures, counterValue(t, processErrorsCounter))
+	assert.Equal(t, ecrSuccesses+1, counterValue(t, tokenRequestsCounter.WithLabelValues(providerAWS, "success")))
+	// A secret in each of namespace1 and namespace2
+	assert.Equal(t, awsUpdates+2, counterValue(t, secretsUpdatedCounter.WithLabelValues(providerAWS)))
+	assert.Equal(t, float64(fakeClock.Now().Unix()), gaugeValue(t, lastSuccessGauge))
+
+	// A failed refresh keeps the last success time, every retry is counted
+	succeeded := fakeClock.Now()
+	fakeClock.Step(time.Hour)
+	ecrClient.err = errors.New("AccessDeniedException")
+	assert.NotNil(t, c.process())
+	assert.Equal(t, processes+2, counterValue(t, processCounter))
+	assert.Equal(t, failures+1, counterValue(t, processErrorsCounter))
+	assert.Equal(t, ecrErrors+float64(tokenAttempts()), counterValue(t, tokenRequestsCounter.WithLabelValues(providerAWS, "error")))
+	assert.Equal(t, float64(succeeded.Unix()), gaugeValue(t, lastSuccessGauge))
+}
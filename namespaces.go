@@ -0,0 +1,417 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/labels"
+)
+
+// Reasons a namespace is skipped, the reason label of namespacesSkippedCounter
+const (
+	skipReasonExcluded          = "excluded"
+	skipReasonSelectorMismatch  = "selector-mismatch"
+	skipReasonNotOptedIn        = "not-opted-in"
+	skipReasonOptOutAnnotation  = "opt-out-annotation"
+	skipReasonNotFound          = "not-found"
+	skipReasonDeleted           = "deleted"
+	skipReasonBlocked           = "blocked"
+	skipReasonUnknownAWSAccount = "unknown-aws-account"
+	skipReasonTerminating       = "terminating"
+	skipReasonMissingSA         = "missing-sa"
+)
+
+// namespacesSkippedCounter counts, by reason, each time a refresh leaves a
+// namespace out, to explain namespaces that aren't getting credentials
+var namespacesSkippedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "registry_creds_namespaces_skipped_total",
+	Help: "Number of times a namespace was skipped, by reason",
+}, []string{"reason"})
+
+func init() {
+	prometheus.MustRegister(namespacesSkippedCounter)
+}
+
+func recordNamespaceSkipped(reason string) {
+	namespacesSkippedCounter.WithLabelValues(reason).Inc()
+}
+
+// recordNamespaceSkippedOnce counts a skip at most once per namespace and
+// reason in a refresh, for skips every provider's pass would otherwise count
+// again
+func (c *controller) recordNamespaceSkippedOnce(namespace, reason string) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	key := reason + "/" + namespace
+	if c.cycle.skipped[key] {
+		return
+	}
+	if c.cycle.skipped == nil {
+		c.cycle.skipped = map[string]bool{}
+	}
+	c.cycle.skipped[key] = true
+	recordNamespaceSkipped(reason)
+}
+
+// filterTerminatingNamespaces drops namespaces being deleted, the API server
+// refuses to create anything in them
+func (c *controller) filterTerminatingNamespaces(namespaces []api.Namespace) []api.Namespace {
+	active := []api.Namespace{}
+	for _, namespace := range namespaces {
+		if namespace.Status.Phase == api.NamespaceTerminating {
+			c.recordNamespaceSkippedOnce(namespace.GetName(), skipReasonTerminating)
+			continue
+		}
+		active = append(active, namespace)
+	}
+	return active
+}
+
+// parseOwnerAnnotation splits --owner-annotation into its key and value
+func parseOwnerAnnotation(ownerAnnotation string) (string, string, error) {
+	parts := strings.SplitN(ownerAnnotation, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("%q must be key=value", ownerAnnotation)
+	}
+	return parts[0], parts[1], nil
+}
+
+// namespaceExcluded reports whether --excluded-namespaces lists the namespace,
+// which then never gets a secret or has its service accounts changed
+func namespaceExcluded(namespace string) bool {
+	for _, excluded := range *argExcludedNamespaces {
+		if excluded == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// namespaceSelector returns --namespace-selector, matching every namespace when it isn't set
+func namespaceSelector() labels.Selector {
+	// validateParams already checked the selector
+	selector, err := labels.Parse(*argNamespaceSelector)
+	if err != nil {
+		return labels.Everything()
+	}
+	return selector
+}
+
+// filterSelectedNamespaces keeps the namespaces matching --namespace-selector.
+// Listing from the API server already applies it, but namespaces from the
+// informer cache, --namespaces or a ConfigMap are filtered here.
+func filterSelectedNamespaces(namespaces []api.Namespace) []api.Namespace {
+	if *argNamespaceSelector == "" {
+		return namespaces
+	}
+
+	selector := namespaceSelector()
+	selected := []api.Namespace{}
+	for _, namespace := range namespaces {
+		if selector.Matches(labels.Set(namespace.Labels)) {
+			selected = append(selected, namespace)
+		} else {
+			recordNamespaceSkipped(skipReasonSelectorMismatch)
+		}
+	}
+	return selected
+}
+
+// enabledAnnotation set to "true" opts a namespace in with --require-annotation
+const enabledAnnotation = "registry-creds.io/enabled"
+
+// shortAnnotationPrefix is the prefix without the .io the enabled and
+// providers namespace annotations are also accepted under, e.g.
+// registry-creds/providers. The controller's own keys all use registry-creds.io/.
+const shortAnnotationPrefix = "registry-creds/"
+
+// namespaceAnnotation returns a registry-creds.io/ namespace annotation, or
+// else the same key under shortAnnotationPrefix
+func namespaceAnnotation(namespace api.Namespace, key string) (string, bool) {
+	if value, ok := namespace.Annotations[key]; ok {
+		return value, true
+	}
+	value, ok := namespace.Annotations[shortAnnotationPrefix+strings.TrimPrefix(key, "registry-creds.io/")]
+	return value, ok
+}
+
+// filterOptedInNamespaces keeps the namespaces carrying enabledAnnotation when
+// --require-annotation is set, or all of them when it isn't
+func filterOptedInNamespaces(namespaces []api.Namespace) []api.Namespace {
+	if !*argRequireAnnotation {
+		return namespaces
+	}
+
+	optedIn := []api.Namespace{}
+	for _, namespace := range namespaces {
+		if enabled, _ := namespaceAnnotation(namespace, enabledAnnotation); enabled == "true" {
+			optedIn = append(optedIn, namespace)
+		} else {
+			recordNamespaceSkipped(skipReasonNotOptedIn)
+		}
+	}
+	if skipped := len(namespaces) - len(optedIn); skipped > 0 && !quietProgress() {
+		log.Printf("Skipping %d namespaces without the %s=true annotation", skipped, enabledAnnotation)
+	}
+	return optedIn
+}
+
+// filterOwnedNamespaces keeps the namespaces carrying --owner-annotation, or
+// all of them when it isn't set. Other exclusions, such as
+// --excluded-namespaces, still apply to the namespaces it keeps.
+func filterOwnedNamespaces(namespaces []api.Namespace) ([]api.Namespace, error) {
+	if *argOwnerAnnotation == "" {
+		return namespaces, nil
+	}
+
+	key, value, err := parseOwnerAnnotation(*argOwnerAnnotation)
+	if err != nil {
+		return nil, err
+	}
+
+	owned := []api.Namespace{}
+	for _, namespace := range namespaces {
+		if annotation, ok := namespace.Annotations[key]; ok && annotation == value {
+			owned = append(owned, namespace)
+		} else {
+			recordNamespaceSkipped(skipReasonSelectorMismatch)
+		}
+	}
+	return owned, nil
+}
+
+// skipProvidersAnnotation lists, comma separated, the providers whose secrets
+// a namespace doesn't want, e.g. registry-creds.io/skip-providers: gcr
+const skipProvidersAnnotation = "registry-creds.io/skip-providers"
+
+// providersAnnotation lists, comma separated, the only providers whose secrets
+// a namespace wants, e.g. registry-creds.io/providers: ecr,gcr. Without it the
+// namespace gets every provider's secret. It's also accepted as
+// registry-creds/providers.
+const providersAnnotation = "registry-creds.io/providers"
+
+// namespacesForProvider drops the namespaces that skip the provider with
+// skipProvidersAnnotation, or leave it out of providersAnnotation
+func namespacesForProvider(namespaces []api.Namespace, provider string) []api.Namespace {
+	kept := []api.Namespace{}
+	for _, namespace := range namespaces {
+		if skipsProvider(namespace, provider) {
+			recordNamespaceSkipped(skipReasonOptOutAnnotation)
+			continue
+		}
+		kept = append(kept, namespace)
+	}
+	return kept
+}
+
+func skipsProvider(namespace api.Namespace, provider string) bool {
+	if listsProvider(namespace.Annotations[skipProvidersAnnotation], provider) {
+		return true
+	}
+	wanted, ok := namespaceAnnotation(namespace, providersAnnotation)
+	return ok && strings.TrimSpace(wanted) != "" && !listsProvider(wanted, provider)
+}
+
+// listsProvider reports whether a comma separated annotation value names the
+// provider. AWS can also be named ecr, after its registry.
+func listsProvider(value, provider string) bool {
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == provider || (name == "ecr" && provider == providerAWS) {
+			return true
+		}
+	}
+	return false
+}
+
+// namespacesConfigMapKey is the key of the --namespaces-from-configmap
+// ConfigMap listing the namespaces, separated by commas or whitespace
+const namespacesConfigMapKey = "namespaces"
+
+// parseConfigMapRef splits a namespace/name ConfigMap reference
+func parseConfigMapRef(ref string) (string, string, error) {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("%q must be namespace/name", ref)
+	}
+	return parts[0], parts[1], nil
+}
+
+// namespacesFromConfigMap reads the namespaces listed in the
+// --namespaces-from-configmap ConfigMap
+func (c *controller) namespacesFromConfigMap() ([]string, error) {
+	namespace, name, err := parseConfigMapRef(*argNamespacesFromConfigMap)
+	if err != nil {
+		return nil, err
+	}
+
+	configMap, err := c.kubeClient.ConfigMaps(namespace).Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("reading namespaces from ConfigMap %s: %v", *argNamespacesFromConfigMap, err)
+	}
+	value, ok := configMap.Data[namespacesConfigMapKey]
+	if !ok {
+		return nil, fmt.Errorf("ConfigMap %s has no %q key", *argNamespacesFromConfigMap, namespacesConfigMapKey)
+	}
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	}), nil
+}
+
+// getListedNamespaces gets each namespace in --namespaces, or in the
+// --namespaces-from-configmap ConfigMap read again on every refresh, instead
+// of listing all of them, so the controller doesn't need permission to list
+// namespaces. A listed namespace that doesn't exist is skipped with a warning.
+func (c *controller) getListedNamespaces() ([]api.Namespace, error) {
+	names := *argNamespaces
+	source := "--namespaces"
+	if *argNamespacesFromConfigMap != "" {
+		var err error
+		if names, err = c.namespacesFromConfigMap(); err != nil {
+			return nil, err
+		}
+		source = "ConfigMap " + *argNamespacesFromConfigMap
+	}
+
+	namespaces := []api.Namespace{}
+	for _, name := range names {
+		namespace, err := c.kubeClient.Namespaces().Get(name)
+		if errors.IsNotFound(err) {
+			log.Printf("Namespace %s in %s doesn't exist, skipping", name, source)
+			recordNamespaceSkipped(skipReasonNotFound)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		namespaces = append(namespaces, *namespace)
+	}
+	return namespaces, nil
+}
+
+// namespaceGone reports whether err is a NotFound caused by the namespace
+// having been deleted since it was listed. A NotFound for a namespace that
+// still exists, such as a missing service account, is a real error, as is
+// one the controller isn't allowed to check.
+func (c *controller) namespaceGone(namespace string, err error) bool {
+	if !errors.IsNotFound(err) {
+		return false
+	}
+	_, getErr := c.kubeClient.Namespaces().Get(namespace)
+	return errors.IsNotFound(getErr)
+}
+
+// byPriority orders namespaces by the position of their priority label value
+// in --namespace-priority-order. Namespaces without the label, or with a value
+// that isn't listed, come after all the others.
+type byPriority struct {
+	namespaces []api.Namespace
+	rank       map[string]int
+}
+
+func (b byPriority) priority(namespace api.Namespace) int {
+	if rank, ok := b.rank[namespace.Labels[*argNamespacePriorityLabel]]; ok {
+		return rank
+	}
+	return len(b.rank)
+}
+
+func (b byPriority) Len() int {
+	return len(b.namespaces)
+}
+
+func (b byPriority) Swap(i, j int) {
+	b.namespaces[i], b.namespaces[j] = b.namespaces[j], b.namespaces[i]
+}
+
+func (b byPriority) Less(i, j int) bool {
+	return b.priority(b.namespaces[i]) < b.priority(b.namespaces[j])
+}
+
+// priorityRanks maps each --namespace-priority-order value to its first position
+func priorityRanks() map[string]int {
+	rank := map[string]int{}
+	for i, value := range *argNamespacePriorityOrder {
+		if _, ok := rank[value]; !ok {
+			rank[value] = i
+		}
+	}
+	return rank
+}
+
+// sortNamespacesByPriority puts high priority namespaces first, so they're
+// refreshed early when every namespace is refreshed at once, e.g. after a
+// provider outage. Namespaces of the same priority keep their order.
+func sortNamespacesByPriority(namespaces []api.Namespace) []api.Namespace {
+	if *argNamespacePriorityLabel == "" {
+		return namespaces
+	}
+
+	sort.Stable(byPriority{namespaces: namespaces, rank: priorityRanks()})
+	return namespaces
+}
+
+// priorityTiers splits namespaces sorted by sortNamespacesByPriority into
+// runs of the same priority, highest first. Without --namespace-priority-label
+// every namespace is in the one tier.
+func priorityTiers(namespaces []api.Namespace) [][]api.Namespace {
+	if *argNamespacePriorityLabel == "" || len(namespaces) == 0 {
+		return [][]api.Namespace{namespaces}
+	}
+
+	b := byPriority{rank: priorityRanks()}
+	tiers := [][]api.Namespace{}
+	start := 0
+	for i := 1; i <= len(namespaces); i++ {
+		if i == len(namespaces) || b.priority(namespaces[i]) != b.priority(namespaces[start]) {
+			tiers = append(tiers, namespaces[start:i])
+			start = i
+		}
+	}
+	return tiers
+}
+
+// namespacesInTier returns the namespaces that are also in tier, in order
+func namespacesInTier(namespaces, tier []api.Namespace) []api.Namespace {
+	inTier := map[string]bool{}
+	for _, namespace := range tier {
+		inTier[namespace.GetName()] = true
+	}
+	selected := []api.Namespace{}
+	for _, namespace := range namespaces {
+		if inTier[namespace.GetName()] {
+			selected = append(selected, namespace)
+		}
+	}
+	return selected
+}
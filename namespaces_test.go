@@ -0,0 +1,501 @@
+package main
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+func TestParseOwnerAnnotation(t *testing.T) {
+	key, value, err := parseOwnerAnnotation("tenancy.example.com/owner=tenant-operator")
+	assert.Nil(t, err)
+	assert.Equal(t, "tenancy.example.com/owner", key)
+	assert.Equal(t, "tenant-operator", value)
+
+	_, _, err = parseOwnerAnnotation("tenancy.example.com/owner")
+	assert.NotNil(t, err)
+	_, _, err = parseOwnerAnnotation("=tenant-operator")
+	assert.NotNil(t, err)
+}
+
+func TestProcessOwnerAnnotation(t *testing.T) {
+	*argOwnerAnnotation = "tenancy.example.com/owner=tenant-operator"
+	defer func() { *argOwnerAnnotation = "" }()
+
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	owned := map[string]string{"tenancy.example.com/owner": "tenant-operator"}
+	kubeClient.namespaces.store["namespace1"] = api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace1", Annotations: owned}}
+	kubeClient.namespaces.store["namespace2"] = api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace2", Annotations: map[string]string{"tenancy.example.com/owner": "someone-else"}}}
+	// Exclusions still apply to owned namespaces
+	kubeClient.namespaces.store["kube-system"] = api.Namespace{ObjectMeta: api.ObjectMeta{Name: "kube-system", Annotations: owned}}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	_, err = c.kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+	_, err = c.kubeClient.Secrets("namespace2").Get(*argGCRSecretName)
+	assert.NotNil(t, err)
+	_, err = c.kubeClient.Secrets("kube-system").Get(*argGCRSecretName)
+	assert.NotNil(t, err)
+}
+
+func TestProcessFailOnZeroNamespaces(t *testing.T) {
+	*argOwnerAnnotation = "tenancy.example.com/owner=tenant-operator"
+	defer func() { *argOwnerAnnotation = "" }()
+
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	// No namespace carries the owner annotation, so nothing is refreshed
+	err := c.process()
+	assert.Nil(t, err)
+
+	*argFailOnZeroNamespaces = true
+	defer func() { *argFailOnZeroNamespaces = false }()
+	err = c.process()
+	assert.NotNil(t, err)
+
+	kubeClient.namespaces.store["namespace1"] = api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace1", Annotations: map[string]string{"tenancy.example.com/owner": "tenant-operator"}}}
+	err = c.process()
+	assert.Nil(t, err)
+}
+
+// orderKubeClient records the order in which namespaces' secrets are first touched
+type orderKubeClient struct {
+	*fakeKubeClient
+	order []string
+}
+
+func (o *orderKubeClient) Secrets(namespace string) unversioned.SecretsInterface {
+	if len(o.order) == 0 || o.order[len(o.order)-1] != namespace {
+		o.order = append(o.order, namespace)
+	}
+	return o.fakeKubeClient.Secrets(namespace)
+}
+
+func TestProcessNamespacePriority(t *testing.T) {
+	*argNamespacePriorityLabel = "priority"
+	defer func() { *argNamespacePriorityLabel = "" }()
+	// Concurrent writes start in priority order but may finish in any
+	defer func(concurrency int) { *argConcurrency = concurrency }(*argConcurrency)
+	*argConcurrency = 1
+
+	fake := newFakeKubeClient()
+	priorities := map[string]string{"ns-a": "", "ns-b": "low", "ns-c": "high", "ns-d": "", "ns-e": "high", "ns-f": "medium"}
+	for name, priority := range priorities {
+		namespace := api.Namespace{ObjectMeta: api.ObjectMeta{Name: name}}
+		if priority != "" {
+			namespace.Labels = map[string]string{"priority": priority}
+		}
+		fake.namespaces.store[name] = namespace
+		fake.secrets[name] = &fakeSecrets{store: map[string]*api.Secret{}}
+		fake.serviceaccounts[name] = &fakeServiceAccounts{store: map[string]*api.ServiceAccount{
+			"default": {ObjectMeta: api.ObjectMeta{Name: "default", Namespace: name}},
+		}}
+	}
+	delete(fake.namespaces.store, "namespace1")
+	delete(fake.namespaces.store, "namespace2")
+
+	kubeClient := &orderKubeClient{fakeKubeClient: fake}
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	// Every provider's secret reaches a priority before the next one gets
+	// any, so no namespace is written after a lower priority one
+	rank := map[string]int{"high": 0, "medium": 1, "low": 2, "": 3}
+	for i := 1; i < len(kubeClient.order); i++ {
+		previous, current := kubeClient.order[i-1], kubeClient.order[i]
+		assert.True(t, rank[priorities[previous]] <= rank[priorities[current]], "%s before %s", previous, current)
+	}
+	for name := range priorities {
+		for _, secretName := range []string{*argAWSSecretName, *argGCRSecretName} {
+			_, ok := fake.secrets[name].store[secretName]
+			assert.True(t, ok, "%s in %s", secretName, name)
+		}
+	}
+}
+
+func TestPriorityTiers(t *testing.T) {
+	namespace := func(name, priority string) api.Namespace {
+		return api.Namespace{ObjectMeta: api.ObjectMeta{Name: name, Labels: map[string]string{"priority": priority}}}
+	}
+	namespaces := []api.Namespace{namespace("a", "high"), namespace("b", "high"), namespace("c", "low"), namespace("d", "")}
+
+	// Without the label every namespace is one tier
+	assert.Equal(t, [][]api.Namespace{namespaces}, priorityTiers(namespaces))
+
+	*argNamespacePriorityLabel = "priority"
+	defer func() { *argNamespacePriorityLabel = "" }()
+	tiers := priorityTiers(namespaces)
+	assert.Equal(t, [][]api.Namespace{namespaces[0:2], namespaces[2:3], namespaces[3:4]}, tiers)
+	assert.Equal(t, []api.Namespace{namespaces[1]}, namespacesInTier([]api.Namespace{namespaces[1], namespaces[2]}, tiers[0]))
+}
+
+func TestSortNamespacesByPriorityDisabled(t *testing.T) {
+	namespaces := []api.Namespace{
+		{ObjectMeta: api.ObjectMeta{Name: "b", Labels: map[string]string{"priority": "low"}}},
+		{ObjectMeta: api.ObjectMeta{Name: "a", Labels: map[string]string{"priority": "high"}}},
+	}
+	sorted := sortNamespacesByPriority(namespaces)
+	assert.Equal(t, "b", sorted[0].Name)
+	assert.Equal(t, "a", sorted[1].Name)
+}
+
+// goneSecrets fails every call the way the API does once the namespace is deleted
+type goneSecrets struct {
+	*fakeSecrets
+	namespace string
+}
+
+func (g *goneSecrets) Get(name string) (*api.Secret, error) {
+	return nil, errors.NewNotFound(api.Resource("secrets"), name)
+}
+
+func (g *goneSecrets) Create(secret *api.Secret) (*api.Secret, error) {
+	return nil, errors.NewNotFound(api.Resource("namespaces"), g.namespace)
+}
+
+type goneNamespaces struct {
+	*fakeNamespaces
+	gone string
+}
+
+func (g *goneNamespaces) Get(name string) (*api.Namespace, error) {
+	if name == g.gone {
+		return nil, errors.NewNotFound(api.Resource("namespaces"), name)
+	}
+	return g.fakeNamespaces.Get(name)
+}
+
+// vanishingKubeClient lists namespace1 but behaves as if it was deleted right after
+type vanishingKubeClient struct {
+	*fakeKubeClient
+}
+
+func (v *vanishingKubeClient) Secrets(namespace string) unversioned.SecretsInterface {
+	if namespace == "namespace1" {
+		return &goneSecrets{fakeSecrets: v.fakeKubeClient.secrets[namespace], namespace: namespace}
+	}
+	return v.fakeKubeClient.Secrets(namespace)
+}
+
+func (v *vanishingKubeClient) Namespaces() unversioned.NamespaceInterface {
+	return &goneNamespaces{fakeNamespaces: v.fakeKubeClient.namespaces, gone: "namespace1"}
+}
+
+func TestProcessSkipsDeletedNamespace(t *testing.T) {
+	kubeClient := &vanishingKubeClient{fakeKubeClient: newFakeKubeClient()}
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	// The other namespaces are still refreshed
+	_, err = kubeClient.Secrets("namespace2").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	_, err = kubeClient.Secrets("namespace2").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+}
+
+func TestNamespaceGone(t *testing.T) {
+	c := &controller{kubeClient: &vanishingKubeClient{fakeKubeClient: newFakeKubeClient()}}
+	notFound := errors.NewNotFound(api.Resource("serviceaccounts"), "default")
+
+	assert.True(t, c.namespaceGone("namespace1", notFound))
+	// A missing service account in a namespace that still exists is a real error
+	assert.False(t, c.namespaceGone("namespace2", notFound))
+	assert.False(t, c.namespaceGone("namespace1", errors.NewBadRequest("bad request")))
+}
+
+func TestProcessListedNamespaces(t *testing.T) {
+	defer func(namespaces []string) { *argNamespaces = namespaces }(*argNamespaces)
+	*argNamespaces = []string{"namespace2", "missing"}
+
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	// A listed namespace that doesn't exist is skipped rather than failing the refresh
+	err := c.process()
+	assert.Nil(t, err)
+
+	_, err = kubeClient.Secrets("namespace2").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	_, err = kubeClient.Secrets("namespace2").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+
+	// Namespaces that aren't listed are left alone
+	_, err = kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.NotNil(t, err)
+	_, err = kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.NotNil(t, err)
+}
+
+func TestProcessNamespacesFromConfigMap(t *testing.T) {
+	defer func(ref string) { *argNamespacesFromConfigMap = ref }(*argNamespacesFromConfigMap)
+	*argNamespacesFromConfigMap = "platform/app-namespaces"
+
+	kubeClient := newFakeKubeClient()
+	kubeClient.ConfigMaps("platform").Create(&api.ConfigMap{
+		ObjectMeta: api.ObjectMeta{Name: "app-namespaces", Namespace: "platform"},
+		Data:       map[string]string{namespacesConfigMapKey: "namespace1\nmissing, "},
+	})
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	// The missing namespace is skipped
+	err := c.process()
+	assert.Nil(t, err)
+	_, err = kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	_, err = kubeClient.Secrets("namespace2").Get(*argAWSSecretName)
+	assert.NotNil(t, err)
+
+	// The ConfigMap is read again on the next refresh
+	kubeClient.configmaps["platform"].store["app-namespaces"].Data[namespacesConfigMapKey] = "namespace1,namespace2"
+	err = c.process()
+	assert.Nil(t, err)
+	_, err = kubeClient.Secrets("namespace2").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+
+	// Without the ConfigMap the refresh fails rather than managing nothing
+	delete(kubeClient.configmaps["platform"].store, "app-namespaces")
+	err = c.process()
+	assert.NotNil(t, err)
+}
+
+func TestProcessSkipProvidersAnnotation(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	kubeClient.namespaces.store["namespace2"] = api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace2", Annotations: map[string]string{skipProvidersAnnotation: "quay, gcr"}}}
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	_, err = c.kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+	_, err = c.kubeClient.Secrets("namespace2").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	_, err = c.kubeClient.Secrets("namespace2").Get(*argGCRSecretName)
+	assert.NotNil(t, err)
+
+	serviceAccount, err := c.kubeClient.ServiceAccounts("namespace2").Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, []api.LocalObjectReference{{Name: *argAWSSecretName}}, serviceAccount.ImagePullSecrets)
+}
+
+func TestProcessProvidersAnnotation(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	kubeClient.namespaces.store["namespace1"] = api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace1", Annotations: map[string]string{providersAnnotation: "ecr"}}}
+	kubeClient.namespaces.store["namespace2"] = api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace2", Annotations: map[string]string{providersAnnotation: "gcr, quay"}}}
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	skipped := skippedCount(t, skipReasonOptOutAnnotation)
+	err := c.process()
+	assert.Nil(t, err)
+	assert.Equal(t, skipped+2, skippedCount(t, skipReasonOptOutAnnotation))
+
+	_, err = c.kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	_, err = c.kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.NotNil(t, err)
+	_, err = c.kubeClient.Secrets("namespace2").Get(*argAWSSecretName)
+	assert.NotNil(t, err)
+	_, err = c.kubeClient.Secrets("namespace2").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+
+	serviceAccount, err := c.kubeClient.ServiceAccounts("namespace1").Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, []api.LocalObjectReference{{Name: *argAWSSecretName}}, serviceAccount.ImagePullSecrets)
+}
+
+func TestSkipsProvider(t *testing.T) {
+	namespace := func(annotations map[string]string) api.Namespace {
+		return api.Namespace{ObjectMeta: api.ObjectMeta{Name: "team-a", Annotations: annotations}}
+	}
+
+	assert.False(t, skipsProvider(namespace(nil), providerGCR))
+	assert.False(t, skipsProvider(namespace(map[string]string{providersAnnotation: " "}), providerGCR))
+	assert.False(t, skipsProvider(namespace(map[string]string{providersAnnotation: "aws,gcr"}), providerGCR))
+	assert.True(t, skipsProvider(namespace(map[string]string{providersAnnotation: "aws"}), providerGCR))
+	assert.False(t, skipsProvider(namespace(map[string]string{providersAnnotation: "ecr"}), providerAWS))
+	assert.True(t, skipsProvider(namespace(map[string]string{"registry-creds/providers": "aws"}), providerGCR))
+
+	// Skipping wins over listing
+	assert.True(t, skipsProvider(namespace(map[string]string{providersAnnotation: "aws,gcr", skipProvidersAnnotation: "gcr"}), providerGCR))
+}
+
+func skippedCount(t *testing.T, reason string) float64 {
+	m := &dto.Metric{}
+	assert.Nil(t, namespacesSkippedCounter.WithLabelValues(reason).Write(m))
+	return m.GetCounter().GetValue()
+}
+
+func TestProcessCountsSkippedNamespaces(t *testing.T) {
+	newController := func(kubeClient kubeInterface) *controller {
+		return &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+	}
+
+	// kube-system is excluded once per refresh, whatever the number of providers
+	skipped := skippedCount(t, skipReasonExcluded)
+	c := newController(newFakeKubeClient())
+	assert.Nil(t, c.process())
+	assert.Equal(t, skipped+1, skippedCount(t, skipReasonExcluded))
+	assert.Nil(t, c.process())
+	assert.Equal(t, skipped+2, skippedCount(t, skipReasonExcluded))
+
+	// Deleted after being listed, once per provider
+	skipped = skippedCount(t, skipReasonDeleted)
+	assert.Nil(t, newController(&vanishingKubeClient{fakeKubeClient: newFakeKubeClient()}).process())
+	assert.Equal(t, skipped+2, skippedCount(t, skipReasonDeleted))
+
+	// Opted out of one provider
+	kubeClient := newFakeKubeClient()
+	kubeClient.namespaces.store["namespace2"] = api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace2", Annotations: map[string]string{skipProvidersAnnotation: "gcr"}}}
+	skipped = skippedCount(t, skipReasonOptOutAnnotation)
+	assert.Nil(t, newController(kubeClient).process())
+	assert.Equal(t, skipped+1, skippedCount(t, skipReasonOptOutAnnotation))
+
+	// Missing the owner annotation
+	func() {
+		*argOwnerAnnotation = "tenancy.example.com/owner=tenant-operator"
+		defer func() { *argOwnerAnnotation = "" }()
+
+		skipped := skippedCount(t, skipReasonSelectorMismatch)
+		assert.Nil(t, newController(newFakeKubeClient()).process())
+		assert.Equal(t, skipped+3, skippedCount(t, skipReasonSelectorMismatch))
+	}()
+
+	// Being deleted: counted once per refresh and given nothing
+	kubeClient = newFakeKubeClient()
+	terminating := kubeClient.namespaces.store["namespace2"]
+	terminating.Status.Phase = api.NamespaceTerminating
+	kubeClient.namespaces.store["namespace2"] = terminating
+	skipped = skippedCount(t, skipReasonTerminating)
+	assert.Nil(t, newController(kubeClient).process())
+	assert.Equal(t, skipped+1, skippedCount(t, skipReasonTerminating))
+	assert.Empty(t, kubeClient.secrets["namespace2"].store)
+	assert.NotEmpty(t, kubeClient.secrets["namespace1"].store)
+
+	// A service account --service-accounts names that doesn't exist, once per
+	// namespace per refresh
+	func() {
+		defer func(serviceAccounts []string) { *argServiceAccounts = serviceAccounts }(*argServiceAccounts)
+		*argServiceAccounts = []string{"default", "missing"}
+
+		skipped := skippedCount(t, skipReasonMissingSA)
+		c := newController(newFakeKubeClient())
+		assert.Nil(t, c.process())
+		assert.Equal(t, skipped+2, skippedCount(t, skipReasonMissingSA))
+		assert.Nil(t, c.process())
+		assert.Equal(t, skipped+4, skippedCount(t, skipReasonMissingSA))
+	}()
+
+	// Listed but not there
+	func() {
+		defer func(namespaces []string) { *argNamespaces = namespaces }(*argNamespaces)
+		*argNamespaces = []string{"namespace2", "missing"}
+
+		skipped := skippedCount(t, skipReasonNotFound)
+		assert.Nil(t, newController(newFakeKubeClient()).process())
+		assert.Equal(t, skipped+1, skippedCount(t, skipReasonNotFound))
+	}()
+}
+
+func TestProcessExcludedNamespaces(t *testing.T) {
+	defer func(excluded []string) { *argExcludedNamespaces = excluded }(*argExcludedNamespaces)
+	*argExcludedNamespaces = []string{"namespace2"}
+
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	skipped := skippedCount(t, skipReasonExcluded)
+	err := c.process()
+	assert.Nil(t, err)
+	assert.Equal(t, skipped+1, skippedCount(t, skipReasonExcluded))
+
+	_, err = c.kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	for _, name := range []string{*argAWSSecretName, *argGCRSecretName} {
+		_, err = c.kubeClient.Secrets("namespace2").Get(name)
+		assert.NotNil(t, err)
+	}
+	serviceAccount, err := c.kubeClient.ServiceAccounts("namespace2").Get("default")
+	assert.Nil(t, err)
+	assert.Empty(t, serviceAccount.ImagePullSecrets)
+
+	// Overriding the list manages kube-system like any other namespace
+	_, err = c.kubeClient.Secrets("kube-system").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+}
+
+func TestProcessNamespaceSelector(t *testing.T) {
+	*argNamespaceSelector = "registry-creds=enabled"
+	defer func() { *argNamespaceSelector = "" }()
+
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	kubeClient.namespaces.store["namespace1"] = api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace1", Labels: map[string]string{"registry-creds": "enabled"}}}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	_, err = c.kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	_, err = c.kubeClient.Secrets("namespace2").Get(*argAWSSecretName)
+	assert.NotNil(t, err)
+
+	// Named namespaces must match too
+	*argNamespaces = []string{"namespace1", "namespace2"}
+	defer func() { *argNamespaces = nil }()
+	namespaces, err := c.listNamespaces()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(namespaces))
+	assert.Equal(t, "namespace1", namespaces[0].Name)
+}
+
+func TestFilterOptedInNamespacesShortPrefix(t *testing.T) {
+	*argRequireAnnotation = true
+	defer func() { *argRequireAnnotation = false }()
+
+	namespaces := []api.Namespace{
+		{ObjectMeta: api.ObjectMeta{Name: "namespace1", Annotations: map[string]string{"registry-creds/enabled": "true"}}},
+		{ObjectMeta: api.ObjectMeta{Name: "namespace2", Annotations: map[string]string{enabledAnnotation: "false", "registry-creds/enabled": "true"}}},
+	}
+
+	// The registry-creds.io/ key wins over the one without .io
+	optedIn := filterOptedInNamespaces(namespaces)
+	assert.Equal(t, 1, len(optedIn))
+	assert.Equal(t, "namespace1", optedIn[0].Name)
+}
+
+func TestProcessRequireAnnotation(t *testing.T) {
+	*argRequireAnnotation = true
+	defer func() { *argRequireAnnotation = false }()
+
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	kubeClient.namespaces.store["namespace1"] = api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace1", Annotations: map[string]string{enabledAnnotation: "true"}}}
+	kubeClient.namespaces.store["namespace2"] = api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace2", Annotations: map[string]string{enabledAnnotation: "false"}}}
+
+	skipped := skippedCount(t, skipReasonNotOptedIn)
+	mismatched := skippedCount(t, skipReasonSelectorMismatch)
+	err := c.process()
+	assert.Nil(t, err)
+	assert.Equal(t, skipped+2, skippedCount(t, skipReasonNotOptedIn))
+	assert.Equal(t, mismatched, skippedCount(t, skipReasonSelectorMismatch))
+
+	_, err = c.kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	_, err = c.kubeClient.Secrets("namespace2").Get(*argAWSSecretName)
+	assert.NotNil(t, err)
+}
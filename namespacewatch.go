@@ -0,0 +1,68 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"log"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/cache"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+// handleNamespaceAdded asks run() to refresh a namespace created since the
+// watch started. Namespaces that existed before come from the informer's
+// initial list and are left to the schedule.
+func (c *controller) handleNamespaceAdded(started time.Time, namespace *api.Namespace) {
+	if namespace.CreationTimestamp.Time.Before(started) {
+		return
+	}
+
+	log.Printf("Namespace %s was created", namespace.Name)
+	c.namespacesAdded <- namespace.Name
+}
+
+// watchNamespaces watches for new namespaces, for --watch-namespaces. The
+// informer lists and watches again whenever the watch closes.
+func (c *controller) watchNamespaces(stopCh <-chan struct{}) {
+	started := c.now()
+	_, controller := cache.NewInformer(&cache.ListWatch{
+		ListFunc: func(options api.ListOptions) (runtime.Object, error) {
+			return c.kubeClient.Namespaces().List(options)
+		},
+		WatchFunc: func(options api.ListOptions) (watch.Interface, error) {
+			return c.kubeClient.Namespaces().Watch(options)
+		},
+	}, &api.Namespace{}, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if namespace, ok := obj.(*api.Namespace); ok {
+				c.handleNamespaceAdded(started, namespace)
+			}
+		},
+	})
+	controller.Run(stopCh)
+}
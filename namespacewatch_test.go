@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+	apiunversioned "k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/util/clock"
+)
+
+func TestRunRefreshesNewNamespace(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient(), clock: fakeClock}
+	c.schedule = &refreshSchedule{}
+	c.namespacesAdded = make(chan string)
+
+	stopCh := make(chan struct{})
+	go c.run(stopCh)
+	waitForTimer(t, fakeClock)
+
+	started := fakeClock.Now()
+	namespace3 := api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace3", CreationTimestamp: apiunversioned.NewTime(started)}}
+	kubeClient.namespaces.store["namespace3"] = namespace3
+	kubeClient.secrets["namespace3"] = &fakeSecrets{store: map[string]*api.Secret{}}
+	kubeClient.serviceaccounts["namespace3"] = &fakeServiceAccounts{store: map[string]*api.ServiceAccount{
+		"default": {ObjectMeta: api.ObjectMeta{Name: "default"}},
+	}}
+	kubeClient.secrets["namespace1"].Delete(*argGCRSecretName)
+
+	// Namespaces from the informer's initial list are left to the schedule
+	namespace1 := kubeClient.namespaces.store["namespace1"]
+	namespace1.CreationTimestamp = apiunversioned.NewTime(started.Add(-time.Hour))
+	c.handleNamespaceAdded(started, &namespace1)
+
+	// Only the new namespace is refreshed. Stopping blocks until the refresh
+	// has finished.
+	c.handleNamespaceAdded(started, &namespace3)
+	stopCh <- struct{}{}
+
+	_, err := kubeClient.Secrets("namespace3").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+	serviceAccount, err := kubeClient.ServiceAccounts("namespace3").Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(serviceAccount.ImagePullSecrets))
+	_, err = kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.NotNil(t, err)
+}
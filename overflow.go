@@ -0,0 +1,123 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"log"
+	"reflect"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+// pullSecretOverflow maps a namespace to the service accounts in it that hit
+// --max-pull-secrets-per-sa during this process()
+type pullSecretOverflow map[string][]string
+
+func (o pullSecretOverflow) add(namespace, serviceAccount string) {
+	for _, name := range o[namespace] {
+		if name == serviceAccount {
+			return
+		}
+	}
+	o[namespace] = append(o[namespace], serviceAccount)
+}
+
+// exceedsPullSecretLimit reports whether one more reference would take the
+// service account over --max-pull-secrets-per-sa. Only per-provider secrets are
+// limited, combined secrets already use a single reference. A service account
+// that was already switched to the combined secret stays on it, rather than
+// flipping back whenever one per-provider reference would fit again.
+func (c *controller) exceedsPullSecretLimit(serviceAccount *api.ServiceAccount) bool {
+	if *argCombineSecrets != combineSecretsOff || *argMaxPullSecretsPerSA <= 0 {
+		return false
+	}
+
+	for _, imagePullSecret := range serviceAccount.ImagePullSecrets {
+		if imagePullSecret.Name == *argCombinedSecretName {
+			return true
+		}
+	}
+	return len(serviceAccount.ImagePullSecrets)+1 > *argMaxPullSecretsPerSA
+}
+
+// processPullSecretOverflow writes the combined secret to the namespaces with
+// service accounts over the limit, and swaps those service accounts'
+// per-provider references for a single reference to it
+func (c *controller) processPullSecretOverflow(combinedAuths map[string]dockerConfigEntry) error {
+	if len(c.pullSecretOverflow) == 0 {
+		return nil
+	}
+
+	newSecret, err := generateCombinedSecretObj(combinedAuths, *argCombinedSecretName)
+	if err != nil {
+		return err
+	}
+	applySecretDataKey(newSecret)
+	markManaged(newSecret, combinedProvider)
+
+	ownSecrets := map[string]bool{*argAWSSecretName: true, *argGCRSecretName: true}
+	if *argSplitSecretFormats {
+		ownSecrets[legacySecretName(*argAWSSecretName)] = true
+		ownSecrets[legacySecretName(*argGCRSecretName)] = true
+	}
+	for namespace, names := range c.pullSecretOverflow {
+		if err := c.ensureSecret(namespace, newSecret); err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			serviceAccount, err := c.getServiceAccount(namespace, name)
+			if err != nil {
+				return err
+			}
+
+			switchOver := func(current []api.LocalObjectReference) []api.LocalObjectReference {
+				imagePullSecrets := []api.LocalObjectReference{}
+				for _, imagePullSecret := range current {
+					if !ownSecrets[imagePullSecret.Name] && imagePullSecret.Name != newSecret.Name {
+						imagePullSecrets = append(imagePullSecrets, imagePullSecret)
+					}
+				}
+				return append(imagePullSecrets, api.LocalObjectReference{Name: newSecret.Name})
+			}
+			imagePullSecrets := switchOver(serviceAccount.ImagePullSecrets)
+
+			// Nothing to write if the service account was already switched over
+			if reflect.DeepEqual(imagePullSecrets, serviceAccount.ImagePullSecrets) {
+				continue
+			}
+			if len(imagePullSecrets) > *argMaxPullSecretsPerSA {
+				log.Printf("Service account %s/%s still has %d image pull secrets, more than %d", namespace, name, len(imagePullSecrets), *argMaxPullSecretsPerSA)
+			}
+
+			serviceAccount, err = c.editServiceAccountPullSecrets(namespace, serviceAccount, switchOver)
+			if err != nil {
+				return err
+			}
+			c.recordWrite(serviceAccount)
+		}
+	}
+	return nil
+}
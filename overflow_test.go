@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+func pullSecretNames(t *testing.T, c *controller, namespace string) []string {
+	serviceAccount, err := c.kubeClient.ServiceAccounts(namespace).Get("default")
+	assert.Nil(t, err)
+
+	names := []string{}
+	for _, imagePullSecret := range serviceAccount.ImagePullSecrets {
+		names = append(names, imagePullSecret.Name)
+	}
+	return names
+}
+
+func TestProcessAtPullSecretLimit(t *testing.T) {
+	*argMaxPullSecretsPerSA = 3
+	defer func() { *argMaxPullSecretsPerSA = 0 }()
+
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+	kubeClient.serviceaccounts["namespace1"].store["default"].ImagePullSecrets = []api.LocalObjectReference{{Name: "other"}}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	// Exactly at the limit, so both per-provider secrets are referenced
+	assert.Equal(t, []string{"other", *argGCRSecretName, *argAWSSecretName}, pullSecretNames(t, c, "namespace1"))
+	_, err = c.kubeClient.Secrets("namespace1").Get(*argCombinedSecretName)
+	assert.NotNil(t, err)
+}
+
+func TestProcessOverPullSecretLimit(t *testing.T) {
+	*argMaxPullSecretsPerSA = 2
+	defer func() { *argMaxPullSecretsPerSA = 0 }()
+
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+	kubeClient.serviceaccounts["namespace1"].store["default"].ImagePullSecrets = []api.LocalObjectReference{{Name: "other"}}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	// The AWS reference would be one too many, so the per-provider references
+	// are swapped for the combined secret
+	assert.Equal(t, []string{"other", *argCombinedSecretName}, pullSecretNames(t, c, "namespace1"))
+	combined, err := c.kubeClient.Secrets("namespace1").Get(*argCombinedSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, combinedProvider, combined.Annotations[providerAnnotation])
+
+	// namespace2 has room, so it keeps per-provider references
+	assert.Equal(t, []string{*argGCRSecretName, *argAWSSecretName}, pullSecretNames(t, c, "namespace2"))
+	_, err = c.kubeClient.Secrets("namespace2").Get(*argCombinedSecretName)
+	assert.NotNil(t, err)
+
+	// The next refresh leaves the switched service account as it is
+	err = c.process()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"other", *argCombinedSecretName}, pullSecretNames(t, c, "namespace1"))
+}
@@ -0,0 +1,187 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"k8s.io/kubernetes/pkg/api"
+	authorizationapi "k8s.io/kubernetes/pkg/apis/authorization"
+	authorizationclient "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset/typed/authorization/unversioned"
+)
+
+// permission is a verb on a resource, in one namespace or cluster wide when namespace is empty,
+// and on one named object or all of them when name is empty
+type permission struct {
+	verb      string
+	resource  string
+	namespace string
+	name      string
+}
+
+func (p permission) String() string {
+	resource := p.resource
+	if p.name != "" {
+		resource = p.resource + "/" + p.name
+	}
+	if p.namespace == api.NamespaceAll {
+		return fmt.Sprintf("%s %s in all namespaces", p.verb, resource)
+	}
+	return fmt.Sprintf("%s %s in namespace %s", p.verb, resource, p.namespace)
+}
+
+// requiredPermissions lists what the controller needs with the current flags
+func requiredPermissions() []permission {
+	required := []permission{
+		{verb: "list", resource: "namespaces"},
+		{verb: "get", resource: "secrets"},
+		{verb: "create", resource: "secrets"},
+		{verb: "update", resource: "secrets"},
+		{verb: "get", resource: "serviceaccounts"},
+		{verb: "create", resource: "events", namespace: *argEventNamespace},
+	}
+
+	required = append(required, permission{verb: "patch", resource: "serviceaccounts"})
+	if *argStripDisabledProviders || *argKeepPreviousSecrets > 0 || *argCleanupRenamedSecrets || *argCleanupDeselected || *argPrune || *argAdminTokenFile != "" {
+		required = append(required,
+			permission{verb: "list", resource: "secrets"},
+			permission{verb: "delete", resource: "secrets"})
+	}
+	if *argReactToPullFailures {
+		required = append(required,
+			permission{verb: "list", resource: "events"},
+			permission{verb: "watch", resource: "events"})
+	}
+	if *argWatchNamespaces {
+		required = append(required, permission{verb: "watch", resource: "namespaces"})
+	}
+	if *argAWSRegionsFromNodes {
+		required = append(required, permission{verb: "list", resource: "nodes"})
+	}
+	if len(*argAdoptLabels) > 0 {
+		required = append(required, permission{verb: "list", resource: "secrets"})
+	}
+	if *argPopulateNewProviders {
+		required = append(required, permission{verb: "list", resource: "secrets"})
+	}
+	if *argServiceAccountSelector != "" || *argAllServiceAccounts || len(*argFulfillPullSecrets) > 0 {
+		required = append(required, permission{verb: "list", resource: "serviceaccounts"})
+	}
+	if *argUseInformers {
+		for _, resource := range []string{"namespaces", "secrets", "serviceaccounts"} {
+			required = append(required,
+				permission{verb: "list", resource: resource},
+				permission{verb: "watch", resource: resource})
+		}
+	}
+	if len(*argNamespaces) > 0 {
+		return scopeToNamespaces(required, *argNamespaces)
+	}
+	if *argNamespacesFromConfigMap != "" {
+		return withNamespacesFromConfigMap(required)
+	}
+	return required
+}
+
+// withNamespacesFromConfigMap replaces listing namespaces with getting them
+// and reading the --namespaces-from-configmap ConfigMap. The listed
+// namespaces can change on every refresh, so the other permissions stay
+// cluster wide.
+func withNamespacesFromConfigMap(required []permission) []permission {
+	// validateParams already checked the reference
+	namespace, name, _ := parseConfigMapRef(*argNamespacesFromConfigMap)
+
+	replaced := []permission{{verb: "get", resource: "configmaps", namespace: namespace, name: name}}
+	for _, p := range required {
+		if p.verb == "list" && p.resource == "namespaces" {
+			p.verb = "get"
+		}
+		replaced = append(replaced, p)
+	}
+	return replaced
+}
+
+// scopeToNamespaces narrows cluster wide permissions to the --namespaces the
+// controller is limited to. Listing namespaces is replaced by getting each of
+// them, so the controller's role can name exactly the namespaces it manages.
+func scopeToNamespaces(required []permission, namespaces []string) []permission {
+	scoped := []permission{}
+	for _, namespace := range namespaces {
+		scoped = append(scoped, permission{verb: "get", resource: "namespaces", name: namespace})
+	}
+	for _, p := range required {
+		if p.resource == "namespaces" {
+			continue
+		}
+		if p.namespace != api.NamespaceAll {
+			scoped = append(scoped, p)
+			continue
+		}
+		for _, namespace := range namespaces {
+			p.namespace = namespace
+			scoped = append(scoped, p)
+		}
+	}
+	return scoped
+}
+
+// checkPermissions asks the API server whether the controller's own identity
+// holds each permission, logging every one that's missing so RBAC problems
+// surface at startup instead of part way through a refresh
+func checkPermissions(client authorizationclient.SelfSubjectAccessReviewsGetter, required []permission) error {
+	checked := map[permission]bool{}
+	missing := 0
+	for _, p := range required {
+		if checked[p] {
+			continue
+		}
+		checked[p] = true
+
+		review, err := client.SelfSubjectAccessReviews().Create(&authorizationapi.SelfSubjectAccessReview{
+			Spec: authorizationapi.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationapi.ResourceAttributes{
+					Namespace: p.namespace,
+					Verb:      p.verb,
+					Resource:  p.resource,
+					Name:      p.name,
+				},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("checking permission to %s: %v", p, err)
+		}
+
+		if !review.Status.Allowed {
+			log.Printf("Missing permission: %s %s", p, review.Status.Reason)
+			missing++
+		}
+	}
+
+	if missing > 0 {
+		return fmt.Errorf("missing %d required permissions, see above (use --skip-permission-check to start anyway)", missing)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	authorizationapi "k8s.io/kubernetes/pkg/apis/authorization"
+	authorizationclient "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset/typed/authorization/unversioned"
+)
+
+// fakeAuthorizationClient allows everything except the denied permissions
+type fakeAuthorizationClient struct {
+	denied  map[permission]bool
+	err     error
+	reviews []permission
+}
+
+func (f *fakeAuthorizationClient) SelfSubjectAccessReviews() authorizationclient.SelfSubjectAccessReviewInterface {
+	return f
+}
+
+func (f *fakeAuthorizationClient) Create(sar *authorizationapi.SelfSubjectAccessReview) (*authorizationapi.SelfSubjectAccessReview, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	attributes := sar.Spec.ResourceAttributes
+	p := permission{verb: attributes.Verb, resource: attributes.Resource, namespace: attributes.Namespace}
+	f.reviews = append(f.reviews, p)
+
+	sar.Status.Allowed = !f.denied[p]
+	if !sar.Status.Allowed {
+		sar.Status.Reason = "denied by fake"
+	}
+	return sar, nil
+}
+
+func TestCheckPermissionsAllowed(t *testing.T) {
+	client := &fakeAuthorizationClient{}
+	err := checkPermissions(client, requiredPermissions())
+	assert.Nil(t, err)
+	assert.Equal(t, len(requiredPermissions()), len(client.reviews))
+}
+
+func TestCheckPermissionsMissing(t *testing.T) {
+	client := &fakeAuthorizationClient{denied: map[permission]bool{
+		{verb: "create", resource: "secrets"}:        true,
+		{verb: "patch", resource: "serviceaccounts"}: true,
+	}}
+
+	err := checkPermissions(client, requiredPermissions())
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "missing 2 required permissions")
+
+	// Every permission is still checked, so all the missing ones are logged
+	assert.Equal(t, len(requiredPermissions()), len(client.reviews))
+}
+
+func TestCheckPermissionsReviewFails(t *testing.T) {
+	client := &fakeAuthorizationClient{err: errors.New("forbidden")}
+	err := checkPermissions(client, requiredPermissions())
+	assert.NotNil(t, err)
+}
+
+func TestRequiredPermissionsFollowFlags(t *testing.T) {
+	*argEventNamespace = "audit"
+	*argUseInformers = true
+	defer func() {
+		*argEventNamespace = ""
+		*argUseInformers = false
+	}()
+
+	required := map[permission]bool{}
+	for _, p := range requiredPermissions() {
+		required[p] = true
+	}
+	assert.True(t, required[permission{verb: "create", resource: "events", namespace: "audit"}])
+	assert.True(t, required[permission{verb: "watch", resource: "secrets"}])
+	assert.False(t, required[permission{verb: "delete", resource: "secrets"}])
+
+	// Duplicates are only reviewed once
+	client := &fakeAuthorizationClient{}
+	assert.Nil(t, checkPermissions(client, requiredPermissions()))
+	assert.Equal(t, len(required), len(client.reviews))
+}
+
+func TestRequiredPermissionsListedNamespaces(t *testing.T) {
+	defer func(namespaces []string) { *argNamespaces = namespaces }(*argNamespaces)
+	*argNamespaces = []string{"namespace1", "namespace2"}
+
+	required := requiredPermissions()
+	assert.Contains(t, required, permission{verb: "get", resource: "namespaces", name: "namespace1"})
+	assert.Contains(t, required, permission{verb: "create", resource: "secrets", namespace: "namespace2"})
+	assert.Contains(t, required, permission{verb: "patch", resource: "serviceaccounts", namespace: "namespace1"})
+	for _, p := range required {
+		assert.NotEqual(t, "list", p.verb, p.String())
+		if p.resource != "namespaces" {
+			assert.NotEqual(t, "", p.namespace, p.String())
+		}
+	}
+}
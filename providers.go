@@ -0,0 +1,90 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// missingProviderSettings returns what a provider still needs before it can
+// refresh, judged from flags and environment only
+func missingProviderSettings(provider string) []string {
+	missing := []string{}
+	switch provider {
+	case providerAWS:
+		if awsAccountID == "" {
+			missing = append(missing, "awsaccount environment variable")
+		}
+		if *argAWSCredentialSource == awsCredentialSourceIRSA {
+			for _, env := range []string{"AWS_ROLE_ARN", "AWS_WEB_IDENTITY_TOKEN_FILE"} {
+				if os.Getenv(env) == "" {
+					missing = append(missing, env+" environment variable")
+				}
+			}
+		}
+	case providerGCR:
+		if !*argEnableGCR {
+			missing = append(missing, "--enable-gcr")
+		}
+	case providerACR:
+		if acrClientID == "" {
+			missing = append(missing, "ACR_CLIENT_ID, ACR_CLIENT_SECRET and ACR_TENANT_ID environment variables")
+		}
+		if *argACRRegistry == "" {
+			missing = append(missing, "--acr-registry")
+		}
+	case providerDockerHub:
+		if !dockerHubEnabled() {
+			missing = append(missing, "--dockerhub-user and --dockerhub-password")
+		}
+	case providerGHCR:
+		if !ghcrEnabled() {
+			missing = append(missing, "--ghcr-user and --ghcr-token or --ghcr-token-file")
+		}
+	}
+	return missing
+}
+
+// listProviders prints every supported provider, whether it's enabled and
+// what settings it's missing, for --list-providers. It doesn't contact any
+// cloud or the cluster.
+func listProviders(w io.Writer) error {
+	disabled := disabledProviders()
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROVIDER\tENABLED\tMISSING")
+	for _, provider := range knownProviders {
+		missing := strings.Join(missingProviderSettings(provider), ", ")
+		if missing == "" {
+			missing = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%t\t%s\n", provider, !disabled[provider], missing)
+	}
+	return tw.Flush()
+}
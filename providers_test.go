@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListProviders(t *testing.T) {
+	accountID := awsAccountID
+	defer func() {
+		awsAccountID = accountID
+		acrClientID = ""
+		*argACRRegistry = ""
+	}()
+
+	awsAccountID = "123456789012"
+	acrClientID = "client"
+	*argACRRegistry = "myregistry.azurecr.io"
+	var out bytes.Buffer
+	assert.Nil(t, listProviders(&out))
+	assert.Equal(t, ""+
+		"PROVIDER   ENABLED  MISSING\n"+
+		"aws        true     -\n"+
+		"gcr        true     -\n"+
+		"acr        true     -\n"+
+		"dockerhub  false    --dockerhub-user and --dockerhub-password\n"+
+		"ghcr       false    --ghcr-user and --ghcr-token or --ghcr-token-file\n", out.String())
+}
+
+func TestListProvidersMissingSettings(t *testing.T) {
+	accountID := awsAccountID
+	*argEnableGCR = false
+	*argAWSCredentialSource = awsCredentialSourceIRSA
+	os.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/registry-creds")
+	defer func() {
+		awsAccountID = accountID
+		*argEnableGCR = true
+		*argAWSCredentialSource = awsCredentialSourceChain
+		os.Unsetenv("AWS_ROLE_ARN")
+	}()
+
+	awsAccountID = ""
+	var out bytes.Buffer
+	assert.Nil(t, listProviders(&out))
+	assert.Equal(t, ""+
+		"PROVIDER   ENABLED  MISSING\n"+
+		"aws        false    awsaccount environment variable, AWS_WEB_IDENTITY_TOKEN_FILE environment variable\n"+
+		"gcr        false    --enable-gcr\n"+
+		"acr        false    ACR_CLIENT_ID, ACR_CLIENT_SECRET and ACR_TENANT_ID environment variables, --acr-registry\n"+
+		"dockerhub  false    --dockerhub-user and --dockerhub-password\n"+
+		"ghcr       false    --ghcr-user and --ghcr-token or --ghcr-token-file\n", out.String())
+}
@@ -0,0 +1,184 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/labels"
+)
+
+const (
+	pruneDisabledProvider = "DisabledProvider"
+	pruneRenamed          = "Renamed"
+)
+
+// pruneEntry is one managed secret a prune removed, along with its references
+type pruneEntry struct {
+	Namespace string `json:"namespace"`
+	Secret    string `json:"secret"`
+	Reason    string `json:"reason"`
+}
+
+// pruneReport lists what a prune removed
+type pruneReport struct {
+	Removed []pruneEntry `json:"removed"`
+}
+
+func (r *pruneReport) write(w io.Writer) error {
+	return json.NewEncoder(w).Encode(r)
+}
+
+// orphanReason says why a managed secret is no longer wanted, or "" when it
+// still is. A secret of a disabled provider is orphaned, and so is one
+// written under a provider's previous secret name, but only once the secret
+// under the current name exists so pulls keep working.
+func (c *controller) orphanReason(namespace string, secret *api.Secret) string {
+	provider := secret.Annotations[providerAnnotation]
+	if c.disabledProviders[provider] {
+		return pruneDisabledProvider
+	}
+
+	name, ok := secret.Annotations[secretNameAnnotation]
+	want, known := configuredSecretNames()[provider]
+	if !ok || !known || name == want {
+		return ""
+	}
+	if _, err := c.kubeClient.Secrets(namespace).Get(want); err != nil {
+		return ""
+	}
+	return pruneRenamed
+}
+
+// prune removes the orphaned managed secrets in every namespace, with their
+// service account references, without refreshing anything. Backups and
+// other instances' secrets are left alone.
+func (c *controller) prune() (*pruneReport, error) {
+	c.processLock.Lock()
+	defer c.processLock.Unlock()
+
+	report := &pruneReport{Removed: []pruneEntry{}}
+	namespaces, err := c.listNamespaces()
+	if err != nil {
+		return report, err
+	}
+	if len(*argAdoptLabels) > 0 {
+		if err := c.adoptLegacySecrets(namespaces); err != nil {
+			return report, err
+		}
+	}
+
+	selector := labels.SelectorFromSet(labels.Set{managedByLabel: managedByValue})
+	for _, namespace := range namespaces {
+		if namespaceExcluded(namespace.GetName()) {
+			continue
+		}
+
+		secrets, err := c.kubeClient.Secrets(namespace.GetName()).List(api.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return report, err
+		}
+		sort.Sort(secretsByName(secrets.Items))
+
+		for _, secret := range secrets.Items {
+			if ownedByOtherInstance(&secret) || secret.Labels[backupOfLabel] != "" {
+				continue
+			}
+			reason := c.orphanReason(namespace.GetName(), &secret)
+			if reason == "" {
+				continue
+			}
+
+			if err := c.removeSecret(namespace.GetName(), secret.Name); err != nil {
+				return report, err
+			}
+			log.Printf("Pruned secret %s/%s: %s", namespace.GetName(), secret.Name, reason)
+			report.Removed = append(report.Removed, pruneEntry{Namespace: namespace.GetName(), Secret: secret.Name, Reason: reason})
+		}
+	}
+	return report, nil
+}
+
+// secretsByName orders secrets by name
+type secretsByName []api.Secret
+
+func (s secretsByName) Len() int {
+	return len(s)
+}
+
+func (s secretsByName) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s secretsByName) Less(i, j int) bool {
+	return s[i].Name < s[j].Name
+}
+
+// readTokenFile reads a token from a file, e.g. the bearer token of the admin
+// endpoints from --admin-token-file, ignoring surrounding whitespace
+func readTokenFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return token, nil
+}
+
+// pruneHandler serves POST /prune, which needs the admin token as a bearer
+// token and responds with the prune report
+func (c *controller) pruneHandler(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		report, err := c.prune()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("prune failed after removing %d secrets: %v", len(report.Removed), err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		report.write(w)
+	}
+}
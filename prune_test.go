@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+func managedSecret(name, provider, configuredName string) *api.Secret {
+	secret := &api.Secret{ObjectMeta: api.ObjectMeta{Name: name}}
+	if configuredName != "" {
+		annotateSecretName(secret, configuredName)
+	}
+	markManaged(secret, provider)
+	return secret
+}
+
+// newPruneKubeClient sets up namespace1 with orphaned and wanted secrets, all
+// referenced from its default service account
+func newPruneKubeClient() *fakeKubeClient {
+	kubeClient := newFakeKubeClient()
+	secrets := map[string]*api.Secret{
+		// Wanted
+		*argAWSSecretName: managedSecret(*argAWSSecretName, providerAWS, *argAWSSecretName),
+		"declared-ecr":    managedSecret("declared-ecr", providerAWS, ""),
+		"team-secret":     {ObjectMeta: api.ObjectMeta{Name: "team-secret"}},
+		// Orphaned: the provider is disabled, or the AWS secret was renamed
+		*argGCRSecretName: managedSecret(*argGCRSecretName, providerGCR, *argGCRSecretName),
+		"old-ecr":         managedSecret("old-ecr", providerAWS, "old-ecr"),
+	}
+	// Someone else's, or a backup
+	other := managedSecret("other-ecr", providerGCR, "other-ecr")
+	other.Labels[instanceLabel] = "other"
+	secrets["other-ecr"] = other
+	backup := managedSecret("old-ecr-20161001-000000", providerAWS, "old-ecr")
+	backup.Labels[backupOfLabel] = "old-ecr"
+	secrets[backup.Name] = backup
+	kubeClient.secrets["namespace1"].store = secrets
+
+	// A renamed secret whose replacement isn't written yet is still needed
+	kubeClient.secrets["namespace2"].store["old-ecr"] = managedSecret("old-ecr", providerAWS, "old-ecr")
+
+	references := []api.LocalObjectReference{}
+	for _, name := range []string{*argAWSSecretName, "declared-ecr", "team-secret", *argGCRSecretName, "old-ecr"} {
+		references = append(references, api.LocalObjectReference{Name: name})
+	}
+	kubeClient.serviceaccounts["namespace1"].store["default"].ImagePullSecrets = references
+	return kubeClient
+}
+
+func TestPrune(t *testing.T) {
+	kubeClient := newPruneKubeClient()
+	c := &controller{kubeClient: kubeClient, disabledProviders: map[string]bool{providerGCR: true}}
+
+	report, err := c.prune()
+	assert.Nil(t, err)
+	assert.Equal(t, []pruneEntry{
+		{Namespace: "namespace1", Secret: *argGCRSecretName, Reason: pruneDisabledProvider},
+		{Namespace: "namespace1", Secret: "old-ecr", Reason: pruneRenamed},
+	}, report.Removed)
+
+	remaining := []string{}
+	for name := range kubeClient.secrets["namespace1"].store {
+		remaining = append(remaining, name)
+	}
+	assert.Equal(t, 5, len(remaining))
+	for _, name := range []string{*argAWSSecretName, "declared-ecr", "team-secret", "other-ecr", "old-ecr-20161001-000000"} {
+		assert.Contains(t, remaining, name)
+	}
+	_, err = kubeClient.Secrets("namespace2").Get("old-ecr")
+	assert.Nil(t, err)
+
+	serviceAccount, err := kubeClient.ServiceAccounts("namespace1").Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, []api.LocalObjectReference{{Name: *argAWSSecretName}, {Name: "declared-ecr"}, {Name: "team-secret"}}, serviceAccount.ImagePullSecrets)
+}
+
+func TestPruneHandler(t *testing.T) {
+	c := &controller{kubeClient: newPruneKubeClient(), disabledProviders: map[string]bool{providerGCR: true}}
+	handler := c.pruneHandler("s3cret")
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/prune", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/prune", nil)
+	request.Header.Set("Authorization", "Bearer wrong")
+	handler(w, request)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	request = httptest.NewRequest("POST", "/prune", nil)
+	request.Header.Set("Authorization", "Bearer s3cret")
+	handler(w, request)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var report pruneReport
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, 2, len(report.Removed))
+}
+
+func TestReadAdminToken(t *testing.T) {
+	file, err := ioutil.TempFile("", "admin-token")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+
+	_, err = readTokenFile(file.Name())
+	assert.NotNil(t, err)
+
+	assert.Nil(t, ioutil.WriteFile(file.Name(), []byte("s3cret\n"), 0600))
+	token, err := readTokenFile(file.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, "s3cret", token)
+}
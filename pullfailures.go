@@ -0,0 +1,127 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/cache"
+	"k8s.io/kubernetes/pkg/fields"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+// pullAuthFailureMarkers are the parts of a kubelet pull failure message,
+// lower cased, that mean the registry rejected the credentials rather than
+// e.g. the image not existing
+var pullAuthFailureMarkers = []string{
+	"unauthorized",
+	"authentication required",
+	"no basic auth credentials",
+	"access denied",
+	"denied:",
+}
+
+// isPullAuthFailure reports whether an event is a pod failing to pull an
+// image because the registry rejected its credentials
+func isPullAuthFailure(event *api.Event) bool {
+	if event.InvolvedObject.Kind != "Pod" || event.Type != api.EventTypeWarning {
+		return false
+	}
+	if event.Reason != "Failed" && event.Reason != "BackOff" {
+		return false
+	}
+
+	message := strings.ToLower(event.Message)
+	for _, marker := range pullAuthFailureMarkers {
+		if strings.Contains(message, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// pullFailureLimiter allows one refresh per namespace per
+// --pull-failure-cooldown, so pods that keep failing with fresh credentials
+// don't turn into a refresh loop
+type pullFailureLimiter struct {
+	last map[string]time.Time
+}
+
+func (l *pullFailureLimiter) allow(namespace string, now time.Time) bool {
+	if l.last == nil {
+		l.last = map[string]time.Time{}
+	}
+	if last, ok := l.last[namespace]; ok && now.Sub(last) < *argPullFailureCooldown {
+		return false
+	}
+	l.last[namespace] = now
+	return true
+}
+
+// handlePullFailureEvent asks run() to refresh the namespace of a pull
+// failure seen since the watch started
+func (c *controller) handlePullFailureEvent(limiter *pullFailureLimiter, started time.Time, event *api.Event) {
+	if !isPullAuthFailure(event) || event.LastTimestamp.Time.Before(started) {
+		return
+	}
+	if !limiter.allow(event.Namespace, c.now()) {
+		return
+	}
+
+	log.Printf("Pod %s/%s failed to pull an image with its credentials: %s", event.Namespace, event.InvolvedObject.Name, event.Message)
+	c.pullFailures <- event.Namespace
+}
+
+// watchPullFailures watches pod warning events across the cluster for image
+// pulls the registry rejected, for --react-to-pull-failures
+func (c *controller) watchPullFailures(stopCh <-chan struct{}) {
+	limiter := &pullFailureLimiter{}
+	started := c.now()
+	selector := fields.Set{"involvedObject.kind": "Pod", "type": api.EventTypeWarning}.AsSelector()
+
+	handle := func(obj interface{}) {
+		if event, ok := obj.(*api.Event); ok {
+			c.handlePullFailureEvent(limiter, started, event)
+		}
+	}
+	_, controller := cache.NewInformer(&cache.ListWatch{
+		ListFunc: func(options api.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			return c.kubeClient.Events(api.NamespaceAll).List(options)
+		},
+		WatchFunc: func(options api.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return c.kubeClient.Events(api.NamespaceAll).Watch(options)
+		},
+	}, &api.Event{}, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc:    handle,
+		UpdateFunc: func(_, obj interface{}) { handle(obj) },
+	})
+	controller.Run(stopCh)
+}
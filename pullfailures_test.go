@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/util/clock"
+)
+
+func pullFailureEvent(namespace, reason, message string, at time.Time) *api.Event {
+	return &api.Event{
+		ObjectMeta:     api.ObjectMeta{Name: "app.1", Namespace: namespace},
+		InvolvedObject: api.ObjectReference{Kind: "Pod", Namespace: namespace, Name: "app"},
+		Type:           api.EventTypeWarning,
+		Reason:         reason,
+		Message:        message,
+		LastTimestamp:  unversioned.NewTime(at),
+	}
+}
+
+func TestIsPullAuthFailure(t *testing.T) {
+	now := time.Now()
+	assert.True(t, isPullAuthFailure(pullFailureEvent("namespace1", "Failed", `Failed to pull image "123.dkr.ecr.us-east-1.amazonaws.com/app": unauthorized: authentication required`, now)))
+	assert.True(t, isPullAuthFailure(pullFailureEvent("namespace1", "BackOff", "Back-off pulling image: no basic auth credentials", now)))
+
+	// Not a credentials problem
+	assert.False(t, isPullAuthFailure(pullFailureEvent("namespace1", "Failed", `Failed to pull image "app": manifest unknown`, now)))
+	assert.False(t, isPullAuthFailure(pullFailureEvent("namespace1", "FailedScheduling", "unauthorized", now)))
+
+	normal := pullFailureEvent("namespace1", "Failed", "unauthorized", now)
+	normal.Type = api.EventTypeNormal
+	assert.False(t, isPullAuthFailure(normal))
+	node := pullFailureEvent("namespace1", "Failed", "unauthorized", now)
+	node.InvolvedObject.Kind = "Node"
+	assert.False(t, isPullAuthFailure(node))
+}
+
+func TestPullFailureLimiter(t *testing.T) {
+	now := time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC)
+	limiter := &pullFailureLimiter{}
+
+	assert.True(t, limiter.allow("namespace1", now))
+	assert.False(t, limiter.allow("namespace1", now.Add(time.Minute)))
+	// Each namespace has its own cooldown
+	assert.True(t, limiter.allow("namespace2", now.Add(time.Minute)))
+	assert.True(t, limiter.allow("namespace1", now.Add(*argPullFailureCooldown)))
+}
+
+func TestRunRefreshesNamespaceOnPullFailure(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient(), clock: fakeClock}
+	c.schedule = &refreshSchedule{}
+	c.pullFailures = make(chan string)
+
+	stopCh := make(chan struct{})
+	go c.run(stopCh)
+	waitForTimer(t, fakeClock)
+
+	kubeClient.secrets["namespace1"].Delete(*argGCRSecretName)
+	kubeClient.secrets["namespace2"].Delete(*argGCRSecretName)
+
+	// Pull failures from before the watch started are history
+	limiter := &pullFailureLimiter{}
+	started := fakeClock.Now()
+	c.handlePullFailureEvent(limiter, started, pullFailureEvent("namespace2", "Failed", "unauthorized: authentication required", started.Add(-time.Minute)))
+
+	// Only the failing namespace is refreshed. Stopping blocks until the
+	// refresh has finished.
+	c.handlePullFailureEvent(limiter, started, pullFailureEvent("namespace1", "Failed", "unauthorized: authentication required", started))
+	stopCh <- struct{}{}
+
+	_, err := kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+	_, err = kubeClient.Secrets("namespace2").Get(*argGCRSecretName)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactedStringHidesValue(t *testing.T) {
+	secret := redactedString("fakeToken")
+
+	for _, format := range []string{"%v", "%s", "%+v", "%#v", "%q", "%x"} {
+		out := fmt.Sprintf(format, secret)
+		assert.NotContains(t, out, "fakeToken", format)
+		assert.Contains(t, out, redacted, format)
+	}
+
+	token := AuthToken{AccessToken: secret, Endpoint: "fakeEndpoint"}
+	out := fmt.Sprintf("%+v", token)
+	assert.NotContains(t, out, "fakeToken")
+	assert.Contains(t, out, "fakeEndpoint")
+
+	assert.Equal(t, "fakeToken", string(secret))
+}
@@ -0,0 +1,159 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+// extraHostsAnnotation lists registry aliases a namespace pulls from with the
+// --registry-hosts-provider credential, e.g. registry-creds.io/extra-hosts: a.internal,b.internal
+const extraHostsAnnotation = "registry-creds.io/extra-hosts"
+
+// readRegistryHosts returns the registry hosts listed one per line in path.
+// Blank lines and lines starting with # are ignored. The file is read on
+// every refresh, so a missing or unreadable file is logged and treated as
+// listing no hosts rather than stopping the controller.
+func readRegistryHosts(path string) []string {
+	if path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("Registry hosts file %s not found, skipping", path)
+		} else {
+			log.Printf("Couldn't read registry hosts file %s: %v", path, err)
+		}
+		return nil
+	}
+
+	hosts := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		host := strings.TrimSpace(scanner.Text())
+		if host == "" || strings.HasPrefix(host, "#") {
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	if len(hosts) == 0 {
+		log.Printf("Registry hosts file %s lists no hosts", path)
+	}
+	return hosts
+}
+
+// addRegistryHosts gives every host its own auths entry holding the shared credential
+func addRegistryHosts(auths map[string]dockerConfigEntry, hosts []string, entry dockerConfigEntry) {
+	for _, host := range hosts {
+		auths[host] = entry
+	}
+}
+
+// namespaceExtraHosts reads the namespace's extra hosts annotation. Invalid
+// hosts are logged and skipped, the valid ones are still used.
+func namespaceExtraHosts(namespace api.Namespace) []string {
+	value, ok := namespace.Annotations[extraHostsAnnotation]
+	if !ok {
+		return nil
+	}
+
+	hosts := []string{}
+	for _, host := range strings.Split(value, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if err := validateRegistryURL(host); err != nil {
+			log.Printf("Ignoring host in %s annotation on namespace %s: %v", extraHostsAnnotation, namespace.Name, err)
+			continue
+		}
+		hosts = append(hosts, registryHost(host))
+	}
+	return hosts
+}
+
+// withExtraHosts returns a copy of a generated secret whose docker config also
+// has an entry for every host, each a copy of the entry for endpoint
+func withExtraHosts(secret *api.Secret, endpoint string, hosts []string) (*api.Secret, error) {
+	copied := *secret
+	copied.Data = map[string][]byte{}
+	for key, value := range secret.Data {
+		copied.Data[key] = value
+	}
+
+	if dockercfg, ok := secret.Data[api.DockerConfigKey]; ok {
+		auths := map[string]json.RawMessage{}
+		if err := json.Unmarshal(dockercfg, &auths); err != nil {
+			return nil, err
+		}
+		if err := copyAuthsEntry(auths, endpoint, hosts); err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(auths)
+		if err != nil {
+			return nil, err
+		}
+		copied.Data[api.DockerConfigKey] = data
+		return &copied, nil
+	}
+
+	var config struct {
+		Auths map[string]json.RawMessage `json:"auths"`
+	}
+	if err := json.Unmarshal(secret.Data[api.DockerConfigJsonKey], &config); err != nil {
+		return nil, err
+	}
+	if err := copyAuthsEntry(config.Auths, endpoint, hosts); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	copied.Data[api.DockerConfigJsonKey] = data
+	return &copied, nil
+}
+
+func copyAuthsEntry(auths map[string]json.RawMessage, endpoint string, hosts []string) error {
+	entry, ok := auths[endpoint]
+	if !ok {
+		return fmt.Errorf("no docker config entry for %s", endpoint)
+	}
+	for _, host := range hosts {
+		auths[host] = entry
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+func writeHostsFile(t *testing.T, dir, contents string) string {
+	path := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadRegistryHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry-hosts")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := writeHostsFile(t, dir, "registry1.internal\n\n# staging\n  registry2.internal  \n")
+	assert.Equal(t, []string{"registry1.internal", "registry2.internal"}, readRegistryHosts(path))
+
+	path = writeHostsFile(t, dir, "")
+	assert.Equal(t, []string{}, readRegistryHosts(path))
+
+	assert.Nil(t, readRegistryHosts(filepath.Join(dir, "missing")))
+	assert.Nil(t, readRegistryHosts(""))
+}
+
+func TestProcessRegistryHostsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry-hosts")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	*argCombineSecrets = combineSecretsCombined
+	*argRegistryHostsFile = writeHostsFile(t, dir, "registry1.internal\nregistry2.internal\n")
+	defer func() {
+		*argCombineSecrets = combineSecretsOff
+		*argRegistryHostsFile = ""
+	}()
+
+	kubeClient := newFakeKubeClient()
+	*argGCRURL = "fakeGCREndpoint"
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	err = c.process()
+	assert.Nil(t, err)
+
+	secret, err := c.kubeClient.Secrets("namespace1").Get(*argCombinedSecretName)
+	assert.Nil(t, err)
+	var config dockerConfigJSON
+	assert.Nil(t, json.Unmarshal(secret.Data[".dockerconfigjson"], &config))
+	assert.Equal(t, 4, len(config.Auths))
+	assert.Equal(t, config.Auths["fakeEndpoint"], config.Auths["registry1.internal"])
+	assert.Equal(t, config.Auths["fakeEndpoint"], config.Auths["registry2.internal"])
+
+	// The file is read again on the next refresh
+	writeHostsFile(t, dir, "registry3.internal\n")
+	err = c.process()
+	assert.Nil(t, err)
+
+	secret, err = c.kubeClient.Secrets("namespace1").Get(*argCombinedSecretName)
+	assert.Nil(t, err)
+	config = dockerConfigJSON{}
+	assert.Nil(t, json.Unmarshal(secret.Data[".dockerconfigjson"], &config))
+	assert.Equal(t, 3, len(config.Auths))
+	assert.Equal(t, config.Auths["fakeEndpoint"], config.Auths["registry3.internal"])
+	_, ok := config.Auths["registry1.internal"]
+	assert.False(t, ok)
+}
+
+func TestNamespaceExtraHosts(t *testing.T) {
+	namespace := api.Namespace{ObjectMeta: api.ObjectMeta{
+		Name:        "namespace1",
+		Annotations: map[string]string{extraHostsAnnotation: "a.internal, https://b.internal:5000,,bad host:port"},
+	}}
+	assert.Equal(t, []string{"a.internal", "b.internal:5000"}, namespaceExtraHosts(namespace))
+
+	assert.Nil(t, namespaceExtraHosts(api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace2"}}))
+}
+
+func TestProcessNamespaceExtraHosts(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	*argGCRURL = "fakeGCREndpoint"
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+	c.cache = newFakeInformerCache(
+		&api.Namespace{ObjectMeta: api.ObjectMeta{
+			Name:        "namespace1",
+			Annotations: map[string]string{extraHostsAnnotation: "a.internal,b.internal"},
+		}},
+		&api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace2"}},
+		&api.ServiceAccount{ObjectMeta: api.ObjectMeta{Name: "default", Namespace: "namespace1"}},
+		&api.ServiceAccount{ObjectMeta: api.ObjectMeta{Name: "default", Namespace: "namespace2"}},
+	)
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	// The AWS secret in the annotated namespace gets an entry per extra host
+	secret, err := c.kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t,
+		`{"auths":{"a.internal":{"auth":"fakeToken","email":"none"},"b.internal":{"auth":"fakeToken","email":"none"},"fakeEndpoint":{"auth":"fakeToken","email":"none"}}}`,
+		string(secret.Data[".dockerconfigjson"]))
+
+	// Only the --registry-hosts-provider secret is extended
+	secret, err = c.kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"fakeGCREndpoint":{"username":"oauth2accesstoken","password":"fakeToken","email":"none"}}`, string(secret.Data[".dockercfg"]))
+
+	secret, err = c.kubeClient.Secrets("namespace2").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"auths":{"fakeEndpoint":{"auth":"fakeToken","email":"none"}}}`, string(secret.Data[".dockerconfigjson"]))
+}
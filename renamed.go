@@ -0,0 +1,102 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"log"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/labels"
+)
+
+// secretNameAnnotation records the --aws-secret-name or --gcr-secret-name a
+// provider secret was written for. A split format's legacy secret carries the
+// name it was split from.
+const secretNameAnnotation = "registry-creds.io/secret-name"
+
+func annotateSecretName(secret *api.Secret, name string) {
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Annotations[secretNameAnnotation] = name
+}
+
+// configuredSecretNames returns the secret name each provider writes under now
+func configuredSecretNames() map[string]string {
+	return map[string]string{
+		providerAWS:       *argAWSSecretName,
+		providerGCR:       *argGCRSecretName,
+		providerACR:       *argACRSecretName,
+		providerDockerHub: *argDockerHubSecretName,
+		providerGHCR:      *argGHCRSecretName,
+	}
+}
+
+// cleanupRenamedSecrets removes the managed secrets written under a provider's
+// previous secret name, with their service account references. Only providers
+// that succeeded this cycle are cleaned up, so the service accounts are never
+// left without the provider's credentials.
+func (c *controller) cleanupRenamedSecrets(namespaces []api.Namespace) error {
+	current := map[string]string{}
+	for _, provider := range c.cycle.succeeded {
+		current[provider] = configuredSecretNames()[provider]
+	}
+	if len(current) == 0 {
+		return nil
+	}
+
+	selector := labels.SelectorFromSet(labels.Set{managedByLabel: managedByValue})
+	for _, namespace := range namespaces {
+		if namespaceExcluded(namespace.GetName()) || c.namespaceBlocked(namespace.GetName()) {
+			continue
+		}
+
+		secrets, err := c.kubeClient.Secrets(namespace.GetName()).List(api.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return err
+		}
+
+		for _, secret := range secrets.Items {
+			if ownedByOtherInstance(&secret) || secret.Labels[backupOfLabel] != "" {
+				continue
+			}
+
+			name, ok := secret.Annotations[secretNameAnnotation]
+			if !ok {
+				continue
+			}
+			provider := secret.Annotations[providerAnnotation]
+			if want, ok := current[provider]; !ok || name == want {
+				continue
+			}
+
+			if err := c.removeSecret(namespace.GetName(), secret.Name); err != nil {
+				return err
+			}
+			log.Printf("Removed secret %s/%s written under the previous %s secret name %s", namespace.GetName(), secret.Name, provider, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util/clock"
+)
+
+func TestProcessCleanupRenamedSecrets(t *testing.T) {
+	defer func(name string) { *argAWSSecretName = name }(*argAWSSecretName)
+	*argCleanupRenamedSecrets = true
+	defer func() { *argCleanupRenamedSecrets = false }()
+
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	*argAWSSecretName = "old-ecr"
+	err := c.process()
+	assert.Nil(t, err)
+
+	// A managed secret without the annotation, e.g. a fulfilled one, isn't a rename
+	fulfilled := &api.Secret{ObjectMeta: api.ObjectMeta{Name: "declared-ecr"}}
+	markManaged(fulfilled, providerAWS)
+	kubeClient.secrets["namespace1"].store["declared-ecr"] = fulfilled
+
+	*argAWSSecretName = "new-ecr"
+	err = c.process()
+	assert.Nil(t, err)
+
+	for _, namespace := range []string{"namespace1", "namespace2"} {
+		_, err = kubeClient.Secrets(namespace).Get("old-ecr")
+		assert.NotNil(t, err)
+		_, err = kubeClient.Secrets(namespace).Get("new-ecr")
+		assert.Nil(t, err)
+		_, err = kubeClient.Secrets(namespace).Get(*argGCRSecretName)
+		assert.Nil(t, err)
+
+		serviceAccount, err := kubeClient.ServiceAccounts(namespace).Get("default")
+		assert.Nil(t, err)
+		assert.Equal(t, []api.LocalObjectReference{{Name: *argGCRSecretName}, {Name: "new-ecr"}}, serviceAccount.ImagePullSecrets)
+	}
+	_, err = kubeClient.Secrets("namespace1").Get("declared-ecr")
+	assert.Nil(t, err)
+}
+
+func TestProcessKeepsRenamedSecretsOfFailedProvider(t *testing.T) {
+	defer func(name string) { *argAWSSecretName = name }(*argAWSSecretName)
+	*argCleanupRenamedSecrets = true
+	defer func() { *argCleanupRenamedSecrets = false }()
+
+	kubeClient := newFakeKubeClient()
+	ecrClient := &flakyEcrClient{}
+	// The fake clock skips the backoff of the failing refresh's token retries
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: newFakeGcrClient(), clock: clock.NewFakeClock(time.Now())}
+
+	*argAWSSecretName = "old-ecr"
+	err := c.process()
+	assert.Nil(t, err)
+
+	// Without the new secret, the old one is still the only way to pull
+	*argAWSSecretName = "new-ecr"
+	ecrClient.err = errors.New("throttled")
+	err = c.process()
+	assert.NotNil(t, err)
+
+	_, err = kubeClient.Secrets("namespace1").Get("old-ecr")
+	assert.Nil(t, err)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util/clock"
+)
+
+// waitForTimer blocks until run() is waiting on the fake clock, which means
+// any process() before it has returned
+func waitForTimer(t *testing.T, fakeClock *clock.FakeClock) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !fakeClock.HasWaiters() {
+		if time.Now().After(deadline) {
+			t.Fatal("run() never waited for the next refresh")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRunReconcilesBeforeFirstTick(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	ecrClient := &flakyEcrClient{}
+	c := &controller{kubeClient: newFakeKubeClient(), ecrClient: ecrClient, gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go c.run(stopCh)
+
+	waitForTimer(t, fakeClock)
+	assert.Equal(t, 1, ecrClient.calls)
+
+	fakeClock.Step(globalRefreshInterval())
+	waitForTimer(t, fakeClock)
+	assert.Equal(t, 2, ecrClient.calls)
+}
+
+func TestRunSkipInitialReconcile(t *testing.T) {
+	*argSkipInitialReconcile = true
+	defer func() { *argSkipInitialReconcile = false }()
+
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	ecrClient := &flakyEcrClient{}
+	c := &controller{kubeClient: newFakeKubeClient(), ecrClient: ecrClient, gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go c.run(stopCh)
+
+	waitForTimer(t, fakeClock)
+	assert.Equal(t, 0, ecrClient.calls)
+
+	fakeClock.Step(globalRefreshInterval())
+	waitForTimer(t, fakeClock)
+	assert.Equal(t, 1, ecrClient.calls)
+}
+
+func TestRunRequireHealthyStartupFails(t *testing.T) {
+	*argRequireHealthyStartup = true
+	defer func() { *argRequireHealthyStartup = false }()
+
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	ecrClient := &flakyEcrClient{err: fmt.Errorf("AccessDeniedException")}
+	c := &controller{kubeClient: newFakeKubeClient(), ecrClient: ecrClient, gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	// run returns instead of waiting for the next refresh, so main exits non-zero
+	err := c.run(stopCh)
+	assert.NotNil(t, err)
+	assert.Equal(t, tokenAttempts(), ecrClient.calls)
+}
+
+func TestRunRequireHealthyStartupSucceeds(t *testing.T) {
+	*argRequireHealthyStartup = true
+	defer func() { *argRequireHealthyStartup = false }()
+
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	ecrClient := &flakyEcrClient{}
+	c := &controller{kubeClient: newFakeKubeClient(), ecrClient: ecrClient, gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	stopCh := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- c.run(stopCh) }()
+
+	waitForTimer(t, fakeClock)
+	assert.Equal(t, 1, ecrClient.calls)
+
+	close(stopCh)
+	assert.Nil(t, <-done)
+}
+
+func TestRunSurvivesFailedRefresh(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	ecrClient := &flakyEcrClient{}
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	stopCh := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- c.run(stopCh) }()
+
+	waitForTimer(t, fakeClock)
+	assert.Equal(t, 1, ecrClient.calls)
+
+	// A later failed refresh is logged and the controller keeps going
+	ecrClient.err = fmt.Errorf("throttled")
+	fakeClock.Step(globalRefreshInterval())
+	waitForTimer(t, fakeClock)
+	assert.Equal(t, 1+tokenAttempts(), ecrClient.calls)
+
+	ecrClient.err = nil
+	fakeClock.Step(globalRefreshInterval())
+	waitForTimer(t, fakeClock)
+	assert.Equal(t, 2+tokenAttempts(), ecrClient.calls)
+
+	close(stopCh)
+	assert.Nil(t, <-done)
+}
+
+func TestRunStartupDelay(t *testing.T) {
+	*argStartupDelay = 5 * time.Minute
+	*argStartupDelayJitter = 10 * time.Minute
+	defer func() { *argStartupDelay, *argStartupDelayJitter = 0, 0 }()
+	defer func(f func(int64) int64) { randInt63n = f }(randInt63n)
+	randInt63n = func(n int64) int64 {
+		assert.Equal(t, int64(10*time.Minute), n)
+		return int64(3 * time.Minute)
+	}
+
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	ecrClient := &flakyEcrClient{}
+	c := &controller{kubeClient: newFakeKubeClient(), ecrClient: ecrClient, gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go c.run(stopCh)
+
+	// Nothing is refreshed until the delay plus the jitter has passed
+	waitForTimer(t, fakeClock)
+	assert.Equal(t, 0, ecrClient.calls)
+	fakeClock.Step(7 * time.Minute)
+	assert.Equal(t, 0, ecrClient.calls)
+
+	fakeClock.Step(time.Minute)
+	waitForTimer(t, fakeClock)
+	assert.Equal(t, 1, ecrClient.calls)
+}
+
+func TestRunStartupProbeGrace(t *testing.T) {
+	*argStartupProbeGrace = 2 * time.Minute
+	defer func() { *argStartupProbeGrace = 0 }()
+
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	ecrClient := &flakyEcrClient{err: fmt.Errorf("AccessDeniedException")}
+	c := &controller{kubeClient: newFakeKubeClient(), ecrClient: ecrClient, gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go c.run(stopCh)
+
+	// GCR alone would be enough for readiness, but the startup refresh partly failed
+	waitForTimer(t, fakeClock)
+	assert.Equal(t, tokenAttempts(), ecrClient.calls)
+	code, providers := getReadyz(c)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.True(t, providers[providerGCR].Healthy)
+
+	// Still failing on the first retry
+	fakeClock.Step(startupRetryInterval)
+	waitForTimer(t, fakeClock)
+	assert.Equal(t, 2*tokenAttempts(), ecrClient.calls)
+	code, _ = getReadyz(c)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	// Ready once a refresh succeeds for every provider
+	c.processLock.Lock()
+	ecrClient.err = nil
+	c.processLock.Unlock()
+	fakeClock.Step(startupRetryInterval)
+	waitForTimer(t, fakeClock)
+	assert.Equal(t, 2*tokenAttempts()+1, ecrClient.calls)
+	code, _ = getReadyz(c)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestRunStartupProbeGraceExpires(t *testing.T) {
+	*argStartupProbeGrace = time.Minute
+	defer func() { *argStartupProbeGrace = 0 }()
+
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	ecrClient := &flakyEcrClient{err: fmt.Errorf("AccessDeniedException")}
+	c := &controller{kubeClient: newFakeKubeClient(), ecrClient: ecrClient, gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	done := make(chan error)
+	go func() { done <- c.run(stopCh) }()
+
+	for i := 0; i < 2; i++ {
+		waitForTimer(t, fakeClock)
+		fakeClock.Step(startupRetryInterval)
+	}
+
+	// The pod restarts instead of running unready
+	assert.NotNil(t, <-done)
+	assert.Equal(t, 3*tokenAttempts(), ecrClient.calls)
+	code, _ := getReadyz(c)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+func TestRunPopulatesNewProviders(t *testing.T) {
+	*argSkipInitialReconcile = true
+	*argPopulateNewProviders = true
+	defer func() { *argSkipInitialReconcile = false; *argPopulateNewProviders = false }()
+
+	kubeClient := newFakeKubeClient()
+	// AWS was already enabled and its secrets are written, GCR was just enabled
+	for _, namespace := range []string{"namespace1", "namespace2"} {
+		existing := &api.Secret{ObjectMeta: api.ObjectMeta{Name: *argAWSSecretName, Namespace: namespace}, Data: map[string][]byte{"old": []byte("token")}}
+		markManaged(existing, providerAWS)
+		kubeClient.secrets[namespace].store[*argAWSSecretName] = existing
+	}
+
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	ecrClient := &flakyEcrClient{}
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go c.run(stopCh)
+	waitForTimer(t, fakeClock)
+
+	// GCR is written everywhere straight away, AWS waits for its first refresh
+	for _, namespace := range []string{"namespace1", "namespace2"} {
+		_, err := kubeClient.Secrets(namespace).Get(*argGCRSecretName)
+		assert.Nil(t, err)
+		secret, err := kubeClient.Secrets(namespace).Get(*argAWSSecretName)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("token"), secret.Data["old"])
+	}
+	assert.Equal(t, 0, ecrClient.calls)
+	assert.Nil(t, c.onlyProviders)
+	assert.NotNil(t, c.schedule)
+
+	fakeClock.Step(globalRefreshInterval())
+	waitForTimer(t, fakeClock)
+	assert.Equal(t, 1, ecrClient.calls)
+}
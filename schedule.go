@@ -0,0 +1,113 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"log"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+// refreshIntervalAnnotation lets a namespace ask for a different refresh
+// interval than --refresh-mins, e.g. registry-creds.io/refresh-interval: 15m
+const refreshIntervalAnnotation = "registry-creds.io/refresh-interval"
+
+// refreshSchedule tracks when each namespace is next due for a refresh
+type refreshSchedule struct {
+	nextRun map[string]time.Time
+}
+
+// ecrTokenLifetime is how long an ECR authorization token is valid
+const ecrTokenLifetime = 12 * time.Hour
+
+// globalRefreshInterval is --refresh-interval when set, otherwise --refresh-mins
+func globalRefreshInterval() time.Duration {
+	if *argRefreshInterval > 0 {
+		return *argRefreshInterval
+	}
+	return time.Duration(*argRefreshMinutes) * time.Minute
+}
+
+// namespaceRefreshInterval reads the namespace's annotation, falling back to
+// the global interval when it's missing or invalid
+func namespaceRefreshInterval(namespace api.Namespace) time.Duration {
+	value, ok := namespace.Annotations[refreshIntervalAnnotation]
+	if !ok {
+		return globalRefreshInterval()
+	}
+
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		log.Printf("Ignoring invalid %s annotation %q on namespace %s", refreshIntervalAnnotation, value, namespace.Name)
+		return globalRefreshInterval()
+	}
+	return interval
+}
+
+// due returns the namespaces whose next run has come, including namespaces
+// that haven't been refreshed yet. Namespaces that no longer exist are forgotten.
+func (s *refreshSchedule) due(namespaces []api.Namespace, now time.Time) []api.Namespace {
+	nextRun := map[string]time.Time{}
+	due := []api.Namespace{}
+	for _, namespace := range namespaces {
+		next, ok := s.nextRun[namespace.Name]
+		if ok {
+			nextRun[namespace.Name] = next
+		}
+		if !ok || !now.Before(next) {
+			due = append(due, namespace)
+		}
+	}
+	s.nextRun = nextRun
+	return due
+}
+
+// refreshed schedules the next run of each namespace one interval after now
+func (s *refreshSchedule) refreshed(namespaces []api.Namespace, now time.Time) {
+	if s.nextRun == nil {
+		s.nextRun = map[string]time.Time{}
+	}
+	for _, namespace := range namespaces {
+		s.nextRun[namespace.Name] = now.Add(namespaceRefreshInterval(namespace))
+	}
+}
+
+// next returns when the earliest namespace is due, or one global interval
+// from now when nothing is scheduled
+func (s *refreshSchedule) next(now time.Time) time.Time {
+	next := now.Add(globalRefreshInterval())
+	for _, run := range s.nextRun {
+		if run.Before(next) {
+			next = run
+		}
+	}
+	return next
+}
+
+// refreshNow makes a namespace due on the next run, like one never refreshed
+func (s *refreshSchedule) refreshNow(namespace string) {
+	delete(s.nextRun, namespace)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util/clock"
+)
+
+func TestNamespaceRefreshInterval(t *testing.T) {
+	namespace := api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace1"}}
+	assert.Equal(t, globalRefreshInterval(), namespaceRefreshInterval(namespace))
+
+	namespace.Annotations = map[string]string{refreshIntervalAnnotation: "15m"}
+	assert.Equal(t, 15*time.Minute, namespaceRefreshInterval(namespace))
+
+	namespace.Annotations[refreshIntervalAnnotation] = "soon"
+	assert.Equal(t, globalRefreshInterval(), namespaceRefreshInterval(namespace))
+
+	namespace.Annotations[refreshIntervalAnnotation] = "-5m"
+	assert.Equal(t, globalRefreshInterval(), namespaceRefreshInterval(namespace))
+}
+
+func TestGlobalRefreshInterval(t *testing.T) {
+	assert.Equal(t, time.Hour, globalRefreshInterval())
+
+	*argRefreshInterval = 30 * time.Minute
+	defer func() { *argRefreshInterval = 0 }()
+	assert.Equal(t, 30*time.Minute, globalRefreshInterval())
+
+	namespace := api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace1"}}
+	assert.Equal(t, 30*time.Minute, namespaceRefreshInterval(namespace))
+	assert.Equal(t, 90*time.Minute, readinessMaxStaleness())
+}
+
+func TestRefreshScheduleAnnotatedNamespaceIsSooner(t *testing.T) {
+	now := time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC)
+	namespaces := []api.Namespace{
+		{ObjectMeta: api.ObjectMeta{Name: "fast", Annotations: map[string]string{refreshIntervalAnnotation: "15m"}}},
+		{ObjectMeta: api.ObjectMeta{Name: "default"}},
+	}
+
+	s := &refreshSchedule{}
+	assert.Equal(t, 2, len(s.due(namespaces, now)))
+	s.refreshed(namespaces, now)
+
+	assert.Equal(t, now.Add(15*time.Minute), s.next(now))
+	assert.Equal(t, 0, len(s.due(namespaces, now.Add(14*time.Minute))))
+
+	due := s.due(namespaces, now.Add(15*time.Minute))
+	assert.Equal(t, 1, len(due))
+	assert.Equal(t, "fast", due[0].Name)
+
+	due = s.due(namespaces, now.Add(globalRefreshInterval()))
+	assert.Equal(t, 2, len(due))
+}
+
+func TestRefreshScheduleForgetsDeletedNamespaces(t *testing.T) {
+	now := time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC)
+	s := &refreshSchedule{}
+	s.refreshed([]api.Namespace{{ObjectMeta: api.ObjectMeta{Name: "gone"}}}, now)
+
+	s.due([]api.Namespace{}, now)
+	assert.Equal(t, 0, len(s.nextRun))
+	assert.Equal(t, now.Add(globalRefreshInterval()), s.next(now))
+}
+
+func TestProcessOnlyRefreshesDueNamespaces(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	kubeClient := newFakeKubeClient()
+	kubeClient.namespaces.store["namespace1"] = api.Namespace{
+		ObjectMeta: api.ObjectMeta{Name: "namespace1", Annotations: map[string]string{refreshIntervalAnnotation: "15m"}},
+	}
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient(), clock: fakeClock, schedule: &refreshSchedule{}}
+
+	assert.Nil(t, c.process())
+
+	// Nothing is due yet, so deleted secrets stay deleted
+	kubeClient.secrets["namespace1"].Delete(*argGCRSecretName)
+	kubeClient.secrets["namespace2"].Delete(*argGCRSecretName)
+	fakeClock.Step(time.Minute)
+	assert.Nil(t, c.process())
+	_, err := c.kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.NotNil(t, err)
+
+	// Only the annotated namespace is due after 15 minutes
+	fakeClock.Step(14 * time.Minute)
+	assert.Nil(t, c.process())
+	_, err = c.kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+	_, err = c.kubeClient.Secrets("namespace2").Get(*argGCRSecretName)
+	assert.NotNil(t, err)
+
+	// The other namespace follows the global interval
+	fakeClock.Step(globalRefreshInterval())
+	assert.Nil(t, c.process())
+	_, err = c.kubeClient.Secrets("namespace2").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,134 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+const (
+	secretFormatDefault = "default"
+	secretFormatBoth    = "both"
+
+	// legacySecretSuffix is appended to the name of the .dockercfg secret when
+	// --split-secret-formats writes each format as its own secret
+	legacySecretSuffix = "-legacy"
+)
+
+func validSecretFormat(format string) bool {
+	return format == secretFormatDefault || format == secretFormatBoth
+}
+
+// legacySecretName is the name of the split-out .dockercfg secret
+func legacySecretName(name string) string {
+	return name + legacySecretSuffix
+}
+
+// applySecretFormat returns the secrets to write for a generated secret. By
+// default that's the secret itself. With --secret-format=both the secret holds
+// its docker config under both .dockerconfigjson and .dockercfg, or with
+// --split-secret-formats is split into <name> holding .dockerconfigjson and
+// <name>-legacy holding .dockercfg, each of the matching type.
+func applySecretFormat(secret *api.Secret) ([]*api.Secret, error) {
+	if *argSecretFormat != secretFormatBoth {
+		return []*api.Secret{secret}, nil
+	}
+
+	configJSON, dockercfg, err := dockerConfigFormats(secret)
+	if err != nil {
+		return nil, fmt.Errorf("converting secret %s to both formats: %v", secret.Name, err)
+	}
+
+	if !*argSplitSecretFormats {
+		secret.Data[api.DockerConfigJsonKey] = configJSON
+		secret.Data[api.DockerConfigKey] = dockercfg
+		return []*api.Secret{secret}, nil
+	}
+
+	legacy := &api.Secret{
+		ObjectMeta: api.ObjectMeta{
+			Name:   legacySecretName(secret.Name),
+			Labels: copyStringMap(secret.Labels),
+		},
+		Data: map[string][]byte{api.DockerConfigKey: dockercfg},
+		Type: api.SecretTypeDockercfg,
+	}
+	secret.Data = map[string][]byte{api.DockerConfigJsonKey: configJSON}
+	secret.Type = api.SecretTypeDockerConfigJson
+	return []*api.Secret{secret, legacy}, nil
+}
+
+// dockerConfigFormats returns a secret's docker config in config.json format
+// and in the legacy .dockercfg format, which is the config.json auths map
+func dockerConfigFormats(secret *api.Secret) ([]byte, []byte, error) {
+	if dockercfg, ok := secret.Data[api.DockerConfigKey]; ok {
+		return []byte(fmt.Sprintf(`{"auths":%s}`, dockercfg)), dockercfg, nil
+	}
+
+	configJSON, ok := secret.Data[api.DockerConfigJsonKey]
+	if !ok {
+		return nil, nil, fmt.Errorf("no docker config found")
+	}
+	var config struct {
+		Auths map[string]json.RawMessage `json:"auths"`
+	}
+	if err := json.Unmarshal(configJSON, &config); err != nil {
+		return nil, nil, err
+	}
+	dockercfg, err := json.Marshal(config.Auths)
+	if err != nil {
+		return nil, nil, err
+	}
+	return configJSON, dockercfg, nil
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(m))
+	for k, v := range m {
+		copied[k] = v
+	}
+	return copied
+}
+
+// copySecret copies a secret deep enough that changing its labels,
+// annotations or data leaves the original alone
+func copySecret(secret *api.Secret) *api.Secret {
+	copied := *secret
+	copied.Labels = copyStringMap(secret.Labels)
+	copied.Annotations = copyStringMap(secret.Annotations)
+	if secret.Data != nil {
+		copied.Data = make(map[string][]byte, len(secret.Data))
+		for k, v := range secret.Data {
+			copied.Data[k] = v
+		}
+	}
+	return &copied
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+func TestApplySecretFormatDefault(t *testing.T) {
+	secret := generateSecretObj("fakeToken", "fakeEndpoint", false, "secretName")
+	secrets, err := applySecretFormat(secret)
+	assert.Nil(t, err)
+	assert.Equal(t, []*api.Secret{secret}, secrets)
+	assert.Equal(t, 1, len(secret.Data))
+}
+
+func TestApplySecretFormatBoth(t *testing.T) {
+	*argSecretFormat = secretFormatBoth
+	defer func() { *argSecretFormat = secretFormatDefault }()
+
+	secret := generateSecretObj("fakeToken", "fakeEndpoint", true, "secretName")
+	secrets, err := applySecretFormat(secret)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(secrets))
+	assert.Equal(t, api.SecretTypeDockerConfigJson, secrets[0].Type)
+	assert.Equal(t, `{"auths":{"fakeEndpoint":{"auth":"fakeToken","email":"none"}}}`, string(secrets[0].Data[api.DockerConfigJsonKey]))
+	assert.Equal(t, `{"fakeEndpoint":{"auth":"fakeToken","email":"none"}}`, string(secrets[0].Data[api.DockerConfigKey]))
+}
+
+func TestProcessSplitSecretFormats(t *testing.T) {
+	*argSecretFormat = secretFormatBoth
+	*argSplitSecretFormats = true
+	defer func() {
+		*argSecretFormat = secretFormatDefault
+		*argSplitSecretFormats = false
+	}()
+
+	kubeClient := newFakeKubeClient()
+	*argGCRURL = "fakeEndpoint"
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	for _, name := range []string{*argGCRSecretName, *argAWSSecretName} {
+		secret, err := c.kubeClient.Secrets("namespace1").Get(name)
+		assert.Nil(t, err)
+		assert.Equal(t, api.SecretTypeDockerConfigJson, secret.Type)
+		assert.Equal(t, 1, len(secret.Data))
+
+		legacy, err := c.kubeClient.Secrets("namespace1").Get(legacySecretName(name))
+		assert.Nil(t, err)
+		assert.Equal(t, api.SecretTypeDockercfg, legacy.Type)
+		assert.Equal(t, 1, len(legacy.Data))
+		assert.Equal(t, managedByValue, legacy.Labels[managedByLabel])
+
+		// Both secrets hold the same credentials
+		var config dockerConfigJSON
+		assert.Nil(t, json.Unmarshal(secret.Data[api.DockerConfigJsonKey], &config))
+		var dockercfg map[string]dockerConfigEntry
+		assert.Nil(t, json.Unmarshal(legacy.Data[api.DockerConfigKey], &dockercfg))
+		assert.Equal(t, config.Auths, dockercfg)
+	}
+
+	serviceAccount, err := c.kubeClient.ServiceAccounts("namespace1").Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, []api.LocalObjectReference{
+		{Name: *argGCRSecretName},
+		{Name: legacySecretName(*argGCRSecretName)},
+		{Name: *argAWSSecretName},
+		{Name: legacySecretName(*argAWSSecretName)},
+	}, serviceAccount.ImagePullSecrets)
+}
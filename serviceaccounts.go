@@ -0,0 +1,295 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/api/v1"
+	"k8s.io/kubernetes/pkg/labels"
+	"k8s.io/kubernetes/pkg/runtime"
+)
+
+// imagePullSecretsHistogram tracks how many ImagePullSecrets patched service
+// accounts have, without a series per service account. Observations that
+// keep moving into higher buckets mean references are being duplicated.
+var imagePullSecretsHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "registry_creds_service_account_image_pull_secrets",
+	Help:    "Number of ImagePullSecrets on a service account after the controller patched it",
+	Buckets: []float64{1, 2, 3, 4, 5, 10, 20, 50},
+})
+
+func init() {
+	prometheus.MustRegister(imagePullSecretsHistogram)
+}
+
+// serviceAccountSettings holds service account fields newer than the vendored
+// API types. A typed Update would silently drop them, so service accounts are
+// patched instead and these are read back from the raw response.
+type serviceAccountSettings struct {
+	AutomountServiceAccountToken *bool `json:"automountServiceAccountToken,omitempty"`
+}
+
+// newNamespaceSAPollInterval is how often a just-created namespace is checked
+// for its default service account
+const newNamespaceSAPollInterval = time.Second
+
+// waitForDefaultServiceAccount waits up to --new-namespace-sa-wait for the
+// default service account of a namespace created less than that long ago. The
+// service account controller creates it shortly after the namespace, so a
+// refresh that catches the namespace in between would otherwise fail.
+func (c *controller) waitForDefaultServiceAccount(namespace api.Namespace) error {
+	if *argNewNamespaceSAWait <= 0 || *argServiceAccountSelector != "" || !namedServiceAccount("default") {
+		return nil
+	}
+	if c.now().Sub(namespace.CreationTimestamp.Time) > *argNewNamespaceSAWait {
+		return nil
+	}
+
+	deadline := c.now().Add(*argNewNamespaceSAWait)
+	for {
+		_, err := c.getServiceAccount(namespace.Name, "default")
+		if err == nil || !c.now().Before(deadline) {
+			return err
+		}
+		log.Printf("Waiting for the default service account of new namespace %s", namespace.Name)
+		c.sleep(newNamespaceSAPollInterval)
+	}
+}
+
+// namedServiceAccount reports whether --service-accounts lists the service account
+func namedServiceAccount(name string) bool {
+	for _, serviceAccount := range *argServiceAccounts {
+		if serviceAccount == name {
+			return true
+		}
+	}
+	return false
+}
+
+// skipServiceAccountAnnotation set to "true" on a service account keeps the
+// controller from changing its ImagePullSecrets
+const skipServiceAccountAnnotation = "registry-creds.io/skip"
+
+// targetServiceAccounts returns the service accounts in a namespace that
+// should reference the secrets: those named by --service-accounts that exist,
+// every service account matching --service-account-selector, or with
+// --all-service-accounts every service account. --exclude-service-accounts and
+// skipServiceAccountAnnotation win over all of these, so an excluded service
+// account is skipped even when it matches.
+func (c *controller) targetServiceAccounts(namespace string) ([]*api.ServiceAccount, error) {
+	serviceAccounts := []*api.ServiceAccount{}
+	switch {
+	case *argAllServiceAccounts:
+		var err error
+		serviceAccounts, err = c.listServiceAccounts(namespace, labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+	case *argServiceAccountSelector == "":
+		for _, name := range *argServiceAccounts {
+			serviceAccount, err := c.getServiceAccount(namespace, name)
+			if errors.IsNotFound(err) {
+				log.Printf("Service account %s not found in namespace %s, skipping", name, namespace)
+				c.recordNamespaceSkippedOnce(namespace, skipReasonMissingSA)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			serviceAccounts = append(serviceAccounts, serviceAccount)
+		}
+	default:
+		selector, err := labels.Parse(*argServiceAccountSelector)
+		if err != nil {
+			return nil, err
+		}
+		serviceAccounts, err = c.listServiceAccounts(namespace, selector)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	excluded := map[string]bool{}
+	for _, name := range *argExcludeServiceAccounts {
+		excluded[name] = true
+	}
+
+	targets := []*api.ServiceAccount{}
+	for _, serviceAccount := range serviceAccounts {
+		if !excluded[serviceAccount.Name] && serviceAccount.Annotations[skipServiceAccountAnnotation] != "true" {
+			targets = append(targets, serviceAccount)
+		}
+	}
+	return targets, nil
+}
+
+// listServiceAccounts lists the service accounts matching selector, from the informer cache when enabled
+func (c *controller) listServiceAccounts(namespace string, selector labels.Selector) ([]*api.ServiceAccount, error) {
+	if c.cache != nil {
+		return c.cache.listServiceAccounts(namespace, selector), nil
+	}
+
+	list, err := c.kubeClient.ServiceAccounts(namespace).List(api.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+
+	serviceAccounts := []*api.ServiceAccount{}
+	for i := range list.Items {
+		serviceAccounts = append(serviceAccounts, &list.Items[i])
+	}
+	return serviceAccounts, nil
+}
+
+// addPullSecretReference references the secret from the service account. With
+// --verify-service-account-updates the service account is read back from the
+// API server afterwards, and if a concurrent write lost the reference it's
+// added again to the service account as read, up to --secret-write-retries times.
+func (c *controller) addPullSecretReference(namespace string, serviceAccount *api.ServiceAccount, secretName string) (*api.ServiceAccount, error) {
+	addReference := func(imagePullSecrets []api.LocalObjectReference) []api.LocalObjectReference {
+		for _, imagePullSecret := range imagePullSecrets {
+			if imagePullSecret.Name == secretName {
+				return imagePullSecrets
+			}
+		}
+		return append(imagePullSecrets, api.LocalObjectReference{Name: secretName})
+	}
+
+	backoff := secretWriteBackoff
+	for attempt := 0; ; attempt++ {
+		updated, err := c.editServiceAccountPullSecrets(namespace, serviceAccount, addReference)
+		if err != nil || !*argVerifyServiceAccountUpdates {
+			return updated, err
+		}
+
+		persisted, err := c.kubeClient.ServiceAccounts(namespace).Get(serviceAccount.Name)
+		if err != nil {
+			return nil, err
+		}
+		if referencesSecret(persisted, secretName) {
+			return persisted, nil
+		}
+		if attempt >= *argSecretWriteRetries {
+			return nil, fmt.Errorf("reference to %s was lost from service account %s/%s after %d attempts", secretName, namespace, serviceAccount.Name, attempt+1)
+		}
+		log.Printf("Reference to %s was lost from service account %s/%s, adding it again", secretName, namespace, serviceAccount.Name)
+		c.sleep(backoff)
+		backoff *= 2
+		serviceAccount = persisted
+	}
+}
+
+// referencesSecret reports whether the service account has the secret in its ImagePullSecrets
+func referencesSecret(serviceAccount *api.ServiceAccount, secretName string) bool {
+	for _, imagePullSecret := range serviceAccount.ImagePullSecrets {
+		if imagePullSecret.Name == secretName {
+			return true
+		}
+	}
+	return false
+}
+
+// editServiceAccountPullSecrets writes the ImagePullSecrets edit returns for
+// the service account's current ones. The write is guarded by the resource
+// version the service account was read at, which is stale when the informer
+// cache lags behind, so on a conflict the service account is read again from
+// the API server and edited again, up to --secret-write-retries times. The
+// service account passed in is left unchanged.
+func (c *controller) editServiceAccountPullSecrets(namespace string, serviceAccount *api.ServiceAccount, edit func([]api.LocalObjectReference) []api.LocalObjectReference) (*api.ServiceAccount, error) {
+	for attempt := 0; ; attempt++ {
+		edited := *serviceAccount
+		edited.ImagePullSecrets = edit(append([]api.LocalObjectReference{}, serviceAccount.ImagePullSecrets...))
+		updated, err := c.updateServiceAccountPullSecrets(namespace, &edited)
+		if !errors.IsConflict(err) || attempt >= *argSecretWriteRetries {
+			return updated, err
+		}
+
+		log.Printf("Service account %s/%s changed since it was read, reading it again", namespace, serviceAccount.Name)
+		serviceAccount, err = c.kubeClient.ServiceAccounts(namespace).Get(serviceAccount.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// updateServiceAccountPullSecrets writes the service account's ImagePullSecrets
+// with a merge patch, leaving every other field as the API server has it
+func (c *controller) updateServiceAccountPullSecrets(namespace string, serviceAccount *api.ServiceAccount) (*api.ServiceAccount, error) {
+	imagePullSecrets := []v1.LocalObjectReference{}
+	for _, imagePullSecret := range serviceAccount.ImagePullSecrets {
+		imagePullSecrets = append(imagePullSecrets, v1.LocalObjectReference{Name: imagePullSecret.Name})
+	}
+
+	patch := map[string]interface{}{
+		"imagePullSecrets": imagePullSecrets,
+	}
+	if serviceAccount.ResourceVersion != "" {
+		patch["metadata"] = map[string]string{"resourceVersion": serviceAccount.ResourceVersion}
+	}
+
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := c.kubeClient.PatchServiceAccount(namespace, serviceAccount.Name, api.MergePatchType, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var settings serviceAccountSettings
+	if err := json.Unmarshal(raw, &settings); err != nil {
+		return nil, err
+	}
+	if settings.AutomountServiceAccountToken != nil && !*settings.AutomountServiceAccountToken {
+		log.Printf("Service account %s/%s has automountServiceAccountToken disabled, image pull secrets still apply", namespace, serviceAccount.Name)
+	}
+
+	obj, err := runtime.Decode(api.Codecs.UniversalDecoder(), raw)
+	if err != nil {
+		return nil, err
+	}
+	updated, ok := obj.(*api.ServiceAccount)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object %T patching service account %s/%s", obj, namespace, serviceAccount.Name)
+	}
+
+	imagePullSecretsHistogram.Observe(float64(len(updated.ImagePullSecrets)))
+	return updated, nil
+}
+
+// referencePullSecret adds a reference to a secret provisioned by someone else
+// to the service accounts in each namespace, with --reference-only. No token
+// is fetched and the secret itself is never read or written.
+func (c *controller) referencePullSecret(name string, namespaces []api.Namespace) error {
+	return c.writeSecret(&api.Secret{ObjectMeta: api.ObjectMeta{Name: name}}, namespaces)
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/errors"
+	apiunversioned "k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/util/clock"
+)
+
+func TestProcessPreservesAutomountServiceAccountToken(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	ecrClient := newFakeEcrClient()
+	gcrClient := newFakeGcrClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: gcrClient}
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	automount := false
+	kubeClient.serviceaccounts["namespace1"].settings = map[string]serviceAccountSettings{
+		"default": {AutomountServiceAccountToken: &automount},
+	}
+	kubeClient.serviceaccounts["namespace1"].store["default"].ResourceVersion = "7"
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	serviceAccount, err := c.kubeClient.ServiceAccounts("namespace1").Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(serviceAccount.ImagePullSecrets))
+
+	// Each patch only carries the references and the resource version guarding them
+	patches := kubeClient.serviceaccounts["namespace1"].patches
+	assert.Equal(t, 2, len(patches))
+	for _, patch := range patches {
+		var fields map[string]json.RawMessage
+		assert.Nil(t, json.Unmarshal(patch, &fields))
+		assert.Equal(t, 2, len(fields))
+		assert.Contains(t, fields, "imagePullSecrets")
+		assert.JSONEq(t, `{"resourceVersion":"7"}`, string(fields["metadata"]))
+		assert.NotContains(t, string(patch), "automountServiceAccountToken")
+	}
+
+	settings := kubeClient.serviceaccounts["namespace1"].settings["default"]
+	assert.NotNil(t, settings.AutomountServiceAccountToken)
+	assert.False(t, *settings.AutomountServiceAccountToken)
+
+	assert.Contains(t, out.String(), "Service account namespace1/default has automountServiceAccountToken disabled, image pull secrets still apply")
+}
+
+func TestUpdateServiceAccountPullSecretsOnlyPatchesPullSecrets(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient}
+
+	serviceAccount := &api.ServiceAccount{
+		ObjectMeta:       api.ObjectMeta{Name: "default"},
+		ImagePullSecrets: []api.LocalObjectReference{{Name: "someSecret"}},
+	}
+
+	updated, err := c.updateServiceAccountPullSecrets("namespace1", serviceAccount)
+	assert.Nil(t, err)
+	assert.Equal(t, "default", updated.Name)
+	assert.Equal(t, []api.LocalObjectReference{{Name: "someSecret"}}, updated.ImagePullSecrets)
+
+	// A merge patch that sets nothing but the references
+	serviceAccounts := kubeClient.serviceaccounts["namespace1"]
+	assert.Equal(t, []api.PatchType{api.MergePatchType}, serviceAccounts.patchTypes)
+	assert.Equal(t, 1, len(serviceAccounts.patches))
+	assert.JSONEq(t, `{"imagePullSecrets":[{"name":"someSecret"}]}`, string(serviceAccounts.patches[0]))
+
+	_, err = c.updateServiceAccountPullSecrets("missing", serviceAccount)
+	assert.NotNil(t, err)
+}
+
+func imagePullSecretsObserved(t *testing.T) (uint64, float64) {
+	m := &dto.Metric{}
+	assert.Nil(t, imagePullSecretsHistogram.Write(m))
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestProcessRecordsImagePullSecretsHistogram(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	kubeClient.serviceaccounts["namespace1"].store["default"].ImagePullSecrets = []api.LocalObjectReference{{Name: "someOtherSecret"}}
+
+	count, sum := imagePullSecretsObserved(t)
+	err := c.process()
+	assert.Nil(t, err)
+
+	// One observation per patch, each provider's pass patches both namespaces:
+	// namespace1 goes to 2 then 3 references, namespace2 to 1 then 2
+	observedCount, observedSum := imagePullSecretsObserved(t)
+	assert.Equal(t, uint64(4), observedCount-count)
+	assert.Equal(t, float64(8), observedSum-sum)
+}
+
+func TestProcessServiceAccountSelectorWithExclude(t *testing.T) {
+	*argServiceAccountSelector = "pull-secrets=inject"
+	*argExcludeServiceAccounts = []string{"build"}
+	defer func() {
+		*argServiceAccountSelector = ""
+		*argExcludeServiceAccounts = nil
+	}()
+
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	store := kubeClient.serviceaccounts["namespace1"].store
+	for _, name := range []string{"default", "app", "build"} {
+		store[name] = &api.ServiceAccount{
+			ObjectMeta: api.ObjectMeta{Name: name, Labels: map[string]string{"pull-secrets": "inject"}},
+		}
+	}
+	store["unlabelled"] = &api.ServiceAccount{ObjectMeta: api.ObjectMeta{Name: "unlabelled"}}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	for name, expected := range map[string]int{"default": 2, "app": 2, "build": 0, "unlabelled": 0} {
+		serviceAccount, err := c.kubeClient.ServiceAccounts("namespace1").Get(name)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, len(serviceAccount.ImagePullSecrets), name)
+	}
+}
+
+func TestProcessSkipServiceAccountAnnotation(t *testing.T) {
+	*argAllServiceAccounts = true
+	defer func() { *argAllServiceAccounts = false }()
+
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	store := kubeClient.serviceaccounts["namespace1"].store
+	store["app"] = &api.ServiceAccount{ObjectMeta: api.ObjectMeta{Name: "app"}}
+	store["self-managed"] = &api.ServiceAccount{
+		ObjectMeta:       api.ObjectMeta{Name: "self-managed", Annotations: map[string]string{skipServiceAccountAnnotation: "true"}},
+		ImagePullSecrets: []api.LocalObjectReference{{Name: "team-secret"}},
+	}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	// The secrets are still written, only the annotated service account is left alone
+	_, err = c.kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+	app, err := c.kubeClient.ServiceAccounts("namespace1").Get("app")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(app.ImagePullSecrets))
+	selfManaged, err := c.kubeClient.ServiceAccounts("namespace1").Get("self-managed")
+	assert.Nil(t, err)
+	assert.Equal(t, []api.LocalObjectReference{{Name: "team-secret"}}, selfManaged.ImagePullSecrets)
+}
+
+func TestProcessAllServiceAccounts(t *testing.T) {
+	*argAllServiceAccounts = true
+	*argExcludeServiceAccounts = []string{"build"}
+	defer func() {
+		*argAllServiceAccounts = false
+		*argExcludeServiceAccounts = nil
+	}()
+
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	store := kubeClient.serviceaccounts["namespace1"].store
+	for _, name := range []string{"app", "build", "worker"} {
+		store[name] = &api.ServiceAccount{ObjectMeta: api.ObjectMeta{Name: name}}
+	}
+	// One reference already exists and must not be added twice
+	store["worker"].ImagePullSecrets = []api.LocalObjectReference{{Name: *argAWSSecretName}}
+
+	// Refreshing again must not duplicate any reference
+	for i := 0; i < 2; i++ {
+		err := c.process()
+		assert.Nil(t, err)
+	}
+
+	for name, expected := range map[string]int{"default": 2, "app": 2, "build": 0, "worker": 2} {
+		serviceAccount, err := c.kubeClient.ServiceAccounts("namespace1").Get(name)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, len(serviceAccount.ImagePullSecrets), name)
+	}
+
+	serviceAccount, err := c.kubeClient.ServiceAccounts("namespace2").Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(serviceAccount.ImagePullSecrets))
+}
+
+func TestExcludeDefaultServiceAccount(t *testing.T) {
+	*argExcludeServiceAccounts = []string{"default"}
+	defer func() { *argExcludeServiceAccounts = nil }()
+
+	c := &controller{kubeClient: newFakeKubeClient()}
+
+	serviceAccounts, err := c.targetServiceAccounts("namespace1")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(serviceAccounts))
+}
+
+// lateServiceAccounts hides the default service account for the first few gets,
+// as if the service account controller hadn't created it yet
+type lateServiceAccounts struct {
+	*fakeServiceAccounts
+	missing int
+}
+
+func (l *lateServiceAccounts) Get(name string) (*api.ServiceAccount, error) {
+	if l.missing > 0 {
+		l.missing--
+		return nil, errors.NewNotFound(api.Resource("serviceaccounts"), name)
+	}
+	return l.fakeServiceAccounts.Get(name)
+}
+
+type lateServiceAccountsKubeClient struct {
+	*fakeKubeClient
+	serviceAccounts *lateServiceAccounts
+}
+
+func (l *lateServiceAccountsKubeClient) ServiceAccounts(namespace string) unversioned.ServiceAccountsInterface {
+	if namespace == "namespace1" {
+		return l.serviceAccounts
+	}
+	return l.fakeKubeClient.ServiceAccounts(namespace)
+}
+
+func TestProcessWaitsForNewNamespaceServiceAccount(t *testing.T) {
+	*argNewNamespaceSAWait = 10 * time.Second
+	defer func() { *argNewNamespaceSAWait = 0 }()
+
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	fake := newFakeKubeClient()
+	fake.namespaces.store["namespace1"] = api.Namespace{ObjectMeta: api.ObjectMeta{
+		Name:              "namespace1",
+		CreationTimestamp: apiunversioned.NewTime(fakeClock.Now()),
+	}}
+	kubeClient := &lateServiceAccountsKubeClient{
+		fakeKubeClient:  fake,
+		serviceAccounts: &lateServiceAccounts{fakeServiceAccounts: fake.serviceaccounts["namespace1"], missing: 3},
+	}
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	err := c.process()
+	assert.Nil(t, err)
+	assert.Equal(t, 3*newNamespaceSAPollInterval, fakeClock.Since(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC)))
+
+	serviceAccount, err := kubeClient.ServiceAccounts("namespace1").Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(serviceAccount.ImagePullSecrets))
+}
+
+func TestProcessGivesUpWaitingForServiceAccount(t *testing.T) {
+	*argNewNamespaceSAWait = 10 * time.Second
+	defer func() { *argNewNamespaceSAWait = 0 }()
+
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	fake := newFakeKubeClient()
+	fake.namespaces.store["namespace1"] = api.Namespace{ObjectMeta: api.ObjectMeta{
+		Name:              "namespace1",
+		CreationTimestamp: apiunversioned.NewTime(fakeClock.Now()),
+	}}
+	kubeClient := &lateServiceAccountsKubeClient{
+		fakeKubeClient:  fake,
+		serviceAccounts: &lateServiceAccounts{fakeServiceAccounts: fake.serviceaccounts["namespace1"], missing: 100},
+	}
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	err := c.process()
+	assert.NotNil(t, err)
+}
+
+func TestUpdateServiceAccountPullSecretsPatchesOnlyImagePullSecrets(t *testing.T) {
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient}
+
+	serviceAccount := &api.ServiceAccount{
+		ObjectMeta:       api.ObjectMeta{Name: "default", Namespace: "namespace1", ResourceVersion: "42", Labels: map[string]string{"team": "a"}},
+		Secrets:          []api.ObjectReference{{Name: "default-token"}},
+		ImagePullSecrets: []api.LocalObjectReference{{Name: *argAWSSecretName}},
+	}
+	_, err := c.updateServiceAccountPullSecrets("namespace1", serviceAccount)
+	assert.Nil(t, err)
+
+	patches := kubeClient.serviceaccounts["namespace1"].patches
+	assert.Equal(t, 1, len(patches))
+	var patch map[string]interface{}
+	assert.Nil(t, json.Unmarshal(patches[0], &patch))
+	// Only the references change, the resource version guards against a concurrent write
+	assert.Equal(t, map[string]interface{}{
+		"imagePullSecrets": []interface{}{map[string]interface{}{"name": *argAWSSecretName}},
+		"metadata":         map[string]interface{}{"resourceVersion": "42"},
+	}, patch)
+}
+
+// droppingKubeClient loses the first service account patch it's sent, as if a
+// concurrent writer replaced the service account right after it
+type droppingKubeClient struct {
+	*fakeKubeClient
+	patches int
+}
+
+func (d *droppingKubeClient) PatchServiceAccount(namespace, name string, pt api.PatchType, data []byte) ([]byte, error) {
+	d.patches++
+	raw, err := d.fakeKubeClient.PatchServiceAccount(namespace, name, pt, data)
+	if err == nil && d.patches == 1 {
+		d.fakeKubeClient.serviceaccounts[namespace].store[name].ImagePullSecrets = nil
+	}
+	return raw, err
+}
+
+func TestProcessVerifiesServiceAccountUpdates(t *testing.T) {
+	*argVerifyServiceAccountUpdates = true
+	defer func() { *argVerifyServiceAccountUpdates = false }()
+	kubeClient := &droppingKubeClient{fakeKubeClient: newFakeKubeClient()}
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient(), clock: clock.NewFakeClock(time.Now())}
+	c.disabledProviders = map[string]bool{providerGCR: true}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	// The dropped patch is noticed and applied again
+	serviceAccount, err := kubeClient.ServiceAccounts("namespace1").Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, []api.LocalObjectReference{{Name: *argAWSSecretName}}, serviceAccount.ImagePullSecrets)
+	assert.Equal(t, 3, kubeClient.patches)
+}
+
+func TestProcessReferenceOnly(t *testing.T) {
+	*argReferenceOnly = true
+	defer func() { *argReferenceOnly = false }()
+
+	kubeClient := newFakeKubeClient()
+	ecrClient := &flakyEcrClient{}
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: newFakeGcrClient()}
+
+	// An externally provisioned secret is left exactly as it is
+	external := &api.Secret{ObjectMeta: api.ObjectMeta{Name: *argAWSSecretName, Namespace: "namespace1"}, Data: map[string][]byte{"from": []byte("vault")}}
+	kubeClient.secrets["namespace1"].store[*argAWSSecretName] = external
+
+	err := c.process()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, ecrClient.calls)
+
+	assert.Equal(t, map[string]*api.Secret{*argAWSSecretName: external}, kubeClient.secrets["namespace1"].store)
+	assert.Equal(t, 0, len(kubeClient.secrets["namespace2"].store))
+
+	for _, namespace := range []string{"namespace1", "namespace2"} {
+		serviceAccount, err := kubeClient.ServiceAccounts(namespace).Get("default")
+		assert.Nil(t, err)
+		assert.Equal(t, []api.LocalObjectReference{{Name: *argGCRSecretName}, {Name: *argAWSSecretName}}, serviceAccount.ImagePullSecrets)
+	}
+}
+
+func TestProcessNamedServiceAccounts(t *testing.T) {
+	defer func(names []string) { *argServiceAccounts = names }(*argServiceAccounts)
+	*argServiceAccounts = []string{"builder", "deployer"}
+
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	// builder only exists in namespace1, deployer in both
+	kubeClient.serviceaccounts["namespace1"].store["builder"] = &api.ServiceAccount{ObjectMeta: api.ObjectMeta{Name: "builder"}}
+	for _, namespace := range []string{"namespace1", "namespace2"} {
+		kubeClient.serviceaccounts[namespace].store["deployer"] = &api.ServiceAccount{ObjectMeta: api.ObjectMeta{Name: "deployer"}}
+	}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	expected := []api.LocalObjectReference{{Name: *argGCRSecretName}, {Name: *argAWSSecretName}}
+	for _, name := range []string{"builder", "deployer"} {
+		serviceAccount, err := kubeClient.ServiceAccounts("namespace1").Get(name)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, serviceAccount.ImagePullSecrets)
+	}
+	serviceAccount, err := kubeClient.ServiceAccounts("namespace2").Get("deployer")
+	assert.Nil(t, err)
+	assert.Equal(t, expected, serviceAccount.ImagePullSecrets)
+
+	serviceAccount, err = kubeClient.ServiceAccounts("namespace1").Get("default")
+	assert.Nil(t, err)
+	assert.Empty(t, serviceAccount.ImagePullSecrets)
+}
+
+// conflictingKubeClient rejects the first service account patch in each
+// namespace with a conflict, after another writer added a reference the patch
+// didn't know about
+type conflictingKubeClient struct {
+	*fakeKubeClient
+	mu         sync.Mutex
+	conflicted map[string]bool
+}
+
+func (c *conflictingKubeClient) PatchServiceAccount(namespace, name string, pt api.PatchType, data []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.conflicted[namespace] {
+		c.conflicted[namespace] = true
+		serviceAccount := c.fakeKubeClient.serviceaccounts[namespace].store[name]
+		serviceAccount.ImagePullSecrets = append(serviceAccount.ImagePullSecrets, api.LocalObjectReference{Name: "other"})
+		return nil, errors.NewConflict(api.Resource("serviceaccounts"), name, nil)
+	}
+	return c.fakeKubeClient.PatchServiceAccount(namespace, name, pt, data)
+}
+
+func TestProcessRetriesServiceAccountConflict(t *testing.T) {
+	kubeClient := &conflictingKubeClient{fakeKubeClient: newFakeKubeClient(), conflicted: map[string]bool{}}
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+	c.disabledProviders = map[string]bool{providerGCR: true}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	// The stale patch is redone on the service account as read again, keeping the other writer's reference
+	serviceAccount, err := kubeClient.ServiceAccounts("namespace1").Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, []api.LocalObjectReference{{Name: "other"}, {Name: *argAWSSecretName}}, serviceAccount.ImagePullSecrets)
+}
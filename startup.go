@@ -0,0 +1,108 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+// startupRetryInterval is how often a failed startup refresh is retried
+// during --startup-probe-grace
+const startupRetryInterval = 30 * time.Second
+
+// randInt63n picks the startup jitter, tests replace it to get a known delay
+var randInt63n = rand.Int63n
+
+// startupDelay returns how long run() waits before the first refresh:
+// --startup-delay plus a random part of --startup-delay-jitter, so
+// controllers restarted together across a fleet don't all fetch tokens at once
+func startupDelay() time.Duration {
+	delay := *argStartupDelay
+	if *argStartupDelayJitter > 0 {
+		delay += time.Duration(randInt63n(int64(*argStartupDelayJitter)))
+	}
+	return delay
+}
+
+// awaitHealthyStartup retries a failed startup refresh every
+// startupRetryInterval until one succeeds for every provider, keeping /readyz
+// unready until then. It returns an error once --startup-probe-grace has
+// passed without a successful refresh, so the pod restarts.
+func (c *controller) awaitHealthyStartup(stopCh <-chan struct{}, err error) error {
+	deadline := c.now().Add(*argStartupProbeGrace)
+	for err != nil {
+		remaining := deadline.Sub(c.now())
+		if remaining <= 0 {
+			return fmt.Errorf("providers didn't refresh within startup-probe-grace of %v: %v", *argStartupProbeGrace, err)
+		}
+		wait := startupRetryInterval
+		if remaining < wait {
+			wait = remaining
+		}
+
+		log.Printf("Startup refresh failed, retrying in %v: %v", wait, err)
+		select {
+		case <-c.after(wait):
+		case <-stopCh:
+			return nil
+		}
+		c.refreshEveryNamespaceNext()
+		err = c.process()
+		c.writeStatusLine(err, c.nextRun(c.now()))
+	}
+
+	c.health.setAwaitingStartup(false)
+	return nil
+}
+
+// populateNewProviders refreshes the providers enabled since the controller
+// last ran in every namespace, on startup, so they don't wait for the first
+// scheduled refresh. The other providers' secrets and schedule are untouched.
+func (c *controller) populateNewProviders() error {
+	providers, err := c.newProviders()
+	if err != nil {
+		return err
+	}
+	if len(providers) == 0 {
+		return nil
+	}
+
+	names := []string{}
+	for provider := range providers {
+		names = append(names, provider)
+	}
+	sort.Strings(names)
+	log.Printf("Populating newly enabled providers in every namespace: %s", strings.Join(names, ", "))
+
+	only, schedule, cursor := c.onlyProviders, c.schedule, c.cursor
+	defer func() { c.onlyProviders, c.schedule, c.cursor = only, schedule, cursor }()
+	c.onlyProviders, c.schedule, c.cursor = providers, nil, nil
+	return c.process()
+}
@@ -0,0 +1,84 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// statusLineOutput is where --status-line writes, tests replace it
+var statusLineOutput io.Writer = os.Stderr
+
+// cycleStatus records which providers one process() refreshed
+type cycleStatus struct {
+	started   time.Time
+	providers []string
+	succeeded []string
+	failed    []string
+	// skipped holds the reason/namespace skips already counted, see
+	// recordNamespaceSkippedOnce
+	skipped map[string]bool
+}
+
+// providerSucceeded records a provider's successful refresh for /readyz and the status line
+func (c *controller) providerSucceeded(provider string) {
+	c.health.recordSuccess(provider, c.now())
+	c.cycle.succeeded = append(c.cycle.succeeded, provider)
+}
+
+// providerFailed records a provider's failed refresh for /readyz and the status line
+func (c *controller) providerFailed(provider string, err error) {
+	c.health.recordFailure(provider, err)
+	c.cycle.failed = append(c.cycle.failed, provider)
+}
+
+// writeStatusLine writes the --status-line summary of the last process() as
+// a single logfmt line. next is when the next refresh runs, zero when there
+// is none.
+func (c *controller) writeStatusLine(err error, next time.Time) {
+	if !*argStatusLine {
+		return
+	}
+
+	status := "ok"
+	if err != nil {
+		status = "failed"
+	}
+	nextRun := "none"
+	if !next.IsZero() {
+		nextRun = next.UTC().Format(time.RFC3339)
+	}
+	fmt.Fprintf(statusLineOutput, "msg=refresh_result status=%s providers=%q succeeded=%q failed=%q duration=%s next_run=%s\n",
+		status,
+		strings.Join(c.cycle.providers, ","),
+		strings.Join(c.cycle.succeeded, ","),
+		strings.Join(c.cycle.failed, ","),
+		c.now().Sub(c.cycle.started),
+		nextRun)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/util/clock"
+)
+
+func TestWriteStatusLine(t *testing.T) {
+	*argStatusLine = true
+	defer func() { *argStatusLine = false }()
+	var out bytes.Buffer
+	defer func(w io.Writer) { statusLineOutput = w }(statusLineOutput)
+	statusLineOutput = &out
+
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	ecrClient := &flakyEcrClient{}
+	c := &controller{kubeClient: newFakeKubeClient(), ecrClient: ecrClient, gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	err := c.process()
+	assert.Nil(t, err)
+	c.writeStatusLine(err, fakeClock.Now().Add(time.Hour))
+	assert.Equal(t, "msg=refresh_result status=ok providers=\"gcr,aws\" succeeded=\"gcr,aws\" failed=\"\" duration=0s next_run=2016-10-01T01:00:00Z\n", out.String())
+
+	// The duration includes the token retries' backoff, 1s, 2s then 4s
+	defer func(f func(int64) int64) { randInt63n = f }(randInt63n)
+	randInt63n = func(n int64) int64 { return n - 1 }
+	out.Reset()
+	ecrClient.err = fmt.Errorf("AccessDeniedException")
+	err = c.process()
+	assert.NotNil(t, err)
+	c.writeStatusLine(err, time.Time{})
+	assert.Equal(t, "msg=refresh_result status=failed providers=\"gcr,aws\" succeeded=\"gcr\" failed=\"aws\" duration=7s next_run=none\n", out.String())
+
+	// Nothing is written without the flag
+	*argStatusLine = false
+	out.Reset()
+	c.writeStatusLine(nil, time.Time{})
+	assert.Equal(t, "", out.String())
+}
@@ -0,0 +1,69 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import "log"
+
+// reconcileSummary counts what the refreshes since the last summary did
+type reconcileSummary struct {
+	Cycles                 int
+	FailedCycles           int
+	Namespaces             int
+	SecretsCreated         int
+	SecretsUpdated         int
+	SecretsUnchanged       int
+	ServiceAccountsUpdated int
+}
+
+// quietProgress reports whether per-refresh progress logs are replaced by
+// the --summary-log-interval summary. Errors are still logged as they happen.
+func quietProgress() bool {
+	return *argSummaryLogInterval > 0
+}
+
+// finishCycle counts a finished process() and logs the summary once
+// --summary-log-interval has passed since the last one, returning whether it did
+func (c *controller) finishCycle(namespaces int, err error) bool {
+	c.summary.Cycles++
+	c.summary.Namespaces += namespaces
+	if err != nil {
+		c.summary.FailedCycles++
+	}
+
+	if !quietProgress() {
+		return false
+	}
+	now := c.now()
+	if !c.lastSummary.IsZero() && now.Sub(c.lastSummary) < *argSummaryLogInterval {
+		return false
+	}
+
+	s := c.summary
+	log.Printf("Summary of the last %d refreshes (%d failed): %d namespaces checked, %d secrets created, %d updated, %d unchanged, %d service accounts updated",
+		s.Cycles, s.FailedCycles, s.Namespaces, s.SecretsCreated, s.SecretsUpdated, s.SecretsUnchanged, s.ServiceAccountsUpdated)
+	c.summary = reconcileSummary{}
+	c.lastSummary = now
+	return true
+}
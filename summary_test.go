@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/util/clock"
+)
+
+func TestSummaryLogInterval(t *testing.T) {
+	*argSummaryLogInterval = 10 * time.Minute
+	defer func() { *argSummaryLogInterval = 0 }()
+
+	start := time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFakeClock(start)
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	// The first refresh is summarized straight away
+	assert.Nil(t, c.process())
+	assert.Equal(t, start, c.lastSummary)
+	assert.Equal(t, reconcileSummary{}, c.summary)
+
+	// Later refreshes are counted until the interval has passed
+	fakeClock.Step(5 * time.Minute)
+	assert.Nil(t, c.process())
+	assert.Equal(t, start, c.lastSummary)
+	assert.Equal(t, 1, c.summary.Cycles)
+	assert.Equal(t, 3, c.summary.Namespaces)
+	assert.Equal(t, 0, c.summary.SecretsCreated)
+	assert.Equal(t, 4, c.summary.SecretsUpdated+c.summary.SecretsUnchanged)
+
+	fakeClock.Step(5 * time.Minute)
+	assert.Nil(t, c.process())
+	assert.Equal(t, start.Add(10*time.Minute), c.lastSummary)
+	assert.Equal(t, reconcileSummary{}, c.summary)
+}
+
+func TestSummaryLogIntervalUnset(t *testing.T) {
+	c := &controller{kubeClient: newFakeKubeClient(), ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	assert.Nil(t, c.process())
+	assert.True(t, c.lastSummary.IsZero())
+	assert.Equal(t, 1, c.summary.Cycles)
+	assert.Equal(t, 4, c.summary.SecretsCreated)
+	// Each secret is added to the default service account of both namespaces
+	assert.Equal(t, 4, c.summary.ServiceAccountsUpdated)
+}
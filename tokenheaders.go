@@ -0,0 +1,105 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// parseTokenRequestHeaders parses --token-request-headers, a list of
+// key=value pairs, checking each is a valid HTTP header
+func parseTokenRequestHeaders(entries []string) (http.Header, error) {
+	headers := http.Header{}
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%q must be key=value", entry)
+		}
+		key, value := parts[0], parts[1]
+		if !validHeaderKey(key) {
+			return nil, fmt.Errorf("invalid header name %q", key)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("value of header %s can't contain line breaks", key)
+		}
+		headers.Add(key, value)
+	}
+	return headers, nil
+}
+
+// validHeaderKey reports whether key is an RFC 7230 token
+func validHeaderKey(key string) bool {
+	for _, r := range key {
+		if r > '~' || r <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return false
+		}
+	}
+	return key != ""
+}
+
+// headerTransport adds headers to every request it sends
+type headerTransport struct {
+	base    http.RoundTripper
+	headers http.Header
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper mustn't change the caller's request
+	r := *req
+	r.Header = http.Header{}
+	for key, values := range req.Header {
+		r.Header[key] = values
+	}
+	for key, values := range t.headers {
+		r.Header[key] = values
+	}
+	return t.base.RoundTrip(&r)
+}
+
+// tokenRequestClient returns the HTTP client for token requests, which adds
+// --token-request-headers when set
+func tokenRequestClient() *http.Client {
+	// validateParams already checked the headers
+	headers, _ := parseTokenRequestHeaders(*argTokenRequestHeaders)
+	if len(headers) == 0 {
+		return http.DefaultClient
+	}
+	return &http.Client{Transport: headerTransport{base: http.DefaultTransport, headers: headers}}
+}
+
+// tokenRequestContext returns the context GCR token sources are created with,
+// carrying the tokenRequestClient when it adds headers
+func tokenRequestContext() context.Context {
+	client := tokenRequestClient()
+	if client == http.DefaultClient {
+		return context.TODO()
+	}
+	return context.WithValue(context.TODO(), oauth2.HTTPClient, client)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// refreshingGcrClient refreshes a token against tokenURL with the HTTP client
+// from the context, like the default credentials do
+type refreshingGcrClient struct {
+	tokenURL string
+}
+
+func (r *refreshingGcrClient) DefaultTokenSource(ctx context.Context, scope ...string) (oauth2.TokenSource, error) {
+	config := &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: r.tokenURL}, Scopes: scope}
+	return config.TokenSource(ctx, &oauth2.Token{RefreshToken: "fakeRefreshToken"}), nil
+}
+
+func TestParseTokenRequestHeaders(t *testing.T) {
+	headers, err := parseTokenRequestHeaders([]string{"X-Egress-Team=platform", "X-Quota=a=b"})
+	assert.Nil(t, err)
+	assert.Equal(t, "platform", headers.Get("X-Egress-Team"))
+	assert.Equal(t, "a=b", headers.Get("X-Quota"))
+
+	for _, entry := range []string{"X-Egress-Team", "=platform", "X Egress=platform", "X-Egress:=platform", "X-Egress=a\r\nHost: evil"} {
+		_, err := parseTokenRequestHeaders([]string{entry})
+		assert.NotNil(t, err, entry)
+	}
+}
+
+func TestGCRTokenRequestHeaders(t *testing.T) {
+	*argTokenRequestHeaders = []string{"X-Egress-Team=platform"}
+	defer func() { *argTokenRequestHeaders = nil }()
+
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"fakeToken","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	c := &controller{gcrClient: &refreshingGcrClient{tokenURL: server.URL}}
+	token, err := c.getGCRAuthorizationKey()
+	assert.Nil(t, err)
+	assert.Equal(t, "fakeToken", string(token.AccessToken))
+	assert.Equal(t, "platform", received.Get("X-Egress-Team"))
+}
@@ -0,0 +1,86 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import "sync"
+
+// tokenSemaphore caps how many provider token requests are in flight at once,
+// across every provider. A nil semaphore doesn't limit anything.
+type tokenSemaphore chan struct{}
+
+// newTokenSemaphore returns a semaphore with size slots, or nil when size
+// isn't positive
+func newTokenSemaphore(size int) tokenSemaphore {
+	if size <= 0 {
+		return nil
+	}
+	return make(tokenSemaphore, size)
+}
+
+func (s tokenSemaphore) acquire() {
+	if s != nil {
+		s <- struct{}{}
+	}
+}
+
+func (s tokenSemaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// fetchToken calls the provider's token function once a slot under
+// --max-inflight-token-requests is free
+func (c *controller) fetchToken(secretGenerator SecretGenerator) (AuthToken, error) {
+	c.tokenRequests.acquire()
+	defer c.tokenRequests.release()
+	token, err := secretGenerator.TokenGenFxn()
+	recordTokenRequest(secretGenerator.Provider, err)
+	return token, err
+}
+
+// fetchedToken is a provider's token, or the error fetching it
+type fetchedToken struct {
+	token AuthToken
+	err   error
+}
+
+// fetchTokens fetches the providers' tokens concurrently, each with its
+// retries, so it's --max-inflight-token-requests that limits how many
+// requests are in flight at once. The results are in the generators' order.
+func (c *controller) fetchTokens(secretGenerators []SecretGenerator) []fetchedToken {
+	fetched := make([]fetchedToken, len(secretGenerators))
+	var wg sync.WaitGroup
+	for i, secretGenerator := range secretGenerators {
+		wg.Add(1)
+		go func(i int, secretGenerator SecretGenerator) {
+			defer wg.Done()
+			token, err := c.fetchTokenWithRetries(secretGenerator)
+			fetched[i] = fetchedToken{token: token, err: err}
+		}(i, secretGenerator)
+	}
+	wg.Wait()
+	return fetched
+}
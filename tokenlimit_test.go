@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingTokenSource counts the token requests in flight, holding each one
+// until release is closed
+type countingTokenSource struct {
+	mu       sync.Mutex
+	inflight int
+	max      int
+	calls    int
+	entered  chan struct{}
+	release  chan struct{}
+}
+
+func (s *countingTokenSource) token() (AuthToken, error) {
+	s.mu.Lock()
+	s.calls++
+	s.inflight++
+	if s.inflight > s.max {
+		s.max = s.inflight
+	}
+	s.mu.Unlock()
+
+	s.entered <- struct{}{}
+	<-s.release
+
+	s.mu.Lock()
+	s.inflight--
+	s.mu.Unlock()
+	return AuthToken{AccessToken: "fakeToken", Endpoint: "fakeEndpoint"}, nil
+}
+
+func TestFetchTokenRespectsMaxInflight(t *testing.T) {
+	source := &countingTokenSource{entered: make(chan struct{}, 10), release: make(chan struct{})}
+	c := &controller{tokenRequests: newTokenSemaphore(2)}
+	generator := SecretGenerator{TokenGenFxn: source.token, Provider: providerAWS}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.fetchToken(generator)
+			assert.Nil(t, err)
+		}()
+	}
+
+	// Two requests get a slot, the others wait for one to finish
+	<-source.entered
+	<-source.entered
+	select {
+	case <-source.entered:
+		t.Fatal("a third token request started while two were in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(source.release)
+	wg.Wait()
+	assert.Equal(t, 5, source.calls)
+	assert.Equal(t, 2, source.max)
+}
+
+func TestNewTokenSemaphoreUnlimited(t *testing.T) {
+	assert.Nil(t, newTokenSemaphore(0))
+
+	// A nil semaphore never blocks
+	var s tokenSemaphore
+	for i := 0; i < 3; i++ {
+		s.acquire()
+	}
+	s.release()
+}
+
+func TestFetchTokensConcurrently(t *testing.T) {
+	source := &countingTokenSource{entered: make(chan struct{}, 10), release: make(chan struct{})}
+	c := &controller{}
+	generators := []SecretGenerator{
+		{TokenGenFxn: source.token, Provider: providerAWS},
+		{TokenGenFxn: source.token, Provider: providerGCR},
+	}
+
+	done := make(chan []fetchedToken)
+	go func() { done <- c.fetchTokens(generators) }()
+
+	// Both providers' requests are in flight before either finishes
+	<-source.entered
+	<-source.entered
+	close(source.release)
+
+	fetched := <-done
+	assert.Equal(t, 2, len(fetched))
+	assert.Nil(t, fetched[0].err)
+	assert.Equal(t, "fakeEndpoint", fetched[1].token.Endpoint)
+	assert.Equal(t, 2, source.max)
+}
@@ -0,0 +1,64 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// tokenRetryBackoff is the wait before the first token retry, doubling after
+// each up to tokenRetryMaxBackoff
+const (
+	tokenRetryBackoff    = time.Second
+	tokenRetryMaxBackoff = 30 * time.Second
+)
+
+// tokenRetryWait picks a random wait between half of backoff and backoff, so
+// controllers that failed together don't retry in lockstep
+func tokenRetryWait(backoff time.Duration) time.Duration {
+	half := backoff / 2
+	return half + time.Duration(randInt63n(int64(half)+1))
+}
+
+// fetchTokenWithRetries fetches the provider's token, retrying a failed
+// request up to --max-retries times with exponential backoff. The last
+// error is returned, so only the provider that keeps failing is marked failed.
+func (c *controller) fetchTokenWithRetries(secretGenerator SecretGenerator) (AuthToken, error) {
+	backoff := tokenRetryBackoff
+	for attempt := 0; ; attempt++ {
+		token, err := c.fetchToken(secretGenerator)
+		if err == nil || attempt >= *argMaxRetries {
+			return token, err
+		}
+
+		wait := tokenRetryWait(backoff)
+		log.Printf("Fetching the %s token failed, retrying in %v: %v", secretGenerator.Provider, wait, err)
+		c.sleep(wait)
+		if backoff *= 2; backoff > tokenRetryMaxBackoff {
+			backoff = tokenRetryMaxBackoff
+		}
+	}
+}
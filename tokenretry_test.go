@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/util/clock"
+)
+
+// failingEcrClient fails its first failures calls, then hands out tokens
+type failingEcrClient struct {
+	fakeEcrClient
+	failures int
+	calls    int
+}
+
+func (f *failingEcrClient) GetAuthorizationToken(input *ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return nil, errors.New("ServiceUnavailableException")
+	}
+	return f.fakeEcrClient.GetAuthorizationToken(input)
+}
+
+// tokenAttempts is how many times one refresh requests a token that keeps
+// failing, the first request and its --max-retries retries
+func tokenAttempts() int {
+	return 1 + *argMaxRetries
+}
+
+func TestProcessRetriesFailedTokenRequest(t *testing.T) {
+	defer func(maxRetries int) { *argMaxRetries = maxRetries }(*argMaxRetries)
+	*argMaxRetries = 3
+	defer func(f func(int64) int64) { randInt63n = f }(randInt63n)
+	randInt63n = func(n int64) int64 { return n - 1 }
+
+	start := time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFakeClock(start)
+	ecrClient := &failingEcrClient{failures: 2}
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	err := c.process()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, ecrClient.calls)
+	_, err = kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+
+	// Waited a second, then two, before the third attempt
+	assert.Equal(t, start.Add(3*time.Second), fakeClock.Now())
+}
+
+func TestProcessGivesUpAfterMaxTokenRetries(t *testing.T) {
+	defer func(maxRetries int) { *argMaxRetries = maxRetries }(*argMaxRetries)
+	*argMaxRetries = 2
+
+	fakeClock := clock.NewFakeClock(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC))
+	ecrClient := &failingEcrClient{failures: 5}
+	kubeClient := newFakeKubeClient()
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: newFakeGcrClient(), clock: fakeClock}
+
+	err := c.process()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "ServiceUnavailableException")
+	assert.Equal(t, 3, ecrClient.calls)
+
+	// GCR is still refreshed
+	_, err = kubeClient.Secrets("namespace1").Get(*argAWSSecretName)
+	assert.NotNil(t, err)
+	_, err = kubeClient.Secrets("namespace1").Get(*argGCRSecretName)
+	assert.Nil(t, err)
+}
+
+func TestMaxRetriesDefault(t *testing.T) {
+	assert.Equal(t, "3", flags.Lookup("max-retries").DefValue)
+}
+
+func TestTokenRetryWait(t *testing.T) {
+	defer func(f func(int64) int64) { randInt63n = f }(randInt63n)
+
+	randInt63n = func(n int64) int64 { return 0 }
+	assert.Equal(t, 2*time.Second, tokenRetryWait(4*time.Second))
+	randInt63n = func(n int64) int64 { return n - 1 }
+	assert.Equal(t, 4*time.Second, tokenRetryWait(4*time.Second))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+func TestForEachNamespaceConcurrency(t *testing.T) {
+	defer func(concurrency int) { *argConcurrency = concurrency }(*argConcurrency)
+	*argConcurrency = 2
+
+	namespaces := []api.Namespace{}
+	for i := 0; i < 6; i++ {
+		namespaces = append(namespaces, api.Namespace{ObjectMeta: api.ObjectMeta{Name: fmt.Sprintf("ns-%d", i)}})
+	}
+
+	var mu sync.Mutex
+	inflight, maxInflight := 0, 0
+	visited := make([]string, len(namespaces))
+	forEachNamespace(namespaces, func(i int, namespace api.Namespace) {
+		mu.Lock()
+		inflight++
+		if inflight > maxInflight {
+			maxInflight = inflight
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+		visited[i] = namespace.Name
+
+		mu.Lock()
+		inflight--
+		mu.Unlock()
+	})
+
+	assert.Equal(t, 2, maxInflight)
+	assert.Equal(t, []string{"ns-0", "ns-1", "ns-2", "ns-3", "ns-4", "ns-5"}, visited)
+}
+
+// waitingKubeClient holds namespace1's secret creates until a secret has been
+// created in namespace2, failing them if that doesn't happen in time
+type waitingKubeClient struct {
+	*fakeKubeClient
+	written chan struct{}
+	once    sync.Once
+}
+
+func (w *waitingKubeClient) Secrets(namespace string) unversioned.SecretsInterface {
+	return &waitingSecrets{fakeSecrets: w.fakeKubeClient.secrets[namespace], client: w, namespace: namespace}
+}
+
+type waitingSecrets struct {
+	*fakeSecrets
+	client    *waitingKubeClient
+	namespace string
+}
+
+func (w *waitingSecrets) Create(secret *api.Secret) (*api.Secret, error) {
+	switch w.namespace {
+	case "namespace1":
+		select {
+		case <-w.client.written:
+		case <-time.After(time.Second):
+			return nil, fmt.Errorf("namespace2 wasn't written while namespace1 was")
+		}
+	case "namespace2":
+		defer w.client.once.Do(func() { close(w.client.written) })
+	}
+	return w.fakeSecrets.Create(secret)
+}
+
+func TestProcessWritesNamespacesConcurrently(t *testing.T) {
+	kubeClient := &waitingKubeClient{fakeKubeClient: newFakeKubeClient(), written: make(chan struct{})}
+	ecrClient := &flakyEcrClient{}
+	c := &controller{kubeClient: kubeClient, ecrClient: ecrClient, gcrClient: newFakeGcrClient()}
+
+	err := c.process()
+	assert.Nil(t, err)
+
+	for _, namespace := range []string{"namespace1", "namespace2"} {
+		_, err = kubeClient.Secrets(namespace).Get(*argAWSSecretName)
+		assert.Nil(t, err)
+	}
+	// The token is fetched once and shared by every namespace
+	assert.Equal(t, 1, ecrClient.calls)
+}
+
+// failingKubeClient fails every secret create in the listed namespaces
+type failingKubeClient struct {
+	*fakeKubeClient
+	failing map[string]bool
+}
+
+func (f *failingKubeClient) Secrets(namespace string) unversioned.SecretsInterface {
+	if f.failing[namespace] {
+		return &failingSecrets{fakeSecrets: f.fakeKubeClient.secrets[namespace], namespace: namespace}
+	}
+	return f.fakeKubeClient.Secrets(namespace)
+}
+
+type failingSecrets struct {
+	*fakeSecrets
+	namespace string
+}
+
+func (f *failingSecrets) Create(secret *api.Secret) (*api.Secret, error) {
+	return nil, fmt.Errorf("etcd unavailable in %s", f.namespace)
+}
+
+func TestProcessAggregatesNamespaceErrors(t *testing.T) {
+	fake := newFakeKubeClient()
+	fake.namespaces.store["namespace3"] = api.Namespace{ObjectMeta: api.ObjectMeta{Name: "namespace3"}}
+	fake.secrets["namespace3"] = &fakeSecrets{store: map[string]*api.Secret{}}
+	fake.serviceaccounts["namespace3"] = &fakeServiceAccounts{store: map[string]*api.ServiceAccount{
+		"default": {ObjectMeta: api.ObjectMeta{Name: "default"}},
+	}}
+
+	kubeClient := &failingKubeClient{fakeKubeClient: fake, failing: map[string]bool{"namespace1": true, "namespace3": true}}
+	c := &controller{kubeClient: kubeClient, ecrClient: newFakeEcrClient(), gcrClient: newFakeGcrClient()}
+
+	err := c.process()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "etcd unavailable in namespace1")
+	assert.Contains(t, err.Error(), "etcd unavailable in namespace3")
+
+	// The namespace between them is still written
+	_, err = kubeClient.Secrets("namespace2").Get(*argAWSSecretName)
+	assert.Nil(t, err)
+}